@@ -11,6 +11,7 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -24,14 +25,18 @@ import (
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/redirect"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/authentication/basic"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/authentication/stepup"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/cookies"
 	proxyhttp "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/http"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests"
 	requestutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests/util"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/binding"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/redis"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/upstream"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/providers"
 )
@@ -40,6 +45,7 @@ const (
 	schemeHTTP      = "http"
 	schemeHTTPS     = "https"
 	applicationJSON = "application/json"
+	applicationGRPC = "application/grpc"
 
 	robotsPath        = "/robots.txt"
 	signInPath        = "/sign_in"
@@ -56,6 +62,24 @@ var (
 
 	// ErrAccessDenied means the user should receive a 401 Unauthorized response
 	ErrAccessDenied = errors.New("access denied")
+
+	// ErrNeedsStepUp means the user should be redirected to the provider to
+	// authenticate again to meet the route's step-up requirements
+	ErrNeedsStepUp = errors.New("redirect to provider for step-up authentication")
+)
+
+// stepUpLoopWindow is how soon after signing in a session that still doesn't
+// meet a route's step-up requirements is denied, rather than redirected to
+// the provider again, to prevent redirect loops with providers that don't
+// support the requested authentication.
+const stepUpLoopWindow = 30 * time.Second
+
+// gRPC status codes sent to gRPC clients in place of error pages.
+// See https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcStatusPermissionDenied = 7
+	grpcStatusInternal         = 13
+	grpcStatusUnauthenticated  = 16
 )
 
 // allowedRoute manages method + path based allowlists
@@ -72,6 +96,7 @@ type OAuthProxy struct {
 	SignInPath string
 
 	allowedRoutes       []allowedRoute
+	stepUpRoutes        []*stepup.Route
 	redirectURL         *url.URL // the url to receive requests at
 	whitelistDomains    []string
 	provider            providers.Provider
@@ -83,10 +108,14 @@ type OAuthProxy struct {
 	skipJwtBearerTokens bool
 	realClientIPParser  ipapi.RealClientIPParser
 	trustedIPs          *ip.NetSet
+	sessionBinder       *binding.Binder
 
 	sessionChain      alice.Chain
 	headersChain      alice.Chain
 	preAuthChain      alice.Chain
+	shuttingDown      chan struct{}
+	shutdownDelay     time.Duration
+	upstreamsDone     chan struct{}
 	pageWriter        pagewriter.Writer
 	server            proxyhttp.Server
 	upstreamProxy     http.Handler
@@ -127,7 +156,18 @@ func NewOAuthProxy(opts *options.Options, validator func(string) bool) (*OAuthPr
 		return nil, fmt.Errorf("error initialising page writer: %v", err)
 	}
 
-	upstreamProxy, err := upstream.NewProxy(opts.UpstreamServers, opts.GetSignatureData(), pageWriter)
+	rateLimits, err := buildRateLimits(opts, pageWriter)
+	if err != nil {
+		return nil, fmt.Errorf("could not build rate limits: %v", err)
+	}
+
+	// Closed once the servers have stopped, to stop the upstream health checks
+	upstreamsDone := make(chan struct{})
+	upstreamProxy, err := upstream.NewProxy(opts.UpstreamServers, opts.GetSignatureData(), pageWriter, upstream.ProxyOpts{
+		RateLimits: rateLimits,
+		IPAccess:   buildIPAccess(opts, pageWriter),
+		Done:       upstreamsDone,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error initialising upstream proxy: %v", err)
 	}
@@ -165,11 +205,20 @@ func NewOAuthProxy(opts *options.Options, validator func(string) bool) (*OAuthPr
 		return nil, err
 	}
 
-	preAuthChain, err := buildPreAuthChain(opts)
+	stepUpRoutes, err := buildStepUpRoutes(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Closed when the proxy starts shutting down, to fail readiness checks
+	shuttingDown := make(chan struct{})
+	readinessChecks := buildReadinessChecks(opts, sessionStore, upstreamProxy)
+	preAuthChain, err := buildPreAuthChain(opts, readinessChecks, shuttingDown)
 	if err != nil {
 		return nil, fmt.Errorf("could not build pre-auth chain: %v", err)
 	}
-	sessionChain := buildSessionChain(opts, sessionStore, basicAuthValidator)
+	sessionBinder := binding.NewBinder(opts.Session.Binding, opts.GetRealClientIPParser())
+	sessionChain := buildSessionChain(opts, sessionStore, basicAuthValidator, validator, sessionBinder)
 	headersChain, err := buildHeadersChain(opts)
 	if err != nil {
 		return nil, fmt.Errorf("could not build headers chain: %v", err)
@@ -192,17 +241,22 @@ func NewOAuthProxy(opts *options.Options, validator func(string) bool) (*OAuthPr
 		sessionStore:        sessionStore,
 		redirectURL:         redirectURL,
 		allowedRoutes:       allowedRoutes,
+		stepUpRoutes:        stepUpRoutes,
 		whitelistDomains:    opts.WhitelistDomains,
 		skipAuthPreflight:   opts.SkipAuthPreflight,
 		skipJwtBearerTokens: opts.SkipJwtBearerTokens,
 		realClientIPParser:  opts.GetRealClientIPParser(),
 		SkipProviderButton:  opts.SkipProviderButton,
 		trustedIPs:          trustedIPs,
+		sessionBinder:       sessionBinder,
 
 		basicAuthValidator: basicAuthValidator,
 		sessionChain:       sessionChain,
 		headersChain:       headersChain,
 		preAuthChain:       preAuthChain,
+		shuttingDown:       shuttingDown,
+		shutdownDelay:      opts.ShutdownDelay,
+		upstreamsDone:      upstreamsDone,
 		pageWriter:         pageWriter,
 		upstreamProxy:      upstreamProxy,
 		redirectValidator:  redirectValidator,
@@ -226,23 +280,57 @@ func (p *OAuthProxy) Start() error {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
+	// SIGHUP is reserved for reloading the configuration, so it must not stop
+	// the proxy
+	signal.Ignore(syscall.SIGHUP)
+
 	// Observe signals in background goroutine.
-	go func() {
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
-		<-sigint
-		cancel() // cancel the context
-	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go p.handleSignals(signals, cancel)
 
+	defer close(p.upstreamsDone)
 	return p.server.Start(ctx)
 }
 
+// handleSignals shuts down the proxy when it receives a signal.
+// Readiness checks fail straight away, and the servers keep accepting
+// connections for the shutdown delay so that load balancers can stop sending
+// requests before the listeners are closed.
+// A second signal exits immediately, without waiting for the shutdown delay
+// or grace period.
+func (p *OAuthProxy) handleSignals(signals <-chan os.Signal, cancel context.CancelFunc) {
+	sig := <-signals
+	logger.Printf("Received %s, shutting down", sig)
+	close(p.shuttingDown)
+
+	if p.shutdownDelay > 0 {
+		logger.Printf("Waiting %s before closing the listeners", p.shutdownDelay)
+		timer := time.NewTimer(p.shutdownDelay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case sig = <-signals:
+			logger.Fatalf("Received %s again, exiting immediately", sig)
+		}
+	}
+	cancel() // cancel the context
+
+	sig = <-signals
+	logger.Fatalf("Received %s again, exiting immediately", sig)
+}
+
 func (p *OAuthProxy) setupServer(opts *options.Options) error {
 	serverOpts := proxyhttp.Opts{
-		Handler:           p,
-		BindAddress:       opts.Server.BindAddress,
-		SecureBindAddress: opts.Server.SecureBindAddress,
-		TLS:               opts.Server.TLS,
+		Handler:             p,
+		BindAddress:         opts.Server.BindAddress,
+		SecureBindAddress:   opts.Server.SecureBindAddress,
+		TLS:                 opts.Server.TLS,
+		EnableHTTP2:         opts.Server.EnableHTTP2,
+		ProxyProtocol:       opts.Server.ProxyProtocol,
+		ShutdownGracePeriod: opts.Server.ShutdownGracePeriod.Duration(),
 	}
 
 	appServer, err := proxyhttp.NewServer(serverOpts)
@@ -250,11 +338,17 @@ func (p *OAuthProxy) setupServer(opts *options.Options) error {
 		return fmt.Errorf("could not build app server: %v", err)
 	}
 
+	// The metrics server also reports the health of load balanced upstreams
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/upstreams", upstream.NewBackendStatusHandler(p.upstreamProxy))
+	metricsMux.Handle("/", middleware.DefaultMetricsHandler)
+
 	metricsServer, err := proxyhttp.NewServer(proxyhttp.Opts{
-		Handler:           middleware.DefaultMetricsHandler,
-		BindAddress:       opts.MetricsServer.BindAddress,
-		SecureBindAddress: opts.MetricsServer.SecureBindAddress,
-		TLS:               opts.MetricsServer.TLS,
+		Handler:             metricsMux,
+		BindAddress:         opts.MetricsServer.BindAddress,
+		SecureBindAddress:   opts.MetricsServer.SecureBindAddress,
+		TLS:                 opts.MetricsServer.TLS,
+		ShutdownGracePeriod: opts.MetricsServer.ShutdownGracePeriod.Duration(),
 	})
 	if err != nil {
 		return fmt.Errorf("could not build metrics server: %v", err)
@@ -299,10 +393,74 @@ func (p *OAuthProxy) buildProxySubrouter(s *mux.Router) {
 	s.Path(userInfoPath).Handler(p.sessionChain.ThenFunc(p.UserInfo))
 }
 
+// buildReadinessChecks constructs the checks of the dependencies that must be
+// available for the proxy to serve requests.
+// The upstreams are only reported, as one unavailable upstream should not
+// stop the proxy serving the others.
+func buildReadinessChecks(opts *options.Options, sessionStore sessionsapi.SessionStore, upstreamProxy http.Handler) []middleware.ReadinessCheck {
+	checks := []middleware.ReadinessCheck{
+		{Name: "sessionStore", Check: sessionStore.VerifyConnection},
+		{Name: "upstreams", Optional: true, Check: func(context.Context) error {
+			return upstream.CheckBackendAvailability(upstreamProxy)
+		}},
+	}
+
+	oidcConfig := opts.Providers[0].OIDCConfig
+	switch {
+	case oidcConfig.IssuerURL != "" && !oidcConfig.SkipDiscovery:
+		checks = append(checks, middleware.ReadinessCheck{
+			Name: "oidc",
+			Check: func(ctx context.Context) error {
+				return checkOIDCDiscovery(ctx, oidcConfig.IssuerURL)
+			},
+		})
+	case oidcConfig.JwksURL != "":
+		checks = append(checks, middleware.ReadinessCheck{
+			Name: "oidc",
+			Check: func(ctx context.Context) error {
+				return checkJwks(ctx, oidcConfig.JwksURL)
+			},
+		})
+	}
+	return checks
+}
+
+// checkOIDCDiscovery fetches the discovery document of the OIDC provider, and
+// the JWKS it points to, to check that the provider configuration and the
+// keys used to verify ID tokens can be refreshed.
+func checkOIDCDiscovery(ctx context.Context, issuerURL string) error {
+	var discovery struct {
+		JwksURL string `json:"jwks_uri"`
+	}
+	discoveryURL := strings.TrimSuffix(issuerURL, "/") + "/.well-known/openid-configuration"
+	if err := requests.New(discoveryURL).WithContext(ctx).Do().UnmarshalInto(&discovery); err != nil {
+		return fmt.Errorf("error fetching OIDC discovery document: %v", err)
+	}
+	if discovery.JwksURL == "" {
+		return errors.New("OIDC discovery document contains no jwks_uri")
+	}
+	return checkJwks(ctx, discovery.JwksURL)
+}
+
+// checkJwks fetches the JWKS of the OIDC provider to check that the keys used
+// to verify ID tokens can be refreshed.
+func checkJwks(ctx context.Context, jwksURL string) error {
+	var keySet struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := requests.New(jwksURL).WithContext(ctx).Do().UnmarshalInto(&keySet); err != nil {
+		return fmt.Errorf("error fetching JWKS: %v", err)
+	}
+	if len(keySet.Keys) == 0 {
+		return errors.New("JWKS contains no keys")
+	}
+	return nil
+}
+
 // buildPreAuthChain constructs a chain that should process every request before
 // the OAuth2 Proxy authentication logic kicks in.
 // For example forcing HTTPS or health checks.
-func buildPreAuthChain(opts *options.Options) (alice.Chain, error) {
+func buildPreAuthChain(opts *options.Options, readinessChecks []middleware.ReadinessCheck, shuttingDown <-chan struct{}) (alice.Chain, error) {
 	chain := alice.New(middleware.NewScope(opts.ReverseProxy, opts.Logging.RequestIDHeader))
 
 	if opts.ForceHTTPS {
@@ -321,17 +479,26 @@ func buildPreAuthChain(opts *options.Options) (alice.Chain, error) {
 		healthCheckUserAgents = append(healthCheckUserAgents, "GoogleHC/1.0")
 	}
 
+	readinessCheck := middleware.NewReadinessCheck(middleware.ReadinessCheckOpts{
+		Path:          opts.ReadyPath,
+		Checks:        readinessChecks,
+		CacheDuration: opts.ReadyCacheDuration,
+		ShuttingDown:  shuttingDown,
+	})
+
 	// To silence logging of health checks, register the health check handler before
 	// the logging handler
 	if opts.Logging.SilencePing {
 		chain = chain.Append(
 			middleware.NewHealthCheck(healthCheckPaths, healthCheckUserAgents),
+			readinessCheck,
 			middleware.NewRequestLogger(),
 		)
 	} else {
 		chain = chain.Append(
 			middleware.NewRequestLogger(),
 			middleware.NewHealthCheck(healthCheckPaths, healthCheckUserAgents),
+			readinessCheck,
 		)
 	}
 
@@ -340,7 +507,7 @@ func buildPreAuthChain(opts *options.Options) (alice.Chain, error) {
 	return chain, nil
 }
 
-func buildSessionChain(opts *options.Options, sessionStore sessionsapi.SessionStore, validator basic.Validator) alice.Chain {
+func buildSessionChain(opts *options.Options, sessionStore sessionsapi.SessionStore, validator basic.Validator, emailValidator func(string) bool, sessionBinder *binding.Binder) alice.Chain {
 	chain := alice.New()
 
 	if opts.SkipJwtBearerTokens {
@@ -360,12 +527,23 @@ func buildSessionChain(opts *options.Options, sessionStore sessionsapi.SessionSt
 		chain = chain.Append(middleware.NewBasicAuthSessionLoader(validator, opts.HtpasswdUserGroups, opts.LegacyPreferEmailToUser))
 	}
 
-	chain = chain.Append(middleware.NewStoredSessionLoader(&middleware.StoredSessionLoaderOptions{
-		SessionStore:    sessionStore,
-		RefreshPeriod:   opts.Cookie.Refresh,
-		RefreshSession:  opts.GetProvider().RefreshSession,
-		ValidateSession: opts.GetProvider().ValidateSession,
-	}))
+	if opts.ClientCertificateSessions {
+		chain = chain.Append(middleware.NewClientCertificateSessionLoader(opts.ClientCertificateUserField, opts.ClientCertificateGroups, emailValidator))
+	}
+
+	storedSessionOpts := &middleware.StoredSessionLoaderOptions{
+		SessionStore:           sessionStore,
+		RefreshPeriod:          opts.Cookie.Refresh,
+		RefreshSession:         opts.GetProvider().RefreshSession,
+		ValidateSession:        opts.GetProvider().ValidateSession,
+		IdleTimeout:            opts.Session.IdleTimeout,
+		ActivityUpdateInterval: opts.Session.ActivityUpdateInterval,
+		MaxLifetime:            opts.Session.MaxLifetime,
+	}
+	if sessionBinder.Enabled() {
+		storedSessionOpts.VerifySessionBinding = sessionBinder.Verify
+	}
+	chain = chain.Append(middleware.NewStoredSessionLoader(storedSessionOpts))
 
 	return chain
 }
@@ -384,6 +562,60 @@ func buildHeadersChain(opts *options.Options) (alice.Chain, error) {
 	return alice.New(requestInjector, responseInjector), nil
 }
 
+// buildRateLimits builds the rate limiting middleware of the upstreams.
+// The upstreams share a single store for each backend, the Redis store uses
+// the same connection options as the Redis session store.
+func buildRateLimits(opts *options.Options, writer pagewriter.Writer) (upstream.RateLimitBuilder, error) {
+	memoryStore := middleware.NewMemoryRateLimitStore()
+
+	var redisStore middleware.RateLimitStore
+	for _, u := range opts.UpstreamServers {
+		if u.RateLimit != nil && u.RateLimit.Backend == options.RedisRateLimitBackend {
+			client, err := redis.NewRedisClient(opts.Session.Redis)
+			if err != nil {
+				return nil, fmt.Errorf("error constructing redis client: %v", err)
+			}
+			redisStore = middleware.NewRedisRateLimitStore(client)
+			break
+		}
+	}
+
+	return func(u options.Upstream) (alice.Constructor, error) {
+		if u.RateLimit == nil {
+			return nil, nil
+		}
+
+		store := memoryStore
+		if u.RateLimit.Backend == options.RedisRateLimitBackend {
+			store = redisStore
+		}
+		return middleware.NewRateLimit(middleware.RateLimitOpts{
+			Upstream:           u.ID,
+			RateLimit:          *u.RateLimit,
+			Store:              store,
+			RealClientIPParser: opts.GetRealClientIPParser(),
+			Writer:             writer,
+		}), nil
+	}, nil
+}
+
+// buildIPAccess builds the client IP access middleware of the upstreams.
+// The client IP is determined in the same way as for the trusted IPs.
+func buildIPAccess(opts *options.Options, writer pagewriter.Writer) upstream.IPAccessBuilder {
+	return func(u options.Upstream) (alice.Constructor, error) {
+		if u.IPAccess == nil {
+			return nil, nil
+		}
+
+		return middleware.NewIPAccess(middleware.IPAccessOpts{
+			Upstream:           u.ID,
+			IPAccess:           *u.IPAccess,
+			RealClientIPParser: opts.GetRealClientIPParser(),
+			Writer:             writer,
+		})
+	}
+}
+
 func buildSignInMessage(opts *options.Options) string {
 	var msg string
 	if len(opts.Templates.Banner) >= 1 {
@@ -456,6 +688,21 @@ func buildRoutesAllowlist(opts *options.Options) ([]allowedRoute, error) {
 	return routes, nil
 }
 
+// buildStepUpRoutes builds the []*stepup.Route list from the StepUpRoutes
+// option
+func buildStepUpRoutes(opts *options.Options) ([]*stepup.Route, error) {
+	routes := make([]*stepup.Route, 0, len(opts.StepUpRoutes))
+	for _, r := range opts.StepUpRoutes {
+		route, err := stepup.ParseRoute(r)
+		if err != nil {
+			return nil, err
+		}
+		logger.Printf("Requiring step-up authentication - Route: %s", r)
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
 // ClearSessionCookie creates a cookie to unset the user's authentication cookie
 // stored in the user's session
 func (p *OAuthProxy) ClearSessionCookie(rw http.ResponseWriter, req *http.Request) error {
@@ -469,6 +716,12 @@ func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*sessionsapi.Session
 
 // SaveSession creates a new session cookie value and sets this on the response
 func (p *OAuthProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *sessionsapi.SessionState) error {
+	if p.sessionBinder != nil {
+		p.sessionBinder.Bind(req, s)
+	}
+	if s.SignedInAt == nil {
+		s.SignedInNow()
+	}
 	return p.sessionStore.Save(rw, req, s)
 }
 
@@ -659,6 +912,15 @@ func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
 
 // OAuthStart starts the OAuth2 authentication flow
 func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
+	p.doOAuthStart(rw, req, nil)
+}
+
+// doOAuthStart starts the OAuth2 authentication flow, requesting the
+// authentication required by the step-up requirement when it is not nil.
+// Otherwise the requirement of any step-up route matching the application
+// redirect is requested, so that step-up works when the flow is started by
+// a reverse proxy using the auth endpoint.
+func (p *OAuthProxy) doOAuthStart(rw http.ResponseWriter, req *http.Request, requirement *stepup.Requirement) {
 	prepareNoCache(rw)
 
 	csrf, err := cookies.NewCSRF(p.CookieOptions)
@@ -682,6 +944,18 @@ func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
 		csrf.HashOIDCNonce(),
 	)
 
+	if requirement == nil {
+		requirement = p.stepUpRequirementForRedirect(appRedirect)
+	}
+	if requirement != nil {
+		loginURL, err = addLoginParams(loginURL, requirement.LoginParams())
+		if err != nil {
+			logger.Errorf("Error adding step-up parameters to login URL: %v", err)
+			p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
 	if _, err := csrf.SetCookie(rw, req); err != nil {
 		logger.Errorf("Error setting CSRF cookie: %v", err)
 		p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
@@ -817,6 +1091,8 @@ func (p *OAuthProxy) enrichSessionState(ctx context.Context, s *sessionsapi.Sess
 func (p *OAuthProxy) AuthOnly(rw http.ResponseWriter, req *http.Request) {
 	session, err := p.getAuthenticatedSession(rw, req)
 	if err != nil {
+		// This includes ErrNeedsStepUp: the reverse proxy sends the user to
+		// /oauth2/start, which requests the step-up for the redirect URL
 		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
@@ -828,9 +1104,10 @@ func (p *OAuthProxy) AuthOnly(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// we are authenticated
+	// we are authenticated, but the client IP must also be allowed to access
+	// the upstream of the original request
 	p.addHeadersForProxying(rw, session)
-	p.headersChain.Then(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	p.headersChain.Append(upstream.NewAuthOnlyIPAccess(p.upstreamProxy)).Then(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		rw.WriteHeader(http.StatusAccepted)
 	})).ServeHTTP(rw, req)
 }
@@ -845,6 +1122,12 @@ func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
 		p.addHeadersForProxying(rw, session)
 		p.headersChain.Then(p.upstreamProxy).ServeHTTP(rw, req)
 	case ErrNeedsLogin:
+		// gRPC clients can't follow redirects or render pages
+		if isGRPC(req) {
+			p.errorGRPC(rw, grpcStatusUnauthenticated, "authentication required")
+			return
+		}
+
 		// we need to send the user to a login screen
 		if isAjax(req) {
 			// no point redirecting an AJAX request
@@ -858,12 +1141,36 @@ func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
 			p.SignInPage(rw, req, http.StatusForbidden)
 		}
 
+	case ErrNeedsStepUp:
+		if isGRPC(req) {
+			p.errorGRPC(rw, grpcStatusUnauthenticated, "step-up authentication required")
+			return
+		}
+
+		if isAjax(req) {
+			// no point redirecting an AJAX request
+			p.errorJSON(rw, http.StatusUnauthorized)
+			return
+		}
+
+		p.doOAuthStart(rw, req, p.stepUpRequirement(req))
+
 	case ErrAccessDenied:
+		if isGRPC(req) {
+			p.errorGRPC(rw, grpcStatusPermissionDenied, "The session failed authorization checks")
+			return
+		}
+
 		p.ErrorPage(rw, req, http.StatusForbidden, "The session failed authorization checks")
 
 	default:
 		// unknown error
 		logger.Errorf("Unexpected internal error: %v", err)
+		if isGRPC(req) {
+			p.errorGRPC(rw, grpcStatusInternal, "internal error")
+			return
+		}
+
 		p.ErrorPage(rw, req, http.StatusInternalServerError, err.Error())
 	}
 }
@@ -950,9 +1257,68 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 		return nil, ErrAccessDenied
 	}
 
+	if requirement := p.stepUpRequirement(req); requirement != nil && !requirement.SatisfiedBy(session) {
+		if session.SinceSignIn() < stepUpLoopWindow {
+			// The user has just signed in but the provider didn't authenticate
+			// them as required, sending them back would loop
+			logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Session does not meet step-up requirements after signing in: %s", session)
+			return nil, ErrAccessDenied
+		}
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Session does not meet step-up requirements: %s", session)
+		return nil, ErrNeedsStepUp
+	}
+
 	return session, nil
 }
 
+// stepUpRequirement returns the requirement of the first step-up route
+// matching the request, or nil if no route matches.
+// Proxied requests are matched on the path of the original request (from
+// X-Forwarded-Uri) so that step-up is also enforced on the AuthOnly endpoint.
+func (p *OAuthProxy) stepUpRequirement(req *http.Request) *stepup.Requirement {
+	path := req.URL.Path
+	if requestURL, err := url.Parse(requestutil.GetRequestURI(req)); err == nil {
+		path = requestURL.Path
+	}
+	for _, route := range p.stepUpRoutes {
+		if route.Matches(req.Method, path) {
+			return &route.Requirement
+		}
+	}
+	return nil
+}
+
+// stepUpRequirementForRedirect returns the requirement of the first step-up
+// route matching the path of the application redirect, or nil if no route
+// matches.
+func (p *OAuthProxy) stepUpRequirementForRedirect(appRedirect string) *stepup.Requirement {
+	redirectURL, err := url.Parse(appRedirect)
+	if err != nil {
+		return nil
+	}
+	for _, route := range p.stepUpRoutes {
+		if route.Matches(http.MethodGet, redirectURL.Path) {
+			return &route.Requirement
+		}
+	}
+	return nil
+}
+
+// addLoginParams sets the given parameters on the provider login URL,
+// replacing any existing values.
+func addLoginParams(loginURL string, params url.Values) (string, error) {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
 // authOnlyAuthorize handles special authorization logic that is only done
 // on the AuthOnly endpoint for use with Nginx subrequest architectures.
 //
@@ -1053,3 +1419,36 @@ func (p *OAuthProxy) errorJSON(rw http.ResponseWriter, code int) {
 	rw.Header().Set("Content-Type", applicationJSON)
 	rw.WriteHeader(code)
 }
+
+// isGRPC checks if a request is a gRPC request, including gRPC requests with
+// a message format suffix such as application/grpc+proto
+func isGRPC(req *http.Request) bool {
+	contentType := req.Header.Get("Content-Type")
+	return contentType == applicationGRPC ||
+		strings.HasPrefix(contentType, applicationGRPC+"+") ||
+		strings.HasPrefix(contentType, applicationGRPC+";")
+}
+
+// errorGRPC returns the gRPC status as a trailers-only response, which gRPC
+// clients report as the status of the call
+func (p *OAuthProxy) errorGRPC(rw http.ResponseWriter, status int, message string) {
+	rw.Header().Set("Content-Type", applicationGRPC)
+	rw.Header().Set("Grpc-Status", strconv.Itoa(status))
+	rw.Header().Set("Grpc-Message", encodeGRPCMessage(message))
+	rw.WriteHeader(http.StatusOK)
+}
+
+// encodeGRPCMessage percent encodes the message as required for the
+// Grpc-Message header
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
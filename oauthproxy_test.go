@@ -10,8 +10,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"regexp"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -996,6 +998,57 @@ func TestAuthOnlyEndpointUnauthorizedOnEmailValidationFailure(t *testing.T) {
 	assert.Equal(t, "Unauthorized\n", string(bodyBytes))
 }
 
+func TestAuthOnlyEndpointIPAccess(t *testing.T) {
+	testCases := map[string]struct {
+		uri          string
+		expectedCode int
+	}{
+		"upstream restricted by ip": {
+			uri:          "/restricted/page",
+			expectedCode: http.StatusForbidden,
+		},
+		"upstream not restricted by ip": {
+			uri:          "/page",
+			expectedCode: http.StatusAccepted,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			test, err := NewAuthOnlyEndpointTest("", func(opts *options.Options) {
+				opts.ReverseProxy = true
+				opts.UpstreamServers = options.Upstreams{
+					{
+						ID:       "restricted",
+						Path:     "/restricted/",
+						Static:   true,
+						IPAccess: &options.IPAccess{Deny: []string{"192.0.2.0/24"}},
+					},
+					{
+						ID:     "open",
+						Path:   "/",
+						Static: true,
+					},
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			created := time.Now()
+			err = test.SaveSession(&sessions.SessionState{
+				Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", CreatedAt: &created})
+			assert.NoError(t, err)
+
+			test.req.RemoteAddr = "192.0.2.1:1234"
+			test.req.Header.Set("X-Real-IP", "192.0.2.1")
+			test.req.Header.Set("X-Forwarded-Uri", tc.uri)
+			test.proxy.ServeHTTP(test.rw, test.req)
+			assert.Equal(t, tc.expectedCode, test.rw.Code)
+		})
+	}
+}
+
 func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
 	var pcTest ProcessCookieTest
 
@@ -1547,6 +1600,58 @@ func TestAjaxForbiddendRequest(t *testing.T) {
 	assert.NotEqual(t, applicationJSON, mime)
 }
 
+func TestGRPCUnauthenticatedRequest(t *testing.T) {
+	for _, contentType := range []string{applicationGRPC, "application/grpc+proto"} {
+		t.Run(contentType, func(t *testing.T) {
+			test, err := newAjaxRequestTest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := make(http.Header)
+			header.Add("Content-Type", contentType)
+
+			code, rh, err := test.getEndpoint("/test", header)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, code)
+			assert.Equal(t, applicationGRPC, rh.Get("Content-Type"))
+			assert.Equal(t, "16", rh.Get("Grpc-Status"))
+			assert.Equal(t, "authentication required", rh.Get("Grpc-Message"))
+		})
+	}
+}
+
+func TestGRPCPermissionDeniedRequest(t *testing.T) {
+	created := time.Now()
+	session := &sessions.SessionState{
+		Groups:      []string{"c"},
+		Email:       "test",
+		AccessToken: "oauth_token",
+		CreatedAt:   &created,
+	}
+
+	test, err := NewProcessCookieTestWithOptionsModifiers(func(opts *options.Options) {
+		opts.Providers[0].AllowedGroups = []string{"a"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test.req, _ = http.NewRequest("POST", "/service.Test/Call", nil)
+	test.req.Header.Add("Content-Type", applicationGRPC)
+	assert.NoError(t, test.SaveSession(session))
+	test.proxy.ServeHTTP(test.rw, test.req)
+
+	assert.Equal(t, http.StatusOK, test.rw.Code)
+	assert.Equal(t, applicationGRPC, test.rw.Header().Get("Content-Type"))
+	assert.Equal(t, "7", test.rw.Header().Get("Grpc-Status"))
+	assert.Equal(t, "The session failed authorization checks", test.rw.Header().Get("Grpc-Message"))
+}
+
+func TestEncodeGRPCMessage(t *testing.T) {
+	assert.Equal(t, "access denied", encodeGRPCMessage("access denied"))
+	assert.Equal(t, "100%25 d%C3%A9j%C3%A0 vu%0A", encodeGRPCMessage("100% déjà vu\n"))
+}
+
 func TestClearSplitCookie(t *testing.T) {
 	opts := baseTestOptions()
 	opts.Cookie.Secret = base64CookieSecret
@@ -1761,6 +1866,111 @@ func Test_prepareNoCache(t *testing.T) {
 	}
 }
 
+func TestHandleSignalsWaitsForShutdownDelay(t *testing.T) {
+	p := &OAuthProxy{
+		shuttingDown:  make(chan struct{}),
+		shutdownDelay: 100 * time.Millisecond,
+	}
+	signals := make(chan os.Signal, 1)
+	cancelled := make(chan struct{})
+	go p.handleSignals(signals, func() { close(cancelled) })
+
+	signals <- syscall.SIGTERM
+	select {
+	case <-p.shuttingDown:
+	case <-time.After(time.Second):
+		t.Fatal("readiness checks did not fail after the signal")
+	}
+
+	select {
+	case <-cancelled:
+		t.Fatal("servers were stopped before the shutdown delay")
+	default:
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("servers were not stopped after the shutdown delay")
+	}
+}
+
+func Test_checkJwks(t *testing.T) {
+	testCases := map[string]struct {
+		status        int
+		body          string
+		expectedError string
+	}{
+		"with keys": {
+			status: http.StatusOK,
+			body:   `{"keys":[{"kty":"RSA","kid":"key"}]}`,
+		},
+		"without keys": {
+			status:        http.StatusOK,
+			body:          `{"keys":[]}`,
+			expectedError: "JWKS contains no keys",
+		},
+		"with an error response": {
+			status:        http.StatusInternalServerError,
+			body:          "internal error",
+			expectedError: "error fetching JWKS: unexpected status \"500\": internal error",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			err := checkJwks(context.Background(), server.URL)
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
+func Test_buildReadinessChecksWithOIDCDiscovery(t *testing.T) {
+	jwks := `{"keys":[{"kty":"RSA","kid":"key"}]}`
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"issuer":%q,"jwks_uri":%q}`, server.URL, server.URL+"/keys")))
+		case "/keys":
+			_, _ = w.Write([]byte(jwks))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	opts := baseTestOptions()
+	opts.Providers[0].OIDCConfig.IssuerURL = server.URL
+	sessionStore, err := sessionscookie.NewCookieSessionStore(&opts.Session, &opts.Cookie)
+	assert.NoError(t, err)
+
+	var oidcCheck func(context.Context) error
+	for _, check := range buildReadinessChecks(opts, sessionStore, nil) {
+		if check.Name == "oidc" {
+			oidcCheck = check.Check
+		}
+	}
+	if oidcCheck == nil {
+		t.Fatal("no oidc readiness check with a discovered provider")
+	}
+
+	assert.NoError(t, oidcCheck(context.Background()))
+
+	jwks = `{"keys":[]}`
+	assert.EqualError(t, oidcCheck(context.Background()), "JWKS contains no keys")
+}
+
 func Test_noCacheHeaders(t *testing.T) {
 	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, err := w.Write([]byte("upstream"))
@@ -2377,6 +2587,149 @@ func TestProxyAllowedGroups(t *testing.T) {
 	}
 }
 
+func TestProxyStepUp(t *testing.T) {
+	now := time.Now()
+	minutesAgo := func(m int) *time.Time {
+		t := now.Add(time.Duration(-m) * time.Minute)
+		return &t
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		session        *sessions.SessionState
+		expectedCode   int
+		expectedParams url.Values
+	}{
+		{
+			name:         "RouteWithoutStepUp",
+			path:         "/",
+			session:      &sessions.SessionState{AuthTime: minutesAgo(60), SignedInAt: minutesAgo(60)},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "RecentAuthentication",
+			path:         "/admin/users",
+			session:      &sessions.SessionState{AuthTime: minutesAgo(5), SignedInAt: minutesAgo(60), ACR: "mfa"},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "OldAuthentication",
+			path:         "/admin/users",
+			session:      &sessions.SessionState{AuthTime: minutesAgo(20), SignedInAt: minutesAgo(60), ACR: "mfa"},
+			expectedCode: http.StatusFound,
+			expectedParams: url.Values{
+				"prompt":     []string{"login"},
+				"max_age":    []string{"600"},
+				"acr_values": []string{"mfa"},
+			},
+		},
+		{
+			name:         "MissingACR",
+			path:         "/admin/users",
+			session:      &sessions.SessionState{AuthTime: minutesAgo(5), SignedInAt: minutesAgo(60), ACR: "pwd"},
+			expectedCode: http.StatusFound,
+			expectedParams: url.Values{
+				"prompt":     []string{"login"},
+				"max_age":    []string{"600"},
+				"acr_values": []string{"mfa"},
+			},
+		},
+		{
+			name:         "MissingACRAfterSigningIn",
+			path:         "/admin/users",
+			session:      &sessions.SessionState{AuthTime: &now, SignedInAt: &now, ACR: "pwd"},
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.session.Email = "test"
+			tt.session.AccessToken = "oauth_token"
+			tt.session.CreatedAt = &now
+
+			upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(200)
+			}))
+			t.Cleanup(upstreamServer.Close)
+
+			test, err := NewProcessCookieTestWithOptionsModifiers(func(opts *options.Options) {
+				opts.StepUpRoutes = []string{"max_age=10m,acr=mfa:^/admin/"}
+				opts.UpstreamServers = options.Upstreams{
+					{
+						ID:   upstreamServer.URL,
+						Path: "/",
+						URI:  upstreamServer.URL,
+					},
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.proxy.provider.Data().LoginURL = &url.URL{Scheme: "https", Host: "provider.example.com", Path: "/authorize"}
+
+			test.req, _ = http.NewRequest("GET", tt.path, nil)
+			err = test.SaveSession(tt.session)
+			assert.NoError(t, err)
+
+			rw := httptest.NewRecorder()
+			test.proxy.ServeHTTP(rw, test.req)
+			assert.Equal(t, tt.expectedCode, rw.Code)
+
+			if tt.expectedParams != nil {
+				location, err := url.Parse(rw.Header().Get("Location"))
+				assert.NoError(t, err)
+				assert.Equal(t, "provider.example.com", location.Host)
+				for key := range tt.expectedParams {
+					assert.Equal(t, tt.expectedParams.Get(key), location.Query().Get(key))
+				}
+			}
+		})
+	}
+}
+
+func TestAuthOnlyStepUp(t *testing.T) {
+	now := time.Now()
+	authTime := now.Add(-20 * time.Minute)
+	signedInAt := now.Add(-60 * time.Minute)
+
+	testCases := map[string]struct {
+		uri          string
+		expectedCode int
+	}{
+		"route without step-up": {
+			uri:          "/page",
+			expectedCode: http.StatusAccepted,
+		},
+		"route requiring step-up": {
+			uri:          "/admin/users?page=2",
+			expectedCode: http.StatusUnauthorized,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			test, err := NewAuthOnlyEndpointTest("", func(opts *options.Options) {
+				opts.ReverseProxy = true
+				opts.StepUpRoutes = []string{"max_age=10m,acr=mfa:^/admin/"}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = test.SaveSession(&sessions.SessionState{
+				Email: "test", AccessToken: "oauth_token", CreatedAt: &now,
+				AuthTime: &authTime, SignedInAt: &signedInAt, ACR: "mfa"})
+			assert.NoError(t, err)
+
+			test.req.Header.Set("X-Forwarded-Uri", tc.uri)
+			test.proxy.ServeHTTP(test.rw, test.req)
+			assert.Equal(t, tc.expectedCode, test.rw.Code)
+		})
+	}
+}
+
 func TestAuthOnlyAllowedGroups(t *testing.T) {
 	testCases := []struct {
 		name               string
@@ -109,7 +109,7 @@ func legacyUpstreamsFlagSet() *pflag.FlagSet {
 	flagSet.Bool("pass-host-header", true, "pass the request Host Header to upstream")
 	flagSet.Bool("proxy-websockets", true, "enables WebSocket proxying")
 	flagSet.Bool("ssl-upstream-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS upstreams")
-	flagSet.StringSlice("upstream", []string{}, "the http url(s) of the upstream endpoint, file:// paths for static files or static://<status_code> for static response. Routing is based on the path")
+	flagSet.StringSlice("upstream", []string{}, "the http url(s) of the upstream endpoint, file:// paths for static files, unix:// paths for unix sockets or static://<status_code> for static response. Routing is based on the path")
 
 	return flagSet
 }
@@ -146,6 +146,16 @@ func (l *LegacyUpstreams) convert() (Upstreams, error) {
 				// Trim the fragment from the end of the URI
 				upstream.URI = strings.SplitN(upstreamString, "#", 2)[0]
 			}
+		case "unix":
+			// The URI path is the socket path, so the route can only be given
+			// as a fragment
+			upstream.ID = "/"
+			upstream.Path = "/"
+			if u.Fragment != "" {
+				upstream.ID = u.Fragment
+				upstream.Path = u.Fragment
+			}
+			upstream.URI = strings.SplitN(upstreamString, "#", 2)[0]
 		case "static":
 			responseCode, err := strconv.Atoi(u.Host)
 			if err != nil {
@@ -440,14 +450,21 @@ func getXAuthRequestAccessTokenHeader() Header {
 }
 
 type LegacyServer struct {
-	MetricsAddress       string `flag:"metrics-address" cfg:"metrics_address"`
-	MetricsSecureAddress string `flag:"metrics-secure-address" cfg:"metrics_secure_address"`
-	MetricsTLSCertFile   string `flag:"metrics-tls-cert-file" cfg:"metrics_tls_cert_file"`
-	MetricsTLSKeyFile    string `flag:"metrics-tls-key-file" cfg:"metrics_tls_key_file"`
-	HTTPAddress          string `flag:"http-address" cfg:"http_address"`
-	HTTPSAddress         string `flag:"https-address" cfg:"https_address"`
-	TLSCertFile          string `flag:"tls-cert-file" cfg:"tls_cert_file"`
-	TLSKeyFile           string `flag:"tls-key-file" cfg:"tls_key_file"`
+	MetricsAddress          string        `flag:"metrics-address" cfg:"metrics_address"`
+	MetricsSecureAddress    string        `flag:"metrics-secure-address" cfg:"metrics_secure_address"`
+	MetricsTLSCertFile      string        `flag:"metrics-tls-cert-file" cfg:"metrics_tls_cert_file"`
+	MetricsTLSKeyFile       string        `flag:"metrics-tls-key-file" cfg:"metrics_tls_key_file"`
+	HTTPAddress             string        `flag:"http-address" cfg:"http_address"`
+	HTTPSAddress            string        `flag:"https-address" cfg:"https_address"`
+	TLSCertFile             string        `flag:"tls-cert-file" cfg:"tls_cert_file"`
+	TLSKeyFile              string        `flag:"tls-key-file" cfg:"tls_key_file"`
+	TLSMinVersion           string        `flag:"tls-min-version" cfg:"tls_min_version"`
+	TLSCipherSuites         []string      `flag:"tls-cipher-suite" cfg:"tls_cipher_suites"`
+	TLSClientCAFile         string        `flag:"tls-client-ca-file" cfg:"tls_client_ca_file"`
+	TLSClientAuth           string        `flag:"tls-client-auth" cfg:"tls_client_auth"`
+	EnableHTTP2             bool          `flag:"enable-http2" cfg:"enable_http2"`
+	ProxyProtocolTrustedIPs []string      `flag:"proxy-protocol-trusted-ip" cfg:"proxy_protocol_trusted_ips"`
+	ShutdownGracePeriod     time.Duration `flag:"shutdown-grace-period" cfg:"shutdown_grace_period"`
 }
 
 func legacyServerFlagset() *pflag.FlagSet {
@@ -461,6 +478,13 @@ func legacyServerFlagset() *pflag.FlagSet {
 	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients")
 	flagSet.String("tls-cert-file", "", "path to certificate file")
 	flagSet.String("tls-key-file", "", "path to private key file")
+	flagSet.String("tls-min-version", "", "minimum TLS version accepted from clients (one of: TLS1.0, TLS1.1, TLS1.2 or TLS1.3, default TLS1.2)")
+	flagSet.StringSlice("tls-cipher-suite", []string{}, "restricts the cipher suites accepted from clients using TLS1.2 or earlier (may be given multiple times)")
+	flagSet.String("tls-client-ca-file", "", "path to the CA bundle used to verify client certificates, the https-address requests a certificate from clients when set")
+	flagSet.String("tls-client-auth", "", "whether clients must present a certificate when tls-client-ca-file is set (one of: request or require, default request)")
+	flagSet.Bool("enable-http2", false, "allow clients to connect with HTTP/2, over TLS or as cleartext (h2c) on the http-address, required to proxy gRPC services")
+	flagSet.StringSlice("proxy-protocol-trusted-ip", []string{}, "list of IPs or CIDR ranges of load balancers allowed to send PROXY protocol headers on the http-address and https-address (may be given multiple times)")
+	flagSet.Duration("shutdown-grace-period", time.Duration(0), "how long in-flight requests and websockets are given to finish on shutdown before their connections are closed (0 waits for in-flight requests without a deadline)")
 
 	return flagSet
 }
@@ -569,8 +593,15 @@ func legacyProviderFlagSet() *pflag.FlagSet {
 
 func (l LegacyServer) convert() (Server, Server) {
 	appServer := Server{
-		BindAddress:       l.HTTPAddress,
-		SecureBindAddress: l.HTTPSAddress,
+		BindAddress:         l.HTTPAddress,
+		SecureBindAddress:   l.HTTPSAddress,
+		EnableHTTP2:         l.EnableHTTP2,
+		ShutdownGracePeriod: Duration(l.ShutdownGracePeriod),
+	}
+	if len(l.ProxyProtocolTrustedIPs) > 0 {
+		appServer.ProxyProtocol = &ProxyProtocol{
+			TrustedIPs: l.ProxyProtocolTrustedIPs,
+		}
 	}
 	if l.TLSKeyFile != "" || l.TLSCertFile != "" {
 		appServer.TLS = &TLS{
@@ -580,6 +611,16 @@ func (l LegacyServer) convert() (Server, Server) {
 			Cert: &SecretSource{
 				FromFile: l.TLSCertFile,
 			},
+			MinVersion: l.TLSMinVersion,
+		}
+		if len(l.TLSCipherSuites) > 0 {
+			appServer.TLS.CipherSuites = l.TLSCipherSuites
+		}
+		if l.TLSClientCAFile != "" {
+			appServer.TLS.ClientCA = &SecretSource{
+				FromFile: l.TLSClientCAFile,
+			}
+			appServer.TLS.ClientAuth = l.TLSClientAuth
 		}
 		// Preserve backwards compatibility, only run one server
 		appServer.BindAddress = ""
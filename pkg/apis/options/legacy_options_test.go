@@ -169,6 +169,28 @@ var _ = Describe("Legacy Options", func() {
 			FlushInterval:         &flushInterval,
 		}
 
+		validUnixWithFragment := "unix:///var/run/app.sock#/app"
+		validUnixWithFragmentUpstream := Upstream{
+			ID:                    "/app",
+			Path:                  "/app",
+			URI:                   "unix:///var/run/app.sock",
+			InsecureSkipTLSVerify: skipVerify,
+			PassHostHeader:        &passHostHeader,
+			ProxyWebSockets:       &proxyWebSockets,
+			FlushInterval:         &flushInterval,
+		}
+
+		validUnix := "unix:///var/run/app.sock"
+		validUnixUpstream := Upstream{
+			ID:                    "/",
+			Path:                  "/",
+			URI:                   validUnix,
+			InsecureSkipTLSVerify: skipVerify,
+			PassHostHeader:        &passHostHeader,
+			ProxyWebSockets:       &proxyWebSockets,
+			FlushInterval:         &flushInterval,
+		}
+
 		validStatic := "static://204"
 		validStaticCode := 204
 		validStaticUpstream := Upstream{
@@ -241,6 +263,16 @@ var _ = Describe("Legacy Options", func() {
 				expectedUpstreams: Upstreams{validFileWithFragmentUpstream},
 				errMsg:            "",
 			}),
+			Entry("with a valid unix socket upstream with a fragment", &convertUpstreamsTableInput{
+				upstreamStrings:   []string{validUnixWithFragment},
+				expectedUpstreams: Upstreams{validUnixWithFragmentUpstream},
+				errMsg:            "",
+			}),
+			Entry("with a valid unix socket upstream", &convertUpstreamsTableInput{
+				upstreamStrings:   []string{validUnix},
+				expectedUpstreams: Upstreams{validUnixUpstream},
+				errMsg:            "",
+			}),
 			Entry("with a valid static upstream", &convertUpstreamsTableInput{
 				upstreamStrings:   []string{validStatic},
 				expectedUpstreams: Upstreams{validStaticUpstream},
@@ -821,6 +853,89 @@ var _ = Describe("Legacy Options", func() {
 					TLS:               tlsConfig,
 				},
 			}),
+			Entry("with a TLS min version and cipher suites specified", legacyServersTableInput{
+				legacyServer: LegacyServer{
+					HTTPAddress:     insecureAddr,
+					HTTPSAddress:    secureAddr,
+					TLSKeyFile:      keyPath,
+					TLSCertFile:     crtPath,
+					TLSMinVersion:   "TLS1.3",
+					TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+				},
+				expectedAppServer: Server{
+					SecureBindAddress: secureAddr,
+					TLS: &TLS{
+						Cert: &SecretSource{
+							FromFile: crtPath,
+						},
+						Key: &SecretSource{
+							FromFile: keyPath,
+						},
+						MinVersion:   "TLS1.3",
+						CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+					},
+				},
+			}),
+			Entry("with a TLS client CA specified", legacyServersTableInput{
+				legacyServer: LegacyServer{
+					HTTPAddress:     insecureAddr,
+					HTTPSAddress:    secureAddr,
+					TLSKeyFile:      keyPath,
+					TLSCertFile:     crtPath,
+					TLSClientCAFile: "ca.crt",
+					TLSClientAuth:   RequireClientCertificate,
+				},
+				expectedAppServer: Server{
+					SecureBindAddress: secureAddr,
+					TLS: &TLS{
+						Cert: &SecretSource{
+							FromFile: crtPath,
+						},
+						Key: &SecretSource{
+							FromFile: keyPath,
+						},
+						ClientCA: &SecretSource{
+							FromFile: "ca.crt",
+						},
+						ClientAuth: RequireClientCertificate,
+					},
+				},
+			}),
+			Entry("with HTTP/2 enabled", legacyServersTableInput{
+				legacyServer: LegacyServer{
+					HTTPAddress:  insecureAddr,
+					HTTPSAddress: secureAddr,
+					EnableHTTP2:  true,
+				},
+				expectedAppServer: Server{
+					BindAddress: insecureAddr,
+					EnableHTTP2: true,
+				},
+			}),
+			Entry("with PROXY protocol trusted IPs", legacyServersTableInput{
+				legacyServer: LegacyServer{
+					HTTPAddress:             insecureAddr,
+					HTTPSAddress:            secureAddr,
+					ProxyProtocolTrustedIPs: []string{"10.0.0.0/8"},
+				},
+				expectedAppServer: Server{
+					BindAddress: insecureAddr,
+					ProxyProtocol: &ProxyProtocol{
+						TrustedIPs: []string{"10.0.0.0/8"},
+					},
+				},
+			}),
+			Entry("with a shutdown grace period", legacyServersTableInput{
+				legacyServer: LegacyServer{
+					HTTPAddress:         insecureAddr,
+					HTTPSAddress:        secureAddr,
+					ShutdownGracePeriod: 30 * time.Second,
+				},
+				expectedAppServer: Server{
+					BindAddress:         insecureAddr,
+					ShutdownGracePeriod: Duration(30 * time.Second),
+				},
+			}),
 			Entry("with metrics HTTP and HTTPS addresses", legacyServersTableInput{
 				legacyServer: LegacyServer{
 					HTTPAddress:          insecureAddr,
@@ -46,15 +46,18 @@ var _ = Describe("Load", func() {
 		},
 
 		Options: Options{
-			ProxyPrefix:        "/oauth2",
-			PingPath:           "/ping",
-			RealClientIPHeader: "X-Real-IP",
-			ForceHTTPS:         false,
-			Cookie:             cookieDefaults(),
-			Session:            sessionOptionsDefaults(),
-			Templates:          templatesDefaults(),
-			SkipAuthPreflight:  false,
-			Logging:            loggingDefaults(),
+			ProxyPrefix:                "/oauth2",
+			PingPath:                   "/ping",
+			ReadyPath:                  "/ready",
+			ReadyCacheDuration:         5 * time.Second,
+			RealClientIPHeader:         "X-Real-IP",
+			ForceHTTPS:                 false,
+			Cookie:                     cookieDefaults(),
+			Session:                    sessionOptionsDefaults(),
+			Templates:                  templatesDefaults(),
+			SkipAuthPreflight:          false,
+			Logging:                    loggingDefaults(),
+			ClientCertificateUserField: "email",
 		},
 	}
 
@@ -3,6 +3,7 @@ package options
 import (
 	"crypto"
 	"net/url"
+	"time"
 
 	oidc "github.com/coreos/go-oidc"
 	ipapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/ip"
@@ -16,17 +17,37 @@ type SignatureData struct {
 	Key  string
 }
 
+// ClientCertificateEmailField uses the first email address SAN of client
+// certificates as the user of sessions.
+const ClientCertificateEmailField = "email"
+
+// ClientCertificateURIField uses the first URI SAN of client certificates as
+// the user of sessions, eg a SPIFFE ID.
+const ClientCertificateURIField = "uri"
+
+// ClientCertificateDNSField uses the first DNS name SAN of client
+// certificates as the user of sessions.
+const ClientCertificateDNSField = "dns"
+
+// ClientCertificateCommonNameField uses the subject common name of client
+// certificates as the user of sessions.
+const ClientCertificateCommonNameField = "cn"
+
 // Options holds Configuration Options that can be set by Command Line Flag,
 // or Config File
 type Options struct {
-	ProxyPrefix        string   `flag:"proxy-prefix" cfg:"proxy_prefix"`
-	PingPath           string   `flag:"ping-path" cfg:"ping_path"`
-	PingUserAgent      string   `flag:"ping-user-agent" cfg:"ping_user_agent"`
-	ReverseProxy       bool     `flag:"reverse-proxy" cfg:"reverse_proxy"`
-	RealClientIPHeader string   `flag:"real-client-ip-header" cfg:"real_client_ip_header"`
-	TrustedIPs         []string `flag:"trusted-ip" cfg:"trusted_ips"`
-	ForceHTTPS         bool     `flag:"force-https" cfg:"force_https"`
-	RawRedirectURL     string   `flag:"redirect-url" cfg:"redirect_url"`
+	ProxyPrefix        string        `flag:"proxy-prefix" cfg:"proxy_prefix"`
+	PingPath           string        `flag:"ping-path" cfg:"ping_path"`
+	PingUserAgent      string        `flag:"ping-user-agent" cfg:"ping_user_agent"`
+	ReadyPath          string        `flag:"ready-path" cfg:"ready_path"`
+	ReadyCacheDuration time.Duration `flag:"ready-cache-duration" cfg:"ready_cache_duration"`
+	ShutdownDelay      time.Duration `flag:"shutdown-delay" cfg:"shutdown_delay"`
+	ReverseProxy       bool          `flag:"reverse-proxy" cfg:"reverse_proxy"`
+	RealClientIPHeader string        `flag:"real-client-ip-header" cfg:"real_client_ip_header"`
+	TrustedIPs         []string      `flag:"trusted-ip" cfg:"trusted_ips"`
+	TrustedProxyIPs    []string      `flag:"trusted-proxy-ip" cfg:"trusted_proxy_ips"`
+	ForceHTTPS         bool          `flag:"force-https" cfg:"force_https"`
+	RawRedirectURL     string        `flag:"redirect-url" cfg:"redirect_url"`
 
 	AuthenticatedEmailsFile string   `flag:"authenticated-emails-file" cfg:"authenticated_emails_file"`
 	EmailDomains            []string `flag:"email-domain" cfg:"email_domains"`
@@ -34,6 +55,10 @@ type Options struct {
 	HtpasswdFile            string   `flag:"htpasswd-file" cfg:"htpasswd_file"`
 	HtpasswdUserGroups      []string `flag:"htpasswd-user-group" cfg:"htpasswd_user_groups"`
 
+	ClientCertificateSessions  bool     `flag:"client-certificate-sessions" cfg:"client_certificate_sessions"`
+	ClientCertificateUserField string   `flag:"client-certificate-user-field" cfg:"client_certificate_user_field"`
+	ClientCertificateGroups    []string `flag:"client-certificate-group" cfg:"client_certificate_groups"`
+
 	Cookie    Cookie         `cfg:",squash"`
 	Session   SessionOptions `cfg:",squash"`
 	Logging   Logging        `cfg:",squash"`
@@ -53,6 +78,7 @@ type Options struct {
 
 	SkipAuthRegex         []string `flag:"skip-auth-regex" cfg:"skip_auth_regex"`
 	SkipAuthRoutes        []string `flag:"skip-auth-route" cfg:"skip_auth_routes"`
+	StepUpRoutes          []string `flag:"step-up-route" cfg:"step_up_routes"`
 	SkipJwtBearerTokens   bool     `flag:"skip-jwt-bearer-tokens" cfg:"skip_jwt_bearer_tokens"`
 	ExtraJwtIssuers       []string `flag:"extra-jwt-issuers" cfg:"extra_jwt_issuers"`
 	SkipProviderButton    bool     `flag:"skip-provider-button" cfg:"skip_provider_button"`
@@ -96,6 +122,8 @@ func NewOptions() *Options {
 		ProxyPrefix:        "/oauth2",
 		Providers:          providerDefaults(),
 		PingPath:           "/ping",
+		ReadyPath:          "/ready",
+		ReadyCacheDuration: 5 * time.Second,
 		RealClientIPHeader: "X-Real-IP",
 		ForceHTTPS:         false,
 		Cookie:             cookieDefaults(),
@@ -103,6 +131,8 @@ func NewOptions() *Options {
 		Templates:          templatesDefaults(),
 		SkipAuthPreflight:  false,
 		Logging:            loggingDefaults(),
+
+		ClientCertificateUserField: ClientCertificateEmailField,
 	}
 }
 
@@ -111,12 +141,14 @@ func NewFlagSet() *pflag.FlagSet {
 	flagSet := pflag.NewFlagSet("oauth2-proxy", pflag.ExitOnError)
 
 	flagSet.Bool("reverse-proxy", false, "are we running behind a reverse proxy, controls whether headers like X-Real-Ip are accepted")
-	flagSet.String("real-client-ip-header", "X-Real-IP", "Header used to determine the real IP of the client (one of: X-Forwarded-For, X-Real-IP, or X-ProxyUser-IP)")
+	flagSet.String("real-client-ip-header", "X-Real-IP", "Header used to determine the real IP of the client (one of: X-Forwarded-For, X-Real-IP, X-ProxyUser-IP or Forwarded)")
+	flagSet.StringSlice("trusted-proxy-ip", []string{}, "list of IPs or CIDR ranges of trusted proxies, the real client IP is the last address in the real client IP header that is not a trusted proxy")
 	flagSet.StringSlice("trusted-ip", []string{}, "list of IPs or CIDR ranges to allow to bypass authentication. WARNING: trusting by IP has inherent security flaws, read the configuration documentation for more information.")
 	flagSet.Bool("force-https", false, "force HTTPS redirect for HTTP requests")
 	flagSet.String("redirect-url", "", "the OAuth Redirect URL. ie: \"https://internalapp.yourcompany.com/oauth2/callback\"")
 	flagSet.StringSlice("skip-auth-regex", []string{}, "(DEPRECATED for --skip-auth-route) bypass authentication for requests path's that match (may be given multiple times)")
 	flagSet.StringSlice("skip-auth-route", []string{}, "bypass authentication for requests that match the method & path. Format: method=path_regex OR path_regex alone for all methods")
+	flagSet.StringSlice("step-up-route", []string{}, "require a recent or stronger authentication for requests that match the method & path. Format: requirements:method=path_regex OR requirements:path_regex, where requirements is a comma separated list of max_age=<duration>, acr=<value> and amr=<value>")
 	flagSet.Bool("skip-provider-button", false, "will skip sign-in-page to directly reach the next step: oauth/start")
 	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests")
 	flagSet.Bool("ssl-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS providers")
@@ -128,10 +160,19 @@ func NewFlagSet() *pflag.FlagSet {
 	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
 	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -B\" for bcrypt encryption")
 	flagSet.StringSlice("htpasswd-user-group", []string{}, "the groups to be set on sessions for htpasswd users (may be given multiple times)")
+	flagSet.Bool("client-certificate-sessions", false, "create sessions for clients presenting a certificate verified against the tls-client-ca-file")
+	flagSet.String("client-certificate-user-field", ClientCertificateEmailField, "the certificate field used as the user of client certificate sessions (one of: email, uri, dns or cn)")
+	flagSet.StringSlice("client-certificate-group", []string{}, "map a certificate organizational unit to a group of client certificate sessions, in the format ou=group (may be given multiple times). By default the organizational units are the groups")
 	flagSet.String("proxy-prefix", "/oauth2", "the url root path that this proxy should be nested under (e.g. /<oauth2>/sign_in)")
 	flagSet.String("ping-path", "/ping", "the ping endpoint that can be used for basic health checks")
 	flagSet.String("ping-user-agent", "", "special User-Agent that will be used for basic health checks")
+	flagSet.String("ready-path", "/ready", "the readiness endpoint, which fails when a dependency is unavailable or once the proxy is shutting down")
+	flagSet.Duration("ready-cache-duration", 5*time.Second, "how long the results of the readiness checks are reused for (minimum 1s)")
+	flagSet.Duration("shutdown-delay", time.Duration(0), "how long the servers keep accepting connections after the readiness endpoint starts failing on shutdown, so that load balancers stop sending requests first")
 	flagSet.String("session-store-type", "cookie", "the session storage provider to use")
+	flagSet.Duration("session-idle-timeout", time.Duration(0), "reject sessions that have not been used for this duration; 0 to disable")
+	flagSet.Duration("session-max-lifetime", time.Duration(0), "reject sessions this long after the user signed in, regardless of refreshes; 0 to disable")
+	flagSet.Duration("session-activity-update-interval", time.Minute, "how often the last activity of a session is saved when --session-idle-timeout is set")
 	flagSet.Bool("session-cookie-minimal", false, "strip OAuth tokens from cookie session stores if they aren't needed (cookie session store only)")
 	flagSet.String("redis-connection-url", "", "URL of redis server for redis session storage (eg: redis://HOST[:PORT])")
 	flagSet.String("redis-password", "", "Redis password. Applicable for all Redis configurations. Will override any password set in `--redis-connection-url`")
@@ -143,6 +184,12 @@ func NewFlagSet() *pflag.FlagSet {
 	flagSet.StringSlice("redis-sentinel-connection-urls", []string{}, "List of Redis sentinel connection URLs (eg redis://HOST[:PORT]). Used in conjunction with --redis-use-sentinel")
 	flagSet.Bool("redis-use-cluster", false, "Connect to redis cluster. Must set --redis-cluster-connection-urls to use this feature")
 	flagSet.StringSlice("redis-cluster-connection-urls", []string{}, "List of Redis cluster connection URLs (eg redis://HOST[:PORT]). Used in conjunction with --redis-use-cluster")
+	flagSet.String("redis-encryption-key-ring-file", "", "Path to a key ring file of `<key-id>:<secret>` lines used to envelope encrypt sessions stored in Redis. The first key encrypts new sessions")
+	flagSet.String("session-binding-client-ip", "", "bind sessions to the client IP subnet they were created from: \"log\" or \"enforce\" (default disabled)")
+	flagSet.Int("session-binding-client-ipv4-prefix", 24, "prefix length of the IPv4 subnet sessions are bound to with --session-binding-client-ip")
+	flagSet.Int("session-binding-client-ipv6-prefix", 64, "prefix length of the IPv6 subnet sessions are bound to with --session-binding-client-ip")
+	flagSet.String("session-binding-user-agent", "", "bind sessions to the User-Agent they were created with: \"log\" or \"enforce\" (default disabled)")
+	flagSet.String("session-binding-client-certificate", "", "bind sessions to the TLS client certificate they were created with: \"log\" or \"enforce\" (default disabled)")
 
 	flagSet.String("signature-key", "", "GAP-Signature request signature key (algorithm:secretkey)")
 	flagSet.Bool("gcp-healthchecks", false, "Enable GCP/GKE healthcheck endpoints")
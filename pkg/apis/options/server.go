@@ -13,9 +13,39 @@ type Server struct {
 	// TLS contains the information for loading the certificate and key for the
 	// secure traffic.
 	TLS *TLS
+
+	// EnableHTTP2 allows clients to connect with HTTP/2, negotiated over TLS
+	// or without TLS (h2c) on the insecure bind address.
+	// This is required to proxy gRPC services.
+	EnableHTTP2 bool
+
+	// ProxyProtocol enables reading the PROXY protocol header sent by load
+	// balancers, such as AWS NLB or HAProxy in TCP mode, so that the client
+	// address of requests is the address of the original client.
+	ProxyProtocol *ProxyProtocol
+
+	// ShutdownGracePeriod is how long in-flight requests and upgraded
+	// connections, such as websockets, are given to finish when the server is
+	// stopped. Connections that are still open after the grace period are
+	// closed.
+	// When 0, in-flight requests are given as long as they need to finish and
+	// upgraded connections are closed immediately.
+	ShutdownGracePeriod Duration
+}
+
+// ProxyProtocol contains the configuration for reading PROXY protocol v1 and
+// v2 headers.
+type ProxyProtocol struct {
+	// TrustedIPs is the list of IPs or CIDR ranges of the load balancers
+	// allowed to send PROXY protocol headers.
+	// The header is optional for connections from these IPs, and is never
+	// read from connections from any other IP.
+	// This value is required.
+	TrustedIPs []string
 }
 
 // TLS contains the information for loading a TLS certifcate and key.
+// Certificates and keys loaded from files are reloaded when the files change.
 type TLS struct {
 	// Key is the TLS key data to use.
 	// Typically this will come from a file.
@@ -24,4 +54,54 @@ type TLS struct {
 	// Cert is the TLS certificate data to use.
 	// Typically this will come from a file.
 	Cert *SecretSource
+
+	// SNICertificates are additional certificates, selected by the server
+	// name requested by clients (SNI).
+	// The Key and Cert are used when no SNI certificate matches the server
+	// name, or clients don't request a server name.
+	SNICertificates []TLSCertificate
+
+	// MinVersion is the minimum TLS version accepted from clients.
+	// Valid values are TLS1.0, TLS1.1, TLS1.2 and TLS1.3.
+	// Defaults to TLS1.2.
+	MinVersion string
+
+	// CipherSuites is the list of cipher suites accepted from clients using
+	// TLS1.2 or earlier, eg. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+	// The cipher suites of TLS1.3 are not configurable.
+	// Defaults to the Go default cipher suites.
+	CipherSuites []string
+
+	// ClientCA is the CA bundle used to verify client certificates.
+	// When set, the server requests a certificate from clients.
+	// Typically this will come from a file.
+	ClientCA *SecretSource
+
+	// ClientAuth determines whether clients must present a certificate when a
+	// ClientCA is set.
+	// Valid values are:
+	// - "request": certificates are verified if clients present one
+	// - "require": clients without a valid certificate are rejected
+	// Defaults to "request".
+	ClientAuth string
+}
+
+// RequestClientCertificate is used to indicate that clients may present a
+// certificate, which is verified against the ClientCA.
+var RequestClientCertificate = "request"
+
+// RequireClientCertificate is used to indicate that clients must present a
+// certificate, which is verified against the ClientCA.
+var RequireClientCertificate = "require"
+
+// TLSCertificate contains the information for loading an additional TLS
+// certificate and key.
+type TLSCertificate struct {
+	// Key is the TLS key data to use.
+	// Typically this will come from a file.
+	Key *SecretSource
+
+	// Cert is the TLS certificate data to use.
+	// Typically this will come from a file.
+	Cert *SecretSource
 }
@@ -1,10 +1,16 @@
 package options
 
+import "time"
+
 // SessionOptions contains configuration options for the SessionStore providers.
 type SessionOptions struct {
-	Type   string             `flag:"session-store-type" cfg:"session_store_type"`
-	Cookie CookieStoreOptions `cfg:",squash"`
-	Redis  RedisStoreOptions  `cfg:",squash"`
+	Type                   string                `flag:"session-store-type" cfg:"session_store_type"`
+	IdleTimeout            time.Duration         `flag:"session-idle-timeout" cfg:"session_idle_timeout"`
+	MaxLifetime            time.Duration         `flag:"session-max-lifetime" cfg:"session_max_lifetime"`
+	ActivityUpdateInterval time.Duration         `flag:"session-activity-update-interval" cfg:"session_activity_update_interval"`
+	Cookie                 CookieStoreOptions    `cfg:",squash"`
+	Redis                  RedisStoreOptions     `cfg:",squash"`
+	Binding                SessionBindingOptions `cfg:",squash"`
 }
 
 // CookieSessionStoreType is used to indicate the CookieSessionStore should be
@@ -32,13 +38,41 @@ type RedisStoreOptions struct {
 	ClusterConnectionURLs  []string `flag:"redis-cluster-connection-urls" cfg:"redis_cluster_connection_urls"`
 	CAPath                 string   `flag:"redis-ca-path" cfg:"redis_ca_path"`
 	InsecureSkipTLSVerify  bool     `flag:"redis-insecure-skip-tls-verify" cfg:"redis_insecure_skip_tls_verify"`
+	EncryptionKeyRingFile  string   `flag:"redis-encryption-key-ring-file" cfg:"redis_encryption_key_ring_file"`
+}
+
+// SessionBindingLogMode is used to indicate that a session presented with
+// client attributes that differ from those it was created with should be
+// logged but still accepted.
+var SessionBindingLogMode = "log"
+
+// SessionBindingEnforceMode is used to indicate that a session presented with
+// client attributes that differ from those it was created with should be
+// rejected, forcing the user to re-authenticate.
+var SessionBindingEnforceMode = "enforce"
+
+// SessionBindingOptions contains configuration options for binding sessions to
+// attributes of the client that created them.
+// Each attribute may be bound in "log" or "enforce" mode, or left empty to
+// disable binding of that attribute.
+type SessionBindingOptions struct {
+	ClientIP          string `flag:"session-binding-client-ip" cfg:"session_binding_client_ip"`
+	ClientIPv4Prefix  int    `flag:"session-binding-client-ipv4-prefix" cfg:"session_binding_client_ipv4_prefix"`
+	ClientIPv6Prefix  int    `flag:"session-binding-client-ipv6-prefix" cfg:"session_binding_client_ipv6_prefix"`
+	UserAgent         string `flag:"session-binding-user-agent" cfg:"session_binding_user_agent"`
+	ClientCertificate string `flag:"session-binding-client-certificate" cfg:"session_binding_client_certificate"`
 }
 
 func sessionOptionsDefaults() SessionOptions {
 	return SessionOptions{
-		Type: CookieSessionStoreType,
+		Type:                   CookieSessionStoreType,
+		ActivityUpdateInterval: time.Minute,
 		Cookie: CookieStoreOptions{
 			Minimal: false,
 		},
+		Binding: SessionBindingOptions{
+			ClientIPv4Prefix: 24,
+			ClientIPv6Prefix: 64,
+		},
 	}
 }
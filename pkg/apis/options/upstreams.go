@@ -5,8 +5,114 @@ import "time"
 const (
 	// DefaultUpstreamFlushInterval is the default value for the Upstream FlushInterval.
 	DefaultUpstreamFlushInterval = 1 * time.Second
+
+	// RoundRobinLoadBalancing distributes requests across the backends in
+	// proportion to their weights.
+	RoundRobinLoadBalancing = "roundRobin"
+
+	// LeastConnectionsLoadBalancing sends requests to the backend with the
+	// fewest active requests relative to its weight.
+	LeastConnectionsLoadBalancing = "leastConnections"
+
+	// ConsistentHashLoadBalancing sends requests for the same session claim
+	// value to the same backend.
+	ConsistentHashLoadBalancing = "consistentHash"
+
+	// DefaultLoadBalancingHashClaim is the default session claim used for
+	// consistent hash load balancing.
+	DefaultLoadBalancingHashClaim = "user"
+
+	// DefaultHealthCheckInterval is the default value for the HealthCheck Interval.
+	DefaultHealthCheckInterval = 10 * time.Second
+
+	// DefaultHealthCheckTimeout is the default value for the HealthCheck Timeout.
+	DefaultHealthCheckTimeout = 2 * time.Second
+
+	// DefaultHealthCheckHealthyThreshold is the default value for the
+	// HealthCheck HealthyThreshold.
+	DefaultHealthCheckHealthyThreshold = 2
+
+	// DefaultHealthCheckUnhealthyThreshold is the default value for the
+	// HealthCheck UnhealthyThreshold.
+	DefaultHealthCheckUnhealthyThreshold = 3
+
+	// DefaultOutlierEjectionDuration is the default value for the
+	// OutlierDetection EjectionDuration.
+	DefaultOutlierEjectionDuration = 30 * time.Second
+
+	// DefaultRetryBackoff is the default value for the Retry Backoff.
+	DefaultRetryBackoff = 100 * time.Millisecond
+
+	// DefaultRetryMaxBackoff is the default value for the Retry MaxBackoff.
+	DefaultRetryMaxBackoff = 2 * time.Second
+
+	// DefaultRetryMaxBodyBufferSize is the default value for the Retry
+	// MaxBodyBufferSize.
+	DefaultRetryMaxBodyBufferSize = 1 << 20
+
+	// DefaultCircuitBreakerOpenDuration is the default value for the
+	// CircuitBreaker OpenDuration.
+	DefaultCircuitBreakerOpenDuration = 30 * time.Second
+
+	// DefaultCircuitBreakerErrorCode is the default value for the
+	// CircuitBreaker ErrorCode.
+	DefaultCircuitBreakerErrorCode = 503
+
+	// HTTPUpstreamProtocol proxies requests with HTTP/1.1, or HTTP/2 when it
+	// is negotiated with an HTTPS upstream.
+	HTTPUpstreamProtocol = "http"
+
+	// H2CUpstreamProtocol proxies requests with HTTP/2 without TLS.
+	H2CUpstreamProtocol = "h2c"
+
+	// H2UpstreamProtocol proxies requests with HTTP/2 over TLS.
+	H2UpstreamProtocol = "h2"
+
+	// DefaultResponseRewriteMaxMatchSize is the default value for the
+	// ResponseRewrite MaxMatchSize.
+	DefaultResponseRewriteMaxMatchSize = 4 << 10
+
+	// DefaultUpstreamCacheMaxSize is the default value for the UpstreamCache
+	// MaxSize.
+	DefaultUpstreamCacheMaxSize = 64 << 20
+
+	// DefaultUpstreamCacheMaxEntrySize is the default value for the
+	// UpstreamCache MaxEntrySize.
+	DefaultUpstreamCacheMaxEntrySize = 1 << 20
+
+	// DefaultUpstreamCacheDiskMaxSize is the default value for the
+	// UpstreamCache DiskMaxSize.
+	DefaultUpstreamCacheDiskMaxSize = 1 << 30
+
+	// UserRateLimitKey limits the requests of each authenticated user.
+	UserRateLimitKey = "user"
+
+	// IPRateLimitKey limits the requests of each client IP.
+	IPRateLimitKey = "ip"
+
+	// RouteRateLimitKey limits all requests to the upstream together.
+	RouteRateLimitKey = "route"
+
+	// MemoryRateLimitBackend stores the rate limits in memory.
+	MemoryRateLimitBackend = "memory"
+
+	// RedisRateLimitBackend stores the rate limits in Redis so that they are
+	// shared by all instances of OAuth2 Proxy.
+	RedisRateLimitBackend = "redis"
+
+	// DefaultRateLimitPeriod is the default value for the RateLimit Period.
+	DefaultRateLimitPeriod = 1 * time.Second
 )
 
+// DefaultResponseRewriteContentTypes are the default media types of the
+// response bodies that are rewritten.
+var DefaultResponseRewriteContentTypes = []string{
+	"text/html",
+	"text/css",
+	"text/javascript",
+	"application/javascript",
+}
+
 // Upstreams is a collection of definitions for upstream servers.
 type Upstreams []Upstream
 
@@ -27,6 +133,19 @@ type Upstream struct {
 	// - `^/baz/(.*)$`: Match any path prefixed with `/baz` and capture the remaining path for use with RewriteTarget
 	Path string `json:"path,omitempty"`
 
+	// Host restricts the upstream to requests for the given host, in
+	// addition to matching the Path.
+	// A host starting with "*." matches any subdomain of the rest of the
+	// host, eg "*.example.com" matches "app.example.com" but not
+	// "example.com". The port of the request host is ignored.
+	// Upstreams with an exact Host take precedence over upstreams with a
+	// wildcard Host, which take precedence over upstreams without a Host,
+	// regardless of their Paths.
+	// When the reverse proxy option is enabled, the X-Forwarded-Host header
+	// is used as the request host.
+	// The combination of Host and Path must be unique across all upstreams.
+	Host string `json:"host,omitempty"`
+
 	// RewriteTarget allows users to rewrite the request path before it is sent to
 	// the upstream server.
 	// Use the Path to capture segments for reuse within the rewrite target.
@@ -35,24 +154,65 @@ type Upstream struct {
 	// upstream server.
 	RewriteTarget string `json:"rewriteTarget,omitempty"`
 
-	// The URI of the upstream server. This may be an HTTP(S) server of a File
-	// based URL. It may include a path, in which case all requests will be served
-	// under that path.
+	// The URI of the upstream server. This may be an HTTP(S) server, a Unix
+	// domain socket or a File based URL. It may include a path, in which case
+	// all requests will be served under that path.
 	// Eg:
 	// - http://localhost:8080
 	// - https://service.localhost
 	// - https://service.localhost/path
+	// - unix:///var/run/app.sock
 	// - file://host/path
 	// If the URI's path is "/base" and the incoming request was for "/dir",
 	// the upstream request will be for "/base/dir".
+	// The path of a unix URI is the path to the socket, requests are sent over
+	// the socket as plain HTTP. When PassHostHeader is disabled, the host
+	// header sent to a unix socket upstream is "localhost".
 	URI string `json:"uri,omitempty"`
 
+	// Backends is a list of HTTP(S) servers that requests to this upstream
+	// are load balanced across.
+	// This can be used instead of the URI when an upstream has several
+	// replicas.
+	Backends []UpstreamBackend `json:"backends,omitempty"`
+
+	// LoadBalancing configures how requests are distributed across the
+	// Backends.
+	// This option can only be used with Backends.
+	LoadBalancing *LoadBalancing `json:"loadBalancing,omitempty"`
+
+	// HealthCheck configures active health checks of the Backends.
+	// Unhealthy backends are removed from rotation until they pass the
+	// health check again.
+	// This option can only be used with Backends.
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+
+	// OutlierDetection configures passive health checking of the Backends.
+	// Backends that fail too many consecutive requests are removed from
+	// rotation for a period of time.
+	// This option can only be used with Backends.
+	OutlierDetection *OutlierDetection `json:"outlierDetection,omitempty"`
+
+	// Retry configures retries of requests that fail to connect to the
+	// upstream or receive one of the configured response codes.
+	// Retries are sent to the same backend as the original request.
+	Retry *Retry `json:"retry,omitempty"`
+
+	// CircuitBreaker configures failing fast when the upstream is failing.
+	// While the circuit breaker is open, requests are not sent to the
+	// upstream and an error page is served instead.
+	CircuitBreaker *CircuitBreaker `json:"circuitBreaker,omitempty"`
+
 	// InsecureSkipTLSVerify will skip TLS verification of upstream HTTPS hosts.
 	// This option is insecure and will allow potential Man-In-The-Middle attacks
 	// betweem OAuth2 Proxy and the usptream server.
 	// Defaults to false.
 	InsecureSkipTLSVerify bool `json:"insecureSkipTLSVerify,omitempty"`
 
+	// TLS configures the TLS connections to HTTPS upstream servers, such as
+	// the client certificate presented to the upstream.
+	TLS *UpstreamTLS `json:"tls,omitempty"`
+
 	// Static will make all requests to this upstream have a static response.
 	// The response will have a body of "Authenticated" and a response code
 	// matching StaticCode.
@@ -76,4 +236,470 @@ type Upstream struct {
 	// ProxyWebSockets enables proxying of websockets to upstream servers
 	// Defaults to true.
 	ProxyWebSockets *bool `json:"proxyWebSockets,omitempty"`
+
+	// Protocol is the protocol used to proxy requests to the upstream server.
+	// Valid values are:
+	// - "http": HTTP/1.1, or HTTP/2 when negotiated with an HTTPS upstream
+	// - "h2c": HTTP/2 without TLS, for http:// and unix:// upstreams
+	// - "h2": HTTP/2 over TLS, for https:// upstreams
+	// Use "h2c" or "h2" to proxy gRPC services, clients must connect to
+	// OAuth2 Proxy with HTTP/2 for streaming requests, see --enable-http2.
+	// Responses from HTTP/2 upstreams are flushed as soon as they are received.
+	// Only the dialTimeout, keepAlive and tlsHandshakeTimeout transport options
+	// can be set for HTTP/2 upstreams.
+	// Defaults to "http".
+	Protocol string `json:"protocol,omitempty"`
+
+	// Transport tunes the connections made to the upstream server.
+	// When not set, the Go default transport settings are used.
+	// These options do not apply to proxied websockets.
+	Transport *UpstreamTransport `json:"transport,omitempty"`
+
+	// RequestHeaders modifies the headers of requests sent to the upstream,
+	// after the injected request headers have been added.
+	RequestHeaders *HeaderRules `json:"requestHeaders,omitempty"`
+
+	// ResponseHeaders modifies the headers of responses from the upstream,
+	// including any injected response headers.
+	ResponseHeaders *HeaderRules `json:"responseHeaders,omitempty"`
+
+	// ResponseRewrite rewrites the links, redirects and cookies in responses
+	// from upstreams that are not aware they are served under a sub-path,
+	// such as upstreams mounted with a RewriteTarget.
+	ResponseRewrite *ResponseRewrite `json:"responseRewrite,omitempty"`
+
+	// Cache configures caching of the upstream's responses, such as static
+	// assets, so that repeated requests are not sent to the upstream.
+	Cache *UpstreamCache `json:"cache,omitempty"`
+
+	// RateLimit limits the rate of requests to the upstream.
+	// Requests over the limit receive a 429 Too Many Requests response.
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+
+	// RequestLimits limits the size and content types of requests to the
+	// upstream.
+	// Requests over the limits receive an error page instead of being
+	// proxied.
+	RequestLimits *RequestLimits `json:"requestLimits,omitempty"`
+
+	// IPAccess restricts access to the upstream by client IP.
+	// The client IP is determined in the same way as for TrustedIPs, taking
+	// the RealClientIPHeader into account when ReverseProxy is enabled.
+	// Requests from denied IPs receive a 403 Forbidden response, even when
+	// authenticated. Auth only requests are also denied when the client IP is
+	// not allowed to access the upstream that serves the original request,
+	// as given by the X-Forwarded-Host and X-Forwarded-Uri headers.
+	IPAccess *IPAccess `json:"ipAccess,omitempty"`
+}
+
+// IPAccess configures which client IPs are allowed to access an upstream.
+type IPAccess struct {
+	// Allow is the list of IPs or CIDR ranges, eg "10.0.0.0/8", that are
+	// allowed to access the upstream.
+	// When set, requests from any other IP are denied.
+	// Defaults to allowing all IPs.
+	Allow []string `json:"allow,omitempty"`
+
+	// Deny is the list of IPs or CIDR ranges that are denied access to the
+	// upstream.
+	// Deny takes precedence over Allow, so that a range can be allowed
+	// except for some of its addresses.
+	Deny []string `json:"deny,omitempty"`
+}
+
+// RequestLimits configures limits on the requests proxied to an upstream.
+type RequestLimits struct {
+	// MaxBodySize is the largest request body, in bytes, that is proxied.
+	// Requests with a larger Content-Length receive a 413 Request Entity Too
+	// Large response. Bodies without a Content-Length, such as chunked
+	// bodies, are counted as they are proxied and the request is aborted
+	// with a 413 response once the limit is reached.
+	// Defaults to 0, request bodies are not limited.
+	MaxBodySize int64 `json:"maxBodySize,omitempty"`
+
+	// MaxHeaderSize is the largest total size, in bytes, of the request
+	// header names and values that is proxied.
+	// Requests with larger headers receive a 431 Request Header Fields Too
+	// Large response.
+	// Defaults to 0, request headers are only limited by the server.
+	MaxHeaderSize int64 `json:"maxHeaderSize,omitempty"`
+
+	// AllowedContentTypes is the list of media types allowed for requests with
+	// a body, eg "application/json" or "image/*".
+	// Requests with a body of any other type, or without a Content-Type,
+	// receive a 415 Unsupported Media Type response.
+	// Defaults to allowing all content types.
+	AllowedContentTypes []string `json:"allowedContentTypes,omitempty"`
+}
+
+// RateLimit configures a token bucket rate limit.
+// Each key has a bucket of Burst tokens, which is refilled at a rate of
+// Requests tokens per Period. Each request takes a token from the bucket, and
+// is rejected when the bucket is empty.
+type RateLimit struct {
+	// Requests is the number of requests allowed in each Period.
+	// This value is required.
+	Requests int `json:"requests,omitempty"`
+
+	// Period is the period over which Requests are allowed.
+	// Defaults to 1 second.
+	Period *Duration `json:"period,omitempty"`
+
+	// Burst is the number of requests that can be made at once, after no
+	// requests have been made for a while.
+	// Defaults to Requests.
+	Burst int `json:"burst,omitempty"`
+
+	// Key determines which requests share a limit.
+	// Valid values are:
+	// - "user": each authenticated user has their own limit, requests
+	//   without a session are limited by client IP
+	// - "ip": each client IP has its own limit
+	// - "route": all requests to the upstream share a single limit
+	// Defaults to "user".
+	Key string `json:"key,omitempty"`
+
+	// Backend is where the rate limits are stored.
+	// Valid values are:
+	// - "memory": limits are stored in memory and apply to each instance of
+	//   OAuth2 Proxy separately
+	// - "redis": limits are stored in Redis, using the --redis-* connection
+	//   options, and are shared by all instances of OAuth2 Proxy
+	// Defaults to "memory".
+	Backend string `json:"backend,omitempty"`
+}
+
+// UpstreamCache configures caching of responses from an upstream.
+// Only successful responses to GET requests are cached, for as long as their
+// Cache-Control max-age, or their Expires header, allows.
+// Responses that set cookies, have a Cache-Control of no-store or no-cache, or
+// vary on request headers other than Accept-Encoding are not cached.
+// Responses to requests with an Authorization header are only cached when
+// they have a Cache-Control of public.
+// Requests with an If-None-Match or If-Modified-Since header matching a
+// cached response are answered with a 304 Not Modified response.
+type UpstreamCache struct {
+	// MaxSize is the size, in bytes, of the in-memory cache.
+	// The least recently used responses are removed when it is full.
+	// Defaults to 64MiB.
+	MaxSize int64 `json:"maxSize,omitempty"`
+
+	// MaxEntrySize is the size, in bytes, of the largest response body that
+	// is cached.
+	// Defaults to 1MiB.
+	MaxEntrySize int64 `json:"maxEntrySize,omitempty"`
+
+	// DefaultTTL is how long responses without a Cache-Control max-age or an
+	// Expires header are cached for.
+	// Defaults to 0, such responses are not cached.
+	DefaultTTL *Duration `json:"defaultTTL,omitempty"`
+
+	// KeyClaims is a list of session claims, such as "user" or "groups", that
+	// are included in the cache key.
+	// Responses are then only shared between requests with the same claim
+	// values.
+	// When empty, the user and email claims are included in the key, and only
+	// responses with a Cache-Control of public are shared by all users.
+	// Responses with a Cache-Control of private are only cached for requests
+	// with a session.
+	KeyClaims []string `json:"keyClaims,omitempty"`
+
+	// DiskPath is the directory of an optional disk cache.
+	// Responses are written to the disk cache as well as the in-memory cache,
+	// so that responses removed from memory can still be served from disk.
+	// Cache files left in the directory by a previous run are removed at
+	// startup.
+	DiskPath string `json:"diskPath,omitempty"`
+
+	// DiskMaxSize is the size, in bytes, of the disk cache.
+	// This option can only be used with DiskPath.
+	// Defaults to 1GiB.
+	DiskMaxSize int64 `json:"diskMaxSize,omitempty"`
+}
+
+// ResponseRewrite configures rewriting of responses from an upstream.
+type ResponseRewrite struct {
+	// PathPrefix is the path the upstream is served under.
+	// It is added to the paths of rewritten redirects and cookies, eg with a
+	// PathPrefix of "/app", a redirect to "/login" is rewritten to
+	// "/app/login".
+	PathPrefix string `json:"pathPrefix,omitempty"`
+
+	// Location enables rewriting of the Location and Content-Location
+	// response headers.
+	// Absolute URLs pointing at the upstream server, or at the request host,
+	// are made relative and absolute paths are prefixed with the PathPrefix.
+	Location bool `json:"location,omitempty"`
+
+	// Cookies enables rewriting of the Path and Domain attributes of
+	// Set-Cookie response headers.
+	// Paths are prefixed with the PathPrefix and the Domain attribute is
+	// replaced with the CookieDomain.
+	Cookies bool `json:"cookies,omitempty"`
+
+	// CookieDomain is the domain set on rewritten cookies.
+	// When empty, the Domain attribute is removed so that cookies apply to
+	// the request host.
+	CookieDomain string `json:"cookieDomain,omitempty"`
+
+	// Body is a list of substitutions made in the response body.
+	// Substitutions are applied in order.
+	// Bodies compressed with gzip are decompressed before the substitutions
+	// are made and compressed again afterwards, bodies with other encodings
+	// are not rewritten.
+	Body []BodyRewrite `json:"body,omitempty"`
+
+	// ContentTypes is the list of media types of the response bodies that are
+	// rewritten.
+	// Defaults to text/html, text/css, text/javascript and
+	// application/javascript.
+	ContentTypes []string `json:"contentTypes,omitempty"`
+
+	// MaxMatchSize is the longest text, in bytes, that a body pattern is
+	// guaranteed to match.
+	// Bodies are rewritten as they are streamed to the client, holding back
+	// only this many bytes in case a match continues into the next part of
+	// the body, so bodies of any size are rewritten without being buffered.
+	// Defaults to 4KiB.
+	MaxMatchSize int64 `json:"maxMatchSize,omitempty"`
+}
+
+// BodyRewrite is a regular expression substitution made in a response body.
+type BodyRewrite struct {
+	// Pattern is the regular expression matched in the response body.
+	Pattern string `json:"pattern,omitempty"`
+
+	// Replacement replaces each match of the Pattern.
+	// Captured groups of the Pattern can be used with `$1` or `${name}`.
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// HeaderRules modify the headers of a request or response.
+// The rules are applied in order: headers are removed, then renamed, then set.
+type HeaderRules struct {
+	// Remove is a list of the names of headers that are removed.
+	Remove []string `json:"remove,omitempty"`
+
+	// Rename is a list of headers that are renamed, keeping their values.
+	// Any existing values of the new name are replaced.
+	Rename []HeaderRename `json:"rename,omitempty"`
+
+	// Set is a list of headers that are set, with values loaded from secrets
+	// or session claims in the same way as the injected headers.
+	// Existing values of the header are replaced, unless PreserveRequestValue
+	// is set, in which case the values are added to the existing values.
+	Set []Header `json:"set,omitempty"`
+}
+
+// HeaderRename renames a header.
+type HeaderRename struct {
+	// From is the current name of the header.
+	From string `json:"from,omitempty"`
+
+	// To is the new name of the header.
+	To string `json:"to,omitempty"`
+}
+
+// UpstreamBackend is a server that an upstream's requests are load balanced
+// across.
+type UpstreamBackend struct {
+	// URI is the HTTP(S) URI of the backend server.
+	// It follows the same rules as the URI of an Upstream.
+	URI string `json:"uri,omitempty"`
+
+	// Weight is the share of requests this backend should receive relative
+	// to the other backends of the upstream.
+	// Defaults to 1.
+	Weight int `json:"weight,omitempty"`
+}
+
+// LoadBalancing configures how an upstream distributes requests across its
+// backends.
+type LoadBalancing struct {
+	// Strategy is the load balancing strategy to use.
+	// Valid values are `roundRobin`, `leastConnections` and `consistentHash`.
+	// Defaults to `roundRobin`.
+	Strategy string `json:"strategy,omitempty"`
+
+	// HashClaim is the session claim whose value is hashed to select a
+	// backend when using the `consistentHash` strategy, so that a user is
+	// consistently sent to the same backend.
+	// Requests without a session are distributed with round robin.
+	// Defaults to `user`.
+	HashClaim string `json:"hashClaim,omitempty"`
+}
+
+// HealthCheck configures periodic HTTP health checks of an upstream's
+// backends.
+type HealthCheck struct {
+	// Path is the path requested on each backend to check its health.
+	// This value is required.
+	Path string `json:"path,omitempty"`
+
+	// Interval is the period between health checks.
+	// Defaults to 10 seconds.
+	Interval *Duration `json:"interval,omitempty"`
+
+	// Timeout is how long to wait for a health check response.
+	// Defaults to 2 seconds.
+	Timeout *Duration `json:"timeout,omitempty"`
+
+	// HealthyThreshold is the number of consecutive successful health checks
+	// required for an unhealthy backend to be returned to rotation.
+	// Defaults to 2.
+	HealthyThreshold int `json:"healthyThreshold,omitempty"`
+
+	// UnhealthyThreshold is the number of consecutive failed health checks
+	// after which a backend is removed from rotation.
+	// Defaults to 3.
+	UnhealthyThreshold int `json:"unhealthyThreshold,omitempty"`
+
+	// ExpectedStatus is the list of response codes of a healthy backend.
+	// Defaults to any 2xx response code.
+	ExpectedStatus []int `json:"expectedStatus,omitempty"`
+}
+
+// OutlierDetection configures the removal of backends from rotation based on
+// the responses to proxied requests.
+type OutlierDetection struct {
+	// ConsecutiveErrors is the number of consecutive connection errors or 5xx
+	// responses after which a backend is removed from rotation.
+	// This value is required.
+	ConsecutiveErrors int `json:"consecutiveErrors,omitempty"`
+
+	// EjectionDuration is how long a backend is removed from rotation for.
+	// Defaults to 30 seconds.
+	EjectionDuration *Duration `json:"ejectionDuration,omitempty"`
+}
+
+// Retry configures retries of failed requests to an upstream.
+type Retry struct {
+	// Attempts is the maximum number of times a request is retried.
+	// This value is required.
+	Attempts int `json:"attempts,omitempty"`
+
+	// StatusCodes is a list of response codes that should be retried.
+	// Requests that fail to connect to the upstream are always retried.
+	StatusCodes []int `json:"statusCodes,omitempty"`
+
+	// Backoff is the time to wait before the first retry, this doubles with
+	// each subsequent retry.
+	// Defaults to 100 milliseconds.
+	Backoff *Duration `json:"backoff,omitempty"`
+
+	// MaxBackoff is the maximum time to wait between retries.
+	// Defaults to 2 seconds.
+	MaxBackoff *Duration `json:"maxBackoff,omitempty"`
+
+	// RetryNonIdempotent enables retries of requests with non-idempotent
+	// methods, such as POST and PATCH.
+	// By default only idempotent methods are retried.
+	RetryNonIdempotent bool `json:"retryNonIdempotent,omitempty"`
+
+	// MaxBodyBufferSize is the maximum size, in bytes, of a request body that
+	// is buffered so that it can be retried.
+	// Requests with larger bodies are not retried.
+	// Defaults to 1MiB.
+	MaxBodyBufferSize int64 `json:"maxBodyBufferSize,omitempty"`
+}
+
+// CircuitBreaker configures failing fast when requests to an upstream
+// consecutively fail.
+type CircuitBreaker struct {
+	// ConsecutiveFailures is the number of consecutive connection failures or
+	// 5xx responses after which the circuit breaker opens.
+	// This value is required.
+	ConsecutiveFailures int `json:"consecutiveFailures,omitempty"`
+
+	// OpenDuration is how long the circuit breaker stays open before a trial
+	// request is sent to the upstream.
+	// Defaults to 30 seconds.
+	OpenDuration *Duration `json:"openDuration,omitempty"`
+
+	// ErrorCode is the response code of the error page served while the
+	// circuit breaker is open.
+	// Defaults to 503.
+	ErrorCode *int `json:"errorCode,omitempty"`
+
+	// ErrorMessage is the message of the error page served while the circuit
+	// breaker is open.
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+// UpstreamTransport configures the timeouts and connection pooling of
+// requests to an upstream server.
+// Any zero value keeps the Go default transport setting.
+type UpstreamTransport struct {
+	// DialTimeout is the maximum time to wait for a connection to the
+	// upstream to be established.
+	// Defaults to 30 seconds.
+	DialTimeout *Duration `json:"dialTimeout,omitempty"`
+
+	// KeepAlive is the interval between keep-alive probes of an active
+	// connection.
+	// Defaults to 30 seconds.
+	KeepAlive *Duration `json:"keepAlive,omitempty"`
+
+	// TLSHandshakeTimeout is the maximum time to wait for a TLS handshake with
+	// the upstream.
+	// Defaults to 10 seconds.
+	TLSHandshakeTimeout *Duration `json:"tlsHandshakeTimeout,omitempty"`
+
+	// ResponseHeaderTimeout is the maximum time to wait for the response
+	// headers after the request has been sent. It does not limit the time
+	// taken to read the response body.
+	// Defaults to no timeout.
+	ResponseHeaderTimeout *Duration `json:"responseHeaderTimeout,omitempty"`
+
+	// IdleConnTimeout is how long an idle connection is kept open before it
+	// is closed.
+	// Defaults to 90 seconds.
+	IdleConnTimeout *Duration `json:"idleConnTimeout,omitempty"`
+
+	// MaxIdleConns is the maximum number of idle connections kept open to
+	// all hosts of the upstream.
+	// Defaults to 100.
+	MaxIdleConns int `json:"maxIdleConns,omitempty"`
+
+	// MaxIdleConnsPerHost is the maximum number of idle connections kept open
+	// to each host of the upstream.
+	// Defaults to 2.
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost,omitempty"`
+
+	// MaxConnsPerHost limits the total number of connections to each host of
+	// the upstream. Requests block while the limit is reached.
+	// Defaults to no limit.
+	MaxConnsPerHost int `json:"maxConnsPerHost,omitempty"`
+
+	// HTTP2 enables HTTP/2 to HTTPS upstreams that support it.
+	// Defaults to true.
+	HTTP2 *bool `json:"http2,omitempty"`
+}
+
+// UpstreamTLS configures TLS connections to an upstream server.
+// Certificates loaded from files are reloaded when the files change.
+// New connections to the upstream, including websockets and health checks,
+// use the reloaded certificates.
+type UpstreamTLS struct {
+	// ClientCert is the PEM encoded client certificate presented to the
+	// upstream server. ClientKey must also be set.
+	ClientCert *SecretSource `json:"clientCert,omitempty"`
+
+	// ClientKey is the PEM encoded private key of the ClientCert.
+	ClientKey *SecretSource `json:"clientKey,omitempty"`
+
+	// CA is a PEM encoded bundle of the certificate authorities trusted to
+	// sign the upstream server's certificate.
+	// Defaults to the system certificate authorities.
+	CA *SecretSource `json:"ca,omitempty"`
+
+	// ServerName overrides the server name sent with SNI and used to verify
+	// the upstream server's certificate.
+	// Defaults to the host of the upstream URI.
+	ServerName string `json:"serverName,omitempty"`
+
+	// MinVersion is the minimum TLS version accepted from the upstream.
+	// Valid values are TLS1.0, TLS1.1, TLS1.2 and TLS1.3.
+	// Defaults to TLS1.2.
+	MinVersion string `json:"minVersion,omitempty"`
 }
@@ -12,6 +12,9 @@ type SessionStore interface {
 	Save(rw http.ResponseWriter, req *http.Request, s *SessionState) error
 	Load(req *http.Request) (*SessionState, error)
 	Clear(rw http.ResponseWriter, req *http.Request) error
+	// VerifyConnection checks that the backend storing the sessions, if any,
+	// can be reached.
+	VerifyConnection(ctx context.Context) error
 }
 
 var ErrLockNotObtained = errors.New("lock: not obtained")
@@ -19,6 +19,13 @@ type SessionState struct {
 	CreatedAt *time.Time `msgpack:"ca,omitempty"`
 	ExpiresOn *time.Time `msgpack:"eo,omitempty"`
 
+	// SignedInAt is when the user signed in, unlike CreatedAt it is not reset
+	// when the session is refreshed
+	SignedInAt *time.Time `msgpack:"sia,omitempty"`
+	// LastActivity is when the session was last used, it is only updated
+	// periodically when an idle timeout is configured
+	LastActivity *time.Time `msgpack:"la,omitempty"`
+
 	AccessToken  string `msgpack:"at,omitempty"`
 	IDToken      string `msgpack:"it,omitempty"`
 	RefreshToken string `msgpack:"rt,omitempty"`
@@ -30,9 +37,25 @@ type SessionState struct {
 	Groups            []string `msgpack:"g,omitempty"`
 	PreferredUsername string   `msgpack:"pu,omitempty"`
 
+	// How the user authenticated with the provider, from the `auth_time`,
+	// `acr` and `amr` ID Token claims
+	AuthTime *time.Time `msgpack:"aut,omitempty"`
+	ACR      string     `msgpack:"acr,omitempty"`
+	AMR      []string   `msgpack:"amr,omitempty"`
+
+	// Hashes of the client attributes the session is bound to
+	ClientIPHash   []byte `msgpack:"cih,omitempty"`
+	UserAgentHash  []byte `msgpack:"uah,omitempty"`
+	ClientCertHash []byte `msgpack:"cch,omitempty"`
+
 	// Internal helpers, not serialized
 	Clock clock.Clock `msgpack:"-"`
 	Lock  Lock        `msgpack:"-"`
+
+	// NeedsResave is set when the session has changed since it was loaded and
+	// should be saved again, eg. when session stores load it using an old
+	// cookie secret or its LastActivity has been updated.
+	NeedsResave bool `msgpack:"-"`
 }
 
 func (s *SessionState) ObtainLock(ctx context.Context, expiration time.Duration) error {
@@ -69,6 +92,13 @@ func (s *SessionState) CreatedAtNow() {
 	s.CreatedAt = &now
 }
 
+// SignedInNow sets a SessionState's SignedInAt and LastActivity to now
+func (s *SessionState) SignedInNow() {
+	now := s.Clock.Now()
+	s.SignedInAt = &now
+	s.LastActivity = &now
+}
+
 // SetExpiresOn sets an expiration
 func (s *SessionState) SetExpiresOn(exp time.Time) {
 	s.ExpiresOn = &exp
@@ -100,6 +130,32 @@ func (s *SessionState) Age() time.Duration {
 	return 0
 }
 
+// SinceAuthentication returns how long ago the user authenticated with the
+// provider. If the provider didn't report an `auth_time`, the time the user
+// signed in to the proxy is used instead.
+func (s *SessionState) SinceAuthentication() time.Duration {
+	if s.AuthTime != nil && !s.AuthTime.IsZero() {
+		return s.Clock.Now().Sub(*s.AuthTime)
+	}
+	return s.SinceSignIn()
+}
+
+// SinceSignIn returns how long ago the user signed in
+func (s *SessionState) SinceSignIn() time.Duration {
+	if s.SignedInAt != nil && !s.SignedInAt.IsZero() {
+		return s.Clock.Now().Sub(*s.SignedInAt)
+	}
+	return 0
+}
+
+// IdleTime returns how long ago the session was last used
+func (s *SessionState) IdleTime() time.Duration {
+	if s.LastActivity != nil && !s.LastActivity.IsZero() {
+		return s.Clock.Now().Sub(*s.LastActivity)
+	}
+	return 0
+}
+
 // String constructs a summary of the session state
 func (s *SessionState) String() string {
 	o := fmt.Sprintf("Session{email:%s user:%s PreferredUsername:%s", s.Email, s.User, s.PreferredUsername)
@@ -149,6 +205,12 @@ func (s *SessionState) GetClaim(claim string) []string {
 		return groups
 	case "preferred_username":
 		return []string{s.PreferredUsername}
+	case "acr":
+		return []string{s.ACR}
+	case "amr":
+		amr := make([]string, len(s.AMR))
+		copy(amr, s.AMR)
+		return amr
 	default:
 		return []string{}
 	}
@@ -73,6 +73,16 @@ var _ = Describe("Director Suite", func() {
 			validator:        testValidator(true),
 			expectedRedirect: "https://a-service.example.com/foo/bar",
 		}),
+		Entry("Proxied request with Forwarded header, outside of ProxyPrefix, redirects to proxied URL", getRedirectTableInput{
+			requestURL: "https://oauth.example.com/foo/bar",
+			headers: map[string]string{
+				"Forwarded":       "for=1.2.3.4;proto=https;host=a-service.example.com, for=10.0.0.1",
+				"X-Forwarded-Uri": "/foo/bar",
+			},
+			reverseProxy:     true,
+			validator:        testValidator(true),
+			expectedRedirect: "https://a-service.example.com/foo/bar",
+		}),
 		Entry("Non-proxied request with spoofed headers, wouldn't redirect", getRedirectTableInput{
 			requestURL: "https://oauth.example.com/foo?bar",
 			headers: map[string]string{
@@ -32,6 +32,8 @@ func (a *appDirector) getXAuthRequestRedirect(req *http.Request) string {
 // getXForwardedHeadersRedirect handles these getAppRedirect strategies:
 // - `X-Forwarded-(Proto|Host|Uri)` headers (when ReverseProxy mode is enabled)
 // - `X-Forwarded-(Proto|Host)` if `Uri` has the ProxyPath (i.e. /oauth2/*)
+// The proto and host of the `Forwarded` header are used when the
+// `X-Forwarded-(Proto|Host)` headers are not present.
 func (a *appDirector) getXForwardedHeadersRedirect(req *http.Request) string {
 	if !requestutil.IsForwardedRequest(req) {
 		return ""
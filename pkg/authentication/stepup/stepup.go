@@ -0,0 +1,155 @@
+package stepup
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+)
+
+// Requirement describes how recently and how strongly a user must have
+// authenticated with the provider to access a route.
+type Requirement struct {
+	// MaxAge is the maximum time since the user authenticated (`auth_time`)
+	MaxAge time.Duration
+
+	// ACRValues are the accepted Authentication Context Class References,
+	// the session's `acr` must match one of these
+	ACRValues []string
+
+	// AMRValues are the accepted Authentication Methods References,
+	// one of the session's `amr` values must match one of these
+	AMRValues []string
+}
+
+// SatisfiedBy checks whether the session meets the requirement
+func (r Requirement) SatisfiedBy(s *sessionsapi.SessionState) bool {
+	if r.MaxAge > 0 && s.SinceAuthentication() > r.MaxAge {
+		return false
+	}
+	if len(r.ACRValues) > 0 && !contains(r.ACRValues, s.ACR) {
+		return false
+	}
+	if len(r.AMRValues) > 0 && !containsAny(r.AMRValues, s.AMR) {
+		return false
+	}
+	return true
+}
+
+// LoginParams returns the authentication request parameters that ask the
+// provider to authenticate the user in a way that meets the requirement.
+func (r Requirement) LoginParams() url.Values {
+	params := url.Values{}
+	if r.MaxAge > 0 || len(r.AMRValues) > 0 {
+		// There is no standard parameter to request authentication methods,
+		// a fresh login is the best we can ask for
+		params.Set("prompt", "login")
+	}
+	if r.MaxAge > 0 {
+		params.Set("max_age", strconv.FormatInt(int64(r.MaxAge/time.Second), 10))
+	}
+	if len(r.ACRValues) > 0 {
+		params.Set("acr_values", strings.Join(r.ACRValues, " "))
+	}
+	return params
+}
+
+// Route applies a Requirement to requests matching a method & path
+type Route struct {
+	method      string
+	pathRegex   *regexp.Regexp
+	Requirement Requirement
+}
+
+// ParseRoute parses a step-up route of the form
+// `requirements:method=path_regex` or `requirements:path_regex`.
+// The requirements are a comma separated list of `max_age=<duration>`,
+// `acr=<value>` and `amr=<value>`, acr and amr may be given multiple times
+// to accept any of the values.
+func ParseRoute(route string) (*Route, error) {
+	parts := strings.SplitN(route, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("step-up route %q must be of the form requirements:[method=]path_regex", route)
+	}
+
+	requirement, err := parseRequirement(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid requirements in step-up route %q: %v", route, err)
+	}
+
+	var method, path string
+	methodPath := strings.SplitN(parts[1], "=", 2)
+	if len(methodPath) == 1 {
+		path = methodPath[0]
+	} else {
+		method = strings.ToUpper(methodPath[0])
+		path = methodPath[1]
+	}
+
+	pathRegex, err := regexp.Compile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling regex /%s/: %v", path, err)
+	}
+
+	return &Route{
+		method:      method,
+		pathRegex:   pathRegex,
+		Requirement: requirement,
+	}, nil
+}
+
+// Matches checks whether the route applies to the request method & path
+func (r *Route) Matches(method, path string) bool {
+	return (r.method == "" || r.method == method) && r.pathRegex.MatchString(path)
+}
+
+func parseRequirement(requirements string) (Requirement, error) {
+	requirement := Requirement{}
+	for _, part := range strings.Split(requirements, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return Requirement{}, fmt.Errorf("requirement %q must be of the form key=value", part)
+		}
+
+		switch kv[0] {
+		case "max_age":
+			maxAge, err := time.ParseDuration(kv[1])
+			if err != nil {
+				return Requirement{}, fmt.Errorf("invalid max_age: %v", err)
+			}
+			if maxAge < time.Second {
+				return Requirement{}, fmt.Errorf("max_age (%s) must be at least 1s", maxAge)
+			}
+			requirement.MaxAge = maxAge
+		case "acr":
+			requirement.ACRValues = append(requirement.ACRValues, kv[1])
+		case "amr":
+			requirement.AMRValues = append(requirement.AMRValues, kv[1])
+		default:
+			return Requirement{}, fmt.Errorf("unknown requirement %q", kv[0])
+		}
+	}
+	return requirement, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(values []string, candidates []string) bool {
+	for _, c := range candidates {
+		if contains(values, c) {
+			return true
+		}
+	}
+	return false
+}
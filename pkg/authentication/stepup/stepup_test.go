@@ -0,0 +1,116 @@
+package stepup
+
+import (
+	"net/url"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Step-up", func() {
+	type parseRouteTableInput struct {
+		route               string
+		expectedRequirement Requirement
+		expectedErr         string
+		matches             [][2]string
+		doesNotMatch        [][2]string
+	}
+
+	DescribeTable("ParseRoute",
+		func(in parseRouteTableInput) {
+			route, err := ParseRoute(in.route)
+			if in.expectedErr != "" {
+				Expect(err).To(MatchError(in.expectedErr))
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+			Expect(route.Requirement).To(Equal(in.expectedRequirement))
+
+			for _, m := range in.matches {
+				Expect(route.Matches(m[0], m[1])).To(BeTrue())
+			}
+			for _, m := range in.doesNotMatch {
+				Expect(route.Matches(m[0], m[1])).To(BeFalse())
+			}
+		},
+		Entry("with a max age for all methods", parseRouteTableInput{
+			route:               "max_age=10m:^/admin/",
+			expectedRequirement: Requirement{MaxAge: 10 * time.Minute},
+			matches:             [][2]string{{"GET", "/admin/users"}, {"POST", "/admin/"}},
+			doesNotMatch:        [][2]string{{"GET", "/"}},
+		}),
+		Entry("with acr and amr values for a method", parseRouteTableInput{
+			route: "acr=mfa,acr=hwk,amr=otp:post=^/admin/",
+			expectedRequirement: Requirement{
+				ACRValues: []string{"mfa", "hwk"},
+				AMRValues: []string{"otp"},
+			},
+			matches:      [][2]string{{"POST", "/admin/users"}},
+			doesNotMatch: [][2]string{{"GET", "/admin/users"}},
+		}),
+		Entry("without requirements", parseRouteTableInput{
+			route:       "^/admin/",
+			expectedErr: "step-up route \"^/admin/\" must be of the form requirements:[method=]path_regex",
+		}),
+		Entry("with an unknown requirement", parseRouteTableInput{
+			route:       "loa=3:^/admin/",
+			expectedErr: "invalid requirements in step-up route \"loa=3:^/admin/\": unknown requirement \"loa\"",
+		}),
+		Entry("with an invalid max age", parseRouteTableInput{
+			route:       "max_age=10:^/admin/",
+			expectedErr: "invalid requirements in step-up route \"max_age=10:^/admin/\": invalid max_age: time: missing unit in duration \"10\"",
+		}),
+		Entry("with a max age below a second", parseRouteTableInput{
+			route:       "max_age=10ms:^/admin/",
+			expectedErr: "invalid requirements in step-up route \"max_age=10ms:^/admin/\": max_age (10ms) must be at least 1s",
+		}),
+		Entry("with an invalid regex", parseRouteTableInput{
+			route:       "acr=mfa:GET=/(admin",
+			expectedErr: "error compiling regex //(admin/: error parsing regexp: missing closing ): `/(admin`",
+		}),
+	)
+
+	Context("Requirement", func() {
+		now := time.Now()
+		minutesAgo := func(m int) *time.Time {
+			t := now.Add(time.Duration(-m) * time.Minute)
+			return &t
+		}
+
+		DescribeTable("SatisfiedBy",
+			func(requirement Requirement, session *sessionsapi.SessionState, satisfied bool) {
+				Expect(requirement.SatisfiedBy(session)).To(Equal(satisfied))
+			},
+			Entry("with no requirements", Requirement{}, &sessionsapi.SessionState{}, true),
+			Entry("with a recent auth_time", Requirement{MaxAge: 10 * time.Minute},
+				&sessionsapi.SessionState{AuthTime: minutesAgo(5)}, true),
+			Entry("with an old auth_time", Requirement{MaxAge: 10 * time.Minute},
+				&sessionsapi.SessionState{AuthTime: minutesAgo(15), SignedInAt: minutesAgo(1)}, false),
+			Entry("without an auth_time but a recent sign in", Requirement{MaxAge: 10 * time.Minute},
+				&sessionsapi.SessionState{SignedInAt: minutesAgo(5)}, true),
+			Entry("with a matching acr", Requirement{ACRValues: []string{"mfa", "hwk"}},
+				&sessionsapi.SessionState{ACR: "hwk"}, true),
+			Entry("with a different acr", Requirement{ACRValues: []string{"mfa"}},
+				&sessionsapi.SessionState{ACR: "pwd"}, false),
+			Entry("with a matching amr", Requirement{AMRValues: []string{"otp"}},
+				&sessionsapi.SessionState{AMR: []string{"pwd", "otp"}}, true),
+			Entry("without a matching amr", Requirement{AMRValues: []string{"otp"}},
+				&sessionsapi.SessionState{AMR: []string{"pwd"}}, false),
+		)
+
+		DescribeTable("LoginParams",
+			func(requirement Requirement, expected url.Values) {
+				Expect(requirement.LoginParams()).To(Equal(expected))
+			},
+			Entry("with a max age", Requirement{MaxAge: 10 * time.Minute},
+				url.Values{"prompt": []string{"login"}, "max_age": []string{"600"}}),
+			Entry("with acr values", Requirement{ACRValues: []string{"mfa", "hwk"}},
+				url.Values{"acr_values": []string{"mfa hwk"}}),
+			Entry("with amr values", Requirement{AMRValues: []string{"otp"}},
+				url.Values{"prompt": []string{"login"}}),
+		)
+	})
+})
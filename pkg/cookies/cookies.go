@@ -41,6 +41,12 @@ func MakeCookieFromOptions(req *http.Request, name string, value string, opts *o
 	return c
 }
 
+// SecretsFromOptions returns the cookie secrets in the order they should be
+// tried when validating a cookie. The primary secret is always first.
+func SecretsFromOptions(opts *options.Cookie) []string {
+	return append([]string{opts.Secret}, opts.OldSecrets...)
+}
+
 // GetCookieDomain returns the correct cookie domain given a list of domains
 // by checking the X-Fowarded-Host and host header of an an http request
 func GetCookieDomain(req *http.Request, cookieDomains []string) string {
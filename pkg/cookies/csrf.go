@@ -137,7 +137,7 @@ func (c *csrf) encodeCookie() (string, error) {
 		return "", fmt.Errorf("error marshalling CSRF to msgpack: %v", err)
 	}
 
-	encrypted, err := encrypt(packed, c.cookieOpts)
+	encrypted, err := encrypt(packed, c.cookieOpts.Secret)
 	if err != nil {
 		return "", err
 	}
@@ -148,12 +148,14 @@ func (c *csrf) encodeCookie() (string, error) {
 // decodeCSRFCookie validates the signature then decrypts and decodes a CSRF
 // cookie into a CSRF struct
 func decodeCSRFCookie(cookie *http.Cookie, opts *options.Cookie) (*csrf, error) {
-	val, _, ok := encryption.Validate(cookie, opts.Secret, opts.Expire)
+	secrets := SecretsFromOptions(opts)
+	val, _, index, ok := encryption.ValidateWithSecrets(cookie, secrets, opts.Expire)
 	if !ok {
 		return nil, errors.New("CSRF cookie failed validation")
 	}
 
-	decrypted, err := decrypt(val, opts)
+	// Decrypt with the same secret that signed the cookie
+	decrypted, err := decrypt(val, secrets[index])
 	if err != nil {
 		return nil, err
 	}
@@ -178,22 +180,22 @@ func csrfCookieName(opts *options.Cookie) string {
 	return fmt.Sprintf("%v_csrf", opts.Name)
 }
 
-func encrypt(data []byte, opts *options.Cookie) ([]byte, error) {
-	cipher, err := makeCipher(opts)
+func encrypt(data []byte, secret string) ([]byte, error) {
+	cipher, err := makeCipher(secret)
 	if err != nil {
 		return nil, err
 	}
 	return cipher.Encrypt(data)
 }
 
-func decrypt(data []byte, opts *options.Cookie) ([]byte, error) {
-	cipher, err := makeCipher(opts)
+func decrypt(data []byte, secret string) ([]byte, error) {
+	cipher, err := makeCipher(secret)
 	if err != nil {
 		return nil, err
 	}
 	return cipher.Decrypt(data)
 }
 
-func makeCipher(opts *options.Cookie) (encryption.Cipher, error) {
-	return encryption.NewCFBCipher(encryption.SecretBytes(opts.Secret))
+func makeCipher(secret string) (encryption.Cipher, error) {
+	return encryption.NewCFBCipher(encryption.SecretBytes(secret))
 }
@@ -115,6 +115,32 @@ var _ = Describe("CSRF Cookie Tests", func() {
 			_, _, valid := encryption.Validate(cookie, cookieOpts.Secret, cookieOpts.Expire)
 			Expect(valid).To(BeTrue())
 		})
+
+		It("decodes cookies created with an old secret", func() {
+			privateCSRF.OAuthState = []byte(csrfState)
+			privateCSRF.OIDCNonce = []byte(csrfNonce)
+
+			encoded, err := privateCSRF.encodeCookie()
+			Expect(err).ToNot(HaveOccurred())
+
+			cookie := &http.Cookie{
+				Name:  privateCSRF.cookieName(),
+				Value: encoded,
+			}
+
+			rotatedOpts := *cookieOpts
+			rotatedOpts.Secret = "0123456789abcdefghijklmnopqrstuv"
+			rotatedOpts.OldSecrets = []string{cookieSecret}
+
+			decoded, err := decodeCSRFCookie(cookie, &rotatedOpts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decoded.OAuthState).To(Equal([]byte(csrfState)))
+			Expect(decoded.OIDCNonce).To(Equal([]byte(csrfNonce)))
+
+			rotatedOpts.OldSecrets = nil
+			_, err = decodeCSRFCookie(cookie, &rotatedOpts)
+			Expect(err).To(MatchError("CSRF cookie failed validation"))
+		})
 	})
 
 	Context("Cookie Management", func() {
@@ -0,0 +1,149 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// envelopeVersion prefixes every envelope encrypted value so that the
+// format can be changed in the future.
+const envelopeVersion byte = 1
+
+// dataKeySize is the size of the random AES-256 data keys generated for
+// each envelope encrypted value.
+const dataKeySize = 32
+
+// KeyProvider wraps and unwraps data keys with key encryption keys that are
+// managed outside of OAuth2 Proxy, eg. by a KMS or HSM.
+// Each key encryption key is identified by an ID which is stored alongside
+// the ciphertext so that keys can be rotated.
+type KeyProvider interface {
+	// PrimaryKeyID returns the ID of the key used to wrap new data keys
+	PrimaryKeyID() string
+
+	// WrapKey encrypts the data key with the key identified by keyID
+	WrapKey(keyID string, dataKey []byte) ([]byte, error)
+
+	// UnwrapKey decrypts a wrapped data key with the key identified by keyID
+	UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error)
+}
+
+type envelopeCipher struct {
+	Cipher      Cipher
+	KeyProvider KeyProvider
+}
+
+// NewEnvelopeCipher returns a Cipher that encrypts values with the embedded
+// Cipher and then encrypts the result with a random AES-GCM data key.
+// The data key is wrapped by the KeyProvider and stored, along with the ID of
+// the key that wrapped it, in the resulting ciphertext.
+func NewEnvelopeCipher(c Cipher, kp KeyProvider) Cipher {
+	return &envelopeCipher{
+		Cipher:      c,
+		KeyProvider: kp,
+	}
+}
+
+// Encrypt encrypts a value with the embedded Cipher & seals it in an envelope
+//
+// The envelope format is:
+//
+//	version (1 byte) | key ID length (1 byte) | key ID |
+//	wrapped data key length (2 bytes) | wrapped data key | ciphertext
+func (c *envelopeCipher) Encrypt(value []byte) ([]byte, error) {
+	encrypted, err := c.Cipher.Encrypt(value)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, fmt.Errorf("failed to create data key: %v", err)
+	}
+	dataCipher, err := NewGCMCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := dataCipher.Encrypt(encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := c.KeyProvider.PrimaryKeyID()
+	if len(keyID) == 0 || len(keyID) > 255 {
+		return nil, fmt.Errorf("key ID must be between 1 and 255 bytes, but is %d bytes", len(keyID))
+	}
+	wrappedKey, err := c.KeyProvider.WrapKey(keyID, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key with key %q: %v", keyID, err)
+	}
+	if len(wrappedKey) > 65535 {
+		return nil, fmt.Errorf("wrapped data key is too large: %d bytes", len(wrappedKey))
+	}
+
+	envelope := make([]byte, 0, 4+len(keyID)+len(wrappedKey)+len(ciphertext))
+	envelope = append(envelope, envelopeVersion, byte(len(keyID)))
+	envelope = append(envelope, keyID...)
+	envelope = append(envelope, 0, 0)
+	binary.BigEndian.PutUint16(envelope[len(envelope)-2:], uint16(len(wrappedKey)))
+	envelope = append(envelope, wrappedKey...)
+	envelope = append(envelope, ciphertext...)
+	return envelope, nil
+}
+
+// Decrypt opens an envelope & decrypts the contents with the embedded Cipher
+func (c *envelopeCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	keyID, wrappedKey, ciphertext, err := parseEnvelope(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := c.KeyProvider.UnwrapKey(keyID, wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key with key %q: %v", keyID, err)
+	}
+	dataCipher, err := NewGCMCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := dataCipher.Decrypt(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Cipher.Decrypt(encrypted)
+}
+
+// EnvelopeKeyID returns the ID of the key that wrapped the data key of an
+// envelope encrypted value.
+func EnvelopeKeyID(ciphertext []byte) (string, error) {
+	keyID, _, _, err := parseEnvelope(ciphertext)
+	return keyID, err
+}
+
+func parseEnvelope(envelope []byte) (keyID string, wrappedKey []byte, ciphertext []byte, err error) {
+	if len(envelope) < 2 {
+		return "", nil, nil, errors.New("envelope is too short")
+	}
+	if envelope[0] != envelopeVersion {
+		return "", nil, nil, fmt.Errorf("unsupported envelope version %d", envelope[0])
+	}
+
+	keyIDLen := int(envelope[1])
+	rest := envelope[2:]
+	if len(rest) < keyIDLen+2 {
+		return "", nil, nil, errors.New("envelope is too short")
+	}
+	keyID, rest = string(rest[:keyIDLen]), rest[keyIDLen:]
+
+	wrappedKeyLen := int(binary.BigEndian.Uint16(rest[:2]))
+	rest = rest[2:]
+	if len(rest) < wrappedKeyLen {
+		return "", nil, nil, errors.New("envelope is too short")
+	}
+
+	return keyID, rest[:wrappedKeyLen], rest[wrappedKeyLen:], nil
+}
@@ -0,0 +1,177 @@
+package encryption
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testKeyRing = `# Newest key first
+key-2:0123456789abcdefghijklmnopqrstuv
+key-1:ZYXWVUTSRQPONMLKJIHGFEDCBA987654
+`
+	testRotatedKeyRing = `key-3:abcdefghijklmnopqrstuv0123456789
+key-2:0123456789abcdefghijklmnopqrstuv
+`
+)
+
+func newTestEnvelopeCipher(t *testing.T, keyRing string) Cipher {
+	kr, err := newLocalKeyRing(strings.NewReader(keyRing))
+	assert.NoError(t, err)
+
+	inner, err := NewGCMCipher([]byte("abcdefghijklmnop"))
+	assert.NoError(t, err)
+
+	return NewEnvelopeCipher(inner, kr)
+}
+
+func TestEnvelopeEncryptAndDecrypt(t *testing.T) {
+	c := newTestEnvelopeCipher(t, testKeyRing)
+	plaintext := []byte("my session state")
+
+	ciphertext, err := c.Encrypt(plaintext)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(ciphertext), string(plaintext))
+
+	keyID, err := EnvelopeKeyID(ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, "key-2", keyID)
+
+	decrypted, err := c.Decrypt(ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+}
+
+func TestEnvelopeKeyRotation(t *testing.T) {
+	oldCipher := newTestEnvelopeCipher(t, testKeyRing)
+	rotatedCipher := newTestEnvelopeCipher(t, testRotatedKeyRing)
+	plaintext := []byte("my session state")
+
+	ciphertext, err := oldCipher.Encrypt(plaintext)
+	assert.NoError(t, err)
+
+	// The rotated ring still holds key-2 so can decrypt old values
+	decrypted, err := rotatedCipher.Decrypt(ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	// New values use the new primary key
+	ciphertext, err = rotatedCipher.Encrypt(plaintext)
+	assert.NoError(t, err)
+	keyID, err := EnvelopeKeyID(ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, "key-3", keyID)
+
+	// The old ring doesn't know about key-3
+	_, err = oldCipher.Decrypt(ciphertext)
+	assert.EqualError(t, err, "failed to unwrap data key with key \"key-3\": unknown key ID \"key-3\"")
+}
+
+func TestEnvelopeDecryptInvalid(t *testing.T) {
+	c := newTestEnvelopeCipher(t, testKeyRing)
+
+	_, err := c.Decrypt([]byte{})
+	assert.EqualError(t, err, "envelope is too short")
+
+	_, err = c.Decrypt([]byte{2, 0})
+	assert.EqualError(t, err, "unsupported envelope version 2")
+
+	_, err = c.Decrypt([]byte{envelopeVersion, 10, 'k', 'e', 'y'})
+	assert.EqualError(t, err, "envelope is too short")
+}
+
+func TestNewLocalKeyRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keyring")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(testKeyRing), 0600))
+
+	kr, err := NewLocalKeyRing(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "key-2", kr.PrimaryKeyID())
+
+	_, err = NewLocalKeyRing(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestNewLocalKeyRingErrors(t *testing.T) {
+	testCases := map[string]struct {
+		keyRing     string
+		expectedErr string
+	}{
+		"empty key ring": {
+			keyRing:     "# no keys\n",
+			expectedErr: "key ring must contain at least one key",
+		},
+		"duplicate key IDs": {
+			keyRing:     "key-1:0123456789abcdef\nkey-1:fedcba9876543210\n",
+			expectedErr: "duplicate key ID \"key-1\" in key ring",
+		},
+		"invalid key size": {
+			keyRing:     "key-1:abcdef\n",
+			expectedErr: "invalid key \"key-1\" in key ring: crypto/aes: invalid key size 6",
+		},
+		"empty key ID": {
+			keyRing:     ":0123456789abcdef\n",
+			expectedErr: "key ID must be between 1 and 255 bytes, but is 0 bytes",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := newLocalKeyRing(strings.NewReader(tc.keyRing))
+			assert.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+type fakePKCS11Session struct {
+	keys map[string]PKCS11ObjectHandle
+}
+
+func (f *fakePKCS11Session) FindKey(label string) (PKCS11ObjectHandle, error) {
+	handle, ok := f.keys[label]
+	if !ok {
+		return 0, errors.New("object not found")
+	}
+	return handle, nil
+}
+
+func (f *fakePKCS11Session) WrapKey(key PKCS11ObjectHandle, dataKey []byte) ([]byte, error) {
+	return append([]byte{byte(key)}, dataKey...), nil
+}
+
+func (f *fakePKCS11Session) UnwrapKey(key PKCS11ObjectHandle, wrappedKey []byte) ([]byte, error) {
+	if wrappedKey[0] != byte(key) {
+		return nil, errors.New("wrong key")
+	}
+	return wrappedKey[1:], nil
+}
+
+func TestPKCS11KeyProvider(t *testing.T) {
+	session := &fakePKCS11Session{keys: map[string]PKCS11ObjectHandle{"hsm-key": 7}}
+
+	_, err := NewPKCS11KeyProvider(session, "missing")
+	assert.EqualError(t, err, "could not find primary key \"missing\": object not found")
+
+	kp, err := NewPKCS11KeyProvider(session, "hsm-key")
+	assert.NoError(t, err)
+
+	inner, err := NewGCMCipher([]byte("abcdefghijklmnop"))
+	assert.NoError(t, err)
+	c := NewEnvelopeCipher(inner, kp)
+
+	ciphertext, err := c.Encrypt([]byte("my session state"))
+	assert.NoError(t, err)
+	decrypted, err := c.Decrypt(ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("my session state"), decrypted)
+}
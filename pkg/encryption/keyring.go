@@ -0,0 +1,94 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// localKeyRing is a KeyProvider backed by a list of AES keys held in memory.
+// The first key in the ring is the primary key, the remaining keys are only
+// used to unwrap data keys wrapped before a key rotation.
+type localKeyRing struct {
+	primaryKeyID string
+	keys         map[string]Cipher
+}
+
+// NewLocalKeyRing constructs a KeyProvider from the key ring file at the
+// path given.
+// Each line of the file is a `<key-id>:<secret>` pair where the secret is a
+// 16, 24 or 32 byte (optionally base64 encoded) AES key. The first key is
+// used to wrap new data keys. Lines starting with `#` are ignored.
+func NewLocalKeyRing(path string) (KeyProvider, error) {
+	// We allow the key ring location via config options
+	data, err := ioutil.ReadFile(path) // #nosec G304
+	if err != nil {
+		return nil, fmt.Errorf("could not open key ring file: %v", err)
+	}
+
+	return newLocalKeyRing(bytes.NewReader(data))
+}
+
+// newLocalKeyRing constructs a localKeyRing from an io.Reader (an opened file).
+func newLocalKeyRing(file io.Reader) (*localKeyRing, error) {
+	csvReader := csv.NewReader(file)
+	csvReader.Comma = ':'
+	csvReader.Comment = '#'
+	csvReader.FieldsPerRecord = 2
+	csvReader.TrimLeadingSpace = true
+
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("could not read key ring file: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("key ring must contain at least one key")
+	}
+
+	kr := &localKeyRing{
+		primaryKeyID: records[0][0],
+		keys:         make(map[string]Cipher, len(records)),
+	}
+	for _, record := range records {
+		keyID, secret := record[0], record[1]
+		if len(keyID) == 0 || len(keyID) > 255 {
+			return nil, fmt.Errorf("key ID must be between 1 and 255 bytes, but is %d bytes", len(keyID))
+		}
+		if _, ok := kr.keys[keyID]; ok {
+			return nil, fmt.Errorf("duplicate key ID %q in key ring", keyID)
+		}
+
+		c, err := NewGCMCipher(SecretBytes(secret))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in key ring: %v", keyID, err)
+		}
+		kr.keys[keyID] = c
+	}
+	return kr, nil
+}
+
+// PrimaryKeyID returns the ID of the first key in the ring
+func (kr *localKeyRing) PrimaryKeyID() string {
+	return kr.primaryKeyID
+}
+
+// WrapKey encrypts the data key with AES-GCM using the key identified by keyID
+func (kr *localKeyRing) WrapKey(keyID string, dataKey []byte) ([]byte, error) {
+	c, ok := kr.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", keyID)
+	}
+	return c.Encrypt(dataKey)
+}
+
+// UnwrapKey decrypts a data key with AES-GCM using the key identified by keyID
+func (kr *localKeyRing) UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	c, ok := kr.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", keyID)
+	}
+	return c.Decrypt(wrappedKey)
+}
@@ -0,0 +1,67 @@
+package encryption
+
+import (
+	"fmt"
+)
+
+// PKCS11ObjectHandle identifies a key object within a PKCS#11 session
+type PKCS11ObjectHandle uint
+
+// PKCS11Session is the subset of a PKCS#11 session needed to wrap data keys
+// with keys held in a hardware security module.
+// OAuth2 Proxy does not ship a PKCS#11 implementation, this interface allows
+// one backed by a vendor's PKCS#11 library to be plugged in.
+type PKCS11Session interface {
+	// FindKey returns the handle of the key object with the given label
+	// (CKA_LABEL)
+	FindKey(label string) (PKCS11ObjectHandle, error)
+
+	// WrapKey wraps the data key with the key object (C_WrapKey)
+	WrapKey(key PKCS11ObjectHandle, dataKey []byte) ([]byte, error)
+
+	// UnwrapKey unwraps the data key with the key object (C_UnwrapKey)
+	UnwrapKey(key PKCS11ObjectHandle, wrappedKey []byte) ([]byte, error)
+}
+
+// pkcs11KeyProvider is a KeyProvider that uses key labels within a PKCS#11
+// token as key IDs.
+type pkcs11KeyProvider struct {
+	session      PKCS11Session
+	primaryLabel string
+}
+
+// NewPKCS11KeyProvider constructs a KeyProvider that wraps data keys with
+// the key labelled primaryLabel in the PKCS#11 session.
+func NewPKCS11KeyProvider(session PKCS11Session, primaryLabel string) (KeyProvider, error) {
+	if _, err := session.FindKey(primaryLabel); err != nil {
+		return nil, fmt.Errorf("could not find primary key %q: %v", primaryLabel, err)
+	}
+
+	return &pkcs11KeyProvider{
+		session:      session,
+		primaryLabel: primaryLabel,
+	}, nil
+}
+
+// PrimaryKeyID returns the label of the primary key
+func (p *pkcs11KeyProvider) PrimaryKeyID() string {
+	return p.primaryLabel
+}
+
+// WrapKey wraps the data key with the key labelled keyID
+func (p *pkcs11KeyProvider) WrapKey(keyID string, dataKey []byte) ([]byte, error) {
+	handle, err := p.session.FindKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return p.session.WrapKey(handle, dataKey)
+}
+
+// UnwrapKey unwraps the data key with the key labelled keyID
+func (p *pkcs11KeyProvider) UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	handle, err := p.session.FindKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return p.session.UnwrapKey(handle, wrappedKey)
+}
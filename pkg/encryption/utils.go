@@ -35,29 +35,49 @@ func SecretBytes(secret string) []byte {
 
 // Validate ensures a cookie is properly signed
 func Validate(cookie *http.Cookie, seed string, expiration time.Duration) (value []byte, t time.Time, ok bool) {
+	value, t, _, ok = ValidateWithSecrets(cookie, []string{seed}, expiration)
+	return
+}
+
+// ValidateWithSecrets ensures a cookie is properly signed by one of the given
+// seeds. Seeds are tried in order, the first being the primary secret and any
+// others being previous secrets kept to allow rotation.
+// The index of the seed that signed the cookie is returned so that callers can
+// detect cookies that should be re-signed with the primary secret.
+func ValidateWithSecrets(cookie *http.Cookie, seeds []string, expiration time.Duration) (value []byte, t time.Time, index int, ok bool) {
 	// value, timestamp, sig
 	parts := strings.Split(cookie.Value, "|")
 	if len(parts) != 3 {
 		return
 	}
-	if checkSignature(parts[2], seed, cookie.Name, parts[0], parts[1]) {
-		ts, err := strconv.Atoi(parts[1])
-		if err != nil {
-			return
+
+	index = -1
+	for i, seed := range seeds {
+		if checkSignature(parts[2], seed, cookie.Name, parts[0], parts[1]) {
+			index = i
+			break
 		}
-		// The expiration timestamp set when the cookie was created
-		// isn't sent back by the browser. Hence, we check whether the
-		// creation timestamp stored in the cookie falls within the
-		// window defined by (Now()-expiration, Now()].
-		t = time.Unix(int64(ts), 0)
-		if t.After(time.Now().Add(expiration*-1)) && t.Before(time.Now().Add(time.Minute*5)) {
-			// it's a valid cookie. now get the contents
-			rawValue, err := base64.URLEncoding.DecodeString(parts[0])
-			if err == nil {
-				value = rawValue
-				ok = true
-				return
-			}
+	}
+	if index < 0 {
+		return
+	}
+
+	ts, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return
+	}
+	// The expiration timestamp set when the cookie was created
+	// isn't sent back by the browser. Hence, we check whether the
+	// creation timestamp stored in the cookie falls within the
+	// window defined by (Now()-expiration, Now()].
+	t = time.Unix(int64(ts), 0)
+	if t.After(time.Now().Add(expiration*-1)) && t.Before(time.Now().Add(time.Minute*5)) {
+		// it's a valid cookie. now get the contents
+		rawValue, err := base64.URLEncoding.DecodeString(parts[0])
+		if err == nil {
+			value = rawValue
+			ok = true
+			return
 		}
 	}
 	return
@@ -7,7 +7,9 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -100,3 +102,28 @@ func TestSignAndValidate(t *testing.T) {
 	assert.False(t, checkSignature(sha256sig, seed, key, "tampered", epoch))
 	assert.False(t, checkSignature(sha1sig, seed, key, "tampered", epoch))
 }
+
+func TestValidateWithSecrets(t *testing.T) {
+	primary := "0123456789abcdef"
+	previous := "fedcba9876543210"
+	unknown := "abcdef0123456789"
+	name := "cookie-name"
+	value := []byte("I am soooo encoded")
+	now := time.Now()
+
+	signed, err := SignedValue(previous, name, value, now)
+	assert.NoError(t, err)
+	cookie := &http.Cookie{Name: name, Value: signed}
+
+	// The primary secret alone can't validate the cookie
+	_, _, ok := Validate(cookie, primary, time.Hour)
+	assert.False(t, ok)
+
+	validated, _, index, ok := ValidateWithSecrets(cookie, []string{primary, previous}, time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, 1, index)
+	assert.Equal(t, value, validated)
+
+	_, _, _, ok = ValidateWithSecrets(cookie, []string{primary, unknown}, time.Hour)
+	assert.False(t, ok)
+}
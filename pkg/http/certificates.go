@@ -0,0 +1,130 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/watcher"
+)
+
+// certificateStore holds the certificates served by the TLS listener.
+// Certificates are selected by the server name requested by clients, and are
+// reloaded when the files they were loaded from change so that renewed
+// certificates are served without a restart.
+type certificateStore struct {
+	// sources are the sources of each certificate, the first is the default
+	// certificate and the rest are the SNI certificates
+	sources []options.TLSCertificate
+
+	mu           sync.RWMutex
+	certificates []*tls.Certificate
+}
+
+// newCertificateStore loads the default and SNI certificates of the TLS
+// config.
+func newCertificateStore(opts *options.TLS) (*certificateStore, error) {
+	sources := []options.TLSCertificate{{Key: opts.Key, Cert: opts.Cert}}
+	sources = append(sources, opts.SNICertificates...)
+
+	s := &certificateStore{
+		sources:      sources,
+		certificates: make([]*tls.Certificate, len(sources)),
+	}
+	for i, source := range sources {
+		cert, err := getCertificate(source)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			return nil, fmt.Errorf("sni certificate %d: %v", i-1, err)
+		}
+		s.certificates[i] = cert
+	}
+	return s, nil
+}
+
+// GetCertificate returns the first SNI certificate that is valid for the
+// server name requested by the client, or the default certificate if none
+// match.
+func (s *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if hello.ServerName != "" {
+		for _, cert := range s.certificates[1:] {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return s.certificates[0], nil
+}
+
+// watch reloads each certificate when the files it was loaded from change,
+// until done is closed.
+func (s *certificateStore) watch(done <-chan bool) {
+	for i, source := range s.sources {
+		for _, filename := range certificateFiles(source) {
+			i, filename := i, filename
+			watcher.WatchForUpdates(filename, done, func() {
+				s.reload(i, filename)
+			})
+		}
+	}
+}
+
+// reload loads the certificate again from its source.
+// If the certificate can't be loaded, eg. the key has been updated but the
+// certificate has not been yet, the current certificate is kept.
+func (s *certificateStore) reload(i int, filename string) {
+	cert, err := getCertificate(s.sources[i])
+	if err != nil {
+		logger.Errorf("error reloading TLS certificate after a change to %s: %v", filename, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certificates[i] = cert
+	logger.Printf("reloaded TLS certificate after a change to %s", filename)
+}
+
+// certificateFiles returns the files that the certificate is loaded from.
+func certificateFiles(source options.TLSCertificate) []string {
+	files := []string{}
+	for _, secret := range []*options.SecretSource{source.Key, source.Cert} {
+		if secret != nil && secret.FromFile != "" {
+			files = append(files, secret.FromFile)
+		}
+	}
+	return files
+}
+
+// getCertificate loads the certificate data from its source.
+func getCertificate(source options.TLSCertificate) (*tls.Certificate, error) {
+	keyData, err := getSecretValue(source.Key)
+	if err != nil {
+		return nil, fmt.Errorf("could not load key data: %v", err)
+	}
+
+	certData, err := getSecretValue(source.Cert)
+	if err != nil {
+		return nil, fmt.Errorf("could not load cert data: %v", err)
+	}
+
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse certificate data: %v", err)
+	}
+
+	// Parse the leaf once so that it can be matched against server names
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse certificate data: %v", err)
+	}
+	return &cert, nil
+}
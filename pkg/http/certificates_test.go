@@ -0,0 +1,251 @@
+package http
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// generateCertificate creates a self-signed certificate for the DNS names and
+// returns the PEM encoded key and certificate.
+func generateCertificate(commonName string, dnsNames ...string) ([]byte, []byte) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	Expect(err).ToNot(HaveOccurred())
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	Expect(err).ToNot(HaveOccurred())
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+}
+
+var _ = Describe("Certificates", func() {
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	// startServer starts an https server and returns its address
+	startServer := func(tlsOpts *options.TLS) string {
+		srv, err := NewServer(Opts{
+			Handler:           http.NotFoundHandler(),
+			SecureBindAddress: "127.0.0.1:0",
+			TLS:               tlsOpts,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		go func() {
+			defer GinkgoRecover()
+			Expect(srv.Start(ctx)).To(Succeed())
+		}()
+
+		return srv.(*server).tlsListener.Addr().String()
+	}
+
+	// servedCommonName returns the common name of the certificate served for
+	// the server name
+	servedCommonName := func(addr, serverName string) (string, error) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			ServerName: serverName,
+			// The certificates are self-signed, only the served certificate
+			// is checked
+			InsecureSkipVerify: true, // #nosec G402
+		})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	Context("with SNI certificates", func() {
+		var addr string
+
+		BeforeEach(func() {
+			defaultKey, defaultCert := generateCertificate("default", "example.com")
+			appKey, appCert := generateCertificate("app", "app.example.com")
+			wildcardKey, wildcardCert := generateCertificate("wildcard", "*.example.com")
+
+			addr = startServer(&options.TLS{
+				Key:  &options.SecretSource{Value: defaultKey},
+				Cert: &options.SecretSource{Value: defaultCert},
+				SNICertificates: []options.TLSCertificate{
+					{
+						Key:  &options.SecretSource{Value: appKey},
+						Cert: &options.SecretSource{Value: appCert},
+					},
+					{
+						Key:  &options.SecretSource{Value: wildcardKey},
+						Cert: &options.SecretSource{Value: wildcardCert},
+					},
+				},
+			})
+		})
+
+		It("serves the certificate matching the server name", func() {
+			Expect(servedCommonName(addr, "app.example.com")).To(Equal("app"))
+		})
+
+		It("serves the first matching certificate", func() {
+			Expect(servedCommonName(addr, "other.example.com")).To(Equal("wildcard"))
+		})
+
+		It("serves the default certificate when no certificate matches", func() {
+			Expect(servedCommonName(addr, "example.org")).To(Equal("default"))
+		})
+
+		It("serves the default certificate without a server name", func() {
+			Expect(servedCommonName(addr, "")).To(Equal("default"))
+		})
+	})
+
+	Context("with certificate files", func() {
+		var dir string
+		var addr string
+
+		writeCertificate := func(commonName string) {
+			key, cert := generateCertificate(commonName, "example.com")
+			Expect(ioutil.WriteFile(filepath.Join(dir, "tls.key"), key, 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "tls.crt"), cert, 0600)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "oauth2-proxy-certificates")
+			Expect(err).ToNot(HaveOccurred())
+
+			writeCertificate("original")
+			addr = startServer(&options.TLS{
+				Key:  &options.SecretSource{FromFile: filepath.Join(dir, "tls.key")},
+				Cert: &options.SecretSource{FromFile: filepath.Join(dir, "tls.crt")},
+			})
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("reloads the certificate when the files change", func() {
+			Eventually(func() (string, error) {
+				return servedCommonName(addr, "example.com")
+			}).Should(Equal("original"))
+
+			writeCertificate("renewed")
+
+			Eventually(func() (string, error) {
+				return servedCommonName(addr, "example.com")
+			}, 5*time.Second).Should(Equal("renewed"))
+		})
+
+		It("keeps the certificate when the files are invalid", func() {
+			Expect(ioutil.WriteFile(filepath.Join(dir, "tls.crt"), []byte("invalid"), 0600)).To(Succeed())
+
+			Consistently(func() (string, error) {
+				return servedCommonName(addr, "example.com")
+			}, 500*time.Millisecond).Should(Equal("original"))
+		})
+	})
+
+	Context("with TLS versions and cipher suites", func() {
+		It("rejects clients below the minimum version", func() {
+			addr := startServer(&options.TLS{
+				Key:        &keyDataSource,
+				Cert:       &certDataSource,
+				MinVersion: "TLS1.3",
+			})
+
+			_, err := tls.Dial("tcp", addr, &tls.Config{
+				MaxVersion:         tls.VersionTLS12,
+				InsecureSkipVerify: true, // #nosec G402
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("only accepts the configured cipher suites", func() {
+			addr := startServer(&options.TLS{
+				Key:          &keyDataSource,
+				Cert:         &certDataSource,
+				CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+			})
+
+			conn, err := tls.Dial("tcp", addr, &tls.Config{
+				MaxVersion:         tls.VersionTLS12,
+				InsecureSkipVerify: true, // #nosec G402
+			})
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			Expect(conn.ConnectionState().CipherSuite).To(Equal(tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384))
+		})
+
+		It("returns an error for an unknown min version", func() {
+			_, err := NewServer(Opts{
+				SecureBindAddress: "127.0.0.1:0",
+				TLS: &options.TLS{
+					Key:        &keyDataSource,
+					Cert:       &certDataSource,
+					MinVersion: "SSL3.0",
+				},
+			})
+			Expect(err).To(MatchError("error setting up TLS listener: invalid TLS min version: unknown TLS version \"SSL3.0\": must be one of TLS1.0, TLS1.1, TLS1.2 or TLS1.3"))
+		})
+
+		It("returns an error for an unknown cipher suite", func() {
+			_, err := NewServer(Opts{
+				SecureBindAddress: "127.0.0.1:0",
+				TLS: &options.TLS{
+					Key:          &keyDataSource,
+					Cert:         &certDataSource,
+					CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"},
+				},
+			})
+			Expect(err).To(MatchError("error setting up TLS listener: invalid TLS cipher suites: unknown cipher suite \"TLS_RSA_WITH_RC4_128_SHA\""))
+		})
+	})
+
+	It("returns an error for an invalid SNI certificate", func() {
+		_, err := NewServer(Opts{
+			SecureBindAddress: "127.0.0.1:0",
+			TLS: &options.TLS{
+				Key:  &keyDataSource,
+				Cert: &certDataSource,
+				SNICertificates: []options.TLSCertificate{
+					{Key: &keyDataSource},
+				},
+			},
+		})
+		Expect(err).To(MatchError("error setting up TLS listener: could not load certificate: sni certificate 0: could not load cert data: no configuration provided"))
+	})
+})
@@ -0,0 +1,117 @@
+package http
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// connectionTracker tracks the open connections of a listener.
+// http.Server.Shutdown does not wait for connections that have been hijacked,
+// such as proxied websockets, so these are tracked to give them time to
+// finish and to close them once the shutdown grace period has expired.
+type connectionTracker struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+
+	// idle is closed when the last connection is closed, if there are
+	// goroutines waiting for the connections to finish
+	idle chan struct{}
+}
+
+func newConnectionTracker() *connectionTracker {
+	return &connectionTracker{
+		conns: make(map[*trackedConn]struct{}),
+	}
+}
+
+// track wraps the listener so that the connections it accepts are tracked.
+func (t *connectionTracker) track(listener net.Listener) net.Listener {
+	return trackingListener{Listener: listener, tracker: t}
+}
+
+// wait blocks until all tracked connections have been closed, or the context
+// is done.
+func (t *connectionTracker) wait(ctx context.Context) error {
+	t.mu.Lock()
+	if len(t.conns) == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeAll closes all tracked connections.
+func (t *connectionTracker) closeAll() {
+	t.mu.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func (t *connectionTracker) add(conn *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[conn] = struct{}{}
+}
+
+func (t *connectionTracker) remove(conn *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, conn)
+	if len(t.conns) == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// trackingListener adds the connections it accepts to the tracker.
+type trackingListener struct {
+	net.Listener
+	tracker *connectionTracker
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := &trackedConn{Conn: conn, tracker: l.tracker}
+	l.tracker.add(tracked)
+	return tracked, nil
+}
+
+// trackedConn is removed from its tracker when it is closed.
+type trackedConn struct {
+	net.Conn
+	tracker *connectionTracker
+	once    sync.Once
+}
+
+// Close closes the connection and stops tracking it.
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.tracker.remove(c)
+	})
+	return err
+}
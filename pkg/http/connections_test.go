@@ -0,0 +1,153 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Shutdown", func() {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var release chan struct{}
+	var started chan struct{}
+	var stopped chan error
+
+	// blockingHandler blocks until released, upgrading the connection by
+	// hijacking it when requested
+	blockingHandler := func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/upgrade" {
+			conn, buf, err := rw.(http.Hijacker).Hijack()
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			_, err = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: upgrade\r\nUpgrade: test\r\n\r\n")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(buf.Flush()).To(Succeed())
+
+			close(started)
+			<-release
+			return
+		}
+
+		close(started)
+		<-release
+		rw.Write([]byte(hello))
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		release = make(chan struct{})
+		started = make(chan struct{})
+		stopped = make(chan error, 1)
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	// startServer starts an http server with the grace period and returns
+	// its address
+	startServer := func(gracePeriod time.Duration) string {
+		srv, err := NewServer(Opts{
+			Handler:             http.HandlerFunc(blockingHandler),
+			BindAddress:         "127.0.0.1:0",
+			ShutdownGracePeriod: gracePeriod,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		go func() {
+			stopped <- srv.Start(ctx)
+		}()
+
+		return srv.(*server).listener.Addr().String()
+	}
+
+	// upgrade opens an upgraded connection to the server
+	upgrade := func(addr string) net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = fmt.Fprintf(conn, "GET /upgrade HTTP/1.1\r\nHost: %s\r\nConnection: upgrade\r\nUpgrade: test\r\n\r\n", addr)
+		Expect(err).ToNot(HaveOccurred())
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+		return conn
+	}
+
+	It("gives in-flight requests the grace period to finish", func() {
+		addr := startServer(time.Minute)
+
+		responses := make(chan string, 1)
+		go func() {
+			defer GinkgoRecover()
+			resp, err := client.Get(fmt.Sprintf("http://%s/", addr))
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			responses <- string(body)
+		}()
+		Eventually(started).Should(BeClosed())
+
+		cancel()
+		Consistently(stopped).ShouldNot(Receive())
+
+		close(release)
+		Eventually(responses).Should(Receive(Equal(hello)))
+		Eventually(stopped).Should(Receive(BeNil()))
+	})
+
+	It("gives upgraded connections the grace period to finish", func() {
+		addr := startServer(time.Minute)
+		conn := upgrade(addr)
+		defer conn.Close()
+		Eventually(started).Should(BeClosed())
+
+		cancel()
+		Consistently(stopped).ShouldNot(Receive())
+
+		close(release)
+		Eventually(stopped).Should(Receive(BeNil()))
+	})
+
+	It("closes upgraded connections once the grace period expires", func() {
+		defer close(release)
+
+		addr := startServer(200 * time.Millisecond)
+		conn := upgrade(addr)
+		defer conn.Close()
+		Eventually(started).Should(BeClosed())
+
+		cancel()
+		Eventually(stopped, time.Second).Should(Receive(BeNil()))
+
+		_, err := conn.Read(make([]byte, 1))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("closes upgraded connections immediately without a grace period", func() {
+		defer close(release)
+
+		addr := startServer(0)
+		conn := upgrade(addr)
+		defer conn.Close()
+		Eventually(started).Should(BeClosed())
+
+		cancel()
+		Eventually(stopped).Should(Receive(BeNil()))
+
+		_, err := conn.Read(make([]byte, 1))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,257 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+const (
+	// proxyProtocolHeaderTimeout is how long a trusted connection has to send
+	// the PROXY protocol header
+	proxyProtocolHeaderTimeout = 10 * time.Second
+
+	// proxyProtocolV1MaxLength is the maximum length of a v1 header line,
+	// including the CRLF
+	proxyProtocolV1MaxLength = 107
+)
+
+var (
+	proxyProtocolV1Prefix    = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// parseProxyProtocolTrustedIPs parses the IPs and CIDR ranges allowed to send
+// PROXY protocol headers.
+func parseProxyProtocolTrustedIPs(trustedIPs []string) (*ip.NetSet, error) {
+	if len(trustedIPs) == 0 {
+		return nil, errors.New("no trusted IPs provided")
+	}
+
+	set := ip.NewNetSet()
+	for _, ipStr := range trustedIPs {
+		ipNet := ip.ParseIPNet(ipStr)
+		if ipNet == nil {
+			return nil, fmt.Errorf("could not parse IP network (%s)", ipStr)
+		}
+		set.AddIPNet(*ipNet)
+	}
+	return set, nil
+}
+
+// proxyProtocolListener reads the PROXY protocol header of connections from
+// trusted IPs, such as a load balancer, so that the client and server
+// addresses of the connection are those of the original connection to the
+// load balancer.
+type proxyProtocolListener struct {
+	net.Listener
+	trustedIPs *ip.NetSet
+}
+
+// Accept waits for and returns the next connection to the listener.
+// The header is read lazily, by the goroutine serving the connection, so that
+// a slow client can't block accepting other connections.
+func (l proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !l.trustedIPs.Has(addr.IP) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn is a connection that may start with a PROXY protocol
+// header.
+// Connections without a header are served with their own addresses.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	err        error
+}
+
+// Read reads data from the connection, after the PROXY protocol header.
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY protocol header, or
+// the address of the connection if there is no header.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the server address from the PROXY protocol header, or
+// the address of the connection if there is no header.
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readHeader reads the PROXY protocol header once.
+// Errors are returned by subsequent reads so that the connection is closed.
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout)); err != nil {
+			c.err = err
+			return
+		}
+
+		c.remoteAddr, c.localAddr, c.err = readProxyProtocolHeader(c.reader)
+		if c.err != nil {
+			logger.Errorf("Error reading PROXY protocol header from %s: %v", c.Conn.RemoteAddr(), c.err)
+			return
+		}
+
+		c.err = c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+// readProxyProtocolHeader reads a v1 or v2 PROXY protocol header.
+// It returns nil addresses when there is no header, or the header does not
+// contain addresses, such as health checks from the load balancer itself.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	switch first[0] {
+	case proxyProtocolV1Prefix[0]:
+		if prefix, err := r.Peek(len(proxyProtocolV1Prefix)); err == nil && bytes.Equal(prefix, proxyProtocolV1Prefix) {
+			return readProxyProtocolV1(r)
+		}
+	case proxyProtocolV2Signature[0]:
+		if signature, err := r.Peek(len(proxyProtocolV2Signature)); err == nil && bytes.Equal(signature, proxyProtocolV2Signature) {
+			return readProxyProtocolV2(r)
+		}
+	}
+	return nil, nil, nil
+}
+
+// readProxyProtocolV1 reads a human-readable v1 header, eg
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > proxyProtocolV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("invalid PROXY protocol v1 header: header line is not terminated")
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol v1 header: %q", strings.TrimSpace(string(line)))
+	}
+
+	src, err := parseProxyProtocolV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyProtocolV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+// parseProxyProtocolV1Addr parses an address and port of a v1 header.
+func parseProxyProtocolV1Addr(addr, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header: invalid address %q", addr)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header: invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyProtocolV2 reads a binary v2 header.
+// Only the addresses of TCP over IPv4 and IPv6 connections are used, any TLVs
+// are ignored.
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol v2 header: %v", err)
+	}
+
+	version, command := header[12]>>4, header[12]&0x0f
+	if version != 2 {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol v2 header: unsupported version %d", version)
+	}
+	family, transport := header[13]>>4, header[13]&0x0f
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol v2 header: %v", err)
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL connections are made by the proxy itself, eg health checks
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, fmt.Errorf("invalid PROXY protocol v2 header: unsupported command %d", command)
+	}
+
+	const stream = 0x1
+	var ipLength int
+	switch {
+	case family == 0x1 && transport == stream:
+		ipLength = net.IPv4len
+	case family == 0x2 && transport == stream:
+		ipLength = net.IPv6len
+	default:
+		// Unspecified and unix addresses can't be used as client IPs
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*ipLength+4 {
+		return nil, nil, errors.New("invalid PROXY protocol v2 header: address block is too short")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLength]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLength:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLength : 2*ipLength]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLength+2:])),
+	}
+	return src, dst, nil
+}
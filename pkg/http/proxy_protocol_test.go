@@ -0,0 +1,260 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// proxyProtocolV2Header builds a v2 header for TCP over IPv4 or IPv6.
+func proxyProtocolV2Header(command byte, src, dst *net.TCPAddr) []byte {
+	family := byte(0x11)
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil {
+		family = 0x21
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	payload := append(append([]byte{}, srcIP...), dstIP...)
+	payload = append(payload, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(payload[len(payload)-4:], uint16(src.Port))
+	binary.BigEndian.PutUint16(payload[len(payload)-2:], uint16(dst.Port))
+
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+var _ = Describe("PROXY protocol", func() {
+	type readHeaderTableInput struct {
+		data             []byte
+		expectedRemote   string
+		expectedLocal    string
+		expectedErr      string
+		expectedUnparsed string
+	}
+
+	DescribeTable("readProxyProtocolHeader",
+		func(in readHeaderTableInput) {
+			r := bufio.NewReader(strings.NewReader(string(in.data)))
+			remote, local, err := readProxyProtocolHeader(r)
+			if in.expectedErr != "" {
+				Expect(err).To(MatchError(in.expectedErr))
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+
+			if in.expectedRemote == "" {
+				Expect(remote).To(BeNil())
+				Expect(local).To(BeNil())
+			} else {
+				Expect(remote.String()).To(Equal(in.expectedRemote))
+				Expect(local.String()).To(Equal(in.expectedLocal))
+			}
+
+			unparsed, err := ioutil.ReadAll(r)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(unparsed)).To(Equal(in.expectedUnparsed))
+		},
+		Entry("with a v1 TCP4 header", readHeaderTableInput{
+			data:             []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n"),
+			expectedRemote:   "192.0.2.1:56324",
+			expectedLocal:    "198.51.100.1:443",
+			expectedUnparsed: "GET / HTTP/1.1\r\n",
+		}),
+		Entry("with a v1 TCP6 header", readHeaderTableInput{
+			data:             []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET / HTTP/1.1\r\n"),
+			expectedRemote:   "[2001:db8::1]:56324",
+			expectedLocal:    "[2001:db8::2]:443",
+			expectedUnparsed: "GET / HTTP/1.1\r\n",
+		}),
+		Entry("with a v1 UNKNOWN header", readHeaderTableInput{
+			data:             []byte("PROXY UNKNOWN\r\nGET / HTTP/1.1\r\n"),
+			expectedUnparsed: "GET / HTTP/1.1\r\n",
+		}),
+		Entry("with an invalid v1 address", readHeaderTableInput{
+			data:        []byte("PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n"),
+			expectedErr: "invalid PROXY protocol v1 header: invalid address \"192.0.2\"",
+		}),
+		Entry("with an invalid v1 port", readHeaderTableInput{
+			data:        []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"),
+			expectedErr: "invalid PROXY protocol v1 header: invalid port \"65536\"",
+		}),
+		Entry("with a v1 header with missing fields", readHeaderTableInput{
+			data:        []byte("PROXY TCP4 192.0.2.1\r\n"),
+			expectedErr: "invalid PROXY protocol v1 header: \"PROXY TCP4 192.0.2.1\"",
+		}),
+		Entry("with an unterminated v1 header", readHeaderTableInput{
+			data:        []byte("PROXY TCP4 " + strings.Repeat("1", proxyProtocolV1MaxLength) + "\r\n"),
+			expectedErr: "invalid PROXY protocol v1 header: header line is not terminated",
+		}),
+		Entry("with a v2 IPv4 header", readHeaderTableInput{
+			data: append(proxyProtocolV2Header(0x1,
+				&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+				&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+			), []byte("GET / HTTP/1.1\r\n")...),
+			expectedRemote:   "192.0.2.1:56324",
+			expectedLocal:    "198.51.100.1:443",
+			expectedUnparsed: "GET / HTTP/1.1\r\n",
+		}),
+		Entry("with a v2 IPv6 header", readHeaderTableInput{
+			data: append(proxyProtocolV2Header(0x1,
+				&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+				&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			), []byte("GET / HTTP/1.1\r\n")...),
+			expectedRemote:   "[2001:db8::1]:56324",
+			expectedLocal:    "[2001:db8::2]:443",
+			expectedUnparsed: "GET / HTTP/1.1\r\n",
+		}),
+		Entry("with a v2 LOCAL header", readHeaderTableInput{
+			data: append(proxyProtocolV2Header(0x0,
+				&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+				&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+			), []byte("GET / HTTP/1.1\r\n")...),
+			expectedUnparsed: "GET / HTTP/1.1\r\n",
+		}),
+		Entry("with a truncated v2 header", readHeaderTableInput{
+			data:        append(append([]byte{}, proxyProtocolV2Signature...), 0x21, 0x11, 0, 12, 192, 0),
+			expectedErr: "invalid PROXY protocol v2 header: unexpected EOF",
+		}),
+		Entry("with an unsupported v2 version", readHeaderTableInput{
+			data:        append(append([]byte{}, proxyProtocolV2Signature...), 0x31, 0x11, 0, 0),
+			expectedErr: "invalid PROXY protocol v2 header: unsupported version 3",
+		}),
+		Entry("without a header", readHeaderTableInput{
+			data:             []byte("POST / HTTP/1.1\r\n"),
+			expectedUnparsed: "POST / HTTP/1.1\r\n",
+		}),
+		Entry("with an empty connection", readHeaderTableInput{
+			data: []byte{},
+		}),
+	)
+
+	Context("with a server", func() {
+		var ctx context.Context
+		var cancel context.CancelFunc
+
+		remoteAddrHandler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(req.RemoteAddr))
+		})
+
+		BeforeEach(func() {
+			ctx, cancel = context.WithCancel(context.Background())
+		})
+
+		AfterEach(func() {
+			cancel()
+		})
+
+		// startServer starts a server with the PROXY protocol enabled and
+		// returns its address
+		startServer := func(trustedIPs []string, secure bool) string {
+			opts := Opts{
+				Handler:       remoteAddrHandler,
+				ProxyProtocol: &options.ProxyProtocol{TrustedIPs: trustedIPs},
+			}
+			if secure {
+				opts.SecureBindAddress = "127.0.0.1:0"
+				opts.TLS = &options.TLS{Key: &keyDataSource, Cert: &certDataSource}
+			} else {
+				opts.BindAddress = "127.0.0.1:0"
+			}
+			srv, err := NewServer(opts)
+			Expect(err).ToNot(HaveOccurred())
+
+			go func() {
+				defer GinkgoRecover()
+				Expect(srv.Start(ctx)).To(Succeed())
+			}()
+
+			s := srv.(*server)
+			if secure {
+				return s.tlsListener.Addr().String()
+			}
+			return s.listener.Addr().String()
+		}
+
+		// clientWithHeader returns a client that sends the header on each
+		// new connection
+		clientWithHeader := func(header []byte) *http.Client {
+			transport := client.Transport.(*http.Transport).Clone()
+			transport.DisableKeepAlives = true
+			transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				if _, err := conn.Write(header); err != nil {
+					return nil, err
+				}
+				return conn, nil
+			}
+			return &http.Client{Transport: transport}
+		}
+
+		get := func(c *http.Client, url string) (int, string) {
+			resp, err := c.Get(url)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			return resp.StatusCode, string(body)
+		}
+
+		It("uses the client address of a v1 header on http", func() {
+			addr := startServer([]string{"127.0.0.1"}, false)
+			c := clientWithHeader([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 80\r\n"))
+
+			code, body := get(c, fmt.Sprintf("http://%s/", addr))
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).To(Equal("192.0.2.1:56324"))
+		})
+
+		It("uses the client address of a v2 header on https", func() {
+			addr := startServer([]string{"127.0.0.0/8"}, true)
+			c := clientWithHeader(proxyProtocolV2Header(0x1,
+				&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+				&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			))
+
+			code, body := get(c, fmt.Sprintf("https://%s/", addr))
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).To(Equal("[2001:db8::1]:56324"))
+		})
+
+		It("serves trusted connections without a header", func() {
+			addr := startServer([]string{"127.0.0.1"}, false)
+
+			code, body := get(client, fmt.Sprintf("http://%s/", addr))
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).To(HavePrefix("127.0.0.1:"))
+		})
+
+		It("does not read headers from untrusted connections", func() {
+			addr := startServer([]string{"10.0.0.0/8"}, false)
+			c := clientWithHeader([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 80\r\n"))
+
+			code, _ := get(c, fmt.Sprintf("http://%s/", addr))
+			Expect(code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	It("returns an error for an invalid trusted IP", func() {
+		_, err := NewServer(Opts{
+			BindAddress:   "127.0.0.1:0",
+			ProxyProtocol: &options.ProxyProtocol{TrustedIPs: []string{"10.0.0.0/33"}},
+		})
+		Expect(err).To(MatchError("error parsing PROXY protocol trusted IPs: could not parse IP network (10.0.0.0/33)"))
+	})
+})
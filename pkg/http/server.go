@@ -3,6 +3,7 @@ package http
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
@@ -12,7 +13,11 @@ import (
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options/util"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	pkgutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/util"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -35,12 +40,37 @@ type Opts struct {
 
 	// TLS is the TLS configuration for the server.
 	TLS *options.TLS
+
+	// EnableHTTP2 allows clients to connect with HTTP/2.
+	EnableHTTP2 bool
+
+	// ProxyProtocol is the PROXY protocol configuration for the listeners.
+	ProxyProtocol *options.ProxyProtocol
+
+	// ShutdownGracePeriod is how long connections are given to finish when
+	// the server is stopped.
+	ShutdownGracePeriod time.Duration
 }
 
 // NewServer creates a new Server from the options given.
 func NewServer(opts Opts) (Server, error) {
 	s := &server{
-		handler: opts.Handler,
+		handler:             opts.Handler,
+		shutdownGracePeriod: opts.ShutdownGracePeriod,
+		connections:         newConnectionTracker(),
+		tlsConnections:      newConnectionTracker(),
+	}
+	if opts.EnableHTTP2 {
+		// Connections over TLS negotiate HTTP/2 before reaching the handler,
+		// so this only handles cleartext HTTP/2
+		s.handler = h2c.NewHandler(opts.Handler, &http2.Server{})
+	}
+	if opts.ProxyProtocol != nil {
+		trustedIPs, err := parseProxyProtocolTrustedIPs(opts.ProxyProtocol.TrustedIPs)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing PROXY protocol trusted IPs: %v", err)
+		}
+		s.proxyProtocolTrustedIPs = trustedIPs
 	}
 	if err := s.setupListener(opts); err != nil {
 		return nil, fmt.Errorf("error setting up listener: %v", err)
@@ -56,8 +86,26 @@ func NewServer(opts Opts) (Server, error) {
 type server struct {
 	handler http.Handler
 
+	// shutdownGracePeriod is how long connections are given to finish when
+	// the server is stopped, or 0 to wait for in-flight requests without a
+	// deadline
+	shutdownGracePeriod time.Duration
+
+	// proxyProtocolTrustedIPs are the IPs allowed to send PROXY protocol
+	// headers, or nil if the PROXY protocol is disabled
+	proxyProtocolTrustedIPs *ip.NetSet
+
 	listener    net.Listener
 	tlsListener net.Listener
+
+	// connections and tlsConnections track the open connections of each
+	// listener
+	connections    *connectionTracker
+	tlsConnections *connectionTracker
+
+	// certificates are the certificates served by the TLS listener, or nil
+	// if the HTTPS server is disabled
+	certificates *certificateStore
 }
 
 // setupListener sets the server listener if the HTTP server is enabled.
@@ -76,7 +124,7 @@ func (s *server) setupListener(opts Opts) error {
 	if err != nil {
 		return fmt.Errorf("listen (%s, %s) failed: %v", networkType, listenAddr, err)
 	}
-	s.listener = listener
+	s.listener = s.wrapProxyProtocol(s.connections.track(listener))
 
 	return nil
 }
@@ -90,19 +138,27 @@ func (s *server) setupTLSListener(opts Opts) error {
 		return nil
 	}
 
-	config := &tls.Config{
-		MinVersion: tls.VersionTLS12,
-		MaxVersion: tls.VersionTLS13,
-		NextProtos: []string{"http/1.1"},
-	}
 	if opts.TLS == nil {
 		return errors.New("no TLS config provided")
 	}
-	cert, err := getCertificate(opts.TLS)
+	config, err := newTLSConfig(opts.TLS)
+	if err != nil {
+		return err
+	}
+	if opts.EnableHTTP2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	certificates, err := newCertificateStore(opts.TLS)
 	if err != nil {
 		return fmt.Errorf("could not load certificate: %v", err)
 	}
-	config.Certificates = []tls.Certificate{cert}
+	config.GetCertificate = certificates.GetCertificate
+	s.certificates = certificates
+
+	if err := setClientAuth(config, opts.TLS); err != nil {
+		return err
+	}
 
 	listenAddr := getListenAddress(opts.SecureBindAddress)
 
@@ -111,10 +167,20 @@ func (s *server) setupTLSListener(opts Opts) error {
 		return fmt.Errorf("listen (%s) failed: %v", listenAddr, err)
 	}
 
-	s.tlsListener = tls.NewListener(tcpKeepAliveListener{listener.(*net.TCPListener)}, config)
+	s.tlsListener = tls.NewListener(s.wrapProxyProtocol(s.tlsConnections.track(tcpKeepAliveListener{listener.(*net.TCPListener)})), config)
 	return nil
 }
 
+// wrapProxyProtocol reads the PROXY protocol header of connections accepted by
+// the listener, if the PROXY protocol is enabled.
+// The header comes before any TLS handshake.
+func (s *server) wrapProxyProtocol(listener net.Listener) net.Listener {
+	if s.proxyProtocolTrustedIPs == nil {
+		return listener
+	}
+	return proxyProtocolListener{Listener: listener, trustedIPs: s.proxyProtocolTrustedIPs}
+}
+
 // Start starts the HTTP and HTTPS server if applicable.
 // It will block until the context is cancelled.
 // If any errors occur, only the first error will be returned.
@@ -123,7 +189,7 @@ func (s *server) Start(ctx context.Context) error {
 
 	if s.listener != nil {
 		g.Go(func() error {
-			if err := s.startServer(groupCtx, s.listener); err != nil {
+			if err := s.startServer(groupCtx, s.listener, s.connections); err != nil {
 				return fmt.Errorf("error starting insecure server: %v", err)
 			}
 			return nil
@@ -131,8 +197,13 @@ func (s *server) Start(ctx context.Context) error {
 	}
 
 	if s.tlsListener != nil {
+		// Reload certificates until the servers have stopped
+		done := make(chan bool)
+		defer close(done)
+		s.certificates.watch(done)
+
 		g.Go(func() error {
-			if err := s.startServer(groupCtx, s.tlsListener); err != nil {
+			if err := s.startServer(groupCtx, s.tlsListener, s.tlsConnections); err != nil {
 				return fmt.Errorf("error starting secure server: %v", err)
 			}
 			return nil
@@ -145,14 +216,14 @@ func (s *server) Start(ctx context.Context) error {
 // startServer creates and starts a new server with the given listener.
 // When the given context is cancelled the server will be shutdown.
 // If any errors occur, only the first error will be returned.
-func (s *server) startServer(ctx context.Context, listener net.Listener) error {
+func (s *server) startServer(ctx context.Context, listener net.Listener, connections *connectionTracker) error {
 	srv := &http.Server{Handler: s.handler}
 	g, groupCtx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
 		<-groupCtx.Done()
 
-		if err := srv.Shutdown(context.Background()); err != nil {
+		if err := s.shutdown(srv, connections); err != nil {
 			return fmt.Errorf("error shutting down server: %v", err)
 		}
 		return nil
@@ -168,6 +239,35 @@ func (s *server) startServer(ctx context.Context, listener net.Listener) error {
 	return g.Wait()
 }
 
+// shutdown stops the server from accepting new connections and waits for
+// in-flight requests and hijacked connections, such as websockets, to finish.
+// Connections that are still open once the shutdown grace period has expired
+// are closed.
+// Without a grace period, in-flight requests are waited for without a
+// deadline and hijacked connections are closed immediately.
+func (s *server) shutdown(srv *http.Server, connections *connectionTracker) error {
+	// Any connections that are left are closed, whether the server was shut
+	// down cleanly or not
+	defer connections.closeAll()
+
+	if s.shutdownGracePeriod == 0 {
+		return srv.Shutdown(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownGracePeriod)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		err = connections.wait(ctx)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Printf("Shutdown grace period of %s expired, closing open connections", s.shutdownGracePeriod)
+		return nil
+	}
+	return err
+}
+
 // getNetworkScheme gets the scheme for the HTTP server.
 func getNetworkScheme(addr string) string {
 	var scheme string
@@ -190,24 +290,58 @@ func getListenAddress(addr string) string {
 	return slice[len(slice)-1]
 }
 
-// getCertificate loads the certificate data from the TLS config.
-func getCertificate(opts *options.TLS) (tls.Certificate, error) {
-	keyData, err := getSecretValue(opts.Key)
-	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("could not load key data: %v", err)
+// newTLSConfig creates the TLS config for the listener with the TLS versions
+// and cipher suites of the options.
+func newTLSConfig(opts *options.TLS) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS13,
+		NextProtos: []string{"http/1.1"},
 	}
 
-	certData, err := getSecretValue(opts.Cert)
-	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("could not load cert data: %v", err)
+	if opts.MinVersion != "" {
+		version, err := pkgutil.ParseTLSVersion(opts.MinVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS min version: %v", err)
+		}
+		config.MinVersion = version
+	}
+	if len(opts.CipherSuites) > 0 {
+		suites, err := pkgutil.ParseCipherSuites(opts.CipherSuites)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS cipher suites: %v", err)
+		}
+		config.CipherSuites = suites
+	}
+	return config, nil
+}
+
+// setClientAuth configures the verification of client certificates against
+// the client CA, if one is set.
+func setClientAuth(config *tls.Config, opts *options.TLS) error {
+	if opts.ClientCA == nil {
+		return nil
 	}
 
-	cert, err := tls.X509KeyPair(certData, keyData)
+	caData, err := getSecretValue(opts.ClientCA)
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("could not parse certificate data: %v", err)
+		return fmt.Errorf("could not load client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return errors.New("could not load client CA: no certificates found")
 	}
+	config.ClientCAs = pool
 
-	return cert, nil
+	switch opts.ClientAuth {
+	case "", options.RequestClientCertificate:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case options.RequireClientCertificate:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("unknown client auth %q", opts.ClientAuth)
+	}
+	return nil
 }
 
 // getSecretValue wraps util.GetSecretValue so that we can return an error if no
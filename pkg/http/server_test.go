@@ -2,15 +2,25 @@ package http
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"golang.org/x/net/http2"
 )
 
 const hello = "Hello World!"
@@ -211,6 +221,35 @@ var _ = Describe("Server", func() {
 				expectHTTPListener: false,
 				expectTLSListener:  false,
 			}),
+			Entry("with an invalid client CA", &newServerTableInput{
+				opts: Opts{
+					Handler:           handler,
+					SecureBindAddress: "127.0.0.1:0",
+					TLS: &options.TLS{
+						Key:      &keyDataSource,
+						Cert:     &certDataSource,
+						ClientCA: &options.SecretSource{Value: []byte("invalid")},
+					},
+				},
+				expectedErr:        errors.New("error setting up TLS listener: could not load client CA: no certificates found"),
+				expectHTTPListener: false,
+				expectTLSListener:  false,
+			}),
+			Entry("with an unknown client auth", &newServerTableInput{
+				opts: Opts{
+					Handler:           handler,
+					SecureBindAddress: "127.0.0.1:0",
+					TLS: &options.TLS{
+						Key:        &keyDataSource,
+						Cert:       &certDataSource,
+						ClientCA:   &certDataSource,
+						ClientAuth: "optional",
+					},
+				},
+				expectedErr:        errors.New("error setting up TLS listener: unknown client auth \"optional\""),
+				expectHTTPListener: false,
+				expectTLSListener:  false,
+			}),
 			Entry("when the bind address is prefixed with the http scheme", &newServerTableInput{
 				opts: Opts{
 					Handler:     handler,
@@ -362,12 +401,110 @@ var _ = Describe("Server", func() {
 				Expect(err).ToNot(HaveOccurred())
 				Expect(resp.StatusCode).To(Equal(http.StatusOK))
 
+				Expect(resp.ProtoMajor).To(Equal(1))
 				Expect(resp.TLS.VerifiedChains).Should(HaveLen(1))
 				Expect(resp.TLS.VerifiedChains[0]).Should(HaveLen(1))
 				Expect(resp.TLS.VerifiedChains[0][0].Raw).Should(Equal(certData))
 			})
 		})
 
+		Context("with client certificates", func() {
+			var clientCert tls.Certificate
+			var clientCA options.SecretSource
+
+			// commonNameHandler responds with the common name of the verified
+			// client certificate
+			commonNameHandler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if len(req.TLS.VerifiedChains) == 0 {
+					rw.Write([]byte("anonymous"))
+					return
+				}
+				rw.Write([]byte(req.TLS.VerifiedChains[0][0].Subject.CommonName))
+			})
+
+			BeforeEach(func() {
+				priv, err := rsa.GenerateKey(rand.Reader, 2048)
+				Expect(err).ToNot(HaveOccurred())
+
+				template := x509.Certificate{
+					SerialNumber:          big.NewInt(1),
+					Subject:               pkix.Name{CommonName: "client"},
+					NotBefore:             time.Now(),
+					NotAfter:              time.Now().Add(time.Hour),
+					KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+					ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+					BasicConstraintsValid: true,
+					IsCA:                  true,
+				}
+				certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+				Expect(err).ToNot(HaveOccurred())
+
+				clientCert = tls.Certificate{Certificate: [][]byte{certBytes}, PrivateKey: priv}
+				clientCA = options.SecretSource{Value: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})}
+			})
+
+			// startServer starts an https server verifying client certificates
+			// and returns its address
+			startServer := func(clientAuth string) string {
+				srv, err := NewServer(Opts{
+					Handler:           commonNameHandler,
+					SecureBindAddress: "127.0.0.1:0",
+					TLS: &options.TLS{
+						Key:        &keyDataSource,
+						Cert:       &certDataSource,
+						ClientCA:   &clientCA,
+						ClientAuth: clientAuth,
+					},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				go func() {
+					defer GinkgoRecover()
+					Expect(srv.Start(ctx)).To(Succeed())
+				}()
+
+				return fmt.Sprintf("https://%s/", srv.(*server).tlsListener.Addr().String())
+			}
+
+			clientWithCertificate := func() *http.Client {
+				transport := client.Transport.(*http.Transport).Clone()
+				transport.TLSClientConfig.Certificates = []tls.Certificate{clientCert}
+				return &http.Client{Transport: transport}
+			}
+
+			get := func(c *http.Client, url string) string {
+				resp, err := c.Get(url)
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				body, err := ioutil.ReadAll(resp.Body)
+				Expect(err).ToNot(HaveOccurred())
+				return string(body)
+			}
+
+			It("Verifies a client certificate when requested", func() {
+				addr := startServer(options.RequestClientCertificate)
+				Expect(get(clientWithCertificate(), addr)).To(Equal("client"))
+			})
+
+			It("Serves clients without a certificate when requested", func() {
+				addr := startServer(options.RequestClientCertificate)
+				Expect(get(client, addr)).To(Equal("anonymous"))
+			})
+
+			It("Verifies a client certificate when required", func() {
+				addr := startServer(options.RequireClientCertificate)
+				Expect(get(clientWithCertificate(), addr)).To(Equal("client"))
+			})
+
+			It("Rejects clients without a certificate when required", func() {
+				addr := startServer(options.RequireClientCertificate)
+				_, err := client.Get(addr)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
 		Context("with both an http and an https server", func() {
 			var listenAddr, secureListenAddr string
 
@@ -444,6 +581,81 @@ var _ = Describe("Server", func() {
 				}).Should(HaveOccurred())
 			})
 		})
+
+		Context("with HTTP/2 enabled", func() {
+			var listenAddr, secureListenAddr string
+
+			BeforeEach(func() {
+				var err error
+				srv, err = NewServer(Opts{
+					Handler:           handler,
+					BindAddress:       "127.0.0.1:0",
+					SecureBindAddress: "127.0.0.1:0",
+					TLS: &options.TLS{
+						Key:  &keyDataSource,
+						Cert: &certDataSource,
+					},
+					EnableHTTP2: true,
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				s, ok := srv.(*server)
+				Expect(ok).To(BeTrue())
+
+				listenAddr = fmt.Sprintf("http://%s/", s.listener.Addr().String())
+				secureListenAddr = fmt.Sprintf("https://%s/", s.tlsListener.Addr().String())
+			})
+
+			It("Serves HTTP/2 on https", func() {
+				go func() {
+					defer GinkgoRecover()
+					Expect(srv.Start(ctx)).To(Succeed())
+				}()
+
+				resp, err := client.Get(secureListenAddr)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.ProtoMajor).To(Equal(2))
+
+				body, err := ioutil.ReadAll(resp.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(Equal(hello))
+			})
+
+			It("Serves HTTP/2 without TLS on http", func() {
+				go func() {
+					defer GinkgoRecover()
+					Expect(srv.Start(ctx)).To(Succeed())
+				}()
+
+				h2cClient := &http.Client{
+					Transport: &http2.Transport{
+						AllowHTTP: true,
+						DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+							return net.Dial(network, addr)
+						},
+					},
+				}
+				resp, err := h2cClient.Get(listenAddr)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.ProtoMajor).To(Equal(2))
+
+				body, err := ioutil.ReadAll(resp.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(Equal(hello))
+			})
+
+			It("Still serves HTTP/1.1 on http", func() {
+				go func() {
+					defer GinkgoRecover()
+					Expect(srv.Start(ctx)).To(Succeed())
+				}()
+
+				resp, err := client.Get(listenAddr)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.ProtoMajor).To(Equal(1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
 	})
 
 	Context("getNetworkScheme", func() {
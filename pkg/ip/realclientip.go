@@ -7,52 +7,151 @@ import (
 	"strings"
 
 	ipapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/ip"
+	requestutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests/util"
 )
 
-func GetRealClientIPParser(headerKey string) (ipapi.RealClientIPParser, error) {
+// GetRealClientIPParser returns the parser of the real client IP from the
+// given header.
+// When trustedProxies is not nil, the header is only used when the request
+// comes from a trusted proxy. The proxy chain in the header is then walked
+// from the right and the first address that is not a trusted proxy is
+// returned. Otherwise the first address in the header is returned.
+func GetRealClientIPParser(headerKey string, trustedProxies *NetSet) (ipapi.RealClientIPParser, error) {
 	headerKey = http.CanonicalHeaderKey(headerKey)
 
 	switch headerKey {
 	case http.CanonicalHeaderKey("X-Forwarded-For"), http.CanonicalHeaderKey("X-Real-IP"), http.CanonicalHeaderKey("X-ProxyUser-IP"):
-		return &xForwardedForClientIPParser{header: headerKey}, nil
+		return &xForwardedForClientIPParser{header: headerKey, trustedProxies: trustedProxies}, nil
+	case requestutil.Forwarded:
+		return &forwardedClientIPParser{trustedProxies: trustedProxies}, nil
 	}
 
-	// TODO: implement the more standardized but more complex `Forwarded` header.
 	return nil, fmt.Errorf("the http header key (%s) is either invalid or unsupported", headerKey)
 }
 
 type xForwardedForClientIPParser struct {
-	header string
+	header         string
+	trustedProxies *NetSet
 }
 
 // GetRealClientIP obtain the IP address of the end-user (not proxy).
 // Parses headers sharing the format as specified by:
 // * https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-For.
-// Returns the `<client>` portion specified in the above document.
+// Returns the `<client>` portion specified in the above document, or the first
+// address that is not a trusted proxy when trusted proxies are configured.
 // Additionally, is capable of parsing IPs with the port included, for v4 in the format "<ip>:<port>" and for v6 in the
 // format "[<ip>]:<port>".  With-port and without-port formats are seamlessly supported concurrently.
 func (p xForwardedForClientIPParser) GetRealClientIP(h http.Header) (net.IP, error) {
-	var ipStr string
-	if realIP := h.Get(p.header); realIP != "" {
-		ipStr = realIP
-	} else {
+	return p.getRealClientIP(h, nil)
+}
+
+// getRealClientIP obtains the IP address of the end-user of a request from
+// the peer, which is ignored when nil.
+func (p xForwardedForClientIPParser) getRealClientIP(h http.Header, peer net.IP) (net.IP, error) {
+	// Each successive proxy may append itself, comma separated, to the end of the X-Forwarded-for header.
+	chain := []string{}
+	for _, value := range h.Values(p.header) {
+		for _, ipStr := range strings.Split(value, ",") {
+			if ipStr = strings.TrimSpace(ipStr); ipStr != "" {
+				chain = append(chain, ipStr)
+			}
+		}
+	}
+
+	return getClientFromChain(chain, p.header, p.trustedProxies, peer)
+}
+
+type forwardedClientIPParser struct {
+	trustedProxies *NetSet
+}
+
+// GetRealClientIP obtain the IP address of the end-user (not proxy).
+// Parses the `for` parameter of the Forwarded header as specified by:
+// * https://tools.ietf.org/html/rfc7239.
+// Returns the `for` of the first element, or the first address that is not a
+// trusted proxy when trusted proxies are configured.
+// Obfuscated and unknown identifiers are not IP addresses and are skipped.
+func (p forwardedClientIPParser) GetRealClientIP(h http.Header) (net.IP, error) {
+	return p.getRealClientIP(h, nil)
+}
+
+// getRealClientIP obtains the IP address of the end-user of a request from
+// the peer, which is ignored when nil.
+func (p forwardedClientIPParser) getRealClientIP(h http.Header, peer net.IP) (net.IP, error) {
+	chain := []string{}
+	for _, e := range requestutil.GetForwarded(h) {
+		if e.For != "" {
+			chain = append(chain, e.For)
+		}
+	}
+
+	return getClientFromChain(chain, requestutil.Forwarded, p.trustedProxies, peer)
+}
+
+// peerClientIPParser is implemented by the parsers that can check that the
+// request comes from a trusted proxy before relying on its header.
+type peerClientIPParser interface {
+	getRealClientIP(h http.Header, peer net.IP) (net.IP, error)
+}
+
+// getClientFromChain returns the client IP from the chain of addresses added
+// by each proxy.
+// Without trusted proxies the first address, recorded by the first proxy, is
+// the client. Otherwise the header is ignored unless the peer is a trusted
+// proxy, and the chain is walked from the right, as only the addresses added
+// by trusted proxies can be relied upon, and the first untrusted address is
+// the client.
+// Unknown and obfuscated identifiers are skipped without trusted proxies.
+// Otherwise the client of the trusted proxy that added them is unknown, and
+// no IP is returned.
+func getClientFromChain(chain []string, header string, trustedProxies *NetSet, peer net.IP) (net.IP, error) {
+	if trustedProxies == nil {
+		for _, ipStr := range chain {
+			ip, err := parseChainIP(ipStr, header)
+			if err != nil || ip != nil {
+				return ip, err
+			}
+		}
 		return nil, nil
 	}
 
-	// Each successive proxy may append itself, comma separated, to the end of the X-Forwarded-for header.
-	// Select only the first IP listed, as it is the client IP recorded by the first proxy.
-	if commaIndex := strings.IndexRune(ipStr, ','); commaIndex != -1 {
-		ipStr = ipStr[:commaIndex]
+	if peer != nil && !trustedProxies.Has(peer) {
+		return peer, nil
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip, err := parseChainIP(chain[i], header)
+		if err != nil || ip == nil {
+			return nil, err
+		}
+		if !trustedProxies.Has(ip) {
+			return ip, nil
+		}
 	}
-	ipStr = strings.TrimSpace(ipStr)
 
+	// Every address is a trusted proxy, the first is the closest to the client
+	return parseChainIP(chain[0], header)
+}
+
+// parseChainIP parses an address of a proxy chain, with or without a port.
+// It returns nil for the unknown and obfuscated identifiers of the Forwarded
+// header, as they are not IP addresses.
+func parseChainIP(ipStr, header string) (net.IP, error) {
 	if ipHost, _, err := net.SplitHostPort(ipStr); err == nil {
 		ipStr = ipHost
+	} else {
+		ipStr = strings.TrimSuffix(strings.TrimPrefix(ipStr, "["), "]")
+	}
+	if strings.EqualFold(ipStr, "unknown") || strings.HasPrefix(ipStr, "_") {
+		return nil, nil
 	}
 
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
-		return nil, fmt.Errorf("unable to parse ip (%s) from %s header", ipStr, http.CanonicalHeaderKey(p.header))
+		return nil, fmt.Errorf("unable to parse ip (%s) from %s header", ipStr, http.CanonicalHeaderKey(header))
 	}
 
 	return ip, nil
@@ -61,11 +160,22 @@ func (p xForwardedForClientIPParser) GetRealClientIP(h http.Header) (net.IP, err
 // GetClientIP obtains the perceived end-user IP address from headers if p != nil else from req.RemoteAddr.
 func GetClientIP(p ipapi.RealClientIPParser, req *http.Request) (net.IP, error) {
 	if p != nil {
-		return p.GetRealClientIP(req.Header)
+		return getRealClientIP(p, req)
 	}
 	return getRemoteIP(req)
 }
 
+// getRealClientIP obtains the end-user IP address from the headers, passing
+// the address of the peer to the parsers that check it is a trusted proxy.
+func getRealClientIP(p ipapi.RealClientIPParser, req *http.Request) (net.IP, error) {
+	if pp, ok := p.(peerClientIPParser); ok {
+		// A peer that can't be parsed, such as a unix socket, is not checked
+		peer, _ := getRemoteIP(req)
+		return pp.getRealClientIP(req.Header, peer)
+	}
+	return p.GetRealClientIP(req.Header)
+}
+
 // getRemoteIP obtains the IP of the low-level connected network host
 func getRemoteIP(req *http.Request) (net.IP, error) {
 	if ipStr, _, err := net.SplitHostPort(req.RemoteAddr); err != nil {
@@ -81,7 +191,7 @@ func getRemoteIP(req *http.Request) (net.IP, error) {
 func GetClientString(p ipapi.RealClientIPParser, req *http.Request, full bool) (s string) {
 	var realClientIPStr string
 	if p != nil {
-		if realClientIP, err := p.GetRealClientIP(req.Header); err == nil && realClientIP != nil {
+		if realClientIP, err := getRealClientIP(p, req); err == nil && realClientIP != nil {
 			realClientIPStr = realClientIP.String()
 		}
 	}
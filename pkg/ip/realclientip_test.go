@@ -12,6 +12,7 @@ import (
 
 func TestGetRealClientIPParser(t *testing.T) {
 	forwardedForType := reflect.TypeOf((*xForwardedForClientIPParser)(nil))
+	forwardedType := reflect.TypeOf((*forwardedClientIPParser)(nil))
 
 	tests := []struct {
 		header     string
@@ -22,12 +23,13 @@ func TestGetRealClientIPParser(t *testing.T) {
 		{"X-REAL-IP", "", forwardedForType},
 		{"x-proxyuser-ip", "", forwardedForType},
 		{"", "the http header key () is either invalid or unsupported", nil},
-		{"Forwarded", "the http header key (Forwarded) is either invalid or unsupported", nil},
+		{"Forwarded", "", forwardedType},
+		{"forwarded", "", forwardedType},
 		{"2#* @##$$:kd", "the http header key (2#* @##$$:kd) is either invalid or unsupported", nil},
 	}
 
 	for _, test := range tests {
-		p, err := GetRealClientIPParser(test.header)
+		p, err := GetRealClientIPParser(test.header, nil)
 
 		if test.errString == "" {
 			assert.Nil(t, err)
@@ -90,6 +92,135 @@ func TestXForwardedForClientIPParser(t *testing.T) {
 	}
 }
 
+func TestXForwardedForClientIPParserWithTrustedProxies(t *testing.T) {
+	trustedProxies := NewNetSet()
+	trustedProxies.AddIPNet(*ParseIPNet("10.0.0.0/8"))
+	trustedProxies.AddIPNet(*ParseIPNet("fd00::/8"))
+	p := &xForwardedForClientIPParser{header: http.CanonicalHeaderKey("X-Forwarded-For"), trustedProxies: trustedProxies}
+
+	tests := []struct {
+		headerValues []string
+		errString    string
+		expectedIP   net.IP
+	}{
+		{[]string{""}, "", nil},
+		{[]string{"1.2.3.4"}, "", net.ParseIP("1.2.3.4")},
+		{[]string{"1.2.3.4, 10.0.0.1"}, "", net.ParseIP("1.2.3.4")},
+		{[]string{"6.6.6.6, 1.2.3.4, 10.0.0.2, 10.0.0.1"}, "", net.ParseIP("1.2.3.4")},
+		{[]string{"6.6.6.6", "1.2.3.4:1234, [fd00::1]:1234"}, "", net.ParseIP("1.2.3.4")},
+		{[]string{"10.0.0.3, 10.0.0.2"}, "", net.ParseIP("10.0.0.3")},
+		{[]string{"nil, 1.2.3.4, 10.0.0.1"}, "", net.ParseIP("1.2.3.4")},
+		{[]string{"1.2.3.4, nil, 10.0.0.1"}, "unable to parse ip (nil) from X-Forwarded-For header", nil},
+	}
+
+	for _, test := range tests {
+		h := http.Header{}
+		for _, value := range test.headerValues {
+			h.Add("X-Forwarded-For", value)
+		}
+
+		ip, err := p.GetRealClientIP(h)
+
+		if test.errString == "" {
+			assert.Nil(t, err)
+		} else {
+			assert.NotNil(t, err)
+			assert.Equal(t, test.errString, err.Error())
+		}
+
+		if test.expectedIP == nil {
+			assert.Nil(t, ip)
+		} else {
+			assert.NotNil(t, ip)
+			assert.Equal(t, test.expectedIP, ip)
+		}
+	}
+}
+
+func TestForwardedClientIPParser(t *testing.T) {
+	trustedProxies := NewNetSet()
+	trustedProxies.AddIPNet(*ParseIPNet("10.0.0.0/8"))
+
+	tests := []struct {
+		headerValue    string
+		trustedProxies *NetSet
+		errString      string
+		expectedIP     net.IP
+	}{
+		{"", nil, "", nil},
+		{"proto=https", nil, "", nil},
+		{"for=1.2.3.4", nil, "", net.ParseIP("1.2.3.4")},
+		{"For=\"1.2.3.4:1234\";proto=https", nil, "", net.ParseIP("1.2.3.4")},
+		{"for=\"[2001:db8:cafe::17]:4711\"", nil, "", net.ParseIP("2001:db8:cafe::17")},
+		{"for=\"[2001:db8:cafe::17]\"", nil, "", net.ParseIP("2001:db8:cafe::17")},
+		{"for=1.2.3.4, for=10.0.0.1", nil, "", net.ParseIP("1.2.3.4")},
+		{"for=6.6.6.6, for=1.2.3.4;by=10.0.0.2, for=10.0.0.1", trustedProxies, "", net.ParseIP("1.2.3.4")},
+		{"for=10.0.0.2, for=10.0.0.1", trustedProxies, "", net.ParseIP("10.0.0.2")},
+		{"for=unknown", nil, "", nil},
+		{"for=unknown, for=1.2.3.4", nil, "", net.ParseIP("1.2.3.4")},
+		{"for=\"_hidden:_port\", for=1.2.3.4", nil, "", net.ParseIP("1.2.3.4")},
+		{"for=1.2.3.4, for=_hidden, for=10.0.0.1", trustedProxies, "", nil},
+		{"for=_hidden, for=1.2.3.4, for=10.0.0.1", trustedProxies, "", net.ParseIP("1.2.3.4")},
+	}
+
+	for _, test := range tests {
+		p := &forwardedClientIPParser{trustedProxies: test.trustedProxies}
+		h := http.Header{}
+		h.Add("Forwarded", test.headerValue)
+
+		ip, err := p.GetRealClientIP(h)
+
+		if test.errString == "" {
+			assert.Nil(t, err)
+		} else {
+			assert.NotNil(t, err)
+			assert.Equal(t, test.errString, err.Error())
+		}
+
+		if test.expectedIP == nil {
+			assert.Nil(t, ip)
+		} else {
+			assert.NotNil(t, ip)
+			assert.Equal(t, test.expectedIP, ip)
+		}
+	}
+}
+
+func TestGetClientIPWithTrustedProxies(t *testing.T) {
+	trustedProxies := NewNetSet()
+	trustedProxies.AddIPNet(*ParseIPNet("10.0.0.0/8"))
+	xForwardedFor, err := GetRealClientIPParser("X-Forwarded-For", trustedProxies)
+	assert.Nil(t, err)
+	forwarded, err := GetRealClientIPParser("Forwarded", trustedProxies)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		parser      ipapi.RealClientIPParser
+		header      string
+		headerValue string
+		remoteAddr  string
+		expectedIP  net.IP
+	}{
+		{xForwardedFor, "X-Forwarded-For", "1.2.3.4", "10.0.0.1:1234", net.ParseIP("1.2.3.4")},
+		{xForwardedFor, "X-Forwarded-For", "1.2.3.4", "6.6.6.6:1234", net.ParseIP("6.6.6.6")},
+		{xForwardedFor, "X-Forwarded-For", "", "6.6.6.6:1234", net.ParseIP("6.6.6.6")},
+		{forwarded, "Forwarded", "for=1.2.3.4", "10.0.0.1:1234", net.ParseIP("1.2.3.4")},
+		{forwarded, "Forwarded", "for=1.2.3.4", "6.6.6.6:1234", net.ParseIP("6.6.6.6")},
+	}
+
+	for _, test := range tests {
+		req := &http.Request{
+			Header:     http.Header{},
+			RemoteAddr: test.remoteAddr,
+		}
+		req.Header.Add(test.header, test.headerValue)
+
+		ip, err := GetClientIP(test.parser, req)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expectedIP, ip)
+	}
+}
+
 func TestXForwardedForClientIPParserIgnoresOthers(t *testing.T) {
 	p := &xForwardedForClientIPParser{header: http.CanonicalHeaderKey("X-Forwarded-For")}
 
@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/justinas/alice"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// NewClientCertificateSessionLoader creates a new middleware that loads
+// sessions from the verified TLS client certificates of requests.
+// The userField is the certificate field used as the user of the session.
+// The groupMappings map certificate organizational units to session groups,
+// in the format "ou=group". Without mappings, the organizational units are
+// the session groups.
+// The validator applies the email restrictions to the email of the session,
+// or to the user when the certificate has no email address, as sessions
+// without an email are not validated by the proxy.
+func NewClientCertificateSessionLoader(userField string, groupMappings []string, validator func(string) bool) alice.Constructor {
+	groups := make(map[string][]string)
+	for _, mapping := range groupMappings {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 {
+			// Invalid mappings are reported during validation
+			continue
+		}
+		groups[parts[0]] = append(groups[parts[0]], parts[1])
+	}
+
+	return func(next http.Handler) http.Handler {
+		return loadClientCertificateSession(userField, groups, validator, next)
+	}
+}
+
+// loadClientCertificateSession attempts to load a session from the client
+// certificate of the request.
+// Only certificates verified against the client CA by the TLS server are
+// used, if there is no verified certificate no session will be loaded and the
+// request will be passed to the next handler.
+// If a session was loaded by a previous handler, it will not be replaced.
+func loadClientCertificateSession(userField string, groups map[string][]string, validator func(string) bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		scope := middlewareapi.GetRequestScope(req)
+		// If scope is nil, this will panic.
+		// A scope should always be injected before this handler is called.
+		if scope.Session != nil {
+			// The session was already loaded, pass to the next handler
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		cert := req.TLS.VerifiedChains[0][0]
+		session, err := getClientCertificateSession(cert, userField, groups)
+		if err != nil {
+			logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via client certificate: %v", err)
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		identity := session.Email
+		if identity == "" {
+			identity = session.User
+		}
+		if !validator(identity) {
+			logger.PrintAuthf(identity, req, logger.AuthFailure, "Invalid authentication via client certificate: %q is not allowed", identity)
+			next.ServeHTTP(rw, req)
+			return
+		}
+		logger.PrintAuthf(session.User, req, logger.AuthSuccess, "Authenticated via client certificate")
+
+		// Add the session to the scope
+		scope.Session = session
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// getClientCertificateSession creates a session from the subject and SANs of
+// the certificate.
+func getClientCertificateSession(cert *x509.Certificate, userField string, groups map[string][]string) (*sessionsapi.SessionState, error) {
+	var user string
+	switch userField {
+	case options.ClientCertificateEmailField:
+		if len(cert.EmailAddresses) > 0 {
+			user = cert.EmailAddresses[0]
+		}
+	case options.ClientCertificateURIField:
+		if len(cert.URIs) > 0 {
+			user = cert.URIs[0].String()
+		}
+	case options.ClientCertificateDNSField:
+		if len(cert.DNSNames) > 0 {
+			user = cert.DNSNames[0]
+		}
+	case options.ClientCertificateCommonNameField:
+		user = cert.Subject.CommonName
+	default:
+		return nil, fmt.Errorf("unknown user field %q", userField)
+	}
+	if user == "" {
+		return nil, fmt.Errorf("certificate %q has no %s", cert.Subject, userField)
+	}
+
+	session := &sessionsapi.SessionState{
+		User:   user,
+		Groups: []string{},
+	}
+	if len(cert.EmailAddresses) > 0 {
+		session.Email = cert.EmailAddresses[0]
+	}
+
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if len(groups) == 0 {
+			session.Groups = append(session.Groups, ou)
+			continue
+		}
+		session.Groups = append(session.Groups, groups[ou]...)
+	}
+
+	return session, nil
+}
@@ -0,0 +1,174 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client Certificate Session Suite", func() {
+	Context("ClientCertificateSessionLoader", func() {
+		spiffeID, _ := url.Parse("spiffe://example.com/service")
+		verifiedCert := &x509.Certificate{
+			Subject: pkix.Name{
+				CommonName:         "john",
+				OrganizationalUnit: []string{"platform", "security"},
+			},
+			EmailAddresses: []string{"john@example.com"},
+			URIs:           []*url.URL{spiffeID},
+			DNSNames:       []string{"john.example.com"},
+		}
+		serviceCert := &x509.Certificate{
+			Subject: pkix.Name{CommonName: "service"},
+		}
+
+		// The validator allows the example.com email domain, and the service
+		// user
+		validator := func(identity string) bool {
+			return strings.HasSuffix(identity, "@example.com") || identity == "service"
+		}
+
+		type clientCertificateSessionLoaderTableInput struct {
+			userField       string
+			groupMappings   []string
+			tlsState        *tls.ConnectionState
+			existingSession *sessionsapi.SessionState
+			expectedSession *sessionsapi.SessionState
+		}
+
+		DescribeTable("with a client certificate",
+			func(in clientCertificateSessionLoaderTableInput) {
+				scope := &middlewareapi.RequestScope{
+					Session: in.existingSession,
+				}
+
+				// Set up the request with the TLS state and a request scope
+				req := httptest.NewRequest("", "/", nil)
+				req.TLS = in.tlsState
+				req = middlewareapi.AddRequestScope(req, scope)
+
+				rw := httptest.NewRecorder()
+
+				// Create the handler with a next handler that will capture the session
+				// from the scope
+				var gotSession *sessionsapi.SessionState
+				handler := NewClientCertificateSessionLoader(in.userField, in.groupMappings, validator)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					gotSession = middlewareapi.GetRequestScope(r).Session
+				}))
+				handler.ServeHTTP(rw, req)
+
+				Expect(gotSession).To(Equal(in.expectedSession))
+			},
+			Entry("without TLS", clientCertificateSessionLoaderTableInput{
+				userField:       options.ClientCertificateEmailField,
+				tlsState:        nil,
+				expectedSession: nil,
+			}),
+			Entry("without a verified certificate", clientCertificateSessionLoaderTableInput{
+				userField: options.ClientCertificateEmailField,
+				tlsState: &tls.ConnectionState{
+					PeerCertificates: []*x509.Certificate{verifiedCert},
+				},
+				expectedSession: nil,
+			}),
+			Entry("with the email user field", clientCertificateSessionLoaderTableInput{
+				userField: options.ClientCertificateEmailField,
+				tlsState: &tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{{verifiedCert}},
+				},
+				expectedSession: &sessionsapi.SessionState{
+					User:   "john@example.com",
+					Email:  "john@example.com",
+					Groups: []string{"platform", "security"},
+				},
+			}),
+			Entry("with the uri user field", clientCertificateSessionLoaderTableInput{
+				userField: options.ClientCertificateURIField,
+				tlsState: &tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{{verifiedCert}},
+				},
+				expectedSession: &sessionsapi.SessionState{
+					User:   "spiffe://example.com/service",
+					Email:  "john@example.com",
+					Groups: []string{"platform", "security"},
+				},
+			}),
+			Entry("with the dns user field", clientCertificateSessionLoaderTableInput{
+				userField: options.ClientCertificateDNSField,
+				tlsState: &tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{{verifiedCert}},
+				},
+				expectedSession: &sessionsapi.SessionState{
+					User:   "john.example.com",
+					Email:  "john@example.com",
+					Groups: []string{"platform", "security"},
+				},
+			}),
+			Entry("with the cn user field and group mappings", clientCertificateSessionLoaderTableInput{
+				userField:     options.ClientCertificateCommonNameField,
+				groupMappings: []string{"platform=admins", "platform=users", "sales=viewers"},
+				tlsState: &tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{{verifiedCert}},
+				},
+				expectedSession: &sessionsapi.SessionState{
+					User:   "john",
+					Email:  "john@example.com",
+					Groups: []string{"admins", "users"},
+				},
+			}),
+			Entry("with a certificate missing the user field", clientCertificateSessionLoaderTableInput{
+				userField: options.ClientCertificateEmailField,
+				tlsState: &tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "john"}}}},
+				},
+				expectedSession: nil,
+			}),
+			Entry("with a disallowed email", clientCertificateSessionLoaderTableInput{
+				userField: options.ClientCertificateCommonNameField,
+				tlsState: &tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{{{
+						Subject:        pkix.Name{CommonName: "service"},
+						EmailAddresses: []string{"service@example.org"},
+					}}},
+				},
+				expectedSession: nil,
+			}),
+			Entry("with an allowed user and no email", clientCertificateSessionLoaderTableInput{
+				userField: options.ClientCertificateCommonNameField,
+				tlsState: &tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{{serviceCert}},
+				},
+				expectedSession: &sessionsapi.SessionState{
+					User:   "service",
+					Groups: []string{},
+				},
+			}),
+			Entry("with a disallowed user and no email", clientCertificateSessionLoaderTableInput{
+				userField: options.ClientCertificateCommonNameField,
+				tlsState: &tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "intruder"}}}},
+				},
+				expectedSession: nil,
+			}),
+			Entry("with an existing session", clientCertificateSessionLoaderTableInput{
+				userField: options.ClientCertificateEmailField,
+				tlsState: &tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{{verifiedCert}},
+				},
+				existingSession: &sessionsapi.SessionState{User: "user"},
+				expectedSession: &sessionsapi.SessionState{User: "user"},
+			}),
+		)
+	})
+})
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/justinas/alice"
+	ipapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/ip"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// IPAccessOpts contains the options for an IP access middleware.
+type IPAccessOpts struct {
+	// Upstream is the ID of the protected upstream.
+	Upstream string
+
+	// IPAccess is the allow and deny lists applied to requests.
+	IPAccess options.IPAccess
+
+	// RealClientIPParser is used to determine the client IP of requests.
+	RealClientIPParser ipapi.RealClientIPParser
+
+	// Writer renders the error page of requests that are not allowed.
+	Writer pagewriter.Writer
+}
+
+// NewIPAccess creates a new middleware that rejects requests from client IPs
+// that are not allowed with a 403 Forbidden error page.
+func NewIPAccess(opts IPAccessOpts) (alice.Constructor, error) {
+	allow, err := parseNetSet(opts.IPAccess.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseNetSet(opts.IPAccess.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			clientIP, err := getClientIP(opts.RealClientIPParser, req)
+			if err != nil {
+				logger.Errorf("Error obtaining real IP for upstream %q: %v", opts.Upstream, err)
+			}
+
+			if clientIP == nil || (deny != nil && deny.Has(clientIP)) || (allow != nil && !allow.Has(clientIP)) {
+				logger.PrintAuthf(sessionEmail(req), req, logger.AuthFailure, "Client IP %s is not allowed to access upstream %q", clientIP, opts.Upstream)
+				opts.Writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+					Status:    http.StatusForbidden,
+					RequestID: requestID(req),
+					AppError:  fmt.Sprintf("client IP %s is not allowed to access upstream %q", clientIP, opts.Upstream),
+				})
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}, nil
+}
+
+// parseNetSet parses the IPs and CIDR ranges into a NetSet.
+// It returns nil if there are no networks.
+func parseNetSet(networks []string) (*ip.NetSet, error) {
+	if len(networks) == 0 {
+		return nil, nil
+	}
+
+	set := ip.NewNetSet()
+	for _, network := range networks {
+		ipNet := ip.ParseIPNet(network)
+		if ipNet == nil {
+			return nil, fmt.Errorf("could not parse IP network (%s)", network)
+		}
+		set.AddIPNet(*ipNet)
+	}
+	return set, nil
+}
+
+// getClientIP returns the real client IP of the request, falling back to the
+// remote address when the request has no real client IP header.
+func getClientIP(parser ipapi.RealClientIPParser, req *http.Request) (net.IP, error) {
+	clientIP, err := ip.GetClientIP(parser, req)
+	if err != nil || clientIP != nil {
+		return clientIP, err
+	}
+	return ip.GetClientIP(nil, req)
+}
+
+// sessionEmail returns the email of the session of the request, if any.
+func sessionEmail(req *http.Request) string {
+	if scope := middlewareapi.GetRequestScope(req); scope != nil && scope.Session != nil {
+		return scope.Session.Email
+	}
+	return ""
+}
@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IP Access Suite", func() {
+	type ipAccessTableInput struct {
+		ipAccess      options.IPAccess
+		realClientIP  string
+		remoteAddr    string
+		useHeader     bool
+		expectedCode  int
+		expectedError string
+	}
+
+	DescribeTable("should restrict access by client IP",
+		func(in ipAccessTableInput) {
+			opts := IPAccessOpts{
+				Upstream: "app",
+				IPAccess: in.ipAccess,
+				Writer:   &pagewriter.WriterFuncs{},
+			}
+			if in.useHeader {
+				parser, err := ip.GetRealClientIPParser("X-Forwarded-For", nil)
+				Expect(err).ToNot(HaveOccurred())
+				opts.RealClientIPParser = parser
+			}
+			ipAccess, err := NewIPAccess(opts)
+			Expect(err).ToNot(HaveOccurred())
+
+			buf := bytes.NewBuffer(nil)
+			logger.SetOutput(buf)
+			defer logger.SetOutput(GinkgoWriter)
+
+			req := httptest.NewRequest("", "/", nil)
+			req.RemoteAddr = in.remoteAddr
+			if in.realClientIP != "" {
+				req.Header.Set("X-Forwarded-For", in.realClientIP)
+			}
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+				Session: &sessionsapi.SessionState{Email: "user@example.com"},
+			})
+			rw := httptest.NewRecorder()
+			ipAccess(testHandler()).ServeHTTP(rw, req)
+
+			Expect(rw.Code).To(Equal(in.expectedCode))
+			if in.expectedCode == http.StatusForbidden {
+				Expect(buf.String()).To(ContainSubstring("user@example.com"))
+				Expect(buf.String()).To(ContainSubstring("[AuthFailure] " + in.expectedError))
+				Expect(rw.Body.String()).To(HavePrefix("403 - client IP"))
+			} else {
+				Expect(buf.String()).To(BeEmpty())
+			}
+		},
+		Entry("with a remote address in the allow list", ipAccessTableInput{
+			ipAccess:     options.IPAccess{Allow: []string{"10.0.0.0/8"}},
+			remoteAddr:   "10.1.2.3:1234",
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with a remote address outside the allow list", ipAccessTableInput{
+			ipAccess:      options.IPAccess{Allow: []string{"10.0.0.0/8"}},
+			remoteAddr:    "192.168.0.1:1234",
+			expectedCode:  http.StatusForbidden,
+			expectedError: "Client IP 192.168.0.1 is not allowed to access upstream \"app\"",
+		}),
+		Entry("with a remote address in the deny list", ipAccessTableInput{
+			ipAccess:      options.IPAccess{Deny: []string{"192.168.0.1"}},
+			remoteAddr:    "192.168.0.1:1234",
+			expectedCode:  http.StatusForbidden,
+			expectedError: "Client IP 192.168.0.1 is not allowed to access upstream \"app\"",
+		}),
+		Entry("with a remote address outside the deny list", ipAccessTableInput{
+			ipAccess:     options.IPAccess{Deny: []string{"192.168.0.1"}},
+			remoteAddr:   "192.168.0.2:1234",
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with a remote address in both lists", ipAccessTableInput{
+			ipAccess:      options.IPAccess{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.0/24"}},
+			remoteAddr:    "10.0.0.1:1234",
+			expectedCode:  http.StatusForbidden,
+			expectedError: "Client IP 10.0.0.1 is not allowed to access upstream \"app\"",
+		}),
+		Entry("with an IPv6 remote address in the allow list", ipAccessTableInput{
+			ipAccess:     options.IPAccess{Allow: []string{"fd00::/8"}},
+			remoteAddr:   "[fd00::1]:1234",
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with a real client IP in the allow list", ipAccessTableInput{
+			ipAccess:     options.IPAccess{Allow: []string{"10.0.0.0/8"}},
+			realClientIP: "10.1.2.3, 172.16.0.1",
+			remoteAddr:   "172.16.0.1:1234",
+			useHeader:    true,
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with a real client IP outside the allow list", ipAccessTableInput{
+			ipAccess:      options.IPAccess{Allow: []string{"10.0.0.0/8"}},
+			realClientIP:  "192.168.0.1",
+			remoteAddr:    "10.0.0.1:1234",
+			useHeader:     true,
+			expectedCode:  http.StatusForbidden,
+			expectedError: "Client IP 192.168.0.1 is not allowed to access upstream \"app\"",
+		}),
+		Entry("with no real client IP header", ipAccessTableInput{
+			ipAccess:     options.IPAccess{Allow: []string{"10.0.0.0/8"}},
+			remoteAddr:   "10.0.0.1:1234",
+			useHeader:    true,
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with an invalid real client IP header", ipAccessTableInput{
+			ipAccess:      options.IPAccess{Deny: []string{"192.168.0.1"}},
+			realClientIP:  "not-an-ip",
+			remoteAddr:    "10.0.0.1:1234",
+			useHeader:     true,
+			expectedCode:  http.StatusForbidden,
+			expectedError: "Client IP <nil> is not allowed to access upstream \"app\"",
+		}),
+	)
+
+	It("returns an error for an invalid network", func() {
+		_, err := NewIPAccess(IPAccessOpts{
+			Upstream: "app",
+			IPAccess: options.IPAccess{Allow: []string{"10.0.0.0/33"}},
+		})
+		Expect(err).To(MatchError("could not parse IP network (10.0.0.0/33)"))
+	})
+})
@@ -0,0 +1,307 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/justinas/alice"
+	ipapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/ip"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RateLimitStore stores the token buckets of rate limits.
+type RateLimitStore interface {
+	// Take takes a token from the bucket for the key.
+	// The bucket holds up to burst tokens and is refilled at rate tokens per
+	// second.
+	// If the bucket is empty, the request is not allowed and the duration
+	// until a token is available is returned.
+	Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error)
+}
+
+// RateLimitOpts contains the options for a rate limiting middleware.
+type RateLimitOpts struct {
+	// Upstream is the ID of the rate limited upstream.
+	Upstream string
+
+	// RateLimit is the limit applied to requests.
+	RateLimit options.RateLimit
+
+	// Store stores the token buckets.
+	Store RateLimitStore
+
+	// RealClientIPParser is used to determine the client IP of requests.
+	RealClientIPParser ipapi.RealClientIPParser
+
+	// Writer renders the error page of requests over the limit.
+	Writer pagewriter.Writer
+
+	// Registerer registers the rate limit metrics.
+	// Defaults to the default prometheus.Registry.
+	Registerer prometheus.Registerer
+}
+
+// NewRateLimit creates a new middleware that rejects requests over the rate
+// limit with a 429 Too Many Requests response.
+func NewRateLimit(opts RateLimitOpts) alice.Constructor {
+	registerer := opts.Registerer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	throttled := registerRateLimitedRequestsCounter(registerer)
+
+	limit := opts.RateLimit
+	period := options.DefaultRateLimitPeriod
+	if limit.Period != nil && limit.Period.Duration() > 0 {
+		period = limit.Period.Duration()
+	}
+	rate := float64(limit.Requests) / period.Seconds()
+	burst := limit.Burst
+	if burst == 0 {
+		burst = limit.Requests
+	}
+	key := limit.Key
+	if key == "" {
+		key = options.UserRateLimitKey
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			bucket := rateLimitBucket(opts.Upstream, key, opts.RealClientIPParser, req)
+
+			allowed, wait, err := opts.Store.Take(req.Context(), bucket, rate, burst)
+			if err != nil {
+				// Fail open so that a store outage does not take down the upstream
+				logger.Errorf("Error checking rate limit for upstream %q: %v", opts.Upstream, err)
+				next.ServeHTTP(rw, req)
+				return
+			}
+			if !allowed {
+				throttled.WithLabelValues(opts.Upstream, key).Inc()
+				retryAfter := int64(math.Ceil(wait.Seconds()))
+				if retryAfter < 1 {
+					retryAfter = 1
+				}
+				rw.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+				opts.Writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+					Status:    http.StatusTooManyRequests,
+					RequestID: requestID(req),
+					AppError:  fmt.Sprintf("rate limit of upstream %q exceeded", opts.Upstream),
+				})
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// rateLimitBucket returns the key of the token bucket for the request.
+// Requests without a session are limited by client IP when the limit is per
+// user.
+func rateLimitBucket(upstream, key string, parser ipapi.RealClientIPParser, req *http.Request) string {
+	prefix := fmt.Sprintf("oauth2-proxy-ratelimit-%s-", upstream)
+	switch key {
+	case options.RouteRateLimitKey:
+		return prefix + "route"
+	case options.UserRateLimitKey:
+		if scope := middlewareapi.GetRequestScope(req); scope != nil && scope.Session != nil {
+			user := scope.Session.User
+			if user == "" {
+				user = scope.Session.Email
+			}
+			if user != "" {
+				return prefix + "user-" + user
+			}
+		}
+	}
+	return prefix + "ip-" + ip.GetClientString(parser, req, false)
+}
+
+// requestID returns the ID of the request, if it has a request scope.
+func requestID(req *http.Request) string {
+	if scope := middlewareapi.GetRequestScope(req); scope != nil {
+		return scope.RequestID
+	}
+	return ""
+}
+
+// memoryRateLimitStore stores token buckets in memory.
+type memoryRateLimitStore struct {
+	clock clock.Clock
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	cleanedAt time.Time
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	// fullAt is when the bucket will be full and can be forgotten
+	fullAt time.Time
+}
+
+// rateLimitCleanupInterval is how often full buckets are removed from the
+// memory store
+const rateLimitCleanupInterval = time.Minute
+
+// NewMemoryRateLimitStore creates a RateLimitStore that stores the token
+// buckets in memory.
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Take takes a token from the bucket for the key.
+func (s *memoryRateLimitStore) Take(_ context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	s.cleanup(now)
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), updatedAt: now}
+		s.buckets[key] = bucket
+	}
+
+	elapsed := now.Sub(bucket.updatedAt).Seconds()
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+elapsed*rate)
+	bucket.updatedAt = now
+
+	allowed := false
+	var wait time.Duration
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		allowed = true
+	} else {
+		wait = time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+	bucket.fullAt = now.Add(time.Duration((float64(burst) - bucket.tokens) / rate * float64(time.Second)))
+
+	return allowed, wait, nil
+}
+
+// cleanup removes buckets that have refilled, as they are the same as new
+// buckets.
+func (s *memoryRateLimitStore) cleanup(now time.Time) {
+	if now.Sub(s.cleanedAt) < rateLimitCleanupInterval {
+		return
+	}
+	s.cleanedAt = now
+
+	for key, bucket := range s.buckets {
+		if !now.Before(bucket.fullAt) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// RateLimitRedisClient is the Redis client used by the Redis RateLimitStore.
+type RateLimitRedisClient interface {
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// redisTokenBucketScript takes a token from the bucket stored in KEYS[1].
+// ARGV is the rate in tokens per second, the burst and the current time in
+// milliseconds.
+// It returns whether the request is allowed and the milliseconds until a
+// token is available.
+const redisTokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - updated) / 1000 * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "updated", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, wait}
+`
+
+// redisRateLimitStore stores token buckets in Redis so that they are shared
+// between instances.
+type redisRateLimitStore struct {
+	client RateLimitRedisClient
+	clock  clock.Clock
+}
+
+// NewRedisRateLimitStore creates a RateLimitStore that stores the token
+// buckets in Redis.
+func NewRedisRateLimitStore(client RateLimitRedisClient) RateLimitStore {
+	return &redisRateLimitStore{
+		client: client,
+	}
+}
+
+// Take takes a token from the bucket for the key.
+func (s *redisRateLimitStore) Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	now := s.clock.Now().UnixNano() / int64(time.Millisecond)
+	result, err := s.client.Eval(ctx, redisTokenBucketScript, []string{key}, rate, burst, now)
+	if err != nil {
+		return false, 0, fmt.Errorf("error evaluating rate limit script: %v", err)
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected rate limit script result: %v", result)
+	}
+	allowed, ok := values[0].(int64)
+	if !ok {
+		return false, 0, fmt.Errorf("unexpected rate limit script result: %v", result)
+	}
+	wait, ok := values[1].(int64)
+	if !ok {
+		return false, 0, fmt.Errorf("unexpected rate limit script result: %v", result)
+	}
+
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+// registerRateLimitedRequestsCounter registers 'oauth2_proxy_rate_limited_requests_total'
+// This keeps a tally of the requests rejected by rate limits
+func registerRateLimitedRequestsCounter(registerer prometheus.Registerer) *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "oauth2_proxy_rate_limited_requests_total",
+			Help: "Total number of requests rejected by rate limits by upstream and rate limit key.",
+		},
+		[]string{"upstream", "key"},
+	)
+
+	if err := registerer.Register(counter); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counter = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			panic(err)
+		}
+	}
+
+	return counter
+}
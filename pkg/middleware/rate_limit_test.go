@@ -0,0 +1,240 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testRateLimitRedisClient adapts a go-redis client to the
+// RateLimitRedisClient interface
+type testRateLimitRedisClient struct {
+	*redis.Client
+}
+
+func (c *testRateLimitRedisClient) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	return c.Client.Eval(ctx, script, keys, args...).Result()
+}
+
+var _ = Describe("Rate Limit Suite", func() {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type rateLimitTableInput struct {
+		key            string
+		session        *sessionsapi.SessionState
+		remoteAddr     string
+		otherSession   *sessionsapi.SessionState
+		otherAddr      string
+		expectedShared bool
+	}
+
+	DescribeTable("should limit requests by key",
+		func(in rateLimitTableInput) {
+			registry := prometheus.NewRegistry()
+			handler := NewRateLimit(RateLimitOpts{
+				Upstream:   "app",
+				RateLimit:  options.RateLimit{Requests: 1, Key: in.key},
+				Store:      NewMemoryRateLimitStore(),
+				Writer:     &pagewriter.WriterFuncs{},
+				Registerer: registry,
+			})(testHandler())
+
+			serve := func(session *sessionsapi.SessionState, remoteAddr string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("", "/", nil)
+				req.RemoteAddr = remoteAddr
+				req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{Session: session})
+				rw := httptest.NewRecorder()
+				handler.ServeHTTP(rw, req)
+				return rw
+			}
+
+			Expect(serve(in.session, in.remoteAddr).Code).To(Equal(http.StatusOK))
+
+			rw := serve(in.session, in.remoteAddr)
+			Expect(rw.Code).To(Equal(http.StatusTooManyRequests))
+			Expect(rw.Header().Get("Retry-After")).To(Equal("1"))
+			Expect(rw.Body.String()).To(Equal("429 - rate limit of upstream \"app\" exceeded"))
+
+			other := serve(in.otherSession, in.otherAddr)
+			if in.expectedShared {
+				Expect(other.Code).To(Equal(http.StatusTooManyRequests))
+			} else {
+				Expect(other.Code).To(Equal(http.StatusOK))
+			}
+
+			counter, err := registry.Gather()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(counter).To(HaveLen(1))
+			Expect(counter[0].GetName()).To(Equal("oauth2_proxy_rate_limited_requests_total"))
+		},
+		Entry("with a user key", rateLimitTableInput{
+			key:            options.UserRateLimitKey,
+			session:        &sessionsapi.SessionState{User: "alice"},
+			remoteAddr:     "10.0.0.1:1234",
+			otherSession:   &sessionsapi.SessionState{User: "bob"},
+			otherAddr:      "10.0.0.1:1234",
+			expectedShared: false,
+		}),
+		Entry("with the default key and no session", rateLimitTableInput{
+			key:            "",
+			remoteAddr:     "10.0.0.1:1234",
+			otherAddr:      "10.0.0.2:1234",
+			expectedShared: false,
+		}),
+		Entry("with an ip key", rateLimitTableInput{
+			key:            options.IPRateLimitKey,
+			session:        &sessionsapi.SessionState{User: "alice"},
+			remoteAddr:     "10.0.0.1:1234",
+			otherSession:   &sessionsapi.SessionState{User: "bob"},
+			otherAddr:      "10.0.0.1:5678",
+			expectedShared: true,
+		}),
+		Entry("with a route key", rateLimitTableInput{
+			key:            options.RouteRateLimitKey,
+			session:        &sessionsapi.SessionState{User: "alice"},
+			remoteAddr:     "10.0.0.1:1234",
+			otherSession:   &sessionsapi.SessionState{User: "bob"},
+			otherAddr:      "10.0.0.2:1234",
+			expectedShared: true,
+		}),
+	)
+
+	It("counts throttled requests", func() {
+		registry := prometheus.NewRegistry()
+		handler := NewRateLimit(RateLimitOpts{
+			Upstream:   "app",
+			RateLimit:  options.RateLimit{Requests: 1, Key: options.RouteRateLimitKey},
+			Store:      NewMemoryRateLimitStore(),
+			Writer:     &pagewriter.WriterFuncs{},
+			Registerer: registry,
+		})(testHandler())
+
+		for i := 0; i < 3; i++ {
+			req := httptest.NewRequest("", "/", nil)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		counter := registerRateLimitedRequestsCounter(registry)
+		Expect(testutil.ToFloat64(counter.WithLabelValues("app", options.RouteRateLimitKey))).To(Equal(2.0))
+	})
+
+	It("allows requests when the store fails", func() {
+		mr, err := miniredis.Run()
+		Expect(err).ToNot(HaveOccurred())
+		client := &testRateLimitRedisClient{redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+		defer client.Close()
+		mr.Close()
+
+		handler := NewRateLimit(RateLimitOpts{
+			Upstream:   "app",
+			RateLimit:  options.RateLimit{Requests: 1},
+			Store:      NewRedisRateLimitStore(client),
+			Writer:     &pagewriter.WriterFuncs{},
+			Registerer: prometheus.NewRegistry(),
+		})(testHandler())
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("", "/", nil))
+		Expect(rw.Code).To(Equal(http.StatusOK))
+	})
+
+	Context("Memory store", func() {
+		It("refills tokens over time", func() {
+			store := NewMemoryRateLimitStore().(*memoryRateLimitStore)
+			store.clock.Set(now)
+			ctx := context.Background()
+
+			// 2 tokens per second, burst of 2
+			for i := 0; i < 2; i++ {
+				allowed, _, err := store.Take(ctx, "key", 2, 2)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(allowed).To(BeTrue())
+			}
+			allowed, wait, err := store.Take(ctx, "key", 2, 2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allowed).To(BeFalse())
+			Expect(wait).To(Equal(500 * time.Millisecond))
+
+			Expect(store.clock.Add(500 * time.Millisecond)).To(Succeed())
+			allowed, _, err = store.Take(ctx, "key", 2, 2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allowed).To(BeTrue())
+		})
+
+		It("removes full buckets", func() {
+			store := NewMemoryRateLimitStore().(*memoryRateLimitStore)
+			store.clock.Set(now)
+			ctx := context.Background()
+
+			_, _, err := store.Take(ctx, "key", 1, 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(store.buckets).To(HaveKey("key"))
+
+			Expect(store.clock.Add(2 * rateLimitCleanupInterval)).To(Succeed())
+			_, _, err = store.Take(ctx, "other", 1, 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(store.buckets).ToNot(HaveKey("key"))
+		})
+	})
+
+	Context("Redis store", func() {
+		var mr *miniredis.Miniredis
+		var client *testRateLimitRedisClient
+
+		BeforeEach(func() {
+			var err error
+			mr, err = miniredis.Run()
+			Expect(err).ToNot(HaveOccurred())
+			client = &testRateLimitRedisClient{redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+		})
+
+		AfterEach(func() {
+			Expect(client.Close()).To(Succeed())
+			mr.Close()
+		})
+
+		It("shares tokens between stores", func() {
+			store := NewRedisRateLimitStore(client).(*redisRateLimitStore)
+			store.clock.Set(now)
+			other := NewRedisRateLimitStore(client).(*redisRateLimitStore)
+			other.clock.Set(now)
+			ctx := context.Background()
+
+			allowed, _, err := store.Take(ctx, "key", 1, 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allowed).To(BeTrue())
+
+			allowed, wait, err := other.Take(ctx, "key", 1, 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allowed).To(BeFalse())
+			Expect(wait).To(Equal(time.Second))
+
+			Expect(other.clock.Add(time.Second)).To(Succeed())
+			allowed, _, err = other.Take(ctx, "key", 1, 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allowed).To(BeTrue())
+		})
+
+		It("expires buckets", func() {
+			store := NewRedisRateLimitStore(client).(*redisRateLimitStore)
+			store.clock.Set(now)
+
+			_, _, err := store.Take(context.Background(), "key", 1, 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mr.TTL("key")).To(Equal(2 * time.Second))
+		})
+	})
+})
@@ -0,0 +1,208 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/justinas/alice"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+const (
+	// readinessCheckTimeout is the maximum time a single readiness check may
+	// take before it is reported as failed.
+	readinessCheckTimeout = 5 * time.Second
+
+	// minReadinessCacheDuration is the shortest time the results of the checks
+	// are reused for, so that probes can't overload the dependencies.
+	minReadinessCacheDuration = time.Second
+
+	readinessStatusOK    = "ok"
+	readinessStatusError = "error"
+
+	// shutdownCheckName is the name of the check that fails once the server
+	// is shutting down.
+	shutdownCheckName = "shutdown"
+)
+
+// ReadinessCheck is a dependency that must be reachable for the server to be
+// ready to serve requests.
+type ReadinessCheck struct {
+	// Name identifies the check in the response.
+	Name string
+
+	// Check returns an error if the dependency is not ready.
+	Check func(ctx context.Context) error
+
+	// Optional checks are reported in the response, but do not fail the
+	// readiness check.
+	Optional bool
+}
+
+// ReadinessCheckOpts contains the information required to set up the
+// readiness check.
+type ReadinessCheckOpts struct {
+	// Path is the path the readiness check is served on.
+	// The readiness check is disabled when empty.
+	Path string
+
+	// Checks are run to determine whether the server is ready.
+	Checks []ReadinessCheck
+
+	// CacheDuration is how long the results of the checks are reused for, so
+	// that frequent probes do not overload the dependencies.
+	// Durations shorter than a second are raised to a second.
+	CacheDuration time.Duration
+
+	// ShuttingDown is closed once the server starts shutting down, so that
+	// load balancers stop sending new requests while in-flight requests are
+	// given time to finish.
+	ShuttingDown <-chan struct{}
+}
+
+// readinessCheckResult is the result of a single check in the response.
+// The errors of failed checks are logged rather than returned, as the
+// readiness check is served without authentication.
+type readinessCheckResult struct {
+	Status string `json:"status"`
+
+	optional bool
+}
+
+// readinessResponse is the response of the readiness check.
+type readinessResponse struct {
+	Status string                          `json:"status"`
+	Checks map[string]readinessCheckResult `json:"checks"`
+}
+
+// NewReadinessCheck creates a new middleware that answers readiness checks on
+// the configured path.
+// Unlike the health check, which only shows that the server is alive, the
+// readiness check fails when any of the required checks fail or the server is
+// shutting down.
+func NewReadinessCheck(opts ReadinessCheckOpts) alice.Constructor {
+	cacheDuration := opts.CacheDuration
+	if cacheDuration < minReadinessCacheDuration {
+		cacheDuration = minReadinessCacheDuration
+	}
+
+	r := &readinessChecker{
+		checks:        opts.Checks,
+		cacheDuration: cacheDuration,
+		shuttingDown:  opts.ShuttingDown,
+	}
+	return func(next http.Handler) http.Handler {
+		return readinessCheck(opts.Path, r, next)
+	}
+}
+
+func readinessCheck(path string, r *readinessChecker, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if path == "" || req.URL.EscapedPath() != path {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		response := r.status()
+		rw.Header().Set("Content-Type", "application/json")
+		if response.Status == readinessStatusOK {
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(rw).Encode(response); err != nil {
+			logger.Errorf("Error encoding readiness response: %v", err)
+		}
+	})
+}
+
+// readinessChecker runs the readiness checks and caches their results.
+type readinessChecker struct {
+	checks        []ReadinessCheck
+	cacheDuration time.Duration
+	shuttingDown  <-chan struct{}
+
+	clock clock.Clock
+
+	// mu is held while the checks run, so that concurrent probes share a
+	// single run of the checks
+	mu        sync.Mutex
+	results   map[string]readinessCheckResult
+	checkedAt time.Time
+}
+
+// status returns the readiness of the server.
+// The shutdown state is never cached, so that load balancers are told about
+// a shutdown straight away.
+func (r *readinessChecker) status() readinessResponse {
+	response := readinessResponse{
+		Status: readinessStatusOK,
+		Checks: make(map[string]readinessCheckResult),
+	}
+	for name, result := range r.cachedResults() {
+		response.Checks[name] = result
+	}
+
+	select {
+	case <-r.shuttingDown:
+		response.Checks[shutdownCheckName] = readinessCheckResult{Status: readinessStatusError}
+	default:
+		response.Checks[shutdownCheckName] = readinessCheckResult{Status: readinessStatusOK}
+	}
+
+	for _, result := range response.Checks {
+		if result.Status != readinessStatusOK && !result.optional {
+			response.Status = readinessStatusError
+		}
+	}
+	return response
+}
+
+// cachedResults returns the results of the checks, running them again if the
+// cached results have expired.
+func (r *readinessChecker) cachedResults() map[string]readinessCheckResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.results != nil && r.clock.Since(r.checkedAt) < r.cacheDuration {
+		return r.results
+	}
+
+	r.results = r.runChecks()
+	r.checkedAt = r.clock.Now()
+	return r.results
+}
+
+// runChecks runs all of the checks concurrently.
+// The results are shared between probes, so the checks are not cancelled
+// when the probe that triggered them disconnects.
+func (r *readinessChecker) runChecks() map[string]readinessCheckResult {
+	ctx, cancel := context.WithTimeout(context.Background(), readinessCheckTimeout)
+	defer cancel()
+
+	errs := make([]error, len(r.checks))
+	var wg sync.WaitGroup
+	for i, check := range r.checks {
+		wg.Add(1)
+		go func(i int, check ReadinessCheck) {
+			defer wg.Done()
+			errs[i] = check.Check(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	results := make(map[string]readinessCheckResult, len(r.checks))
+	for i, check := range r.checks {
+		if errs[i] != nil {
+			logger.Errorf("Readiness check %q failed: %v", check.Name, errs[i])
+			results[check.Name] = readinessCheckResult{Status: readinessStatusError, optional: check.Optional}
+			continue
+		}
+		results[check.Name] = readinessCheckResult{Status: readinessStatusOK, optional: check.Optional}
+	}
+	return results
+}
@@ -0,0 +1,184 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ReadinessCheck suite", func() {
+	passingCheck := ReadinessCheck{
+		Name:  "passing",
+		Check: func(context.Context) error { return nil },
+	}
+	failingCheck := ReadinessCheck{
+		Name:  "failing",
+		Check: func(context.Context) error { return errors.New("dependency unavailable") },
+	}
+	optionalCheck := ReadinessCheck{
+		Name:     "optional",
+		Check:    func(context.Context) error { return errors.New("dependency unavailable") },
+		Optional: true,
+	}
+
+	type requestTableInput struct {
+		readyPath      string
+		checks         []ReadinessCheck
+		shuttingDown   bool
+		requestString  string
+		expectedStatus int
+		expectedBody   string
+	}
+
+	DescribeTable("when serving a request",
+		func(in *requestTableInput) {
+			req := httptest.NewRequest("", in.requestString, nil)
+			rw := httptest.NewRecorder()
+
+			shuttingDown := make(chan struct{})
+			if in.shuttingDown {
+				close(shuttingDown)
+			}
+
+			handler := NewReadinessCheck(ReadinessCheckOpts{
+				Path:         in.readyPath,
+				Checks:       in.checks,
+				ShuttingDown: shuttingDown,
+			})(http.NotFoundHandler())
+			handler.ServeHTTP(rw, req)
+
+			Expect(rw.Code).To(Equal(in.expectedStatus))
+			Expect(rw.Body.String()).To(Equal(in.expectedBody))
+		},
+		Entry("when no ready path is configured", &requestTableInput{
+			readyPath:      "",
+			requestString:  "http://example.com/ready",
+			expectedStatus: 404,
+			expectedBody:   "404 page not found\n",
+		}),
+		Entry("when requesting the ready path", &requestTableInput{
+			readyPath:      "/ready",
+			requestString:  "http://example.com/ready",
+			expectedStatus: 200,
+			expectedBody:   `{"status":"ok","checks":{"shutdown":{"status":"ok"}}}` + "\n",
+		}),
+		Entry("when requesting the ready path with passing checks", &requestTableInput{
+			readyPath:      "/ready",
+			checks:         []ReadinessCheck{passingCheck},
+			requestString:  "http://example.com/ready",
+			expectedStatus: 200,
+			expectedBody:   `{"status":"ok","checks":{"passing":{"status":"ok"},"shutdown":{"status":"ok"}}}` + "\n",
+		}),
+		Entry("when requesting the ready path with a failing check", &requestTableInput{
+			readyPath:      "/ready",
+			checks:         []ReadinessCheck{passingCheck, failingCheck},
+			requestString:  "http://example.com/ready",
+			expectedStatus: 503,
+			expectedBody:   `{"status":"error","checks":{"failing":{"status":"error"},"passing":{"status":"ok"},"shutdown":{"status":"ok"}}}` + "\n",
+		}),
+		Entry("when requesting the ready path with a failing optional check", &requestTableInput{
+			readyPath:      "/ready",
+			checks:         []ReadinessCheck{passingCheck, optionalCheck},
+			requestString:  "http://example.com/ready",
+			expectedStatus: 200,
+			expectedBody:   `{"status":"ok","checks":{"optional":{"status":"error"},"passing":{"status":"ok"},"shutdown":{"status":"ok"}}}` + "\n",
+		}),
+		Entry("when requesting the ready path while shutting down", &requestTableInput{
+			readyPath:      "/ready",
+			checks:         []ReadinessCheck{passingCheck},
+			shuttingDown:   true,
+			requestString:  "http://example.com/ready",
+			expectedStatus: 503,
+			expectedBody:   `{"status":"error","checks":{"passing":{"status":"ok"},"shutdown":{"status":"error"}}}` + "\n",
+		}),
+		Entry("when requesting a different path while shutting down", &requestTableInput{
+			readyPath:      "/ready",
+			shuttingDown:   true,
+			requestString:  "http://example.com/different",
+			expectedStatus: 404,
+			expectedBody:   "404 page not found\n",
+		}),
+	)
+
+	It("reuses the results for at least the minimum cache duration", func() {
+		calls := 0
+		handler := NewReadinessCheck(ReadinessCheckOpts{
+			Path: "/ready",
+			Checks: []ReadinessCheck{{
+				Name: "counting",
+				Check: func(context.Context) error {
+					calls++
+					return nil
+				},
+			}},
+		})(http.NotFoundHandler())
+
+		for i := 0; i < 2; i++ {
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest("", "http://example.com/ready", nil))
+			Expect(rw.Code).To(Equal(http.StatusOK))
+		}
+		Expect(calls).To(Equal(1))
+	})
+
+	Context("with a cache duration", func() {
+		var calls int
+		var checkErr error
+		var shuttingDown chan struct{}
+		var checker *readinessChecker
+		var handler http.Handler
+
+		BeforeEach(func() {
+			calls = 0
+			checkErr = nil
+			shuttingDown = make(chan struct{})
+			checker = &readinessChecker{
+				checks: []ReadinessCheck{{
+					Name: "counting",
+					Check: func(context.Context) error {
+						calls++
+						return checkErr
+					},
+				}},
+				cacheDuration: time.Minute,
+				shuttingDown:  shuttingDown,
+			}
+			checker.clock.Set(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+			handler = readinessCheck("/ready", checker, http.NotFoundHandler())
+		})
+
+		probe := func() int {
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest("", "http://example.com/ready", nil))
+			return rw.Code
+		}
+
+		It("reuses the results until the cache duration has passed", func() {
+			Expect(probe()).To(Equal(http.StatusOK))
+			Expect(calls).To(Equal(1))
+
+			checkErr = errors.New("dependency unavailable")
+			Expect(checker.clock.Add(30 * time.Second)).To(Succeed())
+			Expect(probe()).To(Equal(http.StatusOK))
+			Expect(calls).To(Equal(1))
+
+			Expect(checker.clock.Add(30 * time.Second)).To(Succeed())
+			Expect(probe()).To(Equal(http.StatusServiceUnavailable))
+			Expect(calls).To(Equal(2))
+		})
+
+		It("does not cache the shutdown state", func() {
+			Expect(probe()).To(Equal(http.StatusOK))
+
+			close(shuttingDown)
+			Expect(probe()).To(Equal(http.StatusServiceUnavailable))
+			Expect(calls).To(Equal(1))
+		})
+	})
+})
@@ -31,6 +31,22 @@ type StoredSessionLoaderOptions struct {
 	// If the sesssion is older than `RefreshPeriod` but the provider doesn't
 	// refresh it, we must re-validate using this validation.
 	ValidateSession func(context.Context, *sessionsapi.SessionState) bool
+
+	// Optional check that the request comes from the client the session is
+	// bound to. An error implies the session should be rejected.
+	VerifySessionBinding func(*http.Request, *sessionsapi.SessionState) error
+
+	// How long a session may be unused before it is rejected.
+	// Zero disables the idle timeout.
+	IdleTimeout time.Duration
+
+	// How often the last activity of the session should be saved, this limits
+	// the number of writes to the session store when an idle timeout is set.
+	ActivityUpdateInterval time.Duration
+
+	// How long after the user signed in the session is rejected, regardless
+	// of refreshes. Zero disables the limit.
+	MaxLifetime time.Duration
 }
 
 // NewStoredSessionLoader creates a new storedSessionLoader which loads
@@ -43,6 +59,10 @@ func NewStoredSessionLoader(opts *StoredSessionLoaderOptions) alice.Constructor
 		refreshPeriod:    opts.RefreshPeriod,
 		sessionRefresher: opts.RefreshSession,
 		sessionValidator: opts.ValidateSession,
+		bindingVerifier:  opts.VerifySessionBinding,
+		idleTimeout:      opts.IdleTimeout,
+		activityInterval: opts.ActivityUpdateInterval,
+		maxLifetime:      opts.MaxLifetime,
 	}
 	return ss.loadSession
 }
@@ -54,6 +74,10 @@ type storedSessionLoader struct {
 	refreshPeriod    time.Duration
 	sessionRefresher func(context.Context, *sessionsapi.SessionState) (bool, error)
 	sessionValidator func(context.Context, *sessionsapi.SessionState) bool
+	bindingVerifier  func(*http.Request, *sessionsapi.SessionState) error
+	idleTimeout      time.Duration
+	activityInterval time.Duration
+	maxLifetime      time.Duration
 }
 
 // loadSession attempts to load a session as identified by the request cookies.
@@ -99,14 +123,72 @@ func (s *storedSessionLoader) getValidatedSession(rw http.ResponseWriter, req *h
 		return nil, nil
 	}
 
+	if s.bindingVerifier != nil {
+		if err := s.bindingVerifier(req, session); err != nil {
+			return nil, fmt.Errorf("session (%s) is not valid for this client: %v", session, err)
+		}
+	}
+
+	err = s.checkSessionTimeouts(session)
+	if err != nil {
+		return nil, fmt.Errorf("session (%s) has timed out: %v", session, err)
+	}
+
 	err = s.refreshSessionIfNeeded(rw, req, session)
 	if err != nil {
 		return nil, fmt.Errorf("error refreshing access token for session (%s): %v", session, err)
 	}
 
+	// The session was loaded with an old cookie secret or its activity was
+	// updated (and it wasn't saved by a refresh), save it again
+	if session.NeedsResave {
+		err = s.saveSession(rw, req, session)
+		if err != nil {
+			// The session is still valid, it will be re-saved on a later request
+			logger.Errorf("Unable to re-save session: %v", err)
+		}
+	}
+
 	return session, nil
 }
 
+// checkSessionTimeouts rejects sessions that have been idle for longer than
+// the idle timeout or that were signed in longer ago than the max lifetime.
+// If the session is still valid, its last activity is updated when it is
+// older than the activity update interval.
+func (s *storedSessionLoader) checkSessionTimeouts(session *sessionsapi.SessionState) error {
+	if s.maxLifetime > time.Duration(0) {
+		if session.SignedInAt == nil || session.SignedInAt.IsZero() {
+			// Sessions created before the max lifetime was configured start
+			// their lifetime from their last refresh. The sign in time is
+			// copied and saved once, so that later refreshes don't extend it.
+			// Sessions without either time can't be limited, so are expired.
+			if session.CreatedAt == nil || session.CreatedAt.IsZero() {
+				return errors.New("session has no sign in time to check the maximum lifetime against")
+			}
+			signedInAt := *session.CreatedAt
+			session.SignedInAt = &signedInAt
+			session.NeedsResave = true
+		}
+		if session.SinceSignIn() > s.maxLifetime {
+			return fmt.Errorf("session exceeded the maximum lifetime of %s", s.maxLifetime)
+		}
+	}
+
+	if s.idleTimeout <= time.Duration(0) {
+		return nil
+	}
+	if session.IdleTime() > s.idleTimeout {
+		return fmt.Errorf("session was idle for longer than %s", s.idleTimeout)
+	}
+	if session.LastActivity == nil || session.IdleTime() >= s.activityInterval {
+		now := session.Clock.Now()
+		session.LastActivity = &now
+		session.NeedsResave = true
+	}
+	return nil
+}
+
 // refreshSessionIfNeeded will attempt to refresh a session if the session
 // is older than the refresh period.
 // Success or fail, we will then validate the session.
@@ -156,11 +238,17 @@ func (s *storedSessionLoader) refreshSession(rw http.ResponseWriter, req *http.R
 	session.CreatedAtNow()
 
 	// Because the session was refreshed, make sure to save it
-	err = s.store.Save(rw, req, session)
+	return s.saveSession(rw, req, session)
+}
+
+// saveSession persists the session to the session store.
+func (s *storedSessionLoader) saveSession(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) error {
+	err := s.store.Save(rw, req, session)
 	if err != nil {
 		logger.PrintAuthf(session.Email, req, logger.AuthError, "error saving session: %v", err)
 		return fmt.Errorf("error saving session: %v", err)
 	}
+	session.NeedsResave = false
 	return nil
 }
 
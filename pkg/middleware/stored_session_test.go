@@ -81,6 +81,13 @@ var _ = Describe("Stored Session Suite", func() {
 						CreatedAt:    &createdPast,
 						ExpiresOn:    &createdFuture,
 					}, nil
+				case "_oauth2_proxy=RotatedSecretSession":
+					return &sessionsapi.SessionState{
+						RefreshToken: noRefresh,
+						CreatedAt:    &createdPast,
+						ExpiresOn:    &createdFuture,
+						NeedsResave:  true,
+					}, nil
 				case "_oauth2_proxy=NonExistent":
 					return nil, fmt.Errorf("invalid cookie")
 				default:
@@ -254,6 +261,22 @@ var _ = Describe("Stored Session Suite", func() {
 				refreshSession:  defaultRefreshFunc,
 				validateSession: func(context.Context, *sessionsapi.SessionState) bool { return false },
 			}),
+			Entry("with a session loaded with an old cookie secret", storedSessionLoaderTableInput{
+				requestHeaders: http.Header{
+					"Cookie": []string{"_oauth2_proxy=RotatedSecretSession"},
+				},
+				existingSession: nil,
+				expectedSession: &sessionsapi.SessionState{
+					RefreshToken: noRefresh,
+					CreatedAt:    &createdPast,
+					ExpiresOn:    &createdFuture,
+					NeedsResave:  false,
+				},
+				store:           defaultSessionStore,
+				refreshPeriod:   10 * time.Minute,
+				refreshSession:  defaultRefreshFunc,
+				validateSession: defaultValidateFunc,
+			}),
 			Entry("when the session is not refreshed and is no longer valid", storedSessionLoaderTableInput{
 				requestHeaders: http.Header{
 					"Cookie": []string{"_oauth2_proxy=InvalidNoRefreshSession"},
@@ -491,6 +514,119 @@ var _ = Describe("Stored Session Suite", func() {
 		)
 	})
 
+	Context("checkSessionTimeouts", func() {
+		type checkSessionTimeoutsTableInput struct {
+			idleTimeout        time.Duration
+			maxLifetime        time.Duration
+			session            *sessionsapi.SessionState
+			expectedErr        error
+			expectActivitySave bool
+		}
+
+		now := time.Now()
+		minutesAgo := func(m int) *time.Time {
+			t := now.Add(time.Duration(-m) * time.Minute)
+			return &t
+		}
+
+		DescribeTable("with a session",
+			func(in checkSessionTimeoutsTableInput) {
+				s := &storedSessionLoader{
+					idleTimeout:      in.idleTimeout,
+					activityInterval: time.Minute,
+					maxLifetime:      in.maxLifetime,
+				}
+				lastActivity := in.session.LastActivity
+
+				err := s.checkSessionTimeouts(in.session)
+				if in.expectedErr != nil {
+					Expect(err).To(MatchError(in.expectedErr))
+					return
+				}
+				Expect(err).ToNot(HaveOccurred())
+				Expect(in.session.NeedsResave).To(Equal(in.expectActivitySave))
+				if in.expectActivitySave {
+					Expect(in.session.LastActivity).ToNot(Equal(lastActivity))
+				} else {
+					Expect(in.session.LastActivity).To(Equal(lastActivity))
+				}
+			},
+			Entry("when timeouts are disabled", checkSessionTimeoutsTableInput{
+				session: &sessionsapi.SessionState{
+					SignedInAt:   minutesAgo(600),
+					LastActivity: minutesAgo(600),
+				},
+			}),
+			Entry("when the session is within the idle timeout and was recently active", checkSessionTimeoutsTableInput{
+				idleTimeout: 30 * time.Minute,
+				session: &sessionsapi.SessionState{
+					LastActivity: &now,
+				},
+			}),
+			Entry("when the session is within the idle timeout and activity is stale", checkSessionTimeoutsTableInput{
+				idleTimeout: 30 * time.Minute,
+				session: &sessionsapi.SessionState{
+					LastActivity: minutesAgo(10),
+				},
+				expectActivitySave: true,
+			}),
+			Entry("when the session has no recorded activity", checkSessionTimeoutsTableInput{
+				idleTimeout:        30 * time.Minute,
+				session:            &sessionsapi.SessionState{},
+				expectActivitySave: true,
+			}),
+			Entry("when the session has been idle for too long", checkSessionTimeoutsTableInput{
+				idleTimeout: 30 * time.Minute,
+				session: &sessionsapi.SessionState{
+					LastActivity: minutesAgo(31),
+				},
+				expectedErr: errors.New("session was idle for longer than 30m0s"),
+			}),
+			Entry("when the session is within the max lifetime", checkSessionTimeoutsTableInput{
+				maxLifetime: 8 * time.Hour,
+				session: &sessionsapi.SessionState{
+					SignedInAt: minutesAgo(60),
+				},
+			}),
+			Entry("when the session exceeded the max lifetime", checkSessionTimeoutsTableInput{
+				maxLifetime: 8 * time.Hour,
+				session: &sessionsapi.SessionState{
+					// A recent refresh does not extend the lifetime
+					CreatedAt:  minutesAgo(1),
+					SignedInAt: minutesAgo(481),
+				},
+				expectedErr: errors.New("session exceeded the maximum lifetime of 8h0m0s"),
+			}),
+		)
+
+		It("starts the lifetime of sessions without a sign in time from their creation", func() {
+			s := &storedSessionLoader{maxLifetime: 8 * time.Hour}
+			session := &sessionsapi.SessionState{CreatedAt: minutesAgo(481)}
+
+			Expect(s.checkSessionTimeouts(session)).To(MatchError("session exceeded the maximum lifetime of 8h0m0s"))
+			Expect(session.SignedInAt).To(Equal(session.CreatedAt))
+		})
+
+		It("keeps the sign in time of sessions without one when they are refreshed", func() {
+			s := &storedSessionLoader{maxLifetime: 8 * time.Hour}
+			session := &sessionsapi.SessionState{CreatedAt: minutesAgo(60)}
+
+			Expect(s.checkSessionTimeouts(session)).To(Succeed())
+			Expect(session.NeedsResave).To(BeTrue())
+
+			// A refresh resets the creation time but not the sign in time
+			*session.CreatedAt = now
+			Expect(session.SignedInAt).To(Equal(minutesAgo(60)))
+		})
+
+		It("expires sessions without a sign in or creation time", func() {
+			s := &storedSessionLoader{maxLifetime: 8 * time.Hour}
+			session := &sessionsapi.SessionState{}
+
+			Expect(s.checkSessionTimeouts(session)).To(MatchError("session has no sign in time to check the maximum lifetime against"))
+		})
+	})
+
 	Context("validateSession", func() {
 		var s *storedSessionLoader
 
@@ -564,3 +700,7 @@ func (f *fakeSessionStore) Clear(rw http.ResponseWriter, req *http.Request) erro
 	}
 	return nil
 }
+
+func (f *fakeSessionStore) VerifyConnection(_ context.Context) error {
+	return nil
+}
@@ -0,0 +1,108 @@
+package util
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Forwarded is the standardized header for proxied requests, as specified by
+// RFC 7239.
+const Forwarded = "Forwarded"
+
+// ForwardedElement is a single element of the Forwarded header, added by one
+// of the proxies a request passed through.
+type ForwardedElement struct {
+	// For is the client that made the request to the proxy.
+	For string
+	// By is the interface of the proxy that received the request.
+	By string
+	// Host is the Host header of the request received by the proxy.
+	Host string
+	// Proto is the protocol of the request received by the proxy.
+	Proto string
+}
+
+// GetForwarded parses the elements of the Forwarded headers, in the order they
+// were added by the proxies.
+// Unknown parameters and malformed pairs are ignored.
+func GetForwarded(h http.Header) []ForwardedElement {
+	elements := []ForwardedElement{}
+	for _, value := range h.Values(Forwarded) {
+		for _, element := range splitQuoted(value, ',') {
+			if strings.TrimSpace(element) == "" {
+				continue
+			}
+
+			var e ForwardedElement
+			for _, pair := range splitQuoted(element, ';') {
+				i := strings.IndexByte(pair, '=')
+				if i < 0 {
+					continue
+				}
+				name := strings.ToLower(strings.TrimSpace(pair[:i]))
+				value := unquote(strings.TrimSpace(pair[i+1:]))
+				switch name {
+				case "for":
+					e.For = value
+				case "by":
+					e.By = value
+				case "host":
+					e.Host = value
+				case "proto":
+					e.Proto = strings.ToLower(value)
+				}
+			}
+			elements = append(elements, e)
+		}
+	}
+	return elements
+}
+
+// getForwardedValue returns the first non-empty value of the Forwarded
+// elements, which was set by the proxy closest to the client.
+func getForwardedValue(h http.Header, value func(ForwardedElement) string) string {
+	for _, e := range GetForwarded(h) {
+		if v := value(e); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// splitQuoted splits s around each sep that is not within a quoted string.
+func splitQuoted(s string, sep byte) []string {
+	parts := []string{}
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case inQuotes && s[i] == '\\':
+			// Skip the escaped character
+			i++
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote removes the quotes and escapes from a quoted string.
+// Values that are not quoted are returned unchanged.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+
+	var b strings.Builder
+	s = s[1 : len(s)-1]
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -14,8 +14,13 @@ const (
 
 // GetRequestProto returns the request scheme or X-Forwarded-Proto if present
 // and the request is proxied.
+// The proto of the Forwarded header is used when X-Forwarded-Proto is not
+// present.
 func GetRequestProto(req *http.Request) string {
 	proto := req.Header.Get(XForwardedProto)
+	if proto == "" {
+		proto = getForwardedValue(req.Header, func(e ForwardedElement) string { return e.Proto })
+	}
 	if !IsProxied(req) || proto == "" {
 		proto = req.URL.Scheme
 	}
@@ -24,8 +29,13 @@ func GetRequestProto(req *http.Request) string {
 
 // GetRequestHost returns the request host header or X-Forwarded-Host if
 // present and the request is proxied.
+// The host of the Forwarded header is used when X-Forwarded-Host is not
+// present.
 func GetRequestHost(req *http.Request) string {
 	host := req.Header.Get(XForwardedHost)
+	if host == "" {
+		host = getForwardedValue(req.Header, func(e ForwardedElement) string { return e.Host })
+	}
 	if !IsProxied(req) || host == "" {
 		host = req.Host
 	}
@@ -58,6 +58,17 @@ var _ = Describe("Util Suite", func() {
 				req.Header.Add("X-Forwarded-Host", "external.oauth2proxy.text")
 				Expect(util.GetRequestHost(req)).To(Equal("external.oauth2proxy.text"))
 			})
+
+			It("returns the Forwarded host if X-Forwarded-Host is not present", func() {
+				req.Header.Add("Forwarded", "for=1.2.3.4;host=external.oauth2proxy.text, for=10.0.0.1;host=internal.oauth2proxy.text")
+				Expect(util.GetRequestHost(req)).To(Equal("external.oauth2proxy.text"))
+			})
+
+			It("prefers the X-Forwarded-Host to the Forwarded host", func() {
+				req.Header.Add("X-Forwarded-Host", "external.oauth2proxy.text")
+				req.Header.Add("Forwarded", "host=other.oauth2proxy.text")
+				Expect(util.GetRequestHost(req)).To(Equal("external.oauth2proxy.text"))
+			})
 		})
 	})
 
@@ -75,6 +86,11 @@ var _ = Describe("Util Suite", func() {
 				req.Header.Add("X-Forwarded-Proto", "https")
 				Expect(util.GetRequestProto(req)).To(Equal(proto))
 			})
+
+			It("ignores Forwarded and returns the scheme", func() {
+				req.Header.Add("Forwarded", "proto=https")
+				Expect(util.GetRequestProto(req)).To(Equal(proto))
+			})
 		})
 
 		Context("IsProxied is true", func() {
@@ -92,6 +108,11 @@ var _ = Describe("Util Suite", func() {
 				req.Header.Add("X-Forwarded-Proto", "https")
 				Expect(util.GetRequestProto(req)).To(Equal("https"))
 			})
+
+			It("returns the Forwarded proto if X-Forwarded-Proto is not present", func() {
+				req.Header.Add("Forwarded", "for=1.2.3.4;proto=HTTPS")
+				Expect(util.GetRequestProto(req)).To(Equal("https"))
+			})
 		})
 	})
 
@@ -128,4 +149,28 @@ var _ = Describe("Util Suite", func() {
 			})
 		})
 	})
+
+	Context("GetForwarded", func() {
+		It("parses the elements of the Forwarded headers", func() {
+			h := http.Header{}
+			h.Add("Forwarded", `for=192.0.2.43;Proto=HTTPS;host="app.example.com", for="[2001:db8:cafe::17]:4711"`)
+			h.Add("Forwarded", `for=10.0.0.1;by=10.0.0.2;ext="a,b;c=\"d\""`)
+
+			Expect(util.GetForwarded(h)).To(Equal([]util.ForwardedElement{
+				{For: "192.0.2.43", Proto: "https", Host: "app.example.com"},
+				{For: "[2001:db8:cafe::17]:4711"},
+				{For: "10.0.0.1", By: "10.0.0.2"},
+			}))
+		})
+
+		It("ignores empty elements and malformed pairs", func() {
+			h := http.Header{}
+			h.Add("Forwarded", "for=192.0.2.43;proto, ,for")
+
+			Expect(util.GetForwarded(h)).To(Equal([]util.ForwardedElement{
+				{For: "192.0.2.43"},
+				{},
+			}))
+		})
+	})
 })
@@ -0,0 +1,123 @@
+package binding
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+
+	ipapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// hashSize is the number of bytes of each SHA-256 attribute hash kept in the
+// session. Truncating keeps session cookies small while still making
+// accidental collisions practically impossible.
+const hashSize = 16
+
+// Binder records attributes of the client that created a session and checks
+// that later requests presenting the session come from the same client.
+type Binder struct {
+	opts               options.SessionBindingOptions
+	realClientIPParser ipapi.RealClientIPParser
+}
+
+// NewBinder creates a Binder from the session binding options.
+// The realClientIPParser is used to determine the client IP and may be nil.
+func NewBinder(opts options.SessionBindingOptions, realClientIPParser ipapi.RealClientIPParser) *Binder {
+	return &Binder{
+		opts:               opts,
+		realClientIPParser: realClientIPParser,
+	}
+}
+
+// Enabled returns whether any client attribute is bound to sessions.
+func (b *Binder) Enabled() bool {
+	return b.opts.ClientIP != "" || b.opts.UserAgent != "" || b.opts.ClientCertificate != ""
+}
+
+// Bind records hashes of the configured client attributes on the session.
+// Attributes that are not present on the request (eg. no client certificate)
+// are left unbound.
+func (b *Binder) Bind(req *http.Request, s *sessionsapi.SessionState) {
+	if b.opts.ClientIP != "" {
+		s.ClientIPHash = b.clientIPHash(req)
+	}
+	if b.opts.UserAgent != "" {
+		s.UserAgentHash = userAgentHash(req)
+	}
+	if b.opts.ClientCertificate != "" {
+		s.ClientCertHash = clientCertHash(req)
+	}
+}
+
+// Verify checks the request's client attributes against those recorded on
+// the session.
+// Mismatches are logged and, for attributes bound in enforce mode, an error
+// is returned to indicate the session should be rejected.
+func (b *Binder) Verify(req *http.Request, s *sessionsapi.SessionState) error {
+	checks := []struct {
+		name     string
+		mode     string
+		bound    []byte
+		computed func(*http.Request) []byte
+	}{
+		{name: "client IP", mode: b.opts.ClientIP, bound: s.ClientIPHash, computed: b.clientIPHash},
+		{name: "User-Agent", mode: b.opts.UserAgent, bound: s.UserAgentHash, computed: userAgentHash},
+		{name: "client certificate", mode: b.opts.ClientCertificate, bound: s.ClientCertHash, computed: clientCertHash},
+	}
+
+	for _, check := range checks {
+		// Sessions created before binding was enabled are not bound
+		if check.mode == "" || check.bound == nil {
+			continue
+		}
+		if hmac.Equal(check.bound, check.computed(req)) {
+			continue
+		}
+
+		if check.mode == options.SessionBindingEnforceMode {
+			logger.PrintAuthf(s.Email, req, logger.AuthFailure, "Session %s does not match the request", check.name)
+			return fmt.Errorf("session %s binding mismatch", check.name)
+		}
+		logger.Printf("Session %s does not match the request - User: %s", check.name, s.User)
+	}
+	return nil
+}
+
+// clientIPHash hashes the subnet of the client IP so that clients moving
+// within a network are still accepted.
+func (b *Binder) clientIPHash(req *http.Request) []byte {
+	clientIP, err := ip.GetClientIP(b.realClientIPParser, req)
+	if err != nil || clientIP == nil {
+		return nil
+	}
+
+	var subnet net.IP
+	if ipv4 := clientIP.To4(); ipv4 != nil {
+		subnet = ipv4.Mask(net.CIDRMask(b.opts.ClientIPv4Prefix, 32))
+	} else {
+		subnet = clientIP.Mask(net.CIDRMask(b.opts.ClientIPv6Prefix, 128))
+	}
+	return hash([]byte(subnet))
+}
+
+func userAgentHash(req *http.Request) []byte {
+	return hash([]byte(req.UserAgent()))
+}
+
+func clientCertHash(req *http.Request) []byte {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return hash(req.TLS.PeerCertificates[0].Raw)
+}
+
+func hash(value []byte) []byte {
+	sum := sha256.Sum256(value)
+	return sum[:hashSize]
+}
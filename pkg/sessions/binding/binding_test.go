@@ -0,0 +1,127 @@
+package binding
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Binder", func() {
+	const (
+		createAddr = "192.0.2.10:1234"
+		createUA   = "Mozilla/5.0"
+	)
+
+	type bindingTableInput struct {
+		opts        options.SessionBindingOptions
+		remoteAddr  string
+		userAgent   string
+		clientCert  []byte
+		expectedErr string
+	}
+
+	newBinder := func(opts options.SessionBindingOptions) *Binder {
+		if opts.ClientIPv4Prefix == 0 {
+			opts.ClientIPv4Prefix = 24
+		}
+		if opts.ClientIPv6Prefix == 0 {
+			opts.ClientIPv6Prefix = 64
+		}
+		return NewBinder(opts, nil)
+	}
+
+	DescribeTable("Verify",
+		func(in bindingTableInput) {
+			binder := newBinder(in.opts)
+
+			createReq := httptest.NewRequest("GET", "/", nil)
+			createReq.RemoteAddr = createAddr
+			createReq.Header.Set("User-Agent", createUA)
+			createReq.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{{Raw: []byte("client-cert")}},
+			}
+
+			session := &sessionsapi.SessionState{Email: "user@example.com"}
+			binder.Bind(createReq, session)
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+			req.RemoteAddr = in.remoteAddr
+			req.Header.Set("User-Agent", in.userAgent)
+			if in.clientCert != nil {
+				req.TLS = &tls.ConnectionState{
+					PeerCertificates: []*x509.Certificate{{Raw: in.clientCert}},
+				}
+			}
+
+			err := binder.Verify(req, session)
+			if in.expectedErr != "" {
+				Expect(err).To(MatchError(in.expectedErr))
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+			}
+		},
+		Entry("with binding disabled", bindingTableInput{
+			remoteAddr: "198.51.100.1:1234",
+			userAgent:  "curl/7.0",
+		}),
+		Entry("with a client IP in the same subnet", bindingTableInput{
+			opts:       options.SessionBindingOptions{ClientIP: options.SessionBindingEnforceMode},
+			remoteAddr: "192.0.2.200:4321",
+		}),
+		Entry("with a client IP in a different subnet", bindingTableInput{
+			opts:        options.SessionBindingOptions{ClientIP: options.SessionBindingEnforceMode},
+			remoteAddr:  "192.0.3.10:1234",
+			expectedErr: "session client IP binding mismatch",
+		}),
+		Entry("with a client IP in a different subnet in log mode", bindingTableInput{
+			opts:       options.SessionBindingOptions{ClientIP: options.SessionBindingLogMode},
+			remoteAddr: "192.0.3.10:1234",
+		}),
+		Entry("with a matching User-Agent", bindingTableInput{
+			opts:       options.SessionBindingOptions{UserAgent: options.SessionBindingEnforceMode},
+			remoteAddr: createAddr,
+			userAgent:  createUA,
+		}),
+		Entry("with a different User-Agent", bindingTableInput{
+			opts:        options.SessionBindingOptions{UserAgent: options.SessionBindingEnforceMode},
+			remoteAddr:  createAddr,
+			userAgent:   "curl/7.0",
+			expectedErr: "session User-Agent binding mismatch",
+		}),
+		Entry("with a matching client certificate", bindingTableInput{
+			opts:       options.SessionBindingOptions{ClientCertificate: options.SessionBindingEnforceMode},
+			remoteAddr: createAddr,
+			clientCert: []byte("client-cert"),
+		}),
+		Entry("with a different client certificate", bindingTableInput{
+			opts:        options.SessionBindingOptions{ClientCertificate: options.SessionBindingEnforceMode},
+			remoteAddr:  createAddr,
+			clientCert:  []byte("other-cert"),
+			expectedErr: "session client certificate binding mismatch",
+		}),
+		Entry("with no client certificate", bindingTableInput{
+			opts:        options.SessionBindingOptions{ClientCertificate: options.SessionBindingEnforceMode},
+			remoteAddr:  createAddr,
+			expectedErr: "session client certificate binding mismatch",
+		}),
+	)
+
+	It("does not reject sessions created before binding was enabled", func() {
+		binder := newBinder(options.SessionBindingOptions{
+			ClientIP:  options.SessionBindingEnforceMode,
+			UserAgent: options.SessionBindingEnforceMode,
+		})
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = createAddr
+		Expect(binder.Verify(req, &sessionsapi.SessionState{})).To(Succeed())
+	})
+})
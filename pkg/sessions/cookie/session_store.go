@@ -1,6 +1,7 @@
 package cookie
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -53,15 +54,27 @@ func (s *SessionStore) Load(req *http.Request) (*sessions.SessionState, error) {
 		// always http.ErrNoCookie
 		return nil, fmt.Errorf("cookie %q not present", s.Cookie.Name)
 	}
-	val, _, ok := encryption.Validate(c, s.Cookie.Secret, s.Cookie.Expire)
+	secrets := pkgcookies.SecretsFromOptions(s.Cookie)
+	val, _, index, ok := encryption.ValidateWithSecrets(c, secrets, s.Cookie.Expire)
 	if !ok {
 		return nil, errors.New("cookie signature not valid")
 	}
 
-	session, err := sessions.DecodeSessionState(val, s.CookieCipher, true)
+	cipher := s.CookieCipher
+	if index > 0 {
+		// The cookie was signed with an old secret, so it was also
+		// encrypted with it
+		cipher, err = encryption.NewCFBCipher(encryption.SecretBytes(secrets[index]))
+		if err != nil {
+			return nil, fmt.Errorf("error initialising cipher: %v", err)
+		}
+	}
+
+	session, err := sessions.DecodeSessionState(val, cipher, true)
 	if err != nil {
 		return nil, err
 	}
+	session.NeedsResave = index > 0
 	return session, nil
 }
 
@@ -82,6 +95,12 @@ func (s *SessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+// VerifyConnection always succeeds, as sessions are stored in the cookies of
+// requests
+func (s *SessionStore) VerifyConnection(_ context.Context) error {
+	return nil
+}
+
 // cookieForSession serializes a session state for storage in a cookie
 func (s *SessionStore) cookieForSession(ss *sessions.SessionState) ([]byte, error) {
 	if s.Minimal && (ss.AccessToken != "" || ss.IDToken != "" || ss.RefreshToken != "") {
@@ -1,12 +1,14 @@
 package persistence
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
 )
 
 // Manager wraps a Store and handles the implementation details of the
@@ -14,6 +16,10 @@ import (
 type Manager struct {
 	Store   Store
 	Options *options.Cookie
+
+	// KeyProvider optionally envelope encrypts sessions before they are
+	// persisted using keys managed outside of OAuth2 Proxy.
+	KeyProvider encryption.KeyProvider
 }
 
 // NewManager creates a Manager that can wrap a Store and manage the
@@ -40,6 +46,7 @@ func (m *Manager) Save(rw http.ResponseWriter, req *http.Request, s *sessions.Se
 			return fmt.Errorf("error creating a session ticket: %v", err)
 		}
 	}
+	tckt.keyProvider = m.KeyProvider
 
 	err = tckt.saveSession(s, func(key string, val []byte, exp time.Duration) error {
 		return m.Store.Save(req.Context(), key, val, exp)
@@ -58,6 +65,7 @@ func (m *Manager) Load(req *http.Request) (*sessions.SessionState, error) {
 	if err != nil {
 		return nil, err
 	}
+	tckt.keyProvider = m.KeyProvider
 
 	return tckt.loadSession(
 		func(key string) ([]byte, error) {
@@ -90,3 +98,8 @@ func (m *Manager) Clear(rw http.ResponseWriter, req *http.Request) error {
 		return m.Store.Clear(req.Context(), key)
 	})
 }
+
+// VerifyConnection checks that the Store can be reached.
+func (m *Manager) VerifyConnection(ctx context.Context) error {
+	return m.Store.VerifyConnection(ctx)
+}
@@ -1,12 +1,17 @@
 package persistence
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/tests"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("Persistence Manager Tests", func() {
@@ -22,4 +27,96 @@ var _ = Describe("Persistence Manager Tests", func() {
 			ms.FastForward(d)
 			return nil
 		})
+
+	Context("with an envelope encryption key provider", func() {
+		var keyRingDir string
+		var keyProvider encryption.KeyProvider
+
+		BeforeEach(func() {
+			var err error
+			keyRingDir, err = ioutil.TempDir("", "keyring")
+			Expect(err).ToNot(HaveOccurred())
+
+			keyRingFile := filepath.Join(keyRingDir, "keyring")
+			keyRing := "key-2:0123456789abcdefghijklmnopqrstuv\nkey-1:ZYXWVUTSRQPONMLKJIHGFEDCBA987654\n"
+			Expect(ioutil.WriteFile(keyRingFile, []byte(keyRing), 0600)).To(Succeed())
+
+			keyProvider, err = encryption.NewLocalKeyRing(keyRingFile)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(keyRingDir)).To(Succeed())
+		})
+
+		tests.RunSessionStoreTests(
+			func(_ *options.SessionOptions, cookieOpts *options.Cookie) (sessionsapi.SessionStore, error) {
+				manager := NewManager(ms, cookieOpts)
+				manager.KeyProvider = keyProvider
+				return manager, nil
+			},
+			func(d time.Duration) error {
+				ms.FastForward(d)
+				return nil
+			})
+
+		It("stores sessions with the primary key ID", func() {
+			t, err := newTicket(&options.Cookie{Name: "dummy"})
+			Expect(err).ToNot(HaveOccurred())
+			t.keyProvider = keyProvider
+
+			store := map[string][]byte{}
+			err = t.saveSession(&sessionsapi.SessionState{User: "foobar"}, func(k string, v []byte, e time.Duration) error {
+				store[k] = v
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			keyID, err := encryption.EnvelopeKeyID(store[t.id])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keyID).To(Equal("key-2"))
+		})
+
+		It("loads sessions saved before the key provider was configured", func() {
+			t, err := newTicket(&options.Cookie{Name: "dummy"})
+			Expect(err).ToNot(HaveOccurred())
+
+			store := map[string][]byte{}
+			err = t.saveSession(&sessionsapi.SessionState{User: "foobar"}, func(k string, v []byte, e time.Duration) error {
+				store[k] = v
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			t.keyProvider = keyProvider
+			loaded, err := t.loadSession(
+				func(k string) ([]byte, error) { return store[k], nil },
+				func(k string) sessionsapi.Lock { return &sessionsapi.NoOpLock{} },
+			)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(loaded.User).To(Equal("foobar"))
+			Expect(loaded.NeedsResave).To(BeTrue())
+
+			err = t.saveSession(loaded, func(k string, v []byte, e time.Duration) error {
+				store[k] = v
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			keyID, err := encryption.EnvelopeKeyID(store[t.id])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keyID).To(Equal("key-2"))
+		})
+
+		It("does not load sessions with an invalid envelope", func() {
+			t, err := newTicket(&options.Cookie{Name: "dummy"})
+			Expect(err).ToNot(HaveOccurred())
+			t.keyProvider = keyProvider
+
+			_, err = t.loadSession(
+				func(k string) ([]byte, error) { return []byte("invalid"), nil },
+				func(k string) sessionsapi.Lock { return &sessionsapi.NoOpLock{} },
+			)
+			Expect(err).To(HaveOccurred())
+		})
+	})
 })
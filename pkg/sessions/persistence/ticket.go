@@ -41,6 +41,13 @@ type ticket struct {
 	id      string
 	secret  []byte
 	options *options.Cookie
+
+	// rotated is set when the ticket cookie was signed with an old
+	// cookie secret and should be re-signed with the primary secret.
+	rotated bool
+
+	// keyProvider, if set, is used to envelope encrypt the session
+	keyProvider encryption.KeyProvider
 }
 
 // newTicket creates a new ticket. The ID & secret will be randomly created
@@ -100,13 +107,18 @@ func decodeTicketFromRequest(req *http.Request, cookieOpts *options.Cookie) (*ti
 	}
 
 	// An existing cookie exists, try to retrieve the ticket
-	val, _, ok := encryption.Validate(requestCookie, cookieOpts.Secret, cookieOpts.Expire)
+	val, _, index, ok := encryption.ValidateWithSecrets(requestCookie, cookies.SecretsFromOptions(cookieOpts), cookieOpts.Expire)
 	if !ok {
 		return nil, fmt.Errorf("session ticket cookie failed validation: %v", err)
 	}
 
 	// Valid cookie, decode the ticket
-	return decodeTicket(string(val), cookieOpts)
+	tckt, err := decodeTicket(string(val), cookieOpts)
+	if err != nil {
+		return nil, err
+	}
+	tckt.rotated = index > 0
+	return tckt, nil
 }
 
 // saveSession encodes the SessionState with the ticket's secret and persists
@@ -137,15 +149,40 @@ func (t *ticket) loadSession(loader loadFunc, initLock initLockFunc) (*sessions.
 		return nil, err
 	}
 
+	legacy := false
 	sessionState, err := sessions.DecodeSessionState(ciphertext, c, false)
 	if err != nil {
-		return nil, err
+		legacyState, ok := t.loadLegacySession(ciphertext)
+		if !ok {
+			return nil, err
+		}
+		sessionState, legacy = legacyState, true
 	}
 	lock := initLock(t.id)
 	sessionState.Lock = lock
+	// Legacy sessions are saved again so that they are envelope encrypted
+	sessionState.NeedsResave = t.rotated || legacy
 	return sessionState, nil
 }
 
+// loadLegacySession decodes a session that was saved before the KeyProvider
+// was configured, and so is only encrypted with the ticket secret.
+// It returns false if there is no KeyProvider or the session can't be decoded.
+func (t *ticket) loadLegacySession(ciphertext []byte) (*sessions.SessionState, bool) {
+	if t.keyProvider == nil {
+		return nil, false
+	}
+	c, err := encryption.NewGCMCipher(t.secret)
+	if err != nil {
+		return nil, false
+	}
+	sessionState, err := sessions.DecodeSessionState(ciphertext, c, false)
+	if err != nil {
+		return nil, false
+	}
+	return sessionState, true
+}
+
 // clearSession uses the passed clearFunc to delete a session stored with a
 // key of ticket.id
 func (t *ticket) clearSession(clearer clearFunc) error {
@@ -200,11 +237,19 @@ func (t *ticket) makeCookie(req *http.Request, value string, expires time.Durati
 	), nil
 }
 
-// makeCipher makes a AES-GCM cipher out of the ticket's secret
+// makeCipher makes a AES-GCM cipher out of the ticket's secret.
+// The ticket secret is unique per session and is not derived from the cookie
+// secret, so rotating the cookie secret only requires the ticket cookie itself
+// to be re-signed.
+// If a KeyProvider is configured, the cipher is wrapped in an envelope cipher
+// so that the persisted session also requires a key from the KeyProvider.
 func (t *ticket) makeCipher() (encryption.Cipher, error) {
 	c, err := encryption.NewGCMCipher(t.secret)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make an AES-GCM cipher from the ticket secret: %v", err)
 	}
+	if t.keyProvider != nil {
+		return encryption.NewEnvelopeCipher(c, t.keyProvider), nil
+	}
 	return c, nil
 }
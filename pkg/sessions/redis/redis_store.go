@@ -10,6 +10,7 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/persistence"
 )
@@ -31,7 +32,16 @@ func NewRedisSessionStore(opts *options.SessionOptions, cookieOpts *options.Cook
 	rs := &SessionStore{
 		Client: client,
 	}
-	return persistence.NewManager(rs, cookieOpts), nil
+	manager := persistence.NewManager(rs, cookieOpts)
+
+	if opts.Redis.EncryptionKeyRingFile != "" {
+		keyRing, err := encryption.NewLocalKeyRing(opts.Redis.EncryptionKeyRingFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading redis encryption key ring: %v", err)
+		}
+		manager.KeyProvider = keyRing
+	}
+	return manager, nil
 }
 
 // Save takes a sessions.SessionState and stores the information from it
@@ -69,6 +79,14 @@ func (store *SessionStore) Lock(key string) sessions.Lock {
 	return store.Client.Lock(key)
 }
 
+// VerifyConnection checks that redis can be reached
+func (store *SessionStore) VerifyConnection(ctx context.Context) error {
+	if err := store.Client.Ping(ctx); err != nil {
+		return fmt.Errorf("error connecting to redis: %v", err)
+	}
+	return nil
+}
+
 // NewRedisClient makes a redis.Client (either standalone, sentinel aware, or
 // redis cluster)
 func NewRedisClient(opts options.RedisStoreOptions) (Client, error) {
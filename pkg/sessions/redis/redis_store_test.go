@@ -224,4 +224,26 @@ var _ = Describe("Redis SessionStore Tests", func() {
 			)
 		})
 	})
+
+	Context("VerifyConnection", func() {
+		BeforeEach(func() {
+			var err error
+			ss, err = NewRedisSessionStore(&options.SessionOptions{
+				Type: options.RedisSessionStoreType,
+				Redis: options.RedisStoreOptions{
+					ConnectionURL: "redis://" + mr.Addr(),
+				},
+			}, &options.Cookie{})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("succeeds when redis is reachable", func() {
+			Expect(ss.VerifyConnection(context.Background())).To(Succeed())
+		})
+
+		It("returns an error when redis is not reachable", func() {
+			mr.Close()
+			Expect(ss.VerifyConnection(context.Background())).To(MatchError(HavePrefix("error connecting to redis: ")))
+		})
+	})
 })
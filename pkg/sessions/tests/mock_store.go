@@ -65,6 +65,11 @@ func (s *MockStore) Lock(key string) sessions.Lock {
 	return lock
 }
 
+// VerifyConnection always succeeds for the memory cache
+func (s *MockStore) VerifyConnection(_ context.Context) error {
+	return nil
+}
+
 // FastForward simulates the flow of time to test expirations
 func (s *MockStore) FastForward(duration time.Duration) {
 	for _, mockLock := range s.lockCache {
@@ -133,6 +133,65 @@ func RunSessionStoreTests(newSS NewSessionStoreFunc, persistentFastForward Persi
 				PersistentSessionStoreInterfaceTests(&input)
 			}
 		})
+
+		Context("with a rotated cookie secret", func() {
+			var loadedSession *sessionsapi.SessionState
+
+			BeforeEach(func() {
+				By("saving a session with the old secret")
+				oldSS, err := newSS(opts, input.cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+
+				saveResp := httptest.NewRecorder()
+				err = oldSS.Save(saveResp, httptest.NewRequest("GET", "http://example.com/", nil), input.session)
+				Expect(err).ToNot(HaveOccurred())
+				for _, c := range saveResp.Result().Cookies() {
+					input.request.AddCookie(c)
+				}
+
+				By("rotating the secret")
+				newSecret := make([]byte, 32)
+				_, err = rand.Read(newSecret)
+				Expect(err).ToNot(HaveOccurred())
+
+				rotatedOpts := *input.cookieOpts
+				rotatedOpts.Secret = string(newSecret)
+				rotatedOpts.OldSecrets = []string{string(cookieSecret)}
+				input.cookieOpts = &rotatedOpts
+
+				ss, err = newSS(opts, input.cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+
+				loadedSession, err = ss.Load(input.request)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("loads the session", func() {
+				Expect(loadedSession.Email).To(Equal(input.session.Email))
+				Expect(loadedSession.AccessToken).To(Equal(input.session.AccessToken))
+			})
+
+			It("marks the session to be saved again", func() {
+				Expect(loadedSession.NeedsResave).To(BeTrue())
+			})
+
+			It("signs the saved session with the primary secret", func() {
+				err := ss.Save(input.response, input.request, loadedSession)
+				Expect(err).ToNot(HaveOccurred())
+
+				loadReq := httptest.NewRequest("GET", "http://example.com/", nil)
+				for _, c := range input.response.Result().Cookies() {
+					_, _, valid := encryption.Validate(c, input.cookieOpts.Secret, input.cookieOpts.Expire)
+					Expect(valid).To(BeTrue())
+					loadReq.AddCookie(c)
+				}
+
+				reloaded, err := ss.Load(loadReq)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(reloaded.Email).To(Equal(input.session.Email))
+				Expect(reloaded.NeedsResave).To(BeFalse())
+			})
+		})
 	})
 }
 
@@ -0,0 +1,321 @@
+package upstream
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// hashRingPointsPerWeight is the number of points each unit of backend weight
+// places on the consistent hash ring. More points spread the keys more evenly.
+const hashRingPointsPerWeight = 100
+
+// backend is a single server that an upstream's requests are balanced across.
+type backend struct {
+	uri     string
+	weight  int
+	handler http.Handler
+
+	// transport is the transport for requests to the backend, it is nil for
+	// the http.DefaultTransport
+	transport http.RoundTripper
+
+	// health is nil when no health checks are configured for the upstream
+	health *backendHealth
+
+	// active is the number of requests currently being served by the backend
+	active int64
+}
+
+// ServeHTTP proxies the request to the backend, tracking the number of
+// active requests.
+// Connection errors are rendered as 5xx responses by the error handler, so
+// any 5xx response counts as an error for outlier detection.
+func (b *backend) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&b.active, 1)
+	defer atomic.AddInt64(&b.active, -1)
+
+	if b.health == nil || b.health.consecutiveErrors == 0 {
+		b.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+	b.handler.ServeHTTP(recorder, req)
+	b.health.recordResponse(recorder.status >= http.StatusInternalServerError)
+}
+
+// available returns whether the backend is in rotation.
+func (b *backend) available() bool {
+	return b.health.available()
+}
+
+// anyAvailable returns whether any of the backends are in rotation.
+// When none are, the selectors fail open and use all of the backends.
+func anyAvailable(backends []*backend) bool {
+	for _, b := range backends {
+		if b.available() {
+			return true
+		}
+	}
+	return false
+}
+
+// backendSelector chooses the backend that should serve a request.
+type backendSelector interface {
+	selectBackend(req *http.Request) *backend
+}
+
+// newLoadBalancedProxy creates a handler that balances requests across the
+// backends of the upstream, using the configured load balancing strategy.
+// Health checks of the backends, and reloading of their TLS certificates, run
+// until done is closed.
+func newLoadBalancedProxy(upstream options.Upstream, sigData *options.SignatureData, errorHandler ProxyErrorHandler, done <-chan struct{}) (*loadBalancedProxy, error) {
+	tlsOpts, err := newUpstreamTLS(upstream, done)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS config: %v", err)
+	}
+
+	var metrics *healthMetrics
+	if upstream.HealthCheck != nil || upstream.OutlierDetection != nil {
+		metrics = newHealthMetrics(prometheus.DefaultRegisterer)
+	}
+
+	backends := make([]*backend, 0, len(upstream.Backends))
+	for _, b := range upstream.Backends {
+		u, err := url.Parse(b.URI)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing URI for backend %q: %w", b.URI, err)
+		}
+		if u.Scheme != httpScheme && u.Scheme != httpsScheme {
+			return nil, fmt.Errorf("unknown scheme for backend %q: %q", b.URI, u.Scheme)
+		}
+
+		weight := b.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		handler, err := newHTTPUpstreamProxy(upstream, u, sigData, errorHandler, tlsOpts)
+		if err != nil {
+			return nil, fmt.Errorf("error creating proxy for backend %q: %w", b.URI, err)
+		}
+		backends = append(backends, &backend{
+			uri:       b.URI,
+			weight:    weight,
+			handler:   handler,
+			transport: handler.transport,
+			health:    newBackendHealth(upstream, b.URI, metrics),
+		})
+	}
+
+	selector, err := newBackendSelector(upstream.LoadBalancing, backends)
+	if err != nil {
+		return nil, err
+	}
+
+	if upstream.HealthCheck != nil {
+		go newHealthChecker(upstream, backends).run(done)
+	}
+	return &loadBalancedProxy{backends: backends, selector: selector}, nil
+}
+
+// newBackendSelector creates the backendSelector for the load balancing
+// strategy.
+func newBackendSelector(lb *options.LoadBalancing, backends []*backend) (backendSelector, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("at least one backend is required")
+	}
+
+	strategy := options.RoundRobinLoadBalancing
+	hashClaim := options.DefaultLoadBalancingHashClaim
+	if lb != nil {
+		if lb.Strategy != "" {
+			strategy = lb.Strategy
+		}
+		if lb.HashClaim != "" {
+			hashClaim = lb.HashClaim
+		}
+	}
+
+	switch strategy {
+	case options.RoundRobinLoadBalancing:
+		return newRoundRobinSelector(backends), nil
+	case options.LeastConnectionsLoadBalancing:
+		return &leastConnectionsSelector{backends: backends}, nil
+	case options.ConsistentHashLoadBalancing:
+		return newConsistentHashSelector(backends, hashClaim), nil
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", strategy)
+	}
+}
+
+// loadBalancedProxy serves requests with the backend chosen by its selector.
+type loadBalancedProxy struct {
+	backends []*backend
+	selector backendSelector
+}
+
+// ServeHTTP proxies the request to the selected backend.
+func (l *loadBalancedProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	l.selector.selectBackend(req).ServeHTTP(rw, req)
+}
+
+// backendStatuses reports the health of the backends that have health checks
+// configured.
+func (l *loadBalancedProxy) backendStatuses() []BackendStatus {
+	statuses := []BackendStatus{}
+	for _, b := range l.backends {
+		if b.health != nil {
+			statuses = append(statuses, b.health.status())
+		}
+	}
+	return statuses
+}
+
+// roundRobinSelector implements smooth weighted round robin, this
+// interleaves the backends rather than sending runs of requests to the
+// heavier backends.
+type roundRobinSelector struct {
+	backends []*backend
+	current  []int
+	mu       sync.Mutex
+}
+
+func newRoundRobinSelector(backends []*backend) *roundRobinSelector {
+	return &roundRobinSelector{
+		backends: backends,
+		current:  make([]int, len(backends)),
+	}
+}
+
+func (r *roundRobinSelector) selectBackend(_ *http.Request) *backend {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	skipUnavailable := anyAvailable(r.backends)
+	total := 0
+	best := -1
+	for i, b := range r.backends {
+		if skipUnavailable && !b.available() {
+			continue
+		}
+		r.current[i] += b.weight
+		total += b.weight
+		if best == -1 || r.current[i] > r.current[best] {
+			best = i
+		}
+	}
+	r.current[best] -= total
+	return r.backends[best]
+}
+
+// leastConnectionsSelector chooses the backend with the fewest active
+// requests relative to its weight.
+type leastConnectionsSelector struct {
+	backends []*backend
+
+	// next rotates the starting point of the search so that ties are spread
+	// across the backends
+	next uint32
+}
+
+func (l *leastConnectionsSelector) selectBackend(_ *http.Request) *backend {
+	// The modulo is taken before the conversion, as a uint32 may not fit in an
+	// int on 32-bit platforms
+	start := int(atomic.AddUint32(&l.next, 1) % uint32(len(l.backends)))
+	skipUnavailable := anyAvailable(l.backends)
+
+	var best *backend
+	var bestActive int64
+	for i := range l.backends {
+		b := l.backends[(start+i)%len(l.backends)]
+		if skipUnavailable && !b.available() {
+			continue
+		}
+		active := atomic.LoadInt64(&b.active)
+		// Compare active/weight without dividing
+		if best == nil || active*int64(best.weight) < bestActive*int64(b.weight) {
+			best = b
+			bestActive = active
+		}
+	}
+	return best
+}
+
+// consistentHashSelector maps the value of a session claim onto a hash ring
+// so that requests from the same user are sent to the same backend, and only
+// a small share of users move when backends are added or removed.
+type consistentHashSelector struct {
+	claim    string
+	ring     []uint32
+	owners   map[uint32]*backend
+	fallback backendSelector
+}
+
+func newConsistentHashSelector(backends []*backend, claim string) *consistentHashSelector {
+	c := &consistentHashSelector{
+		claim:    claim,
+		owners:   make(map[uint32]*backend),
+		fallback: newRoundRobinSelector(backends),
+	}
+
+	for _, b := range backends {
+		for i := 0; i < b.weight*hashRingPointsPerWeight; i++ {
+			point := hashKey(b.uri + "#" + strconv.Itoa(i))
+			if _, ok := c.owners[point]; ok {
+				// Collisions are rare, the first backend keeps the point
+				continue
+			}
+			c.owners[point] = b
+			c.ring = append(c.ring, point)
+		}
+	}
+	sort.Slice(c.ring, func(i, j int) bool { return c.ring[i] < c.ring[j] })
+	return c
+}
+
+func (c *consistentHashSelector) selectBackend(req *http.Request) *backend {
+	scope := middleware.GetRequestScope(req)
+	if scope == nil || scope.Session == nil {
+		return c.fallback.selectBackend(req)
+	}
+	value := strings.Join(scope.Session.GetClaim(c.claim), ",")
+	if value == "" {
+		return c.fallback.selectBackend(req)
+	}
+
+	key := hashKey(value)
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i] >= key })
+	if i == len(c.ring) {
+		i = 0
+	}
+
+	// Walk the ring to the next backend in rotation, so that only the users
+	// of an unavailable backend are moved
+	for j := 0; j < len(c.ring); j++ {
+		owner := c.owners[c.ring[(i+j)%len(c.ring)]]
+		if owner.available() {
+			return owner
+		}
+	}
+	return c.owners[c.ring[i]]
+}
+
+// hashKey maps a key onto the hash ring. A cryptographic hash is used for its
+// even distribution, as ring points are generated from similar keys.
+func hashKey(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
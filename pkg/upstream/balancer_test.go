@@ -0,0 +1,223 @@
+package upstream
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Load Balancer Suite", func() {
+	newTestBackends := func(weights ...int) []*backend {
+		backends := make([]*backend, 0, len(weights))
+		for i, weight := range weights {
+			backends = append(backends, &backend{
+				uri:    fmt.Sprintf("http://backend-%d", i),
+				weight: weight,
+			})
+		}
+		return backends
+	}
+
+	newRequest := func(session *sessionsapi.SessionState) *http.Request {
+		req := httptest.NewRequest("", "/", nil)
+		return middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{Session: session})
+	}
+
+	countSelections := func(selector backendSelector, n int) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			counts[selector.selectBackend(newRequest(nil)).uri]++
+		}
+		return counts
+	}
+
+	Context("roundRobinSelector", func() {
+		It("distributes requests in proportion to the weights", func() {
+			selector := newRoundRobinSelector(newTestBackends(1, 2, 3))
+
+			Expect(countSelections(selector, 60)).To(Equal(map[string]int{
+				"http://backend-0": 10,
+				"http://backend-1": 20,
+				"http://backend-2": 30,
+			}))
+		})
+
+		It("interleaves the backends", func() {
+			selector := newRoundRobinSelector(newTestBackends(2, 1))
+
+			uris := []string{}
+			for i := 0; i < 3; i++ {
+				uris = append(uris, selector.selectBackend(newRequest(nil)).uri)
+			}
+			Expect(uris).To(Equal([]string{"http://backend-0", "http://backend-1", "http://backend-0"}))
+		})
+	})
+
+	Context("leastConnectionsSelector", func() {
+		It("selects the backend with the fewest active requests relative to its weight", func() {
+			backends := newTestBackends(1, 2, 1)
+			backends[0].active = 2
+			backends[1].active = 3
+			backends[2].active = 1
+			selector := &leastConnectionsSelector{backends: backends}
+
+			for i := 0; i < 3; i++ {
+				Expect(selector.selectBackend(newRequest(nil))).To(Equal(backends[2]))
+			}
+
+			backends[2].active = 2
+			Expect(selector.selectBackend(newRequest(nil))).To(Equal(backends[1]))
+		})
+
+		It("spreads requests when backends are idle", func() {
+			selector := &leastConnectionsSelector{backends: newTestBackends(1, 1, 1)}
+
+			Expect(countSelections(selector, 30)).To(Equal(map[string]int{
+				"http://backend-0": 10,
+				"http://backend-1": 10,
+				"http://backend-2": 10,
+			}))
+		})
+
+		It("selects a backend when the counter wraps", func() {
+			selector := &leastConnectionsSelector{backends: newTestBackends(1, 1, 1), next: math.MaxUint32 - 1}
+
+			for i := 0; i < 3; i++ {
+				Expect(selector.selectBackend(newRequest(nil))).ToNot(BeNil())
+			}
+		})
+	})
+
+	Context("consistentHashSelector", func() {
+		It("sends requests for the same claim value to the same backend", func() {
+			selector := newConsistentHashSelector(newTestBackends(1, 1, 1), "email")
+
+			for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+				session := &sessionsapi.SessionState{Email: email}
+				first := selector.selectBackend(newRequest(session))
+				for i := 0; i < 10; i++ {
+					Expect(selector.selectBackend(newRequest(session))).To(Equal(first))
+				}
+			}
+		})
+
+		It("spreads users across the backends", func() {
+			selector := newConsistentHashSelector(newTestBackends(1, 1), "user")
+
+			counts := make(map[string]int)
+			for i := 0; i < 200; i++ {
+				session := &sessionsapi.SessionState{User: fmt.Sprintf("user-%d", i)}
+				counts[selector.selectBackend(newRequest(session)).uri]++
+			}
+			Expect(counts).To(HaveLen(2))
+			Expect(counts["http://backend-0"]).To(BeNumerically(">", 50))
+			Expect(counts["http://backend-1"]).To(BeNumerically(">", 50))
+		})
+
+		It("keeps most users on the same backend when a backend is added", func() {
+			before := newConsistentHashSelector(newTestBackends(1, 1, 1), "user")
+			after := newConsistentHashSelector(newTestBackends(1, 1, 1, 1), "user")
+
+			moved := 0
+			for i := 0; i < 200; i++ {
+				req := newRequest(&sessionsapi.SessionState{User: fmt.Sprintf("user-%d", i)})
+				if before.selectBackend(req).uri != after.selectBackend(req).uri {
+					moved++
+				}
+			}
+			// Ideally a quarter of users move to the new backend
+			Expect(moved).To(BeNumerically("<", 100))
+		})
+
+		It("falls back to round robin without a session", func() {
+			selector := newConsistentHashSelector(newTestBackends(1, 1), "user")
+
+			Expect(countSelections(selector, 10)).To(Equal(map[string]int{
+				"http://backend-0": 5,
+				"http://backend-1": 5,
+			}))
+		})
+	})
+
+	type newBackendSelectorTableInput struct {
+		loadBalancing *options.LoadBalancing
+		expected      interface{}
+		expectedErr   string
+	}
+
+	DescribeTable("newBackendSelector",
+		func(in newBackendSelectorTableInput) {
+			selector, err := newBackendSelector(in.loadBalancing, newTestBackends(1))
+			if in.expectedErr != "" {
+				Expect(err).To(MatchError(in.expectedErr))
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+			Expect(selector).To(BeAssignableToTypeOf(in.expected))
+		},
+		Entry("with no load balancing options", newBackendSelectorTableInput{
+			expected: &roundRobinSelector{},
+		}),
+		Entry("with least connections", newBackendSelectorTableInput{
+			loadBalancing: &options.LoadBalancing{Strategy: options.LeastConnectionsLoadBalancing},
+			expected:      &leastConnectionsSelector{},
+		}),
+		Entry("with consistent hash", newBackendSelectorTableInput{
+			loadBalancing: &options.LoadBalancing{Strategy: options.ConsistentHashLoadBalancing},
+			expected:      &consistentHashSelector{},
+		}),
+		Entry("with an unknown strategy", newBackendSelectorTableInput{
+			loadBalancing: &options.LoadBalancing{Strategy: "random"},
+			expectedErr:   "unknown load balancing strategy \"random\"",
+		}),
+	)
+
+	Context("newLoadBalancedProxy", func() {
+		It("proxies requests to each backend", func() {
+			hits := make([]int, 2)
+			backendConfigs := []options.UpstreamBackend{}
+			for i := range hits {
+				i := i
+				backendServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+					hits[i]++
+					rw.WriteHeader(http.StatusOK)
+				}))
+				defer backendServer.Close()
+				backendConfigs = append(backendConfigs, options.UpstreamBackend{URI: backendServer.URL})
+			}
+
+			handler, err := newLoadBalancedProxy(options.Upstream{
+				ID:       "load-balanced",
+				Path:     "/",
+				Backends: backendConfigs,
+			}, nil, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			for i := 0; i < 4; i++ {
+				req := newRequest(nil)
+				req.RequestURI = "/"
+				rw := httptest.NewRecorder()
+				handler.ServeHTTP(rw, req)
+				Expect(rw.Code).To(Equal(http.StatusOK))
+				Expect(middlewareapi.GetRequestScope(req).Upstream).To(Equal("load-balanced"))
+			}
+			Expect(hits).To(Equal([]int{2, 2}))
+		})
+
+		It("rejects backends with an unsupported scheme", func() {
+			_, err := newLoadBalancedProxy(options.Upstream{
+				ID:       "load-balanced",
+				Backends: []options.UpstreamBackend{{URI: "file:///tmp"}},
+			}, nil, nil, nil)
+			Expect(err).To(MatchError("unknown scheme for backend \"file:///tmp\": \"file\""))
+		})
+	})
+})
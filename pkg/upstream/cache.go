@@ -0,0 +1,704 @@
+package upstream
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/justinas/alice"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	requestutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	cacheFileExtension = ".cache"
+
+	cacheResultHit  = "hit"
+	cacheResultMiss = "miss"
+)
+
+// defaultCacheKeyClaims are included in the cache key when no key claims are
+// configured, so that only public responses are shared between users.
+var defaultCacheKeyClaims = []string{"user", "email"}
+
+// cacheEntry is a cached response.
+// It is exported field by field so that it can be encoded to the disk cache.
+type cacheEntry struct {
+	Status   int
+	Header   http.Header
+	Body     []byte
+	StoredAt time.Time
+	Expires  time.Time
+}
+
+// size is the approximate memory used by the entry.
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.Body))
+	for key, values := range e.Header {
+		size += int64(len(key))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
+
+// responseCache caches the responses of an upstream in memory, and
+// optionally on disk.
+type responseCache struct {
+	upstream  string
+	keyClaims []string
+	// sharePublic is set when no key claims are configured, public responses
+	// are then shared by all users
+	sharePublic  bool
+	maxEntrySize int64
+	defaultTTL   time.Duration
+	diskPath     string
+
+	clock   clock.Clock
+	metrics *cacheMetrics
+
+	mu     sync.Mutex
+	memory *lruCache
+	disk   *lruCache
+}
+
+// newResponseCacheHandler creates a new middleware that serves the responses
+// of the upstream from the cache.
+// It returns nil if the upstream does not have a cache.
+func newResponseCacheHandler(upstream options.Upstream, metrics *cacheMetrics) (alice.Constructor, error) {
+	cache, err := newResponseCache(upstream, metrics)
+	if err != nil || cache == nil {
+		return nil, err
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			cache.serveHTTP(next, rw, req)
+		})
+	}, nil
+}
+
+// newResponseCache creates the cache for the upstream, or nil if the upstream
+// does not have a cache.
+func newResponseCache(upstream options.Upstream, metrics *cacheMetrics) (*responseCache, error) {
+	opts := upstream.Cache
+	if opts == nil {
+		return nil, nil
+	}
+
+	c := &responseCache{
+		upstream:     upstream.ID,
+		keyClaims:    opts.KeyClaims,
+		sharePublic:  len(opts.KeyClaims) == 0,
+		maxEntrySize: int64OrDefault(opts.MaxEntrySize, options.DefaultUpstreamCacheMaxEntrySize),
+		defaultTTL:   durationOrDefault(opts.DefaultTTL, 0),
+		diskPath:     opts.DiskPath,
+		metrics:      metrics,
+		memory:       newLRUCache(int64OrDefault(opts.MaxSize, options.DefaultUpstreamCacheMaxSize), nil),
+	}
+	if c.sharePublic {
+		c.keyClaims = defaultCacheKeyClaims
+	}
+
+	if opts.DiskPath != "" {
+		if err := prepareCacheDir(opts.DiskPath); err != nil {
+			return nil, fmt.Errorf("could not prepare disk cache: %v", err)
+		}
+		c.disk = newLRUCache(int64OrDefault(opts.DiskMaxSize, options.DefaultUpstreamCacheDiskMaxSize), c.removeFile)
+	}
+
+	return c, nil
+}
+
+// prepareCacheDir creates the disk cache directory and removes any cache
+// files left by a previous run, as they are not tracked by the new cache.
+func prepareCacheDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+cacheFileExtension))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveHTTP serves the request from the cache when possible.
+// Otherwise the request is passed to the next handler and the response is
+// cached if it is cacheable.
+func (c *responseCache) serveHTTP(next http.Handler, rw http.ResponseWriter, req *http.Request) {
+	requestCacheControl := parseCacheControl(req.Header.Values("Cache-Control"))
+	if req.Method != http.MethodGet || requestCacheControl.has("no-store") {
+		next.ServeHTTP(rw, req)
+		return
+	}
+
+	// If scope is nil, this will panic.
+	// A scope should always be injected before this handler is called.
+	scope := middleware.GetRequestScope(req)
+	key := c.key(req, scope.Session, c.keyClaims)
+	var publicKey string
+	if c.sharePublic {
+		publicKey = c.key(req, nil, nil)
+	}
+
+	if !requestCacheControl.has("no-cache") {
+		entry := c.get(key)
+		if entry == nil && publicKey != "" {
+			entry = c.get(publicKey)
+		}
+		if entry != nil {
+			scope.Upstream = c.upstream
+			c.metrics.request(c.upstream, cacheResultHit)
+			c.writeEntry(rw, req, entry)
+			return
+		}
+	}
+	c.metrics.request(c.upstream, cacheResultMiss)
+
+	recorder := &cacheRecorder{
+		ResponseWriter: rw,
+		maxBodySize:    c.maxEntrySize,
+		initialHeader:  rw.Header().Clone(),
+	}
+	next.ServeHTTP(recorder, req)
+
+	entry, public := c.newEntry(recorder, req, scope.Session)
+	if entry == nil {
+		return
+	}
+	if public {
+		key = publicKey
+	}
+	c.set(key, entry)
+}
+
+// key identifies the response to the request.
+// It includes the values of the claims so that responses are not shared
+// between users with different claims.
+func (c *responseCache) key(req *http.Request, session *sessionsapi.SessionState, claims []string) string {
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+
+	parts := []string{
+		requestutil.GetRequestHost(req),
+		uri,
+		req.Header.Get("Accept-Encoding"),
+	}
+	for _, claim := range claims {
+		parts = append(parts, claim, strings.Join(session.GetClaim(claim), ","))
+	}
+
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
+
+// get returns the unexpired entry for the key from memory, or from disk, or
+// nil if there is no such entry.
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	if entry, ok := c.memory.get(key); ok {
+		if now.Before(entry.Expires) {
+			return entry
+		}
+		c.memory.remove(key)
+	}
+
+	if c.disk == nil {
+		return nil
+	}
+	if _, ok := c.disk.get(key); !ok {
+		return nil
+	}
+
+	entry, err := c.readFile(key)
+	if err != nil {
+		logger.Errorf("Error reading upstream %q cache file: %v", c.upstream, err)
+		c.disk.remove(key)
+		return nil
+	}
+	if !now.Before(entry.Expires) {
+		c.disk.remove(key)
+		return nil
+	}
+
+	c.memory.add(key, entry.size(), entry)
+	return entry
+}
+
+// set stores the entry in memory, and on disk.
+func (c *responseCache) set(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size := entry.size()
+	c.memory.add(key, size, entry)
+
+	if c.disk == nil {
+		return
+	}
+	if err := c.writeFile(key, entry); err != nil {
+		logger.Errorf("Error writing upstream %q cache file: %v", c.upstream, err)
+		c.disk.remove(key)
+		return
+	}
+	c.disk.add(key, size, nil)
+}
+
+func (c *responseCache) filePath(key string) string {
+	return filepath.Join(c.diskPath, key+cacheFileExtension)
+}
+
+func (c *responseCache) readFile(key string) (*cacheEntry, error) {
+	data, err := ioutil.ReadFile(c.filePath(key))
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// writeFile writes the entry to a temporary file before renaming it, so that
+// partially written entries are never read.
+func (c *responseCache) writeFile(key string, entry *cacheEntry) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(c.diskPath, key+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.filePath(key))
+}
+
+func (c *responseCache) removeFile(key string) {
+	if err := os.Remove(c.filePath(key)); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Error removing upstream %q cache file: %v", c.upstream, err)
+	}
+}
+
+// newEntry creates a cache entry from the recorded response, or returns nil
+// if the response is not cacheable.
+// It also returns whether the response is public, and should be shared by
+// all users rather than only users with the same key claims.
+func (c *responseCache) newEntry(recorder *cacheRecorder, req *http.Request, session *sessionsapi.SessionState) (*cacheEntry, bool) {
+	if recorder.status != http.StatusOK || recorder.overflow || recorder.hijacked {
+		return nil, false
+	}
+
+	header := recorder.responseHeader()
+	if len(header.Values("Set-Cookie")) > 0 {
+		return nil, false
+	}
+	for _, vary := range header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			if !strings.EqualFold(strings.TrimSpace(name), "Accept-Encoding") {
+				return nil, false
+			}
+		}
+	}
+
+	cacheControl := parseCacheControl(header.Values("Cache-Control"))
+	if cacheControl.has("no-store") || cacheControl.has("no-cache") {
+		return nil, false
+	}
+	// Responses to authorized requests may be specific to the credentials,
+	// unless the upstream marks them as public
+	if req.Header.Get("Authorization") != "" && !cacheControl.has("public") {
+		return nil, false
+	}
+
+	public := c.sharePublic && cacheControl.has("public") && !cacheControl.has("private")
+	// Requests without a session share the same key, so private responses
+	// may only be cached when the key includes the user
+	shared := public || session == nil
+	if shared && cacheControl.has("private") {
+		return nil, false
+	}
+
+	now := c.clock.Now()
+	ttl := c.ttl(header, cacheControl, shared, now)
+	if ttl <= 0 {
+		return nil, false
+	}
+
+	return &cacheEntry{
+		Status:   recorder.status,
+		Header:   header,
+		Body:     recorder.body.Bytes(),
+		StoredAt: now,
+		Expires:  now.Add(ttl),
+	}, public
+}
+
+// ttl is how long the response can be cached for, based on the
+// Cache-Control and Expires headers, or the default TTL.
+func (c *responseCache) ttl(header http.Header, cacheControl cacheControl, shared bool, now time.Time) time.Duration {
+	if shared {
+		if seconds, ok := cacheControl.seconds("s-maxage"); ok {
+			return seconds
+		}
+	}
+	if seconds, ok := cacheControl.seconds("max-age"); ok {
+		return seconds
+	}
+
+	if expiresHeader := header.Get("Expires"); expiresHeader != "" {
+		expires, err := http.ParseTime(expiresHeader)
+		if err != nil {
+			// Invalid Expires headers mean the response has already expired
+			return 0
+		}
+		date := now
+		if dateHeader, err := http.ParseTime(header.Get("Date")); err == nil {
+			date = dateHeader
+		}
+		return expires.Sub(date)
+	}
+
+	return c.defaultTTL
+}
+
+// writeEntry writes the cached response, or a 304 Not Modified response if
+// the request's conditional headers match the cached response.
+func (c *responseCache) writeEntry(rw http.ResponseWriter, req *http.Request, entry *cacheEntry) {
+	for key, values := range entry.Header {
+		rw.Header()[key] = append([]string(nil), values...)
+	}
+	age := int64(c.clock.Since(entry.StoredAt) / time.Second)
+	rw.Header().Set("Age", strconv.FormatInt(age, 10))
+
+	if notModified(req, entry.Header) {
+		rw.Header().Del("Content-Length")
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rw.WriteHeader(entry.Status)
+	if _, err := rw.Write(entry.Body); err != nil {
+		logger.Errorf("Error writing cached response for upstream %q: %v", c.upstream, err)
+	}
+}
+
+// notModified checks the If-None-Match header against the ETag, or when it
+// is not set, the If-Modified-Since header against the Last-Modified header.
+func notModified(req *http.Request, header http.Header) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ifModifiedSince, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ifModifiedSince)
+}
+
+// cacheControl is the set of directives of a Cache-Control header.
+type cacheControl map[string]string
+
+func parseCacheControl(headers []string) cacheControl {
+	directives := cacheControl{}
+	for _, header := range headers {
+		for _, directive := range strings.Split(header, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value := directive, ""
+			if i := strings.Index(directive, "="); i >= 0 {
+				name, value = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			directives[strings.ToLower(name)] = value
+		}
+	}
+	return directives
+}
+
+func (c cacheControl) has(directive string) bool {
+	_, ok := c[directive]
+	return ok
+}
+
+func (c cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, ok := c[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		// Invalid values mean the response has already expired
+		return 0, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cacheRecorder passes the response to the client while recording it so
+// that it can be cached.
+type cacheRecorder struct {
+	http.ResponseWriter
+	maxBodySize int64
+
+	// initialHeader is the header set before the response was passed to the
+	// upstream, such as the injected response headers
+	initialHeader http.Header
+
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+	hijacked bool
+}
+
+// responseHeader returns the recorded header without the values that were
+// set before the response was passed to the upstream, as these may be
+// specific to the user.
+func (r *cacheRecorder) responseHeader() http.Header {
+	header := http.Header{}
+	for key, values := range r.header {
+		if !equalValues(values, r.initialHeader[key]) {
+			header[key] = values
+		}
+	}
+	return header
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteHeader records the status code and a copy of the headers, and writes
+// the status code to the ResponseWriter
+func (r *cacheRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		r.header = r.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the body, unless it is larger than the max body size, and
+// writes it to the ResponseWriter
+func (r *cacheRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.overflow {
+		if int64(r.body.Len()+len(b)) > r.maxBodySize {
+			r.overflow = true
+			r.body.Reset()
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Hijack implements the `http.Hijacker` interface that actual ResponseWriters
+// implement to support websockets
+func (r *cacheRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := r.ResponseWriter.(http.Hijacker); ok {
+		r.hijacked = true
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("http.Hijacker is not available on writer")
+}
+
+// Flush sends any buffered data to the client. Implements the `http.Flusher`
+// interface
+func (r *cacheRecorder) Flush() {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// lruCache tracks the size of its entries and removes the least recently
+// used entries when it is full.
+// It is not safe for concurrent use.
+type lruCache struct {
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element
+	order   *list.List
+	onEvict func(key string)
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	entry *cacheEntry
+}
+
+func newLRUCache(maxSize int64, onEvict func(key string)) *lruCache {
+	return &lruCache{
+		maxSize: maxSize,
+		items:   make(map[string]*list.Element),
+		order:   list.New(),
+		onEvict: onEvict,
+	}
+}
+
+// get returns the entry for the key and marks it as recently used.
+func (l *lruCache) get(key string) (*cacheEntry, bool) {
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(elem)
+	return elem.Value.(*lruItem).entry, true
+}
+
+// add stores the entry, removing the least recently used entries to make
+// room for it. Entries larger than the cache are not stored.
+func (l *lruCache) add(key string, size int64, entry *cacheEntry) {
+	if elem, ok := l.items[key]; ok {
+		l.size -= elem.Value.(*lruItem).size
+		l.order.Remove(elem)
+		delete(l.items, key)
+	}
+	if size > l.maxSize {
+		if l.onEvict != nil {
+			l.onEvict(key)
+		}
+		return
+	}
+
+	for l.size+size > l.maxSize {
+		l.evict(l.order.Back())
+	}
+	l.items[key] = l.order.PushFront(&lruItem{key: key, size: size, entry: entry})
+	l.size += size
+}
+
+// remove removes the entry for the key.
+func (l *lruCache) remove(key string) {
+	if elem, ok := l.items[key]; ok {
+		l.evict(elem)
+	}
+}
+
+func (l *lruCache) evict(elem *list.Element) {
+	item := elem.Value.(*lruItem)
+	l.order.Remove(elem)
+	delete(l.items, item.key)
+	l.size -= item.size
+	if l.onEvict != nil {
+		l.onEvict(item.key)
+	}
+}
+
+// cacheMetrics reports the cache hits and misses to Prometheus.
+type cacheMetrics struct {
+	requests *prometheus.CounterVec
+}
+
+func newCacheMetrics(registerer prometheus.Registerer) *cacheMetrics {
+	return &cacheMetrics{
+		requests: registerCacheRequestsCounter(registerer),
+	}
+}
+
+func (m *cacheMetrics) request(upstream, result string) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(upstream, result).Inc()
+}
+
+// registerCacheRequestsCounter registers 'oauth2_proxy_upstream_cache_requests_total'
+// This keeps a tally of the cacheable requests that hit or missed the cache
+func registerCacheRequestsCounter(registerer prometheus.Registerer) *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "oauth2_proxy_upstream_cache_requests_total",
+			Help: "Total number of cacheable upstream requests by cache result (hit or miss).",
+		},
+		[]string{"upstream", "result"},
+	)
+
+	if err := registerer.Register(counter); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counter = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			panic(err)
+		}
+	}
+
+	return counter
+}
+
+func int64OrDefault(value, defaultValue int64) int64 {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,406 @@
+package upstream
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Response Cache", func() {
+	var metrics *cacheMetrics
+	var requests int
+	var responseHeaders http.Header
+	var responseBody string
+	var upstream http.Handler
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		metrics = newCacheMetrics(prometheus.NewRegistry())
+		requests = 0
+		responseHeaders = http.Header{"Cache-Control": []string{"max-age=60"}}
+		responseBody = "body"
+		upstream = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			requests++
+			for key, values := range responseHeaders {
+				rw.Header()[key] = values
+			}
+			rw.WriteHeader(http.StatusOK)
+			_, err := rw.Write([]byte(responseBody))
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	newCache := func(opts *options.UpstreamCache) *responseCache {
+		cache, err := newResponseCache(options.Upstream{ID: "cache", Cache: opts}, metrics)
+		Expect(err).ToNot(HaveOccurred())
+		cache.clock.Set(now)
+		return cache
+	}
+
+	serve := func(cache *responseCache, session *sessionsapi.SessionState, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("", "http://example.com/static/app.js", nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{Session: session})
+		rw := httptest.NewRecorder()
+		cache.serveHTTP(upstream, rw, req)
+		return rw
+	}
+
+	It("serves repeated requests from the cache", func() {
+		cache := newCache(&options.UpstreamCache{})
+
+		first := serve(cache, nil, nil)
+		Expect(first.Code).To(Equal(http.StatusOK))
+		Expect(first.Body.String()).To(Equal("body"))
+
+		Expect(cache.clock.Add(10 * time.Second)).To(Succeed())
+		second := serve(cache, nil, nil)
+		Expect(second.Code).To(Equal(http.StatusOK))
+		Expect(second.Body.String()).To(Equal("body"))
+		Expect(second.Header().Get("Cache-Control")).To(Equal("max-age=60"))
+		Expect(second.Header().Get("Age")).To(Equal("10"))
+
+		Expect(requests).To(Equal(1))
+		Expect(testutil.ToFloat64(metrics.requests.WithLabelValues("cache", cacheResultMiss))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(metrics.requests.WithLabelValues("cache", cacheResultHit))).To(Equal(1.0))
+	})
+
+	It("sends requests to the upstream once the response expires", func() {
+		cache := newCache(&options.UpstreamCache{})
+
+		serve(cache, nil, nil)
+		Expect(cache.clock.Add(time.Minute)).To(Succeed())
+		serve(cache, nil, nil)
+
+		Expect(requests).To(Equal(2))
+	})
+
+	It("does not serve requests with no-cache from the cache", func() {
+		cache := newCache(&options.UpstreamCache{})
+
+		serve(cache, nil, nil)
+		serve(cache, nil, map[string]string{"Cache-Control": "no-cache"})
+
+		Expect(requests).To(Equal(2))
+	})
+
+	It("does not cache headers set before the upstream", func() {
+		cache := newCache(&options.UpstreamCache{})
+
+		req := httptest.NewRequest("", "http://example.com/static/app.js", nil)
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+		rw := httptest.NewRecorder()
+		rw.Header().Set("X-Auth-Request-User", "alice")
+		cache.serveHTTP(upstream, rw, req)
+
+		second := serve(cache, nil, nil)
+		Expect(second.Header().Get("X-Auth-Request-User")).To(BeEmpty())
+		Expect(requests).To(Equal(1))
+	})
+
+	type cacheableTableInput struct {
+		opts            *options.UpstreamCache
+		session         *sessionsapi.SessionState
+		responseHeaders http.Header
+		responseBody    string
+		cached          bool
+	}
+
+	DescribeTable("should only cache cacheable responses",
+		func(in cacheableTableInput) {
+			responseHeaders = in.responseHeaders
+			if in.responseBody != "" {
+				responseBody = in.responseBody
+			}
+			cache := newCache(in.opts)
+
+			serve(cache, in.session, nil)
+			serve(cache, in.session, nil)
+
+			if in.cached {
+				Expect(requests).To(Equal(1))
+			} else {
+				Expect(requests).To(Equal(2))
+			}
+		},
+		Entry("with max-age", cacheableTableInput{
+			opts:            &options.UpstreamCache{},
+			responseHeaders: http.Header{"Cache-Control": []string{"public, max-age=60"}},
+			cached:          true,
+		}),
+		Entry("with s-maxage", cacheableTableInput{
+			opts:            &options.UpstreamCache{},
+			responseHeaders: http.Header{"Cache-Control": []string{"max-age=0, s-maxage=60"}},
+			cached:          true,
+		}),
+		Entry("with Expires", cacheableTableInput{
+			opts: &options.UpstreamCache{},
+			responseHeaders: http.Header{
+				"Date":    []string{now.Format(http.TimeFormat)},
+				"Expires": []string{now.Add(time.Hour).Format(http.TimeFormat)},
+			},
+			cached: true,
+		}),
+		Entry("with no freshness information", cacheableTableInput{
+			opts:            &options.UpstreamCache{},
+			responseHeaders: http.Header{},
+			cached:          false,
+		}),
+		Entry("with no freshness information and a default TTL", cacheableTableInput{
+			opts: &options.UpstreamCache{
+				DefaultTTL: func() *options.Duration { d := options.Duration(time.Minute); return &d }(),
+			},
+			responseHeaders: http.Header{},
+			cached:          true,
+		}),
+		Entry("with no-store", cacheableTableInput{
+			opts:            &options.UpstreamCache{},
+			responseHeaders: http.Header{"Cache-Control": []string{"no-store"}},
+			cached:          false,
+		}),
+		Entry("with no-cache", cacheableTableInput{
+			opts:            &options.UpstreamCache{},
+			responseHeaders: http.Header{"Cache-Control": []string{"no-cache, max-age=60"}},
+			cached:          false,
+		}),
+		Entry("with private and no key claims", cacheableTableInput{
+			opts:            &options.UpstreamCache{},
+			responseHeaders: http.Header{"Cache-Control": []string{"private, max-age=60"}},
+			cached:          false,
+		}),
+		Entry("with private and key claims", cacheableTableInput{
+			opts:            &options.UpstreamCache{KeyClaims: []string{"user"}},
+			session:         &sessionsapi.SessionState{User: "alice"},
+			responseHeaders: http.Header{"Cache-Control": []string{"private, max-age=60"}},
+			cached:          true,
+		}),
+		Entry("with private and key claims without a session", cacheableTableInput{
+			opts:            &options.UpstreamCache{KeyClaims: []string{"user"}},
+			responseHeaders: http.Header{"Cache-Control": []string{"private, max-age=60"}},
+			cached:          false,
+		}),
+		Entry("with Set-Cookie", cacheableTableInput{
+			opts: &options.UpstreamCache{},
+			responseHeaders: http.Header{
+				"Cache-Control": []string{"max-age=60"},
+				"Set-Cookie":    []string{"session=abc"},
+			},
+			cached: false,
+		}),
+		Entry("with Vary on Accept-Encoding", cacheableTableInput{
+			opts: &options.UpstreamCache{},
+			responseHeaders: http.Header{
+				"Cache-Control": []string{"max-age=60"},
+				"Vary":          []string{"Accept-Encoding"},
+			},
+			cached: true,
+		}),
+		Entry("with Vary on another header", cacheableTableInput{
+			opts: &options.UpstreamCache{},
+			responseHeaders: http.Header{
+				"Cache-Control": []string{"max-age=60"},
+				"Vary":          []string{"Accept-Encoding, Authorization"},
+			},
+			cached: false,
+		}),
+		Entry("with a body larger than the max entry size", cacheableTableInput{
+			opts:            &options.UpstreamCache{MaxEntrySize: 8},
+			responseHeaders: http.Header{"Cache-Control": []string{"max-age=60"}},
+			responseBody:    strings.Repeat("x", 9),
+			cached:          false,
+		}),
+	)
+
+	It("does not share responses between users without key claims", func() {
+		cache := newCache(&options.UpstreamCache{})
+		alice := &sessionsapi.SessionState{User: "alice", Email: "alice@example.com"}
+		bob := &sessionsapi.SessionState{User: "bob", Email: "bob@example.com"}
+
+		serve(cache, alice, nil)
+		serve(cache, alice, nil)
+		Expect(requests).To(Equal(1))
+
+		serve(cache, bob, nil)
+		Expect(requests).To(Equal(2))
+	})
+
+	It("shares public responses between users without key claims", func() {
+		responseHeaders = http.Header{"Cache-Control": []string{"public, max-age=60"}}
+		cache := newCache(&options.UpstreamCache{})
+
+		serve(cache, &sessionsapi.SessionState{User: "alice"}, nil)
+		serve(cache, &sessionsapi.SessionState{User: "bob"}, nil)
+		serve(cache, nil, nil)
+		Expect(requests).To(Equal(1))
+	})
+
+	It("caches private responses for users without key claims", func() {
+		responseHeaders = http.Header{"Cache-Control": []string{"private, max-age=60"}}
+		cache := newCache(&options.UpstreamCache{})
+		alice := &sessionsapi.SessionState{User: "alice"}
+
+		serve(cache, alice, nil)
+		serve(cache, alice, nil)
+		Expect(requests).To(Equal(1))
+
+		serve(cache, &sessionsapi.SessionState{User: "bob"}, nil)
+		Expect(requests).To(Equal(2))
+	})
+
+	DescribeTable("should only cache responses to requests with an Authorization header when they are public",
+		func(cacheControl string, cached bool) {
+			responseHeaders = http.Header{"Cache-Control": []string{cacheControl}}
+			cache := newCache(&options.UpstreamCache{KeyClaims: []string{"user"}})
+			authorization := map[string]string{"Authorization": "Bearer token"}
+
+			serve(cache, nil, authorization)
+			serve(cache, nil, authorization)
+
+			if cached {
+				Expect(requests).To(Equal(1))
+			} else {
+				Expect(requests).To(Equal(2))
+			}
+		},
+		Entry("with max-age", "max-age=60", false),
+		Entry("with public", "public, max-age=60", true),
+	)
+
+	It("does not share responses between users with key claims", func() {
+		cache := newCache(&options.UpstreamCache{KeyClaims: []string{"user", "groups"}})
+		alice := &sessionsapi.SessionState{User: "alice", Groups: []string{"admins"}}
+		bob := &sessionsapi.SessionState{User: "bob", Groups: []string{"admins"}}
+
+		serve(cache, alice, nil)
+		serve(cache, alice, nil)
+		Expect(requests).To(Equal(1))
+
+		serve(cache, bob, nil)
+		Expect(requests).To(Equal(2))
+	})
+
+	type conditionalTableInput struct {
+		requestHeaders map[string]string
+		expectedCode   int
+	}
+
+	DescribeTable("should answer conditional requests from the cache",
+		func(in conditionalTableInput) {
+			responseHeaders = http.Header{
+				"Cache-Control": []string{"max-age=60"},
+				"Etag":          []string{`"v1"`},
+				"Last-Modified": []string{now.Add(-time.Hour).Format(http.TimeFormat)},
+			}
+			cache := newCache(&options.UpstreamCache{})
+			serve(cache, nil, nil)
+
+			rw := serve(cache, nil, in.requestHeaders)
+			Expect(rw.Code).To(Equal(in.expectedCode))
+			Expect(requests).To(Equal(1))
+		},
+		Entry("with a matching If-None-Match", conditionalTableInput{
+			requestHeaders: map[string]string{"If-None-Match": `"v0", W/"v1"`},
+			expectedCode:   http.StatusNotModified,
+		}),
+		Entry("with a different If-None-Match", conditionalTableInput{
+			requestHeaders: map[string]string{"If-None-Match": `"v0"`},
+			expectedCode:   http.StatusOK,
+		}),
+		Entry("with a later If-Modified-Since", conditionalTableInput{
+			requestHeaders: map[string]string{"If-Modified-Since": now.Format(http.TimeFormat)},
+			expectedCode:   http.StatusNotModified,
+		}),
+		Entry("with an earlier If-Modified-Since", conditionalTableInput{
+			requestHeaders: map[string]string{"If-Modified-Since": now.Add(-2 * time.Hour).Format(http.TimeFormat)},
+			expectedCode:   http.StatusOK,
+		}),
+	)
+
+	Context("with a disk cache", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "oauth2-proxy-cache")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("serves responses that do not fit in memory from disk", func() {
+			cache := newCache(&options.UpstreamCache{
+				MaxSize:  1,
+				DiskPath: dir,
+			})
+
+			serve(cache, nil, nil)
+			files, err := filepath.Glob(filepath.Join(dir, "*"+cacheFileExtension))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+
+			rw := serve(cache, nil, nil)
+			Expect(rw.Body.String()).To(Equal("body"))
+			Expect(requests).To(Equal(1))
+		})
+
+		It("removes cache files when they are evicted", func() {
+			cache := newCache(&options.UpstreamCache{
+				DiskPath:    dir,
+				DiskMaxSize: 1,
+			})
+
+			serve(cache, nil, nil)
+			files, err := filepath.Glob(filepath.Join(dir, "*"+cacheFileExtension))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(BeEmpty())
+		})
+
+		It("removes cache files from a previous run", func() {
+			stale := filepath.Join(dir, "stale"+cacheFileExtension)
+			other := filepath.Join(dir, "other.txt")
+			Expect(ioutil.WriteFile(stale, []byte("stale"), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(other, []byte("other"), 0600)).To(Succeed())
+
+			newCache(&options.UpstreamCache{DiskPath: dir})
+
+			Expect(stale).ToNot(BeAnExistingFile())
+			Expect(other).To(BeAnExistingFile())
+		})
+	})
+
+	It("evicts the least recently used entries", func() {
+		evicted := []string{}
+		lru := newLRUCache(10, func(key string) { evicted = append(evicted, key) })
+
+		lru.add("a", 4, nil)
+		lru.add("b", 4, nil)
+		_, ok := lru.get("a")
+		Expect(ok).To(BeTrue())
+
+		lru.add("c", 4, nil)
+		Expect(evicted).To(Equal([]string{"b"}))
+		_, ok = lru.get("b")
+		Expect(ok).To(BeFalse())
+
+		lru.add("d", 11, nil)
+		Expect(evicted).To(Equal([]string{"b", "d"}))
+		Expect(lru.size).To(BeEquivalentTo(8))
+	})
+})
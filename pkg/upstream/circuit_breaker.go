@@ -0,0 +1,144 @@
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// errCircuitOpen is returned by the circuitBreakerTransport for requests made
+// while the circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+const defaultCircuitBreakerErrorMessage = "The upstream server is temporarily unavailable."
+
+// circuitBreakerTransport fails requests fast, without sending them to the
+// upstream, after too many consecutive failures.
+// Once the circuit breaker has been open for the open duration, a single
+// trial request is allowed through. The circuit breaker closes if the trial
+// request succeeds and opens again if it fails.
+type circuitBreakerTransport struct {
+	upstream            string
+	target              string
+	transport           http.RoundTripper
+	consecutiveFailures int
+	openDuration        time.Duration
+
+	clock clock.Clock
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	// trial is set while a trial request is in flight
+	trial bool
+}
+
+func newCircuitBreakerTransport(transport http.RoundTripper, upstream options.Upstream, target *url.URL) *circuitBreakerTransport {
+	cb := upstream.CircuitBreaker
+	return &circuitBreakerTransport{
+		upstream:            upstream.ID,
+		target:              target.Host,
+		transport:           transport,
+		consecutiveFailures: cb.ConsecutiveFailures,
+		openDuration:        durationOrDefault(cb.OpenDuration, options.DefaultCircuitBreakerOpenDuration),
+	}
+}
+
+// RoundTrip sends the request to the upstream unless the circuit breaker is
+// open.
+func (c *circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !c.allow() {
+		return nil, errCircuitOpen
+	}
+
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil && req.Context().Err() != nil {
+		// The client went away, this says nothing about the upstream
+		c.release()
+		return resp, err
+	}
+	c.record(err == nil && resp.StatusCode < http.StatusInternalServerError)
+	return resp, err
+}
+
+// allow returns whether a request may be sent to the upstream.
+func (c *circuitBreakerTransport) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.openedAt.IsZero() {
+		return true
+	}
+	if c.trial || c.clock.Since(c.openedAt) < c.openDuration {
+		return false
+	}
+	c.trial = true
+	return true
+}
+
+// release allows another trial request when a trial request was abandoned.
+func (c *circuitBreakerTransport) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trial = false
+}
+
+// record updates the circuit breaker with the outcome of a request.
+func (c *circuitBreakerTransport) record(success bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.trial = false
+	if success {
+		if !c.openedAt.IsZero() {
+			logger.Printf("upstream %q circuit breaker for %q closed after a successful trial request", c.upstream, c.target)
+		}
+		c.failures = 0
+		c.openedAt = time.Time{}
+		return
+	}
+
+	c.failures++
+	if !c.openedAt.IsZero() || c.failures >= c.consecutiveFailures {
+		if c.openedAt.IsZero() {
+			logger.Errorf("upstream %q circuit breaker for %q opened after %d consecutive failures", c.upstream, c.target, c.failures)
+		}
+		c.openedAt = c.clock.Now()
+	}
+}
+
+// newCircuitBreakerErrorHandler creates a ProxyErrorHandler that serves the
+// configured error page for requests failed by the circuit breaker.
+func newCircuitBreakerErrorHandler(cb *options.CircuitBreaker, writer pagewriter.Writer) ProxyErrorHandler {
+	code := options.DefaultCircuitBreakerErrorCode
+	if cb.ErrorCode != nil {
+		code = *cb.ErrorCode
+	}
+	message := cb.ErrorMessage
+	if message == "" {
+		message = defaultCircuitBreakerErrorMessage
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request, proxyErr error) {
+		if !errors.Is(proxyErr, errCircuitOpen) {
+			writer.ProxyErrorHandler(rw, req, proxyErr)
+			return
+		}
+
+		scope := middleware.GetRequestScope(req)
+		writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+			Status:    code,
+			RequestID: scope.RequestID,
+			AppError:  proxyErr.Error(),
+			Messages:  []interface{}{"%s", message},
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package upstream
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Circuit Breaker Suite", func() {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	target, _ := url.Parse("http://backend")
+
+	Context("circuitBreakerTransport", func() {
+		var transport *circuitBreakerTransport
+		var calls int
+		var failing bool
+
+		BeforeEach(func() {
+			calls = 0
+			failing = true
+			upstream := options.Upstream{
+				ID: "breaker",
+				CircuitBreaker: &options.CircuitBreaker{
+					ConsecutiveFailures: 2,
+					OpenDuration:        durationPtr(time.Minute),
+				},
+			}
+			transport = newCircuitBreakerTransport(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+				calls++
+				if failing {
+					return nil, errors.New("connection refused")
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+			}), upstream, target)
+			transport.clock.Set(now)
+		})
+
+		roundTrip := func() error {
+			_, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+			return err
+		}
+
+		It("opens after consecutive failures", func() {
+			Expect(roundTrip()).ToNot(Equal(errCircuitOpen))
+			Expect(roundTrip()).ToNot(Equal(errCircuitOpen))
+			Expect(roundTrip()).To(Equal(errCircuitOpen))
+			Expect(calls).To(Equal(2))
+		})
+
+		It("counts 5xx responses as failures", func() {
+			transport.transport = roundTripperFunc(func(*http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+			})
+			Expect(roundTrip()).To(Succeed())
+			Expect(roundTrip()).To(Succeed())
+			Expect(roundTrip()).To(Equal(errCircuitOpen))
+		})
+
+		It("resets the failures after a success", func() {
+			Expect(roundTrip()).ToNot(Succeed())
+			failing = false
+			Expect(roundTrip()).To(Succeed())
+			failing = true
+			Expect(roundTrip()).ToNot(Equal(errCircuitOpen))
+			Expect(calls).To(Equal(3))
+		})
+
+		It("closes after a successful trial request", func() {
+			Expect(roundTrip()).ToNot(Succeed())
+			Expect(roundTrip()).ToNot(Succeed())
+
+			Expect(transport.clock.Add(time.Minute)).To(Succeed())
+			failing = false
+			Expect(roundTrip()).To(Succeed())
+			Expect(roundTrip()).To(Succeed())
+			Expect(calls).To(Equal(4))
+		})
+
+		It("opens again after a failed trial request", func() {
+			Expect(roundTrip()).ToNot(Succeed())
+			Expect(roundTrip()).ToNot(Succeed())
+
+			Expect(transport.clock.Add(time.Minute)).To(Succeed())
+			Expect(roundTrip()).ToNot(Equal(errCircuitOpen))
+			Expect(roundTrip()).To(Equal(errCircuitOpen))
+			Expect(calls).To(Equal(3))
+		})
+
+		It("allows a single trial request at a time", func() {
+			Expect(roundTrip()).ToNot(Succeed())
+			Expect(roundTrip()).ToNot(Succeed())
+			Expect(transport.clock.Add(time.Minute)).To(Succeed())
+
+			Expect(transport.allow()).To(BeTrue())
+			Expect(transport.allow()).To(BeFalse())
+		})
+	})
+
+	Context("newProxyErrorHandler", func() {
+		var written pagewriter.ErrorPageOpts
+		var proxyErr error
+
+		writer := &pagewriter.WriterFuncs{
+			ErrorPageFunc: func(rw http.ResponseWriter, opts pagewriter.ErrorPageOpts) {
+				written = opts
+				rw.WriteHeader(opts.Status)
+			},
+			ProxyErrorFunc: func(rw http.ResponseWriter, _ *http.Request, err error) {
+				proxyErr = err
+				rw.WriteHeader(http.StatusBadGateway)
+			},
+		}
+
+		BeforeEach(func() {
+			written = pagewriter.ErrorPageOpts{}
+			proxyErr = nil
+		})
+
+		handle := func(handler ProxyErrorHandler, err error) int {
+			req := middlewareapi.AddRequestScope(httptest.NewRequest("", "/", nil), &middlewareapi.RequestScope{RequestID: "11111111-2222-4333-8444-555555555555"})
+			rw := httptest.NewRecorder()
+			handler(rw, req, err)
+			return rw.Code
+		}
+
+		It("serves the configured error page when the circuit breaker is open", func() {
+			code := http.StatusTooManyRequests
+			handler := newProxyErrorHandler(options.Upstream{CircuitBreaker: &options.CircuitBreaker{
+				ConsecutiveFailures: 1,
+				ErrorCode:           &code,
+				ErrorMessage:        "Try again later",
+			}}, writer)
+
+			Expect(handle(handler, errCircuitOpen)).To(Equal(http.StatusTooManyRequests))
+			Expect(written).To(Equal(pagewriter.ErrorPageOpts{
+				Status:    http.StatusTooManyRequests,
+				RequestID: "11111111-2222-4333-8444-555555555555",
+				AppError:  errCircuitOpen.Error(),
+				Messages:  []interface{}{"%s", "Try again later"},
+			}))
+			Expect(proxyErr).To(BeNil())
+		})
+
+		It("serves the default error page when the circuit breaker is open", func() {
+			handler := newProxyErrorHandler(options.Upstream{CircuitBreaker: &options.CircuitBreaker{ConsecutiveFailures: 1}}, writer)
+
+			Expect(handle(handler, errCircuitOpen)).To(Equal(http.StatusServiceUnavailable))
+			Expect(written.Messages).To(Equal([]interface{}{"%s", defaultCircuitBreakerErrorMessage}))
+		})
+
+		It("serves a bad gateway for other errors", func() {
+			handler := newProxyErrorHandler(options.Upstream{CircuitBreaker: &options.CircuitBreaker{ConsecutiveFailures: 1}}, writer)
+
+			err := errors.New("connection refused")
+			Expect(handle(handler, err)).To(Equal(http.StatusBadGateway))
+			Expect(proxyErr).To(Equal(err))
+		})
+	})
+})
@@ -0,0 +1,152 @@
+package upstream
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/justinas/alice"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/header"
+)
+
+// headerRules applies the header rules of an upstream to a header.
+type headerRules struct {
+	remove   []string
+	rename   []options.HeaderRename
+	replace  []string
+	injector header.Injector
+}
+
+func newHeaderRules(rules *options.HeaderRules) (*headerRules, error) {
+	if rules == nil {
+		return nil, nil
+	}
+
+	injector, err := header.NewInjector(rules.Set)
+	if err != nil {
+		return nil, err
+	}
+
+	replace := []string{}
+	for _, h := range rules.Set {
+		if !h.PreserveRequestValue {
+			replace = append(replace, h.Name)
+		}
+	}
+
+	return &headerRules{
+		remove:   rules.Remove,
+		rename:   rules.Rename,
+		replace:  replace,
+		injector: injector,
+	}, nil
+}
+
+// apply removes, renames and then sets the headers.
+func (r *headerRules) apply(h http.Header, session *sessionsapi.SessionState) {
+	for _, name := range r.remove {
+		h.Del(name)
+	}
+	for _, rename := range r.rename {
+		values := h.Values(rename.From)
+		if len(values) == 0 {
+			continue
+		}
+		h.Del(rename.From)
+		h[http.CanonicalHeaderKey(rename.To)] = values
+	}
+	for _, name := range r.replace {
+		h.Del(name)
+	}
+	r.injector.Inject(h, session)
+}
+
+// newHeaderRulesHandler creates a new middleware that applies the request
+// and response header rules of the upstream.
+// It returns nil if the upstream has no header rules.
+func newHeaderRulesHandler(upstream options.Upstream) (alice.Constructor, error) {
+	if upstream.RequestHeaders == nil && upstream.ResponseHeaders == nil {
+		return nil, nil
+	}
+
+	requestRules, err := newHeaderRules(upstream.RequestHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("error building request header rules: %v", err)
+	}
+	responseRules, err := newHeaderRules(upstream.ResponseHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("error building response header rules: %v", err)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			// If scope is nil, this will panic.
+			// A scope should always be injected before this handler is called.
+			session := middleware.GetRequestScope(req).Session
+
+			if requestRules != nil {
+				requestRules.apply(req.Header, session)
+			}
+			if responseRules != nil {
+				rw = &headerRulesResponseWriter{
+					ResponseWriter: rw,
+					rules:          responseRules,
+					session:        session,
+				}
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}, nil
+}
+
+// headerRulesResponseWriter applies the response header rules when the
+// response headers are written.
+type headerRulesResponseWriter struct {
+	http.ResponseWriter
+	rules       *headerRules
+	session     *sessionsapi.SessionState
+	wroteHeader bool
+}
+
+// WriteHeader applies the header rules and writes the status code to the
+// ResponseWriter
+func (w *headerRulesResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.rules.apply(w.Header(), w.session)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write ensures the header rules are applied before the body is written
+func (w *headerRulesResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack implements the `http.Hijacker` interface that actual ResponseWriters
+// implement to support websockets
+func (w *headerRulesResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("http.Hijacker is not available on writer")
+}
+
+// Flush sends any buffered data to the client. Implements the `http.Flusher`
+// interface
+func (w *headerRulesResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
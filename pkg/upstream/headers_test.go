@@ -0,0 +1,176 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Header Rules", func() {
+	type headerRulesTableInput struct {
+		requestHeaders          *options.HeaderRules
+		responseHeaders         *options.HeaderRules
+		session                 *sessionsapi.SessionState
+		initialRequestHeaders   http.Header
+		upstreamResponseHeaders http.Header
+		expectedRequestHeaders  http.Header
+		expectedResponseHeaders http.Header
+	}
+
+	DescribeTable("should apply the header rules",
+		func(in headerRulesTableInput) {
+			req := httptest.NewRequest("", "http://example.com/", nil)
+			req.Header = in.initialRequestHeaders
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+				Session: in.session,
+			})
+			rw := httptest.NewRecorder()
+
+			headerRules, err := newHeaderRulesHandler(options.Upstream{
+				RequestHeaders:  in.requestHeaders,
+				ResponseHeaders: in.responseHeaders,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(headerRules).ToNot(BeNil())
+
+			var gotRequestHeaders http.Header
+			handler := headerRules(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotRequestHeaders = r.Header.Clone()
+				for key, values := range in.upstreamResponseHeaders {
+					w.Header()[key] = values
+				}
+				_, err := w.Write([]byte("body"))
+				Expect(err).ToNot(HaveOccurred())
+			}))
+			handler.ServeHTTP(rw, req)
+
+			Expect(gotRequestHeaders).To(Equal(in.expectedRequestHeaders))
+			Expect(rw.Header()).To(Equal(in.expectedResponseHeaders))
+			Expect(rw.Body.String()).To(Equal("body"))
+		},
+		Entry("removes request and response headers", headerRulesTableInput{
+			requestHeaders: &options.HeaderRules{
+				Remove: []string{"Cookie"},
+			},
+			responseHeaders: &options.HeaderRules{
+				Remove: []string{"Server", "X-Powered-By"},
+			},
+			initialRequestHeaders: http.Header{
+				"Cookie": []string{"_oauth2_proxy=session"},
+				"Accept": []string{"*/*"},
+			},
+			upstreamResponseHeaders: http.Header{
+				"Server":       []string{"nginx"},
+				"X-Powered-By": []string{"PHP"},
+				"Content-Type": []string{"text/plain"},
+			},
+			expectedRequestHeaders: http.Header{
+				"Accept": []string{"*/*"},
+			},
+			expectedResponseHeaders: http.Header{
+				"Content-Type": []string{"text/plain"},
+			},
+		}),
+		Entry("renames a request header", headerRulesTableInput{
+			requestHeaders: &options.HeaderRules{
+				Rename: []options.HeaderRename{
+					{From: "X-Forwarded-User", To: "x-remote-user"},
+					{From: "X-Missing", To: "X-Other"},
+				},
+			},
+			initialRequestHeaders: http.Header{
+				"X-Forwarded-User": []string{"alice"},
+			},
+			upstreamResponseHeaders: http.Header{
+				"Content-Type": []string{"text/plain"},
+			},
+			expectedRequestHeaders: http.Header{
+				"X-Remote-User": []string{"alice"},
+			},
+			expectedResponseHeaders: http.Header{
+				"Content-Type": []string{"text/plain"},
+			},
+		}),
+		Entry("sets a response header, replacing the upstream value", headerRulesTableInput{
+			responseHeaders: &options.HeaderRules{
+				Set: []options.Header{
+					{
+						Name: "Content-Security-Policy",
+						Values: []options.HeaderValue{
+							{SecretSource: &options.SecretSource{Value: []byte("default-src 'self'")}},
+						},
+					},
+				},
+			},
+			initialRequestHeaders: http.Header{},
+			upstreamResponseHeaders: http.Header{
+				"Content-Security-Policy": []string{"default-src *"},
+			},
+			expectedRequestHeaders: http.Header{},
+			expectedResponseHeaders: http.Header{
+				"Content-Security-Policy": []string{"default-src 'self'"},
+			},
+		}),
+		Entry("appends a response header when preserving the existing value", headerRulesTableInput{
+			responseHeaders: &options.HeaderRules{
+				Set: []options.Header{
+					{
+						Name:                 "Vary",
+						PreserveRequestValue: true,
+						Values: []options.HeaderValue{
+							{SecretSource: &options.SecretSource{Value: []byte("Cookie")}},
+						},
+					},
+				},
+			},
+			initialRequestHeaders: http.Header{},
+			upstreamResponseHeaders: http.Header{
+				"Vary": []string{"Accept-Encoding"},
+			},
+			expectedRequestHeaders: http.Header{},
+			expectedResponseHeaders: http.Header{
+				"Vary": []string{"Accept-Encoding", "Cookie"},
+			},
+		}),
+		Entry("sets a request header from a session claim", headerRulesTableInput{
+			requestHeaders: &options.HeaderRules{
+				Remove: []string{"X-Email"},
+				Set: []options.Header{
+					{
+						Name: "X-Email",
+						Values: []options.HeaderValue{
+							{ClaimSource: &options.ClaimSource{Claim: "email"}},
+						},
+					},
+				},
+			},
+			session: &sessionsapi.SessionState{
+				Email: "alice@example.com",
+			},
+			initialRequestHeaders: http.Header{
+				"X-Email": []string{"mallory@example.com"},
+			},
+			upstreamResponseHeaders: http.Header{
+				"Content-Type": []string{"text/plain"},
+			},
+			expectedRequestHeaders: http.Header{
+				"X-Email": []string{"alice@example.com"},
+			},
+			expectedResponseHeaders: http.Header{
+				"Content-Type": []string{"text/plain"},
+			},
+		}),
+	)
+
+	It("returns nil when the upstream has no header rules", func() {
+		headerRules, err := newHeaderRulesHandler(options.Upstream{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(headerRules).To(BeNil())
+	})
+})
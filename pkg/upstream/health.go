@@ -0,0 +1,446 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BackendStatus reports the health of a single backend of a load balanced
+// upstream.
+type BackendStatus struct {
+	Upstream     string     `json:"upstream"`
+	Backend      string     `json:"backend"`
+	Available    bool       `json:"available"`
+	Healthy      bool       `json:"healthy"`
+	EjectedUntil *time.Time `json:"ejectedUntil,omitempty"`
+}
+
+// backendHealth tracks whether a backend should be kept in rotation, based on
+// active health checks and the responses to proxied requests.
+type backendHealth struct {
+	upstream string
+	uri      string
+
+	healthyThreshold   int
+	unhealthyThreshold int
+	consecutiveErrors  int
+	ejectionDuration   time.Duration
+
+	clock   clock.Clock
+	metrics *healthMetrics
+
+	mu sync.Mutex
+	// healthy is the result of the active health checks
+	healthy   bool
+	successes int
+	failures  int
+	// errors is the number of consecutive failed requests to the backend
+	errors       int
+	ejectedUntil time.Time
+}
+
+// newBackendHealth creates the health tracking for a backend, or nil if
+// neither active or passive health checks are configured for the upstream.
+func newBackendHealth(upstream options.Upstream, uri string, metrics *healthMetrics) *backendHealth {
+	if upstream.HealthCheck == nil && upstream.OutlierDetection == nil {
+		return nil
+	}
+
+	h := &backendHealth{
+		upstream: upstream.ID,
+		uri:      uri,
+		healthy:  true,
+		metrics:  metrics,
+	}
+	if hc := upstream.HealthCheck; hc != nil {
+		h.healthyThreshold = intOrDefault(hc.HealthyThreshold, options.DefaultHealthCheckHealthyThreshold)
+		h.unhealthyThreshold = intOrDefault(hc.UnhealthyThreshold, options.DefaultHealthCheckUnhealthyThreshold)
+	}
+	if od := upstream.OutlierDetection; od != nil {
+		h.consecutiveErrors = od.ConsecutiveErrors
+		h.ejectionDuration = durationOrDefault(od.EjectionDuration, options.DefaultOutlierEjectionDuration)
+	}
+	h.metrics.setUp(h.upstream, h.uri, true)
+	return h
+}
+
+// available returns whether the backend should receive requests.
+func (h *backendHealth) available() bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.availableLocked()
+}
+
+// availableLocked returns whether the backend should receive requests.
+// Expired ejections are cleared here, as the selectors check every backend's
+// availability on each request.
+func (h *backendHealth) availableLocked() bool {
+	if !h.ejectedUntil.IsZero() {
+		if h.clock.Now().Before(h.ejectedUntil) {
+			return false
+		}
+		h.ejectedUntil = time.Time{}
+		h.metrics.setUp(h.upstream, h.uri, h.healthy)
+	}
+	return h.healthy
+}
+
+// recordCheck updates the health of the backend with the result of an active
+// health check.
+func (h *backendHealth) recordCheck(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil {
+		h.failures = 0
+		h.successes++
+		if !h.healthy && h.successes >= h.healthyThreshold {
+			logger.Printf("upstream %q backend %q is healthy", h.upstream, h.uri)
+			h.healthy = true
+		}
+	} else {
+		h.successes = 0
+		h.failures++
+		if h.healthy && h.failures >= h.unhealthyThreshold {
+			logger.Errorf("upstream %q backend %q is unhealthy: %v", h.upstream, h.uri, err)
+			h.healthy = false
+		}
+	}
+	h.metrics.setUp(h.upstream, h.uri, h.availableLocked())
+}
+
+// recordResponse updates the consecutive error count of the backend with the
+// outcome of a proxied request, ejecting the backend from rotation when it
+// reaches the outlier detection threshold.
+func (h *backendHealth) recordResponse(failed bool) {
+	if h.consecutiveErrors == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !failed {
+		h.errors = 0
+		return
+	}
+	h.errors++
+	if h.errors < h.consecutiveErrors {
+		return
+	}
+
+	h.errors = 0
+	h.ejectedUntil = h.clock.Now().Add(h.ejectionDuration)
+	logger.Errorf("upstream %q backend %q ejected for %s after %d consecutive errors", h.upstream, h.uri, h.ejectionDuration, h.consecutiveErrors)
+	h.metrics.ejected(h.upstream, h.uri)
+	h.metrics.setUp(h.upstream, h.uri, false)
+}
+
+// status reports the current health of the backend.
+func (h *backendHealth) status() BackendStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := BackendStatus{
+		Upstream:  h.upstream,
+		Backend:   h.uri,
+		Available: h.availableLocked(),
+		Healthy:   h.healthy,
+	}
+	if !h.ejectedUntil.IsZero() {
+		ejectedUntil := h.ejectedUntil
+		status.EjectedUntil = &ejectedUntil
+	}
+	return status
+}
+
+// healthChecker periodically requests the health check path of each backend
+// of an upstream.
+type healthChecker struct {
+	path           string
+	interval       time.Duration
+	timeout        time.Duration
+	expectedStatus []int
+	backends       []*backend
+}
+
+func newHealthChecker(upstream options.Upstream, backends []*backend) *healthChecker {
+	hc := upstream.HealthCheck
+	return &healthChecker{
+		path:           hc.Path,
+		interval:       durationOrDefault(hc.Interval, options.DefaultHealthCheckInterval),
+		timeout:        durationOrDefault(hc.Timeout, options.DefaultHealthCheckTimeout),
+		expectedStatus: hc.ExpectedStatus,
+		backends:       backends,
+	}
+}
+
+// run checks the backends every interval until done is closed.
+// Checks that are in progress when done is closed are cancelled.
+func (c *healthChecker) run(done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.checkAll(ctx)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll checks the health of every backend concurrently.
+func (c *healthChecker) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range c.backends {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			b.health.recordCheck(c.check(ctx, b))
+		}(b)
+	}
+	wg.Wait()
+}
+
+// check requests the health check path of the backend and checks the
+// response code.
+// The check uses the transport of the backend, so that it connects with the
+// same TLS and transport options as proxied requests.
+func (c *healthChecker) check(ctx context.Context, b *backend) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(b.uri, "/")+c.path, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Transport: b.transport,
+		// Redirects are reported as the status code of the check
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if !c.isExpectedStatus(resp.StatusCode) {
+		return errors.New("unexpected status code " + resp.Status)
+	}
+	return nil
+}
+
+func (c *healthChecker) isExpectedStatus(code int) bool {
+	if len(c.expectedStatus) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, expected := range c.expectedStatus {
+		if code == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// statusRecorder records the status code of a proxied response so that
+// failed requests can be counted against the backend.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code and writes it to the ResponseWriter
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack implements the `http.Hijacker` interface that actual ResponseWriters
+// implement to support websockets
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := r.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("http.Hijacker is not available on writer")
+}
+
+// Flush sends any buffered data to the client. Implements the `http.Flusher`
+// interface
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// healthMetrics reports the health of backends to Prometheus.
+type healthMetrics struct {
+	up        *prometheus.GaugeVec
+	ejections *prometheus.CounterVec
+}
+
+func newHealthMetrics(registerer prometheus.Registerer) *healthMetrics {
+	return &healthMetrics{
+		up:        registerBackendUpGauge(registerer),
+		ejections: registerBackendEjectionsCounter(registerer),
+	}
+}
+
+func (m *healthMetrics) setUp(upstream, uri string, up bool) {
+	if m == nil {
+		return
+	}
+	value := 0.0
+	if up {
+		value = 1
+	}
+	m.up.WithLabelValues(upstream, uri).Set(value)
+}
+
+func (m *healthMetrics) ejected(upstream, uri string) {
+	if m == nil {
+		return
+	}
+	m.ejections.WithLabelValues(upstream, uri).Inc()
+}
+
+// registerBackendUpGauge registers 'oauth2_proxy_upstream_backend_up'
+// This reports whether each backend is currently in rotation
+func registerBackendUpGauge(registerer prometheus.Registerer) *prometheus.GaugeVec {
+	gauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "oauth2_proxy_upstream_backend_up",
+			Help: "Whether the upstream backend is in rotation (1) or not (0).",
+		},
+		[]string{"upstream", "backend"},
+	)
+
+	if err := registerer.Register(gauge); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			gauge = are.ExistingCollector.(*prometheus.GaugeVec)
+		} else {
+			panic(err)
+		}
+	}
+
+	return gauge
+}
+
+// registerBackendEjectionsCounter registers 'oauth2_proxy_upstream_backend_ejections_total'
+// This keeps a tally of the backends ejected by outlier detection
+func registerBackendEjectionsCounter(registerer prometheus.Registerer) *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "oauth2_proxy_upstream_backend_ejections_total",
+			Help: "Total number of upstream backend ejections by outlier detection.",
+		},
+		[]string{"upstream", "backend"},
+	)
+
+	if err := registerer.Register(counter); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counter = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			panic(err)
+		}
+	}
+
+	return counter
+}
+
+func intOrDefault(value, defaultValue int) int {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func durationOrDefault(value *options.Duration, defaultValue time.Duration) time.Duration {
+	if value == nil || value.Duration() == 0 {
+		return defaultValue
+	}
+	return value.Duration()
+}
+
+// backendStatusReporter is implemented by proxies that can report the health
+// of their backends.
+type backendStatusReporter interface {
+	backendStatuses() []BackendStatus
+}
+
+// backendStatuses returns the health of the backends of the proxy, as created
+// by NewProxy.
+func backendStatuses(proxy http.Handler) []BackendStatus {
+	if reporter, ok := proxy.(backendStatusReporter); ok {
+		return reporter.backendStatuses()
+	}
+	return []BackendStatus{}
+}
+
+// NewBackendStatusHandler creates a handler that serves the health of the
+// backends of the proxy, as created by NewProxy, as JSON.
+func NewBackendStatusHandler(proxy http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		statuses := backendStatuses(proxy)
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(statuses); err != nil {
+			logger.Errorf("Error encoding upstream status: %v", err)
+		}
+	})
+}
+
+// CheckBackendAvailability returns an error if any upstream of the proxy, as
+// created by NewProxy, has health checked backends but none of them are
+// available.
+func CheckBackendAvailability(proxy http.Handler) error {
+	available := make(map[string]bool)
+	upstreams := []string{}
+	for _, status := range backendStatuses(proxy) {
+		if _, ok := available[status.Upstream]; !ok {
+			upstreams = append(upstreams, status.Upstream)
+		}
+		available[status.Upstream] = available[status.Upstream] || status.Available
+	}
+
+	unavailable := []string{}
+	for _, upstream := range upstreams {
+		if !available[upstream] {
+			unavailable = append(unavailable, fmt.Sprintf("%q", upstream))
+		}
+	}
+	if len(unavailable) > 0 {
+		return fmt.Errorf("no available backends for upstreams: %s", strings.Join(unavailable, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Health Check Suite", func() {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	errCheckFailed := errors.New("check failed")
+
+	var metrics *healthMetrics
+
+	BeforeEach(func() {
+		metrics = newHealthMetrics(prometheus.NewRegistry())
+	})
+
+	newHealth := func(upstream options.Upstream) *backendHealth {
+		upstream.ID = "health"
+		h := newBackendHealth(upstream, "http://backend", metrics)
+		h.clock.Set(now)
+		return h
+	}
+
+	upGauge := func() float64 {
+		return testutil.ToFloat64(metrics.up.WithLabelValues("health", "http://backend"))
+	}
+
+	It("does not track health without health checks", func() {
+		Expect(newBackendHealth(options.Upstream{}, "http://backend", metrics)).To(BeNil())
+	})
+
+	Context("with active health checks", func() {
+		var h *backendHealth
+
+		BeforeEach(func() {
+			h = newHealth(options.Upstream{HealthCheck: &options.HealthCheck{Path: "/healthz"}})
+		})
+
+		It("starts healthy", func() {
+			Expect(h.available()).To(BeTrue())
+			Expect(upGauge()).To(Equal(1.0))
+		})
+
+		It("removes the backend after the unhealthy threshold", func() {
+			h.recordCheck(errCheckFailed)
+			h.recordCheck(errCheckFailed)
+			Expect(h.available()).To(BeTrue())
+
+			h.recordCheck(errCheckFailed)
+			Expect(h.available()).To(BeFalse())
+			Expect(upGauge()).To(Equal(0.0))
+		})
+
+		It("returns the backend after the healthy threshold", func() {
+			for i := 0; i < 3; i++ {
+				h.recordCheck(errCheckFailed)
+			}
+			h.recordCheck(nil)
+			Expect(h.available()).To(BeFalse())
+
+			h.recordCheck(nil)
+			Expect(h.available()).To(BeTrue())
+			Expect(upGauge()).To(Equal(1.0))
+		})
+
+		It("resets the failures after a successful check", func() {
+			h.recordCheck(errCheckFailed)
+			h.recordCheck(errCheckFailed)
+			h.recordCheck(nil)
+			h.recordCheck(errCheckFailed)
+			Expect(h.available()).To(BeTrue())
+		})
+	})
+
+	Context("with outlier detection", func() {
+		var h *backendHealth
+
+		BeforeEach(func() {
+			h = newHealth(options.Upstream{OutlierDetection: &options.OutlierDetection{
+				ConsecutiveErrors: 2,
+				EjectionDuration:  durationPtr(time.Minute),
+			}})
+		})
+
+		It("ejects the backend after consecutive errors", func() {
+			h.recordResponse(true)
+			Expect(h.available()).To(BeTrue())
+
+			h.recordResponse(true)
+			Expect(h.available()).To(BeFalse())
+			Expect(upGauge()).To(Equal(0.0))
+			Expect(testutil.ToFloat64(metrics.ejections.WithLabelValues("health", "http://backend"))).To(Equal(1.0))
+
+			ejectedUntil := now.Add(time.Minute)
+			Expect(h.status()).To(Equal(BackendStatus{
+				Upstream:     "health",
+				Backend:      "http://backend",
+				Available:    false,
+				Healthy:      true,
+				EjectedUntil: &ejectedUntil,
+			}))
+		})
+
+		It("does not eject the backend when errors are not consecutive", func() {
+			h.recordResponse(true)
+			h.recordResponse(false)
+			h.recordResponse(true)
+			Expect(h.available()).To(BeTrue())
+		})
+
+		It("returns the backend after the ejection duration", func() {
+			h.recordResponse(true)
+			h.recordResponse(true)
+			Expect(h.available()).To(BeFalse())
+
+			Expect(h.clock.Add(time.Minute)).To(Succeed())
+			Expect(h.available()).To(BeTrue())
+			Expect(upGauge()).To(Equal(1.0))
+			Expect(h.status().EjectedUntil).To(BeNil())
+		})
+	})
+
+	Context("backend.ServeHTTP", func() {
+		It("counts 5xx responses towards outlier detection", func() {
+			status := http.StatusBadGateway
+			b := &backend{
+				uri:    "http://backend",
+				weight: 1,
+				handler: http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+					rw.WriteHeader(status)
+				}),
+				health: newHealth(options.Upstream{OutlierDetection: &options.OutlierDetection{ConsecutiveErrors: 2}}),
+			}
+
+			b.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("", "/", nil))
+			Expect(b.available()).To(BeTrue())
+
+			status = http.StatusNotFound
+			b.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("", "/", nil))
+			Expect(b.available()).To(BeTrue())
+
+			status = http.StatusServiceUnavailable
+			b.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("", "/", nil))
+			b.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("", "/", nil))
+			Expect(b.available()).To(BeFalse())
+		})
+	})
+
+	Context("selectors", func() {
+		var backends []*backend
+
+		BeforeEach(func() {
+			backends = []*backend{}
+			for _, uri := range []string{"http://backend-0", "http://backend-1", "http://backend-2"} {
+				h := newBackendHealth(options.Upstream{HealthCheck: &options.HealthCheck{Path: "/"}}, uri, metrics)
+				backends = append(backends, &backend{uri: uri, weight: 1, health: h})
+			}
+		})
+
+		markUnhealthy := func(b *backend) {
+			for i := 0; i < options.DefaultHealthCheckUnhealthyThreshold; i++ {
+				b.health.recordCheck(errCheckFailed)
+			}
+		}
+
+		DescribeTable("skip unavailable backends",
+			func(newSelector func([]*backend) backendSelector) {
+				markUnhealthy(backends[1])
+				selector := newSelector(backends)
+
+				for i := 0; i < 10; i++ {
+					Expect(selector.selectBackend(httptest.NewRequest("", "/", nil)).uri).ToNot(Equal("http://backend-1"))
+				}
+			},
+			Entry("roundRobinSelector", func(b []*backend) backendSelector { return newRoundRobinSelector(b) }),
+			Entry("leastConnectionsSelector", func(b []*backend) backendSelector { return &leastConnectionsSelector{backends: b} }),
+		)
+
+		It("fails open when no backends are available", func() {
+			for _, b := range backends {
+				markUnhealthy(b)
+			}
+			selector := newRoundRobinSelector(backends)
+
+			counts := make(map[string]int)
+			for i := 0; i < 6; i++ {
+				counts[selector.selectBackend(httptest.NewRequest("", "/", nil)).uri]++
+			}
+			Expect(counts).To(HaveLen(3))
+		})
+
+		It("moves only the users of an unavailable backend with consistent hashing", func() {
+			selector := newConsistentHashSelector(backends, "user")
+
+			before := make(map[string]string)
+			for _, user := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+				before[user] = selector.selectBackend(newSessionRequest(user)).uri
+			}
+
+			markUnhealthy(backends[1])
+			for user, uri := range before {
+				after := selector.selectBackend(newSessionRequest(user)).uri
+				Expect(after).ToNot(Equal("http://backend-1"))
+				if uri != "http://backend-1" {
+					Expect(after).To(Equal(uri))
+				}
+			}
+		})
+	})
+
+	Context("healthChecker", func() {
+		var server *httptest.Server
+		var status int
+
+		BeforeEach(func() {
+			status = http.StatusOK
+			server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/healthz" {
+					rw.WriteHeader(http.StatusNotFound)
+					return
+				}
+				rw.WriteHeader(status)
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		type checkTableInput struct {
+			status         int
+			expectedStatus []int
+			expectedErr    bool
+		}
+
+		DescribeTable("check",
+			func(in checkTableInput) {
+				status = in.status
+				checker := newHealthChecker(options.Upstream{HealthCheck: &options.HealthCheck{
+					Path:           "/healthz",
+					ExpectedStatus: in.expectedStatus,
+				}}, nil)
+
+				err := checker.check(context.Background(), &backend{uri: server.URL})
+				if in.expectedErr {
+					Expect(err).To(HaveOccurred())
+				} else {
+					Expect(err).ToNot(HaveOccurred())
+				}
+			},
+			Entry("with a 2xx response", checkTableInput{status: http.StatusNoContent}),
+			Entry("with a 5xx response", checkTableInput{status: http.StatusServiceUnavailable, expectedErr: true}),
+			Entry("with a redirect", checkTableInput{status: http.StatusFound, expectedErr: true}),
+			Entry("with an expected status", checkTableInput{status: http.StatusFound, expectedStatus: []int{http.StatusFound}}),
+			Entry("with an unexpected status", checkTableInput{status: http.StatusOK, expectedStatus: []int{http.StatusNoContent}, expectedErr: true}),
+		)
+
+		It("marks backends that fail the check as unhealthy", func() {
+			upstream := options.Upstream{ID: "health", HealthCheck: &options.HealthCheck{Path: "/healthz", UnhealthyThreshold: 1}}
+			backends := []*backend{
+				{uri: server.URL, health: newBackendHealth(upstream, server.URL, metrics)},
+				{uri: "http://127.0.0.1:1", health: newBackendHealth(upstream, "http://127.0.0.1:1", metrics)},
+			}
+
+			newHealthChecker(upstream, backends).checkAll(context.Background())
+			Expect(backends[0].available()).To(BeTrue())
+			Expect(backends[1].available()).To(BeFalse())
+		})
+
+		It("stops checking once done is closed", func() {
+			upstream := options.Upstream{ID: "health", HealthCheck: &options.HealthCheck{Path: "/healthz", Interval: durationPtr(time.Millisecond)}}
+			backends := []*backend{{uri: server.URL, health: newBackendHealth(upstream, server.URL, metrics)}}
+
+			var checks int32
+			server.Config.Handler = http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				atomic.AddInt32(&checks, 1)
+			})
+
+			done := make(chan struct{})
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				newHealthChecker(upstream, backends).run(done)
+			}()
+			Eventually(func() int32 { return atomic.LoadInt32(&checks) }).Should(BeNumerically(">=", 2))
+
+			close(done)
+			Eventually(stopped).Should(BeClosed())
+			count := atomic.LoadInt32(&checks)
+			Consistently(func() int32 { return atomic.LoadInt32(&checks) }, 50*time.Millisecond).Should(Equal(count))
+		})
+	})
+
+	Context("NewBackendStatusHandler", func() {
+		It("reports the status of load balanced backends", func() {
+			proxy, err := NewProxy(options.Upstreams{
+				{
+					ID:               "balanced",
+					Path:             "/",
+					Backends:         []options.UpstreamBackend{{URI: "http://backend-0"}, {URI: "http://backend-1"}},
+					OutlierDetection: &options.OutlierDetection{ConsecutiveErrors: 1},
+				},
+				{
+					ID:   "single",
+					Path: "/single/",
+					URI:  "http://backend-2",
+				},
+			}, nil, &pagewriter.WriterFuncs{}, ProxyOpts{})
+			Expect(err).ToNot(HaveOccurred())
+
+			rw := httptest.NewRecorder()
+			NewBackendStatusHandler(proxy).ServeHTTP(rw, httptest.NewRequest("", "/upstreams", nil))
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Header().Get("Content-Type")).To(Equal("application/json"))
+
+			var statuses []BackendStatus
+			Expect(json.Unmarshal(rw.Body.Bytes(), &statuses)).To(Succeed())
+			Expect(statuses).To(Equal([]BackendStatus{
+				{Upstream: "balanced", Backend: "http://backend-0", Available: true, Healthy: true},
+				{Upstream: "balanced", Backend: "http://backend-1", Available: true, Healthy: true},
+			}))
+		})
+
+		It("reports no backends for other handlers", func() {
+			rw := httptest.NewRecorder()
+			NewBackendStatusHandler(http.NotFoundHandler()).ServeHTTP(rw, httptest.NewRequest("", "/upstreams", nil))
+			Expect(rw.Body.String()).To(Equal("[]\n"))
+		})
+	})
+
+	Context("CheckBackendAvailability", func() {
+		var proxy http.Handler
+
+		BeforeEach(func() {
+			var err error
+			proxy, err = NewProxy(options.Upstreams{
+				{
+					ID:               "balanced",
+					Path:             "/",
+					Backends:         []options.UpstreamBackend{{URI: "http://backend-0"}, {URI: "http://backend-1"}},
+					OutlierDetection: &options.OutlierDetection{ConsecutiveErrors: 1},
+				},
+			}, nil, &pagewriter.WriterFuncs{}, ProxyOpts{})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		eject := func(i int) {
+			proxy.(*multiUpstreamProxy).loadBalancers[0].backends[i].health.recordResponse(true)
+		}
+
+		It("succeeds when all backends are available", func() {
+			Expect(CheckBackendAvailability(proxy)).To(Succeed())
+		})
+
+		It("succeeds when some backends are available", func() {
+			eject(0)
+			Expect(CheckBackendAvailability(proxy)).To(Succeed())
+		})
+
+		It("fails when no backends of an upstream are available", func() {
+			eject(0)
+			eject(1)
+			Expect(CheckBackendAvailability(proxy)).To(MatchError(`no available backends for upstreams: "balanced"`))
+		})
+
+		It("succeeds for other handlers", func() {
+			Expect(CheckBackendAvailability(http.NotFoundHandler())).To(Succeed())
+		})
+	})
+})
+
+func durationPtr(d time.Duration) *options.Duration {
+	duration := options.Duration(d)
+	return &duration
+}
+
+func newSessionRequest(user string) *http.Request {
+	req := httptest.NewRequest("", "/", nil)
+	return middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+		Session: &sessionsapi.SessionState{User: user},
+	})
+}
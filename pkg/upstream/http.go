@@ -2,6 +2,8 @@ package upstream
 
 import (
 	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -10,6 +12,7 @@ import (
 	"github.com/mbland/hmacauth"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/yhat/wsutil"
 )
 
@@ -20,6 +23,11 @@ const (
 
 	httpScheme  = "http"
 	httpsScheme = "https"
+	unixScheme  = "unix"
+
+	// unixSocketHost is the host of requests to unix socket upstreams when the
+	// host header is not passed
+	unixSocketHost = "localhost"
 )
 
 // SignatureHeaders contains the headers to be signed by the hmac algorithm
@@ -40,17 +48,34 @@ var SignatureHeaders = []string{
 
 // newHTTPUpstreamProxy creates a new httpUpstreamProxy that can serve requests
 // to a single upstream host.
-func newHTTPUpstreamProxy(upstream options.Upstream, u *url.URL, sigData *options.SignatureData, errorHandler ProxyErrorHandler) http.Handler {
+// The TLS options may be nil, in which case the default TLS config is used.
+func newHTTPUpstreamProxy(upstream options.Upstream, u *url.URL, sigData *options.SignatureData, errorHandler ProxyErrorHandler, tlsOpts *upstreamTLS) (*httpUpstreamProxy, error) {
+	// Unix socket upstreams are proxied as plain HTTP over the socket
+	var socketPath string
+	if u.Scheme == unixScheme {
+		socketPath = u.Path
+		u = &url.URL{Scheme: httpScheme, Host: unixSocketHost}
+	}
+
 	// Set path to empty so that request paths start at the server root
 	u.Path = ""
 
+	// Only set the transport when it differs from the http.DefaultTransport
+	transport, err := newUpstreamTransport(upstream, socketPath, tlsOpts.config(u.Hostname()))
+	if err != nil {
+		return nil, fmt.Errorf("could not create transport: %v", err)
+	}
+
 	// Create a ReverseProxy
-	proxy := newReverseProxy(u, upstream, errorHandler)
+	proxy, err := newReverseProxy(u, upstream, transport, errorHandler)
+	if err != nil {
+		return nil, err
+	}
 
 	// Set up a WebSocket proxy if required
 	var wsProxy http.Handler
 	if upstream.ProxyWebSockets == nil || *upstream.ProxyWebSockets {
-		wsProxy = newWebSocketReverseProxy(u, upstream.InsecureSkipTLSVerify)
+		wsProxy = newWebSocketReverseProxy(u, socketPath, tlsOpts.config(u.Hostname()))
 	}
 
 	var auth hmacauth.HmacAuth
@@ -63,7 +88,8 @@ func newHTTPUpstreamProxy(upstream options.Upstream, u *url.URL, sigData *option
 		handler:   proxy,
 		wsHandler: wsProxy,
 		auth:      auth,
-	}
+		transport: transport,
+	}, nil
 }
 
 // httpUpstreamProxy represents a single HTTP(S) upstream proxy
@@ -72,6 +98,10 @@ type httpUpstreamProxy struct {
 	handler   http.Handler
 	wsHandler http.Handler
 	auth      hmacauth.HmacAuth
+
+	// transport is the transport for requests to the upstream, without any
+	// retries or circuit breaking, or nil for the http.DefaultTransport
+	transport http.RoundTripper
 }
 
 // ServeHTTP proxies requests to the upstream provider while signing the
@@ -98,22 +128,40 @@ func (h *httpUpstreamProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 // servers based on the upstream configuration provided.
 // The proxy should render an error page if there are failures connecting to the
 // upstream server.
-func newReverseProxy(target *url.URL, upstream options.Upstream, errorHandler ProxyErrorHandler) http.Handler {
+// If the transport is nil, the http.DefaultTransport is used.
+func newReverseProxy(target *url.URL, upstream options.Upstream, transport http.RoundTripper, errorHandler ProxyErrorHandler) (http.Handler, error) {
 	proxy := httputil.NewSingleHostReverseProxy(target)
 
 	// Configure options on the SingleHostReverseProxy
-	if upstream.FlushInterval != nil {
+	switch {
+	case upstream.Protocol == options.H2CUpstreamProtocol || upstream.Protocol == options.H2UpstreamProtocol:
+		// Flush immediately so that streamed responses, such as gRPC streams,
+		// are not delayed
+		proxy.FlushInterval = -1
+	case upstream.FlushInterval != nil:
 		proxy.FlushInterval = upstream.FlushInterval.Duration()
-	} else {
+	default:
 		proxy.FlushInterval = options.DefaultUpstreamFlushInterval
 	}
 
-	// InsecureSkipVerify is a configurable option we allow
-	/* #nosec G402 */
-	if upstream.InsecureSkipTLSVerify {
-		proxy.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	if transport != nil {
+		proxy.Transport = transport
+	}
+
+	// Retries wrap the circuit breaker so that every attempt is counted
+	if upstream.CircuitBreaker != nil {
+		proxy.Transport = newCircuitBreakerTransport(transportOrDefault(proxy.Transport), upstream, target)
+	}
+	if upstream.Retry != nil {
+		proxy.Transport = newRetryTransport(transportOrDefault(proxy.Transport), upstream.Retry)
+	}
+
+	if upstream.ResponseRewrite != nil {
+		rewriter, err := newResponseRewriter(upstream.ID, target, upstream.ResponseRewrite, newRewriteMetrics(prometheus.DefaultRegisterer))
+		if err != nil {
+			return nil, fmt.Errorf("could not create response rewriter: %v", err)
 		}
+		proxy.ModifyResponse = rewriter.modifyResponse
 	}
 
 	// Ensure we always pass the original request path
@@ -128,7 +176,16 @@ func newReverseProxy(target *url.URL, upstream options.Upstream, errorHandler Pr
 	if errorHandler != nil {
 		proxy.ErrorHandler = errorHandler
 	}
-	return proxy
+	return proxy, nil
+}
+
+// transportOrDefault returns the transport, or the http.DefaultTransport that
+// the ReverseProxy uses if it is nil.
+func transportOrDefault(transport http.RoundTripper) http.RoundTripper {
+	if transport == nil {
+		return http.DefaultTransport
+	}
+	return transport
 }
 
 // setProxyUpstreamHostHeader sets the proxy.Director so that upstream requests
@@ -155,15 +212,17 @@ func setProxyDirector(proxy *httputil.ReverseProxy) {
 }
 
 // newWebSocketReverseProxy creates a new reverse proxy for proxying websocket connections.
-func newWebSocketReverseProxy(u *url.URL, skipTLSVerify bool) http.Handler {
+func newWebSocketReverseProxy(u *url.URL, socketPath string, tlsConfig *tls.Config) http.Handler {
 	// This should create the correct scheme for insecure vs secure connections
 	wsScheme := "ws" + strings.TrimPrefix(u.Scheme, "http")
 	wsURL := &url.URL{Scheme: wsScheme, Host: u.Host}
 
 	wsProxy := wsutil.NewSingleHostReverseProxy(wsURL)
-	/* #nosec G402 */
-	if skipTLSVerify {
-		wsProxy.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	wsProxy.TLSClientConfig = tlsConfig
+	if socketPath != "" {
+		wsProxy.Dial = func(string, string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		}
 	}
 	return wsProxy
 }
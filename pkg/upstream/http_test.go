@@ -1,15 +1,21 @@
 package upstream
 
 import (
+	"bufio"
 	"bytes"
 	"crypto"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -19,6 +25,8 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/net/websocket"
 )
 
@@ -74,7 +82,8 @@ var _ = Describe("HTTP Upstream Suite", func() {
 			u, err := url.Parse(*in.serverAddr)
 			Expect(err).ToNot(HaveOccurred())
 
-			handler := newHTTPUpstreamProxy(upstream, u, in.signatureData, in.errorHandler)
+			handler, err := newHTTPUpstreamProxy(upstream, u, in.signatureData, in.errorHandler, nil)
+			Expect(err).ToNot(HaveOccurred())
 			handler.ServeHTTP(rw, req)
 
 			Expect(rw.Code).To(Equal(in.expectedResponse.code))
@@ -330,9 +339,8 @@ var _ = Describe("HTTP Upstream Suite", func() {
 		u, err := url.Parse(serverAddr)
 		Expect(err).ToNot(HaveOccurred())
 
-		handler := newHTTPUpstreamProxy(upstream, u, nil, nil)
-		httpUpstream, ok := handler.(*httpUpstreamProxy)
-		Expect(ok).To(BeTrue())
+		httpUpstream, err := newHTTPUpstreamProxy(upstream, u, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
 
 		// Override the handler to just run the director and not actually send the request
 		requestInterceptor := func(h http.Handler) http.Handler {
@@ -368,9 +376,10 @@ var _ = Describe("HTTP Upstream Suite", func() {
 				ProxyWebSockets:       &in.proxyWebSockets,
 			}
 
-			handler := newHTTPUpstreamProxy(upstream, u, in.sigData, in.errorHandler)
-			upstreamProxy, ok := handler.(*httpUpstreamProxy)
-			Expect(ok).To(BeTrue())
+			tlsOpts, err := newUpstreamTLS(upstream, nil)
+			Expect(err).ToNot(HaveOccurred())
+			upstreamProxy, err := newHTTPUpstreamProxy(upstream, u, in.sigData, in.errorHandler, tlsOpts)
+			Expect(err).ToNot(HaveOccurred())
 
 			Expect(upstreamProxy.auth != nil).To(Equal(in.sigData != nil))
 			Expect(upstreamProxy.wsHandler != nil).To(Equal(in.proxyWebSockets))
@@ -442,7 +451,8 @@ var _ = Describe("HTTP Upstream Suite", func() {
 			u, err := url.Parse(serverAddr)
 			Expect(err).ToNot(HaveOccurred())
 
-			handler := newHTTPUpstreamProxy(upstream, u, nil, nil)
+			handler, err := newHTTPUpstreamProxy(upstream, u, nil, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
 
 			proxyServer = httptest.NewServer(middleware.NewScope(false, "X-Request-Id")(handler))
 		})
@@ -477,4 +487,189 @@ var _ = Describe("HTTP Upstream Suite", func() {
 			Expect(response.StatusCode).To(Equal(200))
 		})
 	})
+
+	Context("with a unix socket upstream", func() {
+		var socketServer *httptest.Server
+		var socketDir string
+
+		BeforeEach(func() {
+			var err error
+			socketDir, err = ioutil.TempDir("", "oauth2-proxy-upstream-socket")
+			Expect(err).ToNot(HaveOccurred())
+
+			listener, err := net.Listen("unix", filepath.Join(socketDir, "upstream.sock"))
+			Expect(err).ToNot(HaveOccurred())
+			socketServer = httptest.NewUnstartedServer(&testHTTPUpstream{})
+			socketServer.Listener = listener
+			socketServer.Start()
+		})
+
+		AfterEach(func() {
+			socketServer.Close()
+			Expect(os.RemoveAll(socketDir)).To(Succeed())
+		})
+
+		newSocketProxy := func(passHostHeader bool) *httptest.Server {
+			upstream := options.Upstream{
+				ID:              "socket",
+				PassHostHeader:  &passHostHeader,
+				ProxyWebSockets: &truth,
+			}
+
+			u, err := url.Parse("unix://" + filepath.Join(socketDir, "upstream.sock"))
+			Expect(err).ToNot(HaveOccurred())
+
+			handler, err := newHTTPUpstreamProxy(upstream, u, nil, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			return httptest.NewServer(middleware.NewScope(false, "X-Request-Id")(handler))
+		}
+
+		getRequest := func(proxyServer *httptest.Server) testHTTPRequest {
+			req, err := http.NewRequest("GET", proxyServer.URL+"/foo/bar?baz=1", nil)
+			Expect(err).ToNot(HaveOccurred())
+			req.Host = "example.localhost"
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(200))
+
+			var request testHTTPRequest
+			Expect(json.NewDecoder(resp.Body).Decode(&request)).To(Succeed())
+			return request
+		}
+
+		It("will proxy HTTP requests over the socket", func() {
+			proxyServer := newSocketProxy(true)
+			defer proxyServer.Close()
+
+			request := getRequest(proxyServer)
+			Expect(request.RequestURI).To(Equal("/foo/bar?baz=1"))
+			Expect(request.Host).To(Equal("example.localhost"))
+		})
+
+		It("will use localhost as the host when not passing a host header", func() {
+			proxyServer := newSocketProxy(false)
+			defer proxyServer.Close()
+
+			Expect(getRequest(proxyServer).Host).To(Equal("localhost"))
+		})
+
+		It("will proxy websockets over the socket", func() {
+			proxyServer := newSocketProxy(true)
+			defer proxyServer.Close()
+
+			origin := "http://example.localhost"
+			ws, err := websocket.Dial(fmt.Sprintf("ws://%s/", proxyServer.Listener.Addr().String()), "", origin)
+			Expect(err).ToNot(HaveOccurred())
+			defer ws.Close()
+
+			Expect(websocket.Message.Send(ws, []byte("Hello, socket!"))).To(Succeed())
+			var response testWebSocketResponse
+			Expect(websocket.JSON.Receive(ws, &response)).To(Succeed())
+			Expect(response).To(Equal(testWebSocketResponse{
+				Message: "Hello, socket!",
+				Origin:  origin,
+			}))
+		})
+	})
+
+	Context("with an h2c upstream", func() {
+		var upstreamServer, proxyServer *httptest.Server
+		var h2cClient *http.Client
+
+		BeforeEach(func() {
+			// The upstream echoes each line of the request body as it is
+			// received and reports the number of lines in a trailer
+			upstreamServer = httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Trailer", "Grpc-Status, X-Lines")
+				rw.Header().Set("Content-Type", "application/grpc")
+				rw.WriteHeader(http.StatusOK)
+				rw.(http.Flusher).Flush()
+
+				lines := 0
+				scanner := bufio.NewScanner(req.Body)
+				for scanner.Scan() {
+					lines++
+					_, _ = rw.Write([]byte(scanner.Text() + "\n"))
+					rw.(http.Flusher).Flush()
+				}
+				rw.Header().Set("Grpc-Status", "0")
+				rw.Header().Set("X-Lines", fmt.Sprintf("%d", lines))
+			}), &http2.Server{}))
+
+			u, err := url.Parse(upstreamServer.URL)
+			Expect(err).ToNot(HaveOccurred())
+			handler, err := newHTTPUpstreamProxy(options.Upstream{
+				ID:       "h2c",
+				Protocol: options.H2CUpstreamProtocol,
+			}, u, nil, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			proxyServer = httptest.NewServer(h2c.NewHandler(middleware.NewScope(false, "X-Request-Id")(handler), &http2.Server{}))
+
+			h2cClient = &http.Client{
+				Transport: &http2.Transport{
+					AllowHTTP: true,
+					DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+						return net.Dial(network, addr)
+					},
+				},
+			}
+		})
+
+		AfterEach(func() {
+			proxyServer.Close()
+			upstreamServer.Close()
+		})
+
+		It("uses an HTTP/2 transport that flushes immediately", func() {
+			u, err := url.Parse(upstreamServer.URL)
+			Expect(err).ToNot(HaveOccurred())
+			handler, err := newHTTPUpstreamProxy(options.Upstream{ID: "h2c", Protocol: options.H2CUpstreamProtocol}, u, nil, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			proxy, ok := handler.handler.(*httputil.ReverseProxy)
+			Expect(ok).To(BeTrue())
+			Expect(proxy.FlushInterval).To(Equal(time.Duration(-1)))
+			Expect(proxy.Transport).To(BeAssignableToTypeOf(&http2.Transport{}))
+		})
+
+		It("streams the request and response in both directions and preserves trailers", func() {
+			body, bodyWriter := io.Pipe()
+			req, err := http.NewRequest(http.MethodPost, proxyServer.URL+"/service.Echo/Stream", body)
+			Expect(err).ToNot(HaveOccurred())
+			req.Header.Set("Content-Type", "application/grpc")
+
+			// The upstream sends the response headers before reading the body
+			resp, err := h2cClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.ProtoMajor).To(Equal(2))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			_, err = bodyWriter.Write([]byte("first\n"))
+			Expect(err).ToNot(HaveOccurred())
+
+			// Each message is received before the next is sent
+			reader := bufio.NewReader(resp.Body)
+			line, err := reader.ReadString('\n')
+			Expect(err).ToNot(HaveOccurred())
+			Expect(line).To(Equal("first\n"))
+
+			_, err = bodyWriter.Write([]byte("second\n"))
+			Expect(err).ToNot(HaveOccurred())
+			line, err = reader.ReadString('\n')
+			Expect(err).ToNot(HaveOccurred())
+			Expect(line).To(Equal("second\n"))
+
+			Expect(bodyWriter.Close()).To(Succeed())
+			rest, err := ioutil.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rest).To(BeEmpty())
+
+			Expect(resp.Trailer.Get("Grpc-Status")).To(Equal("0"))
+			Expect(resp.Trailer.Get("X-Lines")).To(Equal("2"))
+		})
+	})
 })
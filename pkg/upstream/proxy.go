@@ -3,6 +3,7 @@ package upstream
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -14,20 +15,50 @@ import (
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	requestutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/requests/util"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // ProxyErrorHandler is a function that will be used to render error pages when
 // HTTP proxies fail to connect to upstream servers.
 type ProxyErrorHandler func(http.ResponseWriter, *http.Request, error)
 
+// RateLimitBuilder builds the rate limiting middleware of an upstream.
+// It returns nil if the upstream is not rate limited.
+type RateLimitBuilder func(upstream options.Upstream) (alice.Constructor, error)
+
+// IPAccessBuilder builds the client IP access middleware of an upstream.
+// It returns nil if access to the upstream is not restricted by IP.
+type IPAccessBuilder func(upstream options.Upstream) (alice.Constructor, error)
+
+// ProxyOpts contains the optional middleware and the lifecycle of the proxy.
+type ProxyOpts struct {
+	// RateLimits builds the rate limiting middleware of each upstream.
+	// Upstreams are not rate limited when it is nil.
+	RateLimits RateLimitBuilder
+
+	// IPAccess builds the client IP access middleware of each upstream.
+	// Upstreams are not restricted by IP when it is nil.
+	IPAccess IPAccessBuilder
+
+	// Done is closed once the proxy is no longer used, to stop the health
+	// checks of the upstreams.
+	// The health checks run until the process exits when it is nil.
+	Done <-chan struct{}
+}
+
 // NewProxy creates a new multiUpstreamProxy that can serve requests directed to
 // multiple upstreams.
-func NewProxy(upstreams options.Upstreams, sigData *options.SignatureData, writer pagewriter.Writer) (http.Handler, error) {
+func NewProxy(upstreams options.Upstreams, sigData *options.SignatureData, writer pagewriter.Writer, opts ProxyOpts) (http.Handler, error) {
 	m := &multiUpstreamProxy{
-		serveMux: mux.NewRouter(),
+		serveMux:      mux.NewRouter(),
+		rateLimits:    opts.RateLimits,
+		ipAccess:      opts.IPAccess,
+		ipAccessRules: make(map[string]alice.Constructor),
+		done:          opts.Done,
 	}
 
-	for _, upstream := range sortByPathLongest(upstreams) {
+	for _, upstream := range sortByHostPrecedence(sortByPathLongest(upstreams)) {
 		if upstream.Static {
 			if err := m.registerStaticResponseHandler(upstream, writer); err != nil {
 				return nil, fmt.Errorf("could not register static upstream %q: %v", upstream.ID, err)
@@ -35,6 +66,13 @@ func NewProxy(upstreams options.Upstreams, sigData *options.SignatureData, write
 			continue
 		}
 
+		if len(upstream.Backends) > 0 {
+			if err := m.registerLoadBalancedProxy(upstream, sigData, writer); err != nil {
+				return nil, fmt.Errorf("could not register load balanced upstream %q: %v", upstream.ID, err)
+			}
+			continue
+		}
+
 		u, err := url.Parse(upstream.URI)
 		if err != nil {
 			return nil, fmt.Errorf("error parsing URI for upstream %q: %w", upstream.ID, err)
@@ -44,7 +82,7 @@ func NewProxy(upstreams options.Upstreams, sigData *options.SignatureData, write
 			if err := m.registerFileServer(upstream, u, writer); err != nil {
 				return nil, fmt.Errorf("could not register file upstream %q: %v", upstream.ID, err)
 			}
-		case httpScheme, httpsScheme:
+		case httpScheme, httpsScheme, unixScheme:
 			if err := m.registerHTTPUpstreamProxy(upstream, u, sigData, writer); err != nil {
 				return nil, fmt.Errorf("could not register HTTP upstream %q: %v", upstream.ID, err)
 			}
@@ -60,7 +98,15 @@ func NewProxy(upstreams options.Upstreams, sigData *options.SignatureData, write
 // multiUpstreamProxy will serve requests directed to multiple upstream servers
 // registered in the serverMux.
 type multiUpstreamProxy struct {
-	serveMux *mux.Router
+	serveMux      *mux.Router
+	loadBalancers []*loadBalancedProxy
+	rateLimits    RateLimitBuilder
+	ipAccess      IPAccessBuilder
+	done          <-chan struct{}
+
+	// ipAccessRules are the IP access middleware of the upstreams by ID, so
+	// that they can also be applied to auth only requests
+	ipAccessRules map[string]alice.Constructor
 }
 
 // ServerHTTP handles HTTP requests.
@@ -68,28 +114,180 @@ func (m *multiUpstreamProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request
 	m.serveMux.ServeHTTP(rw, req)
 }
 
+// backendStatuses reports the health of the backends of all load balanced
+// upstreams.
+func (m *multiUpstreamProxy) backendStatuses() []BackendStatus {
+	statuses := []BackendStatus{}
+	for _, lb := range m.loadBalancers {
+		statuses = append(statuses, lb.backendStatuses()...)
+	}
+	return statuses
+}
+
+// matchIPAccess returns the IP access middleware of the upstream that serves
+// the original request of an auth only request, or nil if access to the
+// upstream is not restricted by IP.
+// The original request is taken from the X-Forwarded-Host and X-Forwarded-Uri
+// headers when the request is proxied.
+func (m *multiUpstreamProxy) matchIPAccess(req *http.Request) alice.Constructor {
+	if len(m.ipAccessRules) == 0 {
+		return nil
+	}
+
+	uri, err := url.Parse(requestutil.GetRequestURI(req))
+	if err != nil {
+		logger.Errorf("Error parsing the original request URI for IP access: %v", err)
+		uri = req.URL
+	}
+	original := req.Clone(req.Context())
+	original.URL.Path = uri.Path
+	original.URL.RawPath = uri.RawPath
+
+	match := &mux.RouteMatch{}
+	if !m.serveMux.Match(original, match) || match.Route == nil {
+		return nil
+	}
+	return m.ipAccessRules[match.Route.GetName()]
+}
+
+// ipAccessMatcher is implemented by proxies that can find the IP access
+// middleware of the upstream that serves a request.
+type ipAccessMatcher interface {
+	matchIPAccess(req *http.Request) alice.Constructor
+}
+
+// NewAuthOnlyIPAccess creates a middleware for auth only requests that applies
+// the IP access middleware of the upstream of the proxy, as created by
+// NewProxy, that serves the original request.
+// This allows the IP access of upstreams to be enforced when the proxy is
+// only used to authenticate requests for another reverse proxy.
+func NewAuthOnlyIPAccess(proxy http.Handler) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		matcher, ok := proxy.(ipAccessMatcher)
+		if !ok {
+			return next
+		}
+
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if ipAccess := matcher.matchIPAccess(req); ipAccess != nil {
+				ipAccess(next).ServeHTTP(rw, req)
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
 // registerStaticResponseHandler registers a static response handler with at the given path.
 func (m *multiUpstreamProxy) registerStaticResponseHandler(upstream options.Upstream, writer pagewriter.Writer) error {
-	logger.Printf("mapping path %q => static response %d", upstream.Path, derefStaticCode(upstream.StaticCode))
+	logger.Printf("mapping %s => static response %d", describeRoute(upstream), derefStaticCode(upstream.StaticCode))
 	return m.registerHandler(upstream, newStaticResponseHandler(upstream.ID, upstream.StaticCode), writer)
 }
 
 // registerFileServer registers a new fileServer based on the configuration given.
 func (m *multiUpstreamProxy) registerFileServer(upstream options.Upstream, u *url.URL, writer pagewriter.Writer) error {
-	logger.Printf("mapping path %q => file system %q", upstream.Path, u.Path)
+	logger.Printf("mapping %s => file system %q", describeRoute(upstream), u.Path)
 	return m.registerHandler(upstream, newFileServer(upstream.ID, upstream.Path, u.Path), writer)
 }
 
 // registerHTTPUpstreamProxy registers a new httpUpstreamProxy based on the configuration given.
 func (m *multiUpstreamProxy) registerHTTPUpstreamProxy(upstream options.Upstream, u *url.URL, sigData *options.SignatureData, writer pagewriter.Writer) error {
-	logger.Printf("mapping path %q => upstream %q", upstream.Path, upstream.URI)
-	return m.registerHandler(upstream, newHTTPUpstreamProxy(upstream, u, sigData, writer.ProxyErrorHandler), writer)
+	logger.Printf("mapping %s => upstream %q", describeRoute(upstream), upstream.URI)
+	tlsOpts, err := newUpstreamTLS(upstream, m.done)
+	if err != nil {
+		return fmt.Errorf("could not load TLS config: %v", err)
+	}
+	handler, err := newHTTPUpstreamProxy(upstream, u, sigData, newProxyErrorHandler(upstream, writer), tlsOpts)
+	if err != nil {
+		return err
+	}
+	return m.registerHandler(upstream, handler, writer)
+}
+
+// registerLoadBalancedProxy registers a new loadBalancedProxy based on the configuration given.
+func (m *multiUpstreamProxy) registerLoadBalancedProxy(upstream options.Upstream, sigData *options.SignatureData, writer pagewriter.Writer) error {
+	uris := make([]string, 0, len(upstream.Backends))
+	for _, b := range upstream.Backends {
+		uris = append(uris, b.URI)
+	}
+	logger.Printf("mapping %s => upstream backends %q", describeRoute(upstream), uris)
+
+	handler, err := newLoadBalancedProxy(upstream, sigData, newProxyErrorHandler(upstream, writer), m.done)
+	if err != nil {
+		return err
+	}
+	m.loadBalancers = append(m.loadBalancers, handler)
+	return m.registerHandler(upstream, handler, writer)
+}
+
+// newProxyErrorHandler creates the ProxyErrorHandler for the upstream.
+// When the upstream has a circuit breaker, requests failed by the circuit
+// breaker are served the configured error page rather than a bad gateway
+// error. Requests aborted for exceeding the request limits of the upstream
+// are served a request entity too large error.
+func newProxyErrorHandler(upstream options.Upstream, writer pagewriter.Writer) ProxyErrorHandler {
+	errorHandler := writer.ProxyErrorHandler
+	if upstream.CircuitBreaker != nil {
+		errorHandler = newCircuitBreakerErrorHandler(upstream.CircuitBreaker, writer)
+	}
+	return newRequestLimitsErrorHandler(upstream, writer, errorHandler)
 }
 
 // registerHandler ensures the given handler is regiestered with the serveMux.
 func (m *multiUpstreamProxy) registerHandler(upstream options.Upstream, handler http.Handler, writer pagewriter.Writer) error {
+	var metrics *cacheMetrics
+	if upstream.Cache != nil {
+		metrics = newCacheMetrics(prometheus.DefaultRegisterer)
+	}
+	cache, err := newResponseCacheHandler(upstream, metrics)
+	if err != nil {
+		return err
+	}
+	if cache != nil {
+		handler = cache(handler)
+	}
+
+	// The header rules wrap the cache so that the response headers, which may
+	// be built from the claims of the session, are applied to every response
+	// and never stored in the cache
+	headerRules, err := newHeaderRulesHandler(upstream)
+	if err != nil {
+		return err
+	}
+	if headerRules != nil {
+		handler = headerRules(handler)
+	}
+
+	if requestLimits := newRequestLimits(upstream, writer); requestLimits != nil {
+		handler = requestLimits(handler)
+	}
+
+	// Rate limits apply before the cache so that cached responses are also
+	// limited
+	if m.rateLimits != nil {
+		rateLimit, err := m.rateLimits(upstream)
+		if err != nil {
+			return fmt.Errorf("could not build rate limit: %v", err)
+		}
+		if rateLimit != nil {
+			handler = rateLimit(handler)
+		}
+	}
+
+	// Denied clients are rejected before they use any of the rate limit
+	if m.ipAccess != nil {
+		ipAccess, err := m.ipAccess(upstream)
+		if err != nil {
+			return fmt.Errorf("could not build ip access: %v", err)
+		}
+		if ipAccess != nil {
+			m.ipAccessRules[upstream.ID] = ipAccess
+			handler = ipAccess(handler)
+		}
+	}
+
 	if upstream.RewriteTarget == "" {
-		m.registerSimpleHandler(upstream.Path, handler)
+		m.registerSimpleHandler(upstream.ID, upstream.Host, upstream.Path, handler)
 		return nil
 	}
 
@@ -98,11 +296,12 @@ func (m *multiUpstreamProxy) registerHandler(upstream options.Upstream, handler
 
 // registerSimpleHandler maintains the behaviour of the go standard serveMux
 // by ensuring any path with a trailing `/` matches all paths under that prefix.
-func (m *multiUpstreamProxy) registerSimpleHandler(path string, handler http.Handler) {
+func (m *multiUpstreamProxy) registerSimpleHandler(id, host, path string, handler http.Handler) {
+	route := m.newHostRoute(id, host)
 	if strings.HasSuffix(path, "/") {
-		m.serveMux.PathPrefix(path).Handler(handler)
+		route.PathPrefix(path).Handler(handler)
 	} else {
-		m.serveMux.Path(path).Handler(handler)
+		route.Path(path).Handler(handler)
 	}
 }
 
@@ -118,13 +317,50 @@ func (m *multiUpstreamProxy) registerRewriteHandler(upstream options.Upstream, h
 
 	rewrite := newRewritePath(rewriteRegExp, upstream.RewriteTarget, writer)
 	h := alice.New(rewrite).Then(handler)
-	m.serveMux.MatcherFunc(func(req *http.Request, match *mux.RouteMatch) bool {
+	m.newHostRoute(upstream.ID, upstream.Host).MatcherFunc(func(req *http.Request, match *mux.RouteMatch) bool {
 		return rewriteRegExp.MatchString(req.URL.Path)
 	}).Handler(h)
 
 	return nil
 }
 
+// describeRoute describes the requests routed to the upstream for logging.
+func describeRoute(upstream options.Upstream) string {
+	if upstream.Host == "" {
+		return fmt.Sprintf("path %q", upstream.Path)
+	}
+	return fmt.Sprintf("host %q path %q", upstream.Host, upstream.Path)
+}
+
+// newHostRoute creates a new route, named after the upstream ID, that only
+// matches requests to the host.
+// If the host is empty, the route matches requests to any host.
+func (m *multiUpstreamProxy) newHostRoute(id, host string) *mux.Route {
+	route := m.serveMux.NewRoute().Name(id)
+	if host == "" {
+		return route
+	}
+	return route.MatcherFunc(newHostMatcher(host))
+}
+
+// newHostMatcher creates a matcher for requests to the host.
+// A host starting with "*." matches any subdomain of the rest of the host.
+func newHostMatcher(host string) mux.MatcherFunc {
+	host = strings.ToLower(host)
+	return func(req *http.Request, _ *mux.RouteMatch) bool {
+		reqHost := strings.ToLower(requestutil.GetRequestHost(req))
+		if h, _, err := net.SplitHostPort(reqHost); err == nil {
+			reqHost = h
+		}
+
+		if strings.HasPrefix(host, "*.") {
+			suffix := host[1:]
+			return len(reqHost) > len(suffix) && strings.HasSuffix(reqHost, suffix)
+		}
+		return reqHost == host
+	}
+}
+
 // registerTrailingSlashHandler creates a new matcher that will check if the
 // requested path would match if it had a trailing slash appended.
 // If the path matches with a trailing slash, we send back a redirect.
@@ -176,3 +412,31 @@ func sortByPathLongest(in options.Upstreams) options.Upstreams {
 	})
 	return in
 }
+
+// sortByHostPrecedence ensures that upstreams with an exact host are matched
+// before upstreams with a wildcard host, which are matched before upstreams
+// without a host.
+// Wildcard hosts with a longer domain take precedence over shorter ones.
+// The sort is stable so that the path ordering is kept for upstreams with the
+// same host precedence.
+func sortByHostPrecedence(in options.Upstreams) options.Upstreams {
+	rank := func(host string) int {
+		switch {
+		case host == "":
+			return 0
+		case strings.HasPrefix(host, "*."):
+			return 1
+		default:
+			return 2
+		}
+	}
+
+	sort.SliceStable(in, func(i, j int) bool {
+		iRank, jRank := rank(in[i].Host), rank(in[j].Host)
+		if iRank != jRank {
+			return iRank > jRank
+		}
+		return iRank == 1 && len(in[i].Host) > len(in[j].Host)
+	})
+	return in
+}
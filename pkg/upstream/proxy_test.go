@@ -3,12 +3,15 @@ package upstream
 import (
 	"crypto"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 
+	"github.com/justinas/alice"
 	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
@@ -92,7 +95,7 @@ var _ = Describe("Proxy Suite", func() {
 			}
 
 			var err error
-			upstreamServer, err = NewProxy(upstreams, sigData, writer)
+			upstreamServer, err = NewProxy(upstreams, sigData, writer, ProxyOpts{})
 			Expect(err).ToNot(HaveOccurred())
 		})
 
@@ -313,6 +316,286 @@ var _ = Describe("Proxy Suite", func() {
 		)
 	})
 
+	Context("multiUpstreamProxy with host based routing", func() {
+		var proxy http.Handler
+
+		BeforeEach(func() {
+			codes := []int{200, 201, 202, 203, 204, 205}
+			upstreams := options.Upstreams{
+				{ID: "any-host", Path: "/", Static: true, StaticCode: &codes[0]},
+				{ID: "any-host-api", Path: "/api/", Static: true, StaticCode: &codes[1]},
+				{ID: "app1", Host: "app1.example.com", Path: "/", Static: true, StaticCode: &codes[2]},
+				{ID: "app2", Host: "APP2.example.com", Path: "/", Static: true, StaticCode: &codes[3]},
+				{ID: "wildcard", Host: "*.example.com", Path: "/", Static: true, StaticCode: &codes[4]},
+				{ID: "wildcard-rewrite", Host: "*.internal.example.com", Path: "^/rewrite/(.*)", RewriteTarget: "/$1", Static: true, StaticCode: &codes[5]},
+			}
+
+			var err error
+			proxy, err = NewProxy(upstreams, nil, &pagewriter.WriterFuncs{}, ProxyOpts{})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		type hostRoutingTableInput struct {
+			target       string
+			reverseProxy bool
+			forwarded    string
+			upstream     string
+		}
+
+		DescribeTable("routes requests by host and path",
+			func(in hostRoutingTableInput) {
+				req := middlewareapi.AddRequestScope(
+					httptest.NewRequest("", in.target, nil),
+					&middlewareapi.RequestScope{ReverseProxy: in.reverseProxy},
+				)
+				if in.forwarded != "" {
+					req.Header.Set("X-Forwarded-Host", in.forwarded)
+				}
+				proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+				Expect(middlewareapi.GetRequestScope(req).Upstream).To(Equal(in.upstream))
+			},
+			Entry("with an exact host", hostRoutingTableInput{
+				target:   "http://app1.example.com/api/foo",
+				upstream: "app1",
+			}),
+			Entry("with an exact host in a different case", hostRoutingTableInput{
+				target:   "http://app2.EXAMPLE.com/",
+				upstream: "app2",
+			}),
+			Entry("with a port in the request host", hostRoutingTableInput{
+				target:   "http://app1.example.com:8080/",
+				upstream: "app1",
+			}),
+			Entry("with a subdomain matching a wildcard host", hostRoutingTableInput{
+				target:   "http://app3.example.com/",
+				upstream: "wildcard",
+			}),
+			Entry("with a nested subdomain matching a wildcard host", hostRoutingTableInput{
+				target:   "http://a.b.example.com/",
+				upstream: "wildcard",
+			}),
+			Entry("with a longer wildcard host", hostRoutingTableInput{
+				target:   "http://app.internal.example.com/rewrite/foo",
+				upstream: "wildcard-rewrite",
+			}),
+			Entry("with the domain of a wildcard host", hostRoutingTableInput{
+				target:   "http://example.com/api/foo",
+				upstream: "any-host-api",
+			}),
+			Entry("with an unknown host", hostRoutingTableInput{
+				target:   "http://other.localhost/",
+				upstream: "any-host",
+			}),
+			Entry("with a forwarded host behind a reverse proxy", hostRoutingTableInput{
+				target:       "http://internal.localhost/",
+				reverseProxy: true,
+				forwarded:    "app1.example.com",
+				upstream:     "app1",
+			}),
+			Entry("with a forwarded host when not behind a reverse proxy", hostRoutingTableInput{
+				target:    "http://internal.localhost/",
+				forwarded: "app1.example.com",
+				upstream:  "any-host",
+			}),
+		)
+	})
+
+	Context("multiUpstreamProxy with rate limits", func() {
+		It("applies the rate limit of each upstream", func() {
+			code := 200
+			upstreams := options.Upstreams{
+				{ID: "limited", Path: "/limited/", Static: true, StaticCode: &code, RateLimit: &options.RateLimit{Requests: 1}},
+				{ID: "unlimited", Path: "/", Static: true, StaticCode: &code},
+			}
+
+			rateLimits := func(upstream options.Upstream) (alice.Constructor, error) {
+				if upstream.RateLimit == nil {
+					return nil, nil
+				}
+				return func(next http.Handler) http.Handler {
+					return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+						rw.WriteHeader(http.StatusTooManyRequests)
+					})
+				}, nil
+			}
+
+			proxy, err := NewProxy(upstreams, nil, &pagewriter.WriterFuncs{}, ProxyOpts{RateLimits: rateLimits})
+			Expect(err).ToNot(HaveOccurred())
+
+			for target, code := range map[string]int{
+				"http://example.localhost/limited/foo": http.StatusTooManyRequests,
+				"http://example.localhost/foo":         http.StatusOK,
+			} {
+				req := middlewareapi.AddRequestScope(httptest.NewRequest("", target, nil), &middlewareapi.RequestScope{})
+				rw := httptest.NewRecorder()
+				proxy.ServeHTTP(rw, req)
+				Expect(rw.Code).To(Equal(code))
+			}
+		})
+
+		It("returns an error when the rate limit cannot be built", func() {
+			rateLimits := func(upstream options.Upstream) (alice.Constructor, error) {
+				return nil, errors.New("no store")
+			}
+
+			_, err := NewProxy(options.Upstreams{{ID: "static", Path: "/", Static: true}}, nil, &pagewriter.WriterFuncs{}, ProxyOpts{RateLimits: rateLimits})
+			Expect(err).To(MatchError("could not register static upstream \"static\": could not build rate limit: no store"))
+		})
+	})
+
+	Context("multiUpstreamProxy with ip access", func() {
+		It("applies the ip access of each upstream before the rate limit", func() {
+			code := 200
+			upstreams := options.Upstreams{
+				{ID: "restricted", Path: "/restricted/", Static: true, StaticCode: &code, IPAccess: &options.IPAccess{Allow: []string{"10.0.0.0/8"}}},
+				{ID: "open", Path: "/", Static: true, StaticCode: &code},
+			}
+
+			rateLimits := func(upstream options.Upstream) (alice.Constructor, error) {
+				return func(next http.Handler) http.Handler {
+					return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+						rw.WriteHeader(http.StatusTooManyRequests)
+					})
+				}, nil
+			}
+			ipAccess := func(upstream options.Upstream) (alice.Constructor, error) {
+				if upstream.IPAccess == nil {
+					return nil, nil
+				}
+				return func(next http.Handler) http.Handler {
+					return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+						rw.WriteHeader(http.StatusForbidden)
+					})
+				}, nil
+			}
+
+			proxy, err := NewProxy(upstreams, nil, &pagewriter.WriterFuncs{}, ProxyOpts{RateLimits: rateLimits, IPAccess: ipAccess})
+			Expect(err).ToNot(HaveOccurred())
+
+			for target, code := range map[string]int{
+				"http://example.localhost/restricted/foo": http.StatusForbidden,
+				"http://example.localhost/foo":            http.StatusTooManyRequests,
+			} {
+				req := middlewareapi.AddRequestScope(httptest.NewRequest("", target, nil), &middlewareapi.RequestScope{})
+				rw := httptest.NewRecorder()
+				proxy.ServeHTTP(rw, req)
+				Expect(rw.Code).To(Equal(code))
+			}
+		})
+
+		It("returns an error when the ip access cannot be built", func() {
+			ipAccess := func(upstream options.Upstream) (alice.Constructor, error) {
+				return nil, errors.New("invalid network")
+			}
+
+			_, err := NewProxy(options.Upstreams{{ID: "static", Path: "/", Static: true}}, nil, &pagewriter.WriterFuncs{}, ProxyOpts{IPAccess: ipAccess})
+			Expect(err).To(MatchError("could not register static upstream \"static\": could not build ip access: invalid network"))
+		})
+
+		It("applies the ip access of the upstream of the original request to auth only requests", func() {
+			upstreams := options.Upstreams{
+				{ID: "restricted", Host: "app.example.com", Path: "/restricted/", Static: true, IPAccess: &options.IPAccess{Allow: []string{"10.0.0.0/8"}}},
+				{ID: "open", Path: "/", Static: true},
+			}
+			ipAccess := func(upstream options.Upstream) (alice.Constructor, error) {
+				if upstream.IPAccess == nil {
+					return nil, nil
+				}
+				return func(next http.Handler) http.Handler {
+					return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+						rw.WriteHeader(http.StatusForbidden)
+					})
+				}, nil
+			}
+
+			proxy, err := NewProxy(upstreams, nil, &pagewriter.WriterFuncs{}, ProxyOpts{IPAccess: ipAccess})
+			Expect(err).ToNot(HaveOccurred())
+			authOnly := NewAuthOnlyIPAccess(proxy)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+
+			for _, in := range []struct {
+				host string
+				uri  string
+				code int
+			}{
+				{host: "app.example.com", uri: "/restricted/foo?bar=baz", code: http.StatusForbidden},
+				{host: "app.example.com", uri: "/foo", code: http.StatusAccepted},
+				{host: "other.example.com", uri: "/restricted/foo", code: http.StatusAccepted},
+			} {
+				req := httptest.NewRequest("", "http://proxy.localhost/oauth2/auth", nil)
+				req.Header.Set("X-Forwarded-Host", in.host)
+				req.Header.Set("X-Forwarded-Uri", in.uri)
+				req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{ReverseProxy: true})
+				rw := httptest.NewRecorder()
+				authOnly.ServeHTTP(rw, req)
+				Expect(rw.Code).To(Equal(in.code), "for %s%s", in.host, in.uri)
+			}
+		})
+	})
+
+	Context("multiUpstreamProxy with a cache and response headers", func() {
+		It("applies the response headers of each session to cached responses", func() {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				requests++
+				rw.Header().Set("Cache-Control", "public, max-age=60")
+				rw.Write([]byte("shared"))
+			}))
+			defer server.Close()
+
+			upstreams := options.Upstreams{
+				{
+					ID:    "cached",
+					Path:  "/",
+					URI:   server.URL,
+					Cache: &options.UpstreamCache{},
+					ResponseHeaders: &options.HeaderRules{
+						Set: []options.Header{
+							{
+								Name: "X-User-Email",
+								Values: []options.HeaderValue{
+									{ClaimSource: &options.ClaimSource{Claim: "email"}},
+								},
+							},
+						},
+					},
+				},
+			}
+			proxy, err := NewProxy(upstreams, nil, &pagewriter.WriterFuncs{}, ProxyOpts{})
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, email := range []string{"alice@example.com", "bob@example.com"} {
+				req := httptest.NewRequest("", "http://example.localhost/page", nil)
+				req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{
+					Session: &sessionsapi.SessionState{User: email, Email: email},
+				})
+				rw := httptest.NewRecorder()
+				proxy.ServeHTTP(rw, req)
+
+				Expect(rw.Code).To(Equal(http.StatusOK))
+				Expect(rw.Body.String()).To(Equal("shared"))
+				Expect(rw.Header().Values("X-User-Email")).To(Equal([]string{email}))
+			}
+			// The public response was shared by both users
+			Expect(requests).To(Equal(1))
+		})
+	})
+
+	Context("sortByHostPrecedence", func() {
+		exact := options.Upstream{Host: "app.example.com", Path: "/"}
+		wildcard := options.Upstream{Host: "*.example.com", Path: "/"}
+		longerWildcard := options.Upstream{Host: "*.internal.example.com", Path: "/"}
+		noHostLongPath := options.Upstream{Path: "/longer/path/"}
+		noHostShortPath := options.Upstream{Path: "/"}
+
+		It("sorts hosts by precedence, keeping the path order", func() {
+			input := options.Upstreams{noHostLongPath, noHostShortPath, wildcard, exact, longerWildcard}
+			Expect(sortByHostPrecedence(input)).To(Equal(options.Upstreams{exact, longerWildcard, wildcard, noHostLongPath, noHostShortPath}))
+		})
+	})
+
 	Context("sortByPathLongest", func() {
 		type sortByPathLongestTableInput struct {
 			input          options.Upstreams
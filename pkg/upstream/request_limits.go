@@ -0,0 +1,147 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/justinas/alice"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+)
+
+// errRequestBodyTooLarge is returned when reading a request body that is
+// larger than the MaxBodySize of the upstream
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// newRequestLimits creates a new middleware that rejects requests over the
+// request limits of the upstream.
+// It returns nil if the upstream has no request limits.
+func newRequestLimits(upstream options.Upstream, writer pagewriter.Writer) alice.Constructor {
+	limits := upstream.RequestLimits
+	if limits == nil {
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if limits.MaxHeaderSize > 0 && headerSize(req.Header) > limits.MaxHeaderSize {
+				writeRequestLimitError(rw, req, writer, http.StatusRequestHeaderFieldsTooLarge,
+					fmt.Sprintf("request headers exceed the limit of %d bytes", limits.MaxHeaderSize))
+				return
+			}
+
+			if len(limits.AllowedContentTypes) > 0 && hasBody(req) && !allowedContentType(req.Header.Get("Content-Type"), limits.AllowedContentTypes) {
+				writeRequestLimitError(rw, req, writer, http.StatusUnsupportedMediaType,
+					fmt.Sprintf("request content type %q is not allowed", req.Header.Get("Content-Type")))
+				return
+			}
+
+			if limits.MaxBodySize > 0 && hasBody(req) {
+				if req.ContentLength > limits.MaxBodySize {
+					writeRequestLimitError(rw, req, writer, http.StatusRequestEntityTooLarge,
+						fmt.Sprintf("request body exceeds the limit of %d bytes", limits.MaxBodySize))
+					return
+				}
+				// Bodies without a known length are counted as they are read
+				req.Body = &limitedBody{ReadCloser: req.Body, remaining: limits.MaxBodySize}
+			}
+
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// newRequestLimitsErrorHandler wraps the error handler of the upstream proxy
+// so that requests aborted for exceeding the MaxBodySize receive a 413
+// response.
+func newRequestLimitsErrorHandler(upstream options.Upstream, writer pagewriter.Writer, errorHandler ProxyErrorHandler) ProxyErrorHandler {
+	limits := upstream.RequestLimits
+	if limits == nil || limits.MaxBodySize == 0 {
+		return errorHandler
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request, proxyErr error) {
+		if !errors.Is(proxyErr, errRequestBodyTooLarge) {
+			errorHandler(rw, req, proxyErr)
+			return
+		}
+		writeRequestLimitError(rw, req, writer, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body exceeds the limit of %d bytes", limits.MaxBodySize))
+	}
+}
+
+// writeRequestLimitError writes the error page for a request over the limits.
+func writeRequestLimitError(rw http.ResponseWriter, req *http.Request, writer pagewriter.Writer, status int, appError string) {
+	writer.WriteErrorPage(rw, pagewriter.ErrorPageOpts{
+		Status:    status,
+		RequestID: middleware.GetRequestScope(req).RequestID,
+		AppError:  appError,
+	})
+}
+
+// headerSize is the total size of the header names and values.
+func headerSize(header http.Header) int64 {
+	var size int64
+	for name, values := range header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+// hasBody checks whether the request has a body, either with a known length
+// or a chunked body of unknown length.
+func hasBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0
+}
+
+// allowedContentType checks whether the media type of the content type
+// matches one of the allowed types.
+// Allowed types may end with "/*" to allow any subtype.
+func allowedContentType(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == mediaType {
+			return true
+		}
+		if strings.HasSuffix(a, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(a, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitedBody returns errRequestBodyTooLarge once more than the remaining
+// bytes have been read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errRequestBodyTooLarge
+	}
+	// Read one byte more than remaining so that a body of exactly the limit
+	// is allowed, but a larger body is detected
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return 0, errRequestBodyTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,173 @@
+package upstream
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/app/pagewriter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request Limits", func() {
+	var written pagewriter.ErrorPageOpts
+
+	writer := &pagewriter.WriterFuncs{
+		ErrorPageFunc: func(rw http.ResponseWriter, opts pagewriter.ErrorPageOpts) {
+			written = opts
+			rw.WriteHeader(opts.Status)
+		},
+		ProxyErrorFunc: func(rw http.ResponseWriter, _ *http.Request, err error) {
+			rw.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	BeforeEach(func() {
+		written = pagewriter.ErrorPageOpts{}
+	})
+
+	type requestLimitsTableInput struct {
+		limits           *options.RequestLimits
+		method           string
+		body             io.Reader
+		contentLength    int64
+		headers          map[string]string
+		expectedCode     int
+		expectedAppError string
+	}
+
+	DescribeTable("should reject requests over the limits",
+		func(in requestLimitsTableInput) {
+			limits := newRequestLimits(options.Upstream{RequestLimits: in.limits}, writer)
+			Expect(limits).ToNot(BeNil())
+
+			var body []byte
+			handler := limits(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				var err error
+				body, err = ioutil.ReadAll(req.Body)
+				if err != nil {
+					rw.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				rw.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(in.method, "http://example.com/upload", in.body)
+			if in.contentLength != 0 {
+				req.ContentLength = in.contentLength
+			}
+			for key, value := range in.headers {
+				req.Header.Set(key, value)
+			}
+			req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{RequestID: "11111111-2222-4333-8444-555555555555"})
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			Expect(rw.Code).To(Equal(in.expectedCode))
+			Expect(written.AppError).To(Equal(in.expectedAppError))
+			if in.expectedAppError != "" {
+				Expect(written.RequestID).To(Equal("11111111-2222-4333-8444-555555555555"))
+				Expect(body).To(BeNil())
+			}
+		},
+		Entry("with a body within the limit", requestLimitsTableInput{
+			limits:       &options.RequestLimits{MaxBodySize: 4},
+			method:       http.MethodPost,
+			body:         strings.NewReader("body"),
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with a Content-Length over the limit", requestLimitsTableInput{
+			limits:           &options.RequestLimits{MaxBodySize: 3},
+			method:           http.MethodPost,
+			body:             strings.NewReader("body"),
+			expectedCode:     http.StatusRequestEntityTooLarge,
+			expectedAppError: "request body exceeds the limit of 3 bytes",
+		}),
+		Entry("with an unknown length body over the limit", requestLimitsTableInput{
+			limits:        &options.RequestLimits{MaxBodySize: 3},
+			method:        http.MethodPost,
+			body:          strings.NewReader("body"),
+			contentLength: -1,
+			// The next handler fails to read the body
+			expectedCode: http.StatusBadGateway,
+		}),
+		Entry("with headers over the limit", requestLimitsTableInput{
+			limits:           &options.RequestLimits{MaxHeaderSize: 16},
+			method:           http.MethodGet,
+			headers:          map[string]string{"X-Large": strings.Repeat("x", 16)},
+			expectedCode:     http.StatusRequestHeaderFieldsTooLarge,
+			expectedAppError: "request headers exceed the limit of 16 bytes",
+		}),
+		Entry("with an allowed content type", requestLimitsTableInput{
+			limits:       &options.RequestLimits{AllowedContentTypes: []string{"application/json", "image/*"}},
+			method:       http.MethodPost,
+			body:         strings.NewReader("body"),
+			headers:      map[string]string{"Content-Type": "image/PNG"},
+			expectedCode: http.StatusOK,
+		}),
+		Entry("with a content type that is not allowed", requestLimitsTableInput{
+			limits:           &options.RequestLimits{AllowedContentTypes: []string{"application/json"}},
+			method:           http.MethodPost,
+			body:             strings.NewReader("body"),
+			headers:          map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+			expectedCode:     http.StatusUnsupportedMediaType,
+			expectedAppError: "request content type \"text/plain; charset=utf-8\" is not allowed",
+		}),
+		Entry("with a body and no content type", requestLimitsTableInput{
+			limits:           &options.RequestLimits{AllowedContentTypes: []string{"application/json"}},
+			method:           http.MethodPost,
+			body:             strings.NewReader("body"),
+			expectedCode:     http.StatusUnsupportedMediaType,
+			expectedAppError: "request content type \"\" is not allowed",
+		}),
+		Entry("with no body and no content type", requestLimitsTableInput{
+			limits:       &options.RequestLimits{AllowedContentTypes: []string{"application/json"}},
+			method:       http.MethodGet,
+			expectedCode: http.StatusOK,
+		}),
+	)
+
+	It("returns nil if the upstream has no request limits", func() {
+		Expect(newRequestLimits(options.Upstream{}, writer)).To(BeNil())
+	})
+
+	It("serves a 413 error page when a streamed body exceeds the limit", func() {
+		var received int
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			received = len(body)
+			rw.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		u, err := url.Parse(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+
+		upstream := options.Upstream{
+			ID:            "limited",
+			RequestLimits: &options.RequestLimits{MaxBodySize: 1024},
+		}
+		proxy, err := newHTTPUpstreamProxy(upstream, u, nil, newProxyErrorHandler(upstream, writer), nil)
+		Expect(err).ToNot(HaveOccurred())
+		handler := newRequestLimits(upstream, writer)(proxy)
+
+		// A reader without a length is sent chunked
+		body := io.MultiReader(strings.NewReader(strings.Repeat("x", 4096)))
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/upload", body)
+		req.ContentLength = -1
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		Expect(rw.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(written.AppError).To(Equal("request body exceeds the limit of 1024 bytes"))
+		Expect(received).To(BeNumerically("<=", 1024))
+	})
+})
@@ -0,0 +1,451 @@
+package upstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	rewriteSkippedUnsupportedEncoding = "unsupported_encoding"
+	rewriteSkippedInvalidGzip         = "invalid_gzip"
+)
+
+// bodyRewrite is a compiled options.BodyRewrite.
+type bodyRewrite struct {
+	pattern     *regexp.Regexp
+	replacement []byte
+}
+
+// responseRewriter rewrites the responses of an upstream that is served
+// under a sub-path so that links, redirects and cookies include the sub-path.
+type responseRewriter struct {
+	upstream     string
+	target       *url.URL
+	pathPrefix   string
+	location     bool
+	cookies      bool
+	cookieDomain string
+	body         []bodyRewrite
+	contentTypes map[string]struct{}
+	maxMatchSize int64
+
+	metrics *rewriteMetrics
+}
+
+// newResponseRewriter creates a new responseRewriter for responses from the
+// target server of the upstream.
+func newResponseRewriter(upstream string, target *url.URL, rewrite *options.ResponseRewrite, metrics *rewriteMetrics) (*responseRewriter, error) {
+	body := []bodyRewrite{}
+	for _, b := range rewrite.Body {
+		pattern, err := regexp.Compile(b.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body pattern %q: %v", b.Pattern, err)
+		}
+		body = append(body, bodyRewrite{
+			pattern:     pattern,
+			replacement: []byte(b.Replacement),
+		})
+	}
+
+	contentTypes := rewrite.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = options.DefaultResponseRewriteContentTypes
+	}
+	contentTypeSet := make(map[string]struct{})
+	for _, contentType := range contentTypes {
+		contentTypeSet[strings.ToLower(contentType)] = struct{}{}
+	}
+
+	maxMatchSize := rewrite.MaxMatchSize
+	if maxMatchSize == 0 {
+		maxMatchSize = options.DefaultResponseRewriteMaxMatchSize
+	}
+
+	return &responseRewriter{
+		upstream:     upstream,
+		target:       target,
+		pathPrefix:   strings.TrimSuffix(rewrite.PathPrefix, "/"),
+		location:     rewrite.Location,
+		cookies:      rewrite.Cookies,
+		cookieDomain: rewrite.CookieDomain,
+		body:         body,
+		contentTypes: contentTypeSet,
+		maxMatchSize: maxMatchSize,
+		metrics:      metrics,
+	}, nil
+}
+
+// modifyResponse rewrites the response headers and body.
+// It is used as the ModifyResponse func of the ReverseProxy.
+func (r *responseRewriter) modifyResponse(resp *http.Response) error {
+	if r.location {
+		for _, header := range []string{"Location", "Content-Location"} {
+			if location := resp.Header.Get(header); location != "" {
+				resp.Header.Set(header, r.rewriteLocation(location, resp.Request))
+			}
+		}
+	}
+
+	if r.cookies {
+		cookies := resp.Header.Values("Set-Cookie")
+		for i, cookie := range cookies {
+			cookies[i] = r.rewriteCookie(cookie)
+		}
+	}
+
+	if len(r.body) > 0 {
+		r.rewriteBody(resp)
+	}
+	return nil
+}
+
+// rewriteLocation makes URLs pointing at the upstream server, or the request
+// host, relative and adds the path prefix to absolute paths.
+func (r *responseRewriter) rewriteLocation(location string, req *http.Request) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	if u.Host != "" {
+		if !r.isUpstreamHost(u.Host, req) {
+			return location
+		}
+		u.Scheme = ""
+		u.Host = ""
+		u.User = nil
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+
+	if !strings.HasPrefix(u.Path, "/") {
+		return location
+	}
+	u.Path = r.pathPrefix + u.Path
+	if u.RawPath != "" {
+		u.RawPath = r.pathPrefix + u.RawPath
+	}
+	return u.String()
+}
+
+// isUpstreamHost checks whether the host is the upstream server or the host
+// of the request sent to the upstream server.
+func (r *responseRewriter) isUpstreamHost(host string, req *http.Request) bool {
+	if strings.EqualFold(host, r.target.Host) {
+		return true
+	}
+	return req != nil && strings.EqualFold(host, req.Host)
+}
+
+// rewriteCookie adds the path prefix to the Path attribute and replaces the
+// Domain attribute of a Set-Cookie header.
+// The attributes are rewritten in place so that any attributes not known to
+// the Go cookie parser are preserved.
+func (r *responseRewriter) rewriteCookie(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	rewritten := []string{parts[0]}
+
+	for _, part := range parts[1:] {
+		attr := strings.TrimSpace(part)
+		name, value := attr, ""
+		if i := strings.Index(attr, "="); i >= 0 {
+			name, value = strings.TrimSpace(attr[:i]), strings.TrimSpace(attr[i+1:])
+		}
+
+		switch strings.ToLower(name) {
+		case "path":
+			if strings.HasPrefix(value, "/") {
+				attr = "Path=" + r.pathPrefix + value
+			}
+		case "domain":
+			if r.cookieDomain == "" {
+				continue
+			}
+			attr = "Domain=" + r.cookieDomain
+		}
+		rewritten = append(rewritten, attr)
+	}
+
+	return strings.Join(rewritten, "; ")
+}
+
+// rewriteBody makes the body substitutions in the response body as it is
+// streamed to the client, when the response has one of the rewritten content
+// types.
+// Bodies with an encoding other than gzip, or that are not valid gzip, are
+// passed through unmodified, and the skipped rewrite is logged and counted.
+func (r *responseRewriter) rewriteBody(resp *http.Response) {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return
+	}
+	if !r.rewritesContentType(resp.Header.Get("Content-Type")) {
+		return
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding != "" && encoding != "identity" && encoding != "gzip" {
+		r.skipped(resp, rewriteSkippedUnsupportedEncoding, fmt.Sprintf("content encoding %q is not supported", encoding))
+		return
+	}
+
+	body := resp.Body
+	var content io.Reader = body
+	if encoding == "gzip" {
+		// The gzip header is read straight away, so that invalid bodies can
+		// be passed through with the bytes that were read
+		header := &recordingReader{reader: body, recording: true}
+		reader, err := gzip.NewReader(header)
+		if err != nil {
+			resp.Body = &multiReadCloser{
+				Reader: io.MultiReader(bytes.NewReader(header.recorded.Bytes()), body),
+				Closer: body,
+			}
+			r.skipped(resp, rewriteSkippedInvalidGzip, fmt.Sprintf("invalid gzip body: %v", err))
+			return
+		}
+		header.stop()
+		content = reader
+	}
+
+	for _, b := range r.body {
+		content = newStreamingRewriter(content, b, r.maxMatchSize)
+	}
+
+	if encoding == "gzip" {
+		resp.Body = newGzipStream(content, body)
+	} else {
+		resp.Body = &multiReadCloser{Reader: content, Closer: body}
+	}
+	// The length of the rewritten body is not known until it has been
+	// streamed, and the ETag no longer matches it
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("ETag")
+}
+
+// rewritesContentType checks whether the media type of the content type is
+// one of the rewritten content types.
+func (r *responseRewriter) rewritesContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	_, ok := r.contentTypes[mediaType]
+	return ok
+}
+
+// skipped logs and counts a response body that was not rewritten.
+func (r *responseRewriter) skipped(resp *http.Response, reason, detail string) {
+	path := ""
+	if resp.Request != nil && resp.Request.URL != nil {
+		path = resp.Request.URL.Path
+	}
+	logger.Printf("not rewriting response body of %s from upstream %q: %s", path, r.upstream, detail)
+	r.metrics.skipped(r.upstream, reason)
+}
+
+// streamingReadSize is the size of the reads from the body being rewritten.
+const streamingReadSize = 32 << 10
+
+// streamingRewriter makes the substitutions of a body rewrite while the body
+// is read.
+// The last maxMatchSize bytes read are held back until more of the body has
+// been read, in case a match continues into the next read, so matches are
+// only guaranteed to be found when they are no longer than maxMatchSize.
+type streamingRewriter struct {
+	src          io.Reader
+	rewrite      bodyRewrite
+	maxMatchSize int
+	chunk        []byte
+
+	// in is the input that has not been rewritten yet, preceded by context
+	// bytes of the input that has, so that anchors and word boundaries
+	// match as they would against the whole body
+	in      []byte
+	context int
+
+	out []byte
+	err error
+}
+
+// newStreamingRewriter creates a reader that makes the substitutions of the
+// body rewrite in the src.
+func newStreamingRewriter(src io.Reader, rewrite bodyRewrite, maxMatchSize int64) *streamingRewriter {
+	return &streamingRewriter{
+		src:          src,
+		rewrite:      rewrite,
+		maxMatchSize: int(maxMatchSize),
+		chunk:        make([]byte, streamingReadSize),
+	}
+}
+
+// Read reads the rewritten body.
+func (r *streamingRewriter) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill reads the next part of the body and rewrites as much of the input as
+// can be rewritten.
+func (r *streamingRewriter) fill() {
+	n, err := r.src.Read(r.chunk)
+	r.in = append(r.in, r.chunk[:n]...)
+
+	switch {
+	case err == io.EOF:
+		r.rewriteInput(true)
+		r.err = io.EOF
+	case err != nil:
+		r.err = err
+	case len(r.in)-r.context > r.maxMatchSize:
+		r.rewriteInput(false)
+	}
+}
+
+// rewriteInput makes the substitutions in the input, holding back the last
+// maxMatchSize bytes and any match that ends in them unless the body has
+// been read to the end.
+func (r *streamingRewriter) rewriteInput(final bool) {
+	limit := len(r.in)
+	if !final {
+		limit -= r.maxMatchSize
+	}
+
+	pos := r.context
+	for _, match := range r.rewrite.pattern.FindAllSubmatchIndex(r.in, -1) {
+		if match[0] < r.context {
+			// Matches in the context have already been rewritten
+			continue
+		}
+		if match[1] > limit && match[1]-match[0] < r.maxMatchSize {
+			// The match may continue into the next read
+			if match[0] < limit {
+				limit = match[0]
+			}
+			break
+		}
+		r.out = append(r.out, r.in[pos:match[0]]...)
+		r.out = r.rewrite.pattern.Expand(r.out, r.rewrite.replacement, r.in, match)
+		pos = match[1]
+	}
+	if limit < pos {
+		limit = pos
+	}
+	r.out = append(r.out, r.in[pos:limit]...)
+
+	// Keep a byte of the rewritten input as context for the next matches
+	r.context = 0
+	if limit > 0 {
+		r.context = 1
+	}
+	r.in = append(r.in[:0], r.in[limit-r.context:]...)
+}
+
+// recordingReader records the bytes read from the reader until it is stopped.
+type recordingReader struct {
+	reader    io.Reader
+	recorded  bytes.Buffer
+	recording bool
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if r.recording {
+		r.recorded.Write(p[:n])
+	}
+	return n, err
+}
+
+// stop stops recording the bytes read.
+func (r *recordingReader) stop() {
+	r.recording = false
+	r.recorded = bytes.Buffer{}
+}
+
+// gzipStream compresses the content with gzip as it is read.
+type gzipStream struct {
+	*io.PipeReader
+	body io.Closer
+}
+
+// newGzipStream creates a reader that compresses the content with gzip.
+// Closing it closes the body the content is read from.
+func newGzipStream(content io.Reader, body io.Closer) *gzipStream {
+	reader, writer := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(writer)
+		_, err := io.Copy(gz, content)
+		if err == nil {
+			err = gz.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	return &gzipStream{PipeReader: reader, body: body}
+}
+
+// Close stops the compression and closes the body.
+func (s *gzipStream) Close() error {
+	s.PipeReader.Close()
+	return s.body.Close()
+}
+
+// rewriteMetrics reports the response bodies that were not rewritten to
+// Prometheus.
+type rewriteMetrics struct {
+	skippedRewrites *prometheus.CounterVec
+}
+
+func newRewriteMetrics(registerer prometheus.Registerer) *rewriteMetrics {
+	return &rewriteMetrics{
+		skippedRewrites: registerRewriteSkippedCounter(registerer),
+	}
+}
+
+func (m *rewriteMetrics) skipped(upstream, reason string) {
+	if m == nil {
+		return
+	}
+	m.skippedRewrites.WithLabelValues(upstream, reason).Inc()
+}
+
+// registerRewriteSkippedCounter registers 'oauth2_proxy_upstream_response_rewrite_skipped_total'
+// This keeps a tally of the response bodies that were passed through without
+// being rewritten
+func registerRewriteSkippedCounter(registerer prometheus.Registerer) *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "oauth2_proxy_upstream_response_rewrite_skipped_total",
+			Help: "Total number of upstream response bodies that were not rewritten by reason (unsupported_encoding or invalid_gzip).",
+		},
+		[]string{"upstream", "reason"},
+	)
+
+	if err := registerer.Register(counter); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counter = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			panic(err)
+		}
+	}
+
+	return counter
+}
@@ -0,0 +1,301 @@
+package upstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing/iotest"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Response Rewrite", func() {
+	target := &url.URL{Scheme: "http", Host: "127.0.0.1:8080"}
+
+	var metrics *rewriteMetrics
+
+	BeforeEach(func() {
+		metrics = newRewriteMetrics(prometheus.NewRegistry())
+	})
+
+	skipped := func(reason string) float64 {
+		return testutil.ToFloat64(metrics.skippedRewrites.WithLabelValues("rewrite", reason))
+	}
+
+	newRewriter := func(rewrite *options.ResponseRewrite) *responseRewriter {
+		rewriter, err := newResponseRewriter("rewrite", target, rewrite, metrics)
+		Expect(err).ToNot(HaveOccurred())
+		return rewriter
+	}
+
+	gzipString := func(s string) []byte {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		_, err := writer.Write([]byte(s))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+		return buf.Bytes()
+	}
+
+	gunzipString := func(b []byte) string {
+		reader, err := gzip.NewReader(bytes.NewReader(b))
+		Expect(err).ToNot(HaveOccurred())
+		content, err := ioutil.ReadAll(reader)
+		Expect(err).ToNot(HaveOccurred())
+		return string(content)
+	}
+
+	type locationTableInput struct {
+		location         string
+		expectedLocation string
+	}
+
+	DescribeTable("should rewrite the Location header",
+		func(in locationTableInput) {
+			rewriter := newRewriter(&options.ResponseRewrite{
+				PathPrefix: "/app/",
+				Location:   true,
+			})
+
+			req := httptest.NewRequest("", "http://proxy.example.com/app/", nil)
+			resp := &http.Response{
+				Header:  http.Header{"Location": []string{in.location}},
+				Request: req,
+			}
+			Expect(rewriter.modifyResponse(resp)).To(Succeed())
+			Expect(resp.Header.Get("Location")).To(Equal(in.expectedLocation))
+		},
+		Entry("with an absolute path", locationTableInput{
+			location:         "/login?next=%2Fhome",
+			expectedLocation: "/app/login?next=%2Fhome",
+		}),
+		Entry("with the upstream server", locationTableInput{
+			location:         "http://127.0.0.1:8080/login",
+			expectedLocation: "/app/login",
+		}),
+		Entry("with the request host", locationTableInput{
+			location:         "https://proxy.example.com",
+			expectedLocation: "/app/",
+		}),
+		Entry("with another host", locationTableInput{
+			location:         "https://accounts.example.com/login",
+			expectedLocation: "https://accounts.example.com/login",
+		}),
+		Entry("with a relative path", locationTableInput{
+			location:         "login",
+			expectedLocation: "login",
+		}),
+	)
+
+	type cookieTableInput struct {
+		cookieDomain   string
+		cookie         string
+		expectedCookie string
+	}
+
+	DescribeTable("should rewrite Set-Cookie headers",
+		func(in cookieTableInput) {
+			rewriter := newRewriter(&options.ResponseRewrite{
+				PathPrefix:   "/app",
+				Cookies:      true,
+				CookieDomain: in.cookieDomain,
+			})
+
+			resp := &http.Response{
+				Header: http.Header{"Set-Cookie": []string{in.cookie, "other=value"}},
+			}
+			Expect(rewriter.modifyResponse(resp)).To(Succeed())
+			Expect(resp.Header.Values("Set-Cookie")).To(Equal([]string{in.expectedCookie, "other=value"}))
+		},
+		Entry("with a path", cookieTableInput{
+			cookie:         "session=abc; Path=/; HttpOnly; SameSite=Lax",
+			expectedCookie: "session=abc; Path=/app/; HttpOnly; SameSite=Lax",
+		}),
+		Entry("with a domain", cookieTableInput{
+			cookie:         "session=abc; domain=internal.local; path=/admin",
+			expectedCookie: "session=abc; Path=/app/admin",
+		}),
+		Entry("with a domain and a cookie domain", cookieTableInput{
+			cookieDomain:   "example.com",
+			cookie:         "session=abc; Domain=internal.local; Secure",
+			expectedCookie: "session=abc; Domain=example.com; Secure",
+		}),
+	)
+
+	Context("rewriting the body", func() {
+		var rewriter *responseRewriter
+
+		BeforeEach(func() {
+			rewriter = newRewriter(&options.ResponseRewrite{
+				Body: []options.BodyRewrite{
+					{Pattern: `(href|src)="/`, Replacement: `$1="/app/`},
+				},
+				MaxMatchSize: 16,
+			})
+		})
+
+		newResponse := func(contentType string, body []byte) *http.Response {
+			return &http.Response{
+				Header: http.Header{
+					"Content-Type":   []string{contentType},
+					"Content-Length": []string{"1"},
+					"Etag":           []string{`"abc"`},
+				},
+				Body:          ioutil.NopCloser(bytes.NewReader(body)),
+				ContentLength: int64(len(body)),
+			}
+		}
+
+		readBody := func(resp *http.Response) []byte {
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			return body
+		}
+
+		It("rewrites HTML bodies", func() {
+			resp := newResponse("text/html; charset=utf-8", []byte(`<a href="/home"><img src="/logo.png">`))
+			Expect(rewriter.modifyResponse(resp)).To(Succeed())
+
+			expected := `<a href="/app/home"><img src="/app/logo.png">`
+			Expect(string(readBody(resp))).To(Equal(expected))
+			Expect(resp.ContentLength).To(BeEquivalentTo(-1))
+			Expect(resp.Header.Get("Content-Length")).To(BeEmpty())
+			Expect(resp.Header.Get("ETag")).To(BeEmpty())
+		})
+
+		It("rewrites gzip bodies", func() {
+			resp := newResponse("text/html", gzipString(`<a href="/home">`))
+			resp.Header.Set("Content-Encoding", "gzip")
+			Expect(rewriter.modifyResponse(resp)).To(Succeed())
+
+			Expect(resp.Header.Get("Content-Encoding")).To(Equal("gzip"))
+			Expect(gunzipString(readBody(resp))).To(Equal(`<a href="/app/home">`))
+		})
+
+		It("does not rewrite other content types", func() {
+			resp := newResponse("application/json", []byte(`{"href="/": true}`))
+			Expect(rewriter.modifyResponse(resp)).To(Succeed())
+
+			Expect(string(readBody(resp))).To(Equal(`{"href="/": true}`))
+			Expect(resp.Header.Get("ETag")).To(Equal(`"abc"`))
+		})
+
+		It("does not rewrite other encodings", func() {
+			resp := newResponse("text/html", []byte("compressed"))
+			resp.Header.Set("Content-Encoding", "br")
+			Expect(rewriter.modifyResponse(resp)).To(Succeed())
+
+			Expect(string(readBody(resp))).To(Equal("compressed"))
+			Expect(skipped(rewriteSkippedUnsupportedEncoding)).To(Equal(1.0))
+		})
+
+		It("rewrites bodies larger than the read size", func() {
+			body := strings.Repeat(`<a href="/home">`, streamingReadSize)
+			resp := newResponse("text/html", []byte(body))
+			Expect(rewriter.modifyResponse(resp)).To(Succeed())
+
+			Expect(string(readBody(resp))).To(Equal(strings.Repeat(`<a href="/app/home">`, streamingReadSize)))
+		})
+
+		It("rewrites matches split between reads", func() {
+			body := strings.Repeat("x", 30) + `<a href="/home">` + strings.Repeat("y", 30) + `<img src="/logo.png">`
+			resp := newResponse("text/html", nil)
+			resp.Body = ioutil.NopCloser(iotest.OneByteReader(strings.NewReader(body)))
+			Expect(rewriter.modifyResponse(resp)).To(Succeed())
+
+			expected := strings.Repeat("x", 30) + `<a href="/app/home">` + strings.Repeat("y", 30) + `<img src="/app/logo.png">`
+			Expect(string(readBody(resp))).To(Equal(expected))
+		})
+
+		It("rewrites large gzip bodies", func() {
+			body := strings.Repeat(`<a href="/home">`, streamingReadSize)
+			resp := newResponse("text/html", gzipString(body))
+			resp.Header.Set("Content-Encoding", "gzip")
+			Expect(rewriter.modifyResponse(resp)).To(Succeed())
+
+			Expect(resp.Header.Get("Content-Encoding")).To(Equal("gzip"))
+			Expect(gunzipString(readBody(resp))).To(Equal(strings.Repeat(`<a href="/app/home">`, streamingReadSize)))
+		})
+
+		It("matches anchors against the whole body", func() {
+			rewriter := newRewriter(&options.ResponseRewrite{
+				Body: []options.BodyRewrite{
+					{Pattern: `^<html>`, Replacement: `<!DOCTYPE html><html>`},
+					{Pattern: `\bfoo`, Replacement: `bar`},
+				},
+				MaxMatchSize: 8,
+			})
+
+			body := "<html>" + strings.Repeat("xfoo", 10) + "<html> foo"
+			resp := newResponse("text/html", nil)
+			resp.Body = ioutil.NopCloser(iotest.OneByteReader(strings.NewReader(body)))
+			Expect(rewriter.modifyResponse(resp)).To(Succeed())
+
+			Expect(string(readBody(resp))).To(Equal("<!DOCTYPE html><html>" + strings.Repeat("xfoo", 10) + "<html> bar"))
+		})
+
+		It("passes through invalid gzip bodies", func() {
+			resp := newResponse("text/html", []byte("not gzip"))
+			resp.Header.Set("Content-Encoding", "gzip")
+			Expect(rewriter.modifyResponse(resp)).To(Succeed())
+
+			Expect(string(readBody(resp))).To(Equal("not gzip"))
+			Expect(skipped(rewriteSkippedInvalidGzip)).To(Equal(1.0))
+		})
+	})
+
+	It("rewrites responses from the upstream server", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Content-Type", "text/html")
+			rw.Header().Set("Location", "/login")
+			rw.Header().Add("Set-Cookie", "session=abc; Path=/")
+			rw.WriteHeader(http.StatusFound)
+			_, err := rw.Write([]byte(`<a href="/login">Login</a>`))
+			Expect(err).ToNot(HaveOccurred())
+		}))
+		defer server.Close()
+
+		u, err := url.Parse(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+
+		handler, err := newHTTPUpstreamProxy(options.Upstream{
+			ID: "rewrite",
+			ResponseRewrite: &options.ResponseRewrite{
+				PathPrefix: "/app",
+				Location:   true,
+				Cookies:    true,
+				Body: []options.BodyRewrite{
+					{Pattern: `href="/`, Replacement: `href="/app/`},
+				},
+			},
+		}, u, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		req := httptest.NewRequest("", "http://example.com/", nil)
+		req = middlewareapi.AddRequestScope(req, &middlewareapi.RequestScope{})
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		Expect(rw.Code).To(Equal(http.StatusFound))
+		Expect(rw.Header().Get("Location")).To(Equal("/app/login"))
+		Expect(rw.Header().Get("Set-Cookie")).To(Equal("session=abc; Path=/app/"))
+		Expect(rw.Body.String()).To(Equal(`<a href="/app/login">Login</a>`))
+	})
+
+	It("returns an error for an invalid body pattern", func() {
+		_, err := newResponseRewriter("rewrite", target, &options.ResponseRewrite{
+			Body: []options.BodyRewrite{{Pattern: "("}},
+		}, metrics)
+		Expect(err).To(MatchError(ContainSubstring("invalid body pattern \"(\"")))
+	})
+})
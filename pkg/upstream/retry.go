@@ -0,0 +1,158 @@
+package upstream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+)
+
+// idempotentMethods are the request methods that are safe to retry by
+// default, as defined by RFC 7231 section 4.2.2.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// retryTransport retries requests that fail to connect to the upstream or
+// that receive one of the configured response codes, backing off between
+// each attempt.
+type retryTransport struct {
+	transport          http.RoundTripper
+	attempts           int
+	statusCodes        map[int]bool
+	backoff            time.Duration
+	maxBackoff         time.Duration
+	retryNonIdempotent bool
+	maxBodyBufferSize  int64
+}
+
+func newRetryTransport(transport http.RoundTripper, retry *options.Retry) *retryTransport {
+	statusCodes := make(map[int]bool, len(retry.StatusCodes))
+	for _, code := range retry.StatusCodes {
+		statusCodes[code] = true
+	}
+
+	maxBodyBufferSize := retry.MaxBodyBufferSize
+	if maxBodyBufferSize == 0 {
+		maxBodyBufferSize = options.DefaultRetryMaxBodyBufferSize
+	}
+
+	return &retryTransport{
+		transport:          transport,
+		attempts:           retry.Attempts,
+		statusCodes:        statusCodes,
+		backoff:            durationOrDefault(retry.Backoff, options.DefaultRetryBackoff),
+		maxBackoff:         durationOrDefault(retry.MaxBackoff, options.DefaultRetryMaxBackoff),
+		retryNonIdempotent: retry.RetryNonIdempotent,
+		maxBodyBufferSize:  maxBodyBufferSize,
+	}
+}
+
+// RoundTrip sends the request to the upstream, retrying it if it fails.
+func (r *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !r.retryNonIdempotent && !idempotentMethods[req.Method] {
+		return r.transport.RoundTrip(req)
+	}
+
+	buffered, retryable, err := r.bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if !retryable {
+		return r.transport.RoundTrip(buffered)
+	}
+
+	backoff := r.backoff
+	for attempt := 0; ; attempt++ {
+		attemptReq := buffered.Clone(req.Context())
+		if buffered.GetBody != nil {
+			body, err := buffered.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq.Body = body
+		}
+
+		resp, err := r.transport.RoundTrip(attemptReq)
+		if attempt >= r.attempts || !r.shouldRetry(req, resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			// Drain the body so that the connection can be reused
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > r.maxBackoff {
+			backoff = r.maxBackoff
+		}
+	}
+}
+
+// shouldRetry returns whether the outcome of the request should be retried.
+func (r *retryTransport) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// Requests failed by the circuit breaker or abandoned by the client
+		// will fail again
+		return !errors.Is(err, errCircuitOpen) && req.Context().Err() == nil
+	}
+	return r.statusCodes[resp.StatusCode]
+}
+
+// bufferBody reads the request body into memory, returning a clone of the
+// request with a GetBody func so that the body can be sent with each attempt.
+// If the body is larger than the buffer, the request is not retryable and the
+// clone streams the body to the upstream.
+// The request passed to the transport is not modified.
+func (r *retryTransport) bufferBody(req *http.Request) (*http.Request, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, true, nil
+	}
+	if req.ContentLength > r.maxBodyBufferSize {
+		return req, false, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, r.maxBodyBufferSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	buffered := req.Clone(req.Context())
+	if int64(len(body)) > r.maxBodyBufferSize {
+		buffered.Body = &multiReadCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), req.Body),
+			Closer: req.Body,
+		}
+		return buffered, false, nil
+	}
+
+	req.Body.Close()
+	buffered.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	buffered.Body, _ = buffered.GetBody()
+	return buffered, true, nil
+}
+
+// multiReadCloser reads from the Reader and closes the Closer.
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
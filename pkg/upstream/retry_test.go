@@ -0,0 +1,152 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// roundTripperFunc allows a function to be used as a http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+var _ = Describe("Retry Suite", func() {
+	errConnectionRefused := errors.New("connection refused")
+
+	var bodies []string
+	var responses []int
+
+	// respond returns the next response code, or a connection error for 0
+	respond := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body := ""
+		if req.Body != nil {
+			b, err := ioutil.ReadAll(req.Body)
+			Expect(err).ToNot(HaveOccurred())
+			body = string(b)
+		}
+		bodies = append(bodies, body)
+
+		code := responses[0]
+		if len(responses) > 1 {
+			responses = responses[1:]
+		}
+		if code == 0 {
+			return nil, errConnectionRefused
+		}
+		return &http.Response{StatusCode: code, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+
+	newTransport := func(retry options.Retry) *retryTransport {
+		retry.Backoff = durationPtr(time.Millisecond)
+		return newRetryTransport(respond, &retry)
+	}
+
+	BeforeEach(func() {
+		bodies = []string{}
+	})
+
+	It("retries connection failures", func() {
+		responses = []int{0, 0, http.StatusOK}
+		resp, err := newTransport(options.Retry{Attempts: 2}).RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(bodies).To(HaveLen(3))
+	})
+
+	It("gives up after the configured attempts", func() {
+		responses = []int{0}
+		_, err := newTransport(options.Retry{Attempts: 2}).RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+		Expect(err).To(Equal(errConnectionRefused))
+		Expect(bodies).To(HaveLen(3))
+	})
+
+	It("retries the configured response codes", func() {
+		responses = []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}
+		resp, err := newTransport(options.Retry{Attempts: 3, StatusCodes: []int{http.StatusServiceUnavailable}}).RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+		Expect(bodies).To(HaveLen(2))
+	})
+
+	It("does not retry when the circuit breaker is open", func() {
+		transport := newRetryTransport(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			bodies = append(bodies, "")
+			return nil, errCircuitOpen
+		}), &options.Retry{Attempts: 3})
+
+		_, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+		Expect(err).To(Equal(errCircuitOpen))
+		Expect(bodies).To(HaveLen(1))
+	})
+
+	It("stops backing off when the request is cancelled", func() {
+		responses = []int{0}
+		ctx, cancel := context.WithCancel(context.Background())
+		transport := newRetryTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			time.AfterFunc(10*time.Millisecond, cancel)
+			return respond(req)
+		}), &options.Retry{Attempts: 3, Backoff: durationPtr(time.Minute)})
+
+		_, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		Expect(err).To(Equal(context.Canceled))
+		Expect(bodies).To(HaveLen(1))
+	})
+
+	It("does not retry non-idempotent methods by default", func() {
+		responses = []int{0, http.StatusOK}
+		_, err := newTransport(options.Retry{Attempts: 2}).RoundTrip(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body")))
+		Expect(err).To(Equal(errConnectionRefused))
+		Expect(bodies).To(Equal([]string{"body"}))
+	})
+
+	It("retries non-idempotent methods with the buffered body when enabled", func() {
+		responses = []int{0, http.StatusOK}
+		transport := newTransport(options.Retry{Attempts: 2, RetryNonIdempotent: true})
+
+		resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body")))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(bodies).To(Equal([]string{"body", "body"}))
+	})
+
+	It("does not replace the body of the request", func() {
+		responses = []int{0, http.StatusOK}
+		transport := newTransport(options.Retry{Attempts: 2, RetryNonIdempotent: true})
+
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		body := req.Body
+		_, err := transport.RoundTrip(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(req.Body).To(BeIdenticalTo(body))
+		Expect(req.GetBody).To(BeNil())
+	})
+
+	It("streams bodies larger than the buffer without retrying", func() {
+		responses = []int{0, http.StatusOK}
+		transport := newTransport(options.Retry{Attempts: 2, RetryNonIdempotent: true, MaxBodyBufferSize: 4})
+
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		// Hide the content length so that the body has to be read
+		req.Body = ioutil.NopCloser(bytes.NewBufferString("larger body"))
+		req.ContentLength = -1
+
+		body := req.Body
+
+		_, err := transport.RoundTrip(req)
+		Expect(err).To(Equal(errConnectionRefused))
+		Expect(bodies).To(Equal([]string{"larger body"}))
+		Expect(req.Body).To(BeIdenticalTo(body))
+	})
+})
@@ -0,0 +1,258 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options/util"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	pkgutil "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/util"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/watcher"
+)
+
+// upstreamTLS holds the TLS options of an upstream, to create the TLS config
+// of connections to its backends.
+// The client certificate and CA bundle are reloaded when the files they were
+// loaded from change, so that rotated certificates are used for new
+// connections without a restart.
+type upstreamTLS struct {
+	upstream           string
+	opts               *options.UpstreamTLS
+	insecureSkipVerify bool
+	minVersion         uint16
+
+	// reloading is set when any of the certificates are loaded from files
+	reloading bool
+
+	mu         sync.RWMutex
+	clientCert *tls.Certificate
+	rootCAs    *x509.CertPool
+}
+
+// newUpstreamTLS loads the TLS options of the upstream, and watches the files
+// they were loaded from until done is closed.
+// It returns nil if the default TLS config should be used.
+func newUpstreamTLS(upstream options.Upstream, done <-chan struct{}) (*upstreamTLS, error) {
+	opts := upstream.TLS
+	if opts == nil && !upstream.InsecureSkipTLSVerify {
+		return nil, nil
+	}
+
+	t := &upstreamTLS{
+		upstream:           upstream.ID,
+		opts:               opts,
+		insecureSkipVerify: upstream.InsecureSkipTLSVerify,
+	}
+	if opts == nil {
+		return t, nil
+	}
+
+	if opts.MinVersion != "" {
+		version, err := pkgutil.ParseTLSVersion(opts.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		t.minVersion = version
+	}
+
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+
+	files := upstreamTLSFiles(opts)
+	if len(files) > 0 {
+		t.reloading = true
+		t.watch(files, done)
+	}
+	return t, nil
+}
+
+// config creates the TLS config for connections to the host, or nil if the
+// default TLS config should be used.
+func (t *upstreamTLS) config(host string) *tls.Config {
+	if t == nil {
+		return nil
+	}
+
+	// InsecureSkipVerify is a configurable option we allow
+	/* #nosec G402 */
+	config := &tls.Config{
+		InsecureSkipVerify: t.insecureSkipVerify,
+	}
+	if t.opts == nil {
+		return config
+	}
+
+	config.ServerName = t.opts.ServerName
+	config.MinVersion = t.minVersion
+
+	if !t.reloading {
+		if t.clientCert != nil {
+			config.Certificates = []tls.Certificate{*t.clientCert}
+		}
+		config.RootCAs = t.rootCAs
+		return config
+	}
+
+	if t.opts.ClientCert != nil {
+		config.GetClientCertificate = t.getClientCertificate
+	}
+	if t.opts.CA != nil && !t.insecureSkipVerify {
+		serverName := config.ServerName
+		if serverName == "" {
+			serverName = host
+		}
+
+		// The RootCAs of a config can't be replaced once it is in use, so the
+		// certificates of the backend are verified against the current CA
+		// bundle instead
+		/* #nosec G402 */
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return t.verifyConnection(state, serverName)
+		}
+	}
+	return config
+}
+
+// load loads the client certificate and CA bundle from their sources.
+// The current certificates are only replaced if both load successfully.
+func (t *upstreamTLS) load() error {
+	var clientCert *tls.Certificate
+	if t.opts.ClientCert != nil || t.opts.ClientKey != nil {
+		cert, err := loadClientCertificate(t.opts)
+		if err != nil {
+			return err
+		}
+		clientCert = &cert
+	}
+
+	var rootCAs *x509.CertPool
+	if t.opts.CA != nil {
+		pool, err := loadCertPool(t.opts.CA)
+		if err != nil {
+			return err
+		}
+		rootCAs = pool
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clientCert = clientCert
+	t.rootCAs = rootCAs
+	return nil
+}
+
+// watch reloads the certificates when any of the files change, until done is
+// closed.
+func (t *upstreamTLS) watch(files []string, done <-chan struct{}) {
+	stop := make(chan bool)
+	go func() {
+		<-done
+		close(stop)
+	}()
+
+	for _, filename := range files {
+		filename := filename
+		watcher.WatchForUpdates(filename, stop, func() {
+			t.reload(filename)
+		})
+	}
+}
+
+// reload loads the certificates again after a change to the file.
+// If they can't be loaded, eg. the key has been updated but the certificate
+// has not been yet, the current certificates are kept.
+func (t *upstreamTLS) reload(filename string) {
+	if err := t.load(); err != nil {
+		logger.Errorf("error reloading TLS certificates for upstream %q after a change to %s: %v", t.upstream, filename, err)
+		return
+	}
+	logger.Printf("reloaded TLS certificates for upstream %q after a change to %s", t.upstream, filename)
+}
+
+// getClientCertificate returns the current client certificate.
+func (t *upstreamTLS) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.clientCert, nil
+}
+
+// verifyConnection verifies the certificate chain of the backend against the
+// current CA bundle.
+func (t *upstreamTLS) verifyConnection(state tls.ConnectionState, serverName string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("backend did not present a certificate")
+	}
+
+	t.mu.RLock()
+	roots := t.rootCAs
+	t.mu.RUnlock()
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// loadClientCertificate loads the client certificate and key from their
+// secret sources.
+func loadClientCertificate(opts *options.UpstreamTLS) (tls.Certificate, error) {
+	if opts.ClientCert == nil || opts.ClientKey == nil {
+		return tls.Certificate{}, errors.New("both clientCert and clientKey are required for a client certificate")
+	}
+
+	certData, err := util.GetSecretValue(opts.ClientCert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not load client certificate: %v", err)
+	}
+	keyData, err := util.GetSecretValue(opts.ClientKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not load client key: %v", err)
+	}
+
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not parse client certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// loadCertPool loads the PEM encoded CA bundle from its secret source.
+func loadCertPool(source *options.SecretSource) (*x509.CertPool, error) {
+	data, err := util.GetSecretValue(source)
+	if err != nil {
+		return nil, fmt.Errorf("could not load CA bundle: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("could not parse CA bundle: no certificates found")
+	}
+	return pool, nil
+}
+
+// upstreamTLSFiles returns the files that the TLS config of the upstream is
+// loaded from.
+func upstreamTLSFiles(opts *options.UpstreamTLS) []string {
+	files := []string{}
+	if opts == nil {
+		return files
+	}
+	for _, source := range []*options.SecretSource{opts.ClientCert, opts.ClientKey, opts.CA} {
+		if source != nil && source.FromFile != "" {
+			files = append(files, source.FromFile)
+		}
+	}
+	return files
+}
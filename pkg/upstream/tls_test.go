@@ -0,0 +1,298 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testCertificate is a PEM encoded certificate and key generated for tests.
+type testCertificate struct {
+	certPEM []byte
+	keyPEM  []byte
+	cert    *x509.Certificate
+	key     crypto.Signer
+}
+
+// newTestCertificate creates a certificate from the template, signed by the
+// parent, or self-signed if the parent is nil.
+func newTestCertificate(template *x509.Certificate, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	Expect(err).ToNot(HaveOccurred())
+	template.SerialNumber = serialNumber
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parentCert, parentKey := template, crypto.Signer(key)
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	return &testCertificate{
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		cert:    cert,
+		key:     key,
+	}
+}
+
+var _ = Describe("Upstream TLS Suite", func() {
+	var ca, serverCert, clientCert *testCertificate
+
+	BeforeEach(func() {
+		ca = newTestCertificate(&x509.Certificate{
+			Subject:               pkix.Name{CommonName: "Test CA"},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}, nil)
+		serverCert = newTestCertificate(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: "upstream.local"},
+			DNSNames:    []string{"upstream.local"},
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, ca)
+		clientCert = newTestCertificate(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: "oauth2-proxy"},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca)
+	})
+
+	Context("newUpstreamTLS", func() {
+		It("returns no options without TLS options", func() {
+			tlsOpts, err := newUpstreamTLS(options.Upstream{}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tlsOpts).To(BeNil())
+			Expect(tlsOpts.config("upstream.local")).To(BeNil())
+		})
+
+		It("applies the TLS options", func() {
+			tlsOpts, err := newUpstreamTLS(options.Upstream{
+				TLS: &options.UpstreamTLS{
+					ClientCert: &options.SecretSource{Value: clientCert.certPEM},
+					ClientKey:  &options.SecretSource{Value: clientCert.keyPEM},
+					CA:         &options.SecretSource{Value: ca.certPEM},
+					ServerName: "upstream.local",
+					MinVersion: "TLS1.3",
+				},
+			}, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			config := tlsOpts.config("127.0.0.1")
+			Expect(config.ServerName).To(Equal("upstream.local"))
+			Expect(config.MinVersion).To(Equal(uint16(tls.VersionTLS13)))
+			Expect(config.Certificates).To(HaveLen(1))
+			Expect(config.RootCAs).ToNot(BeNil())
+			Expect(config.InsecureSkipVerify).To(BeFalse())
+		})
+
+		It("creates a new config for each host", func() {
+			tlsOpts, err := newUpstreamTLS(options.Upstream{InsecureSkipTLSVerify: true}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tlsOpts.config("upstream.local")).ToNot(BeIdenticalTo(tlsOpts.config("upstream.local")))
+		})
+
+		It("requires both a client certificate and key", func() {
+			_, err := newUpstreamTLS(options.Upstream{
+				TLS: &options.UpstreamTLS{ClientCert: &options.SecretSource{Value: clientCert.certPEM}},
+			}, nil)
+			Expect(err).To(MatchError("both clientCert and clientKey are required for a client certificate"))
+		})
+
+		It("rejects an invalid CA bundle", func() {
+			_, err := newUpstreamTLS(options.Upstream{
+				TLS: &options.UpstreamTLS{CA: &options.SecretSource{Value: []byte("not a certificate")}},
+			}, nil)
+			Expect(err).To(MatchError("could not parse CA bundle: no certificates found"))
+		})
+	})
+
+	Context("with an upstream requiring client certificates", func() {
+		var server *httptest.Server
+		var tmpDir string
+
+		BeforeEach(func() {
+			server = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				_, _ = rw.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+			}))
+			serverPair, err := tls.X509KeyPair(serverCert.certPEM, serverCert.keyPEM)
+			Expect(err).ToNot(HaveOccurred())
+			clientCAs := x509.NewCertPool()
+			clientCAs.AddCert(ca.cert)
+			server.TLS = &tls.Config{
+				Certificates: []tls.Certificate{serverPair},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    clientCAs,
+			}
+			server.StartTLS()
+
+			tmpDir, err = ioutil.TempDir("", "upstream-tls")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "ca.pem"), ca.certPEM, 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "client.pem"), clientCert.certPEM, 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "client-key.pem"), clientCert.keyPEM, 0600)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			server.Close()
+			Expect(os.RemoveAll(tmpDir)).To(Succeed())
+		})
+
+		mtlsOptions := func() *options.UpstreamTLS {
+			return &options.UpstreamTLS{
+				ClientCert: &options.SecretSource{FromFile: filepath.Join(tmpDir, "client.pem")},
+				ClientKey:  &options.SecretSource{FromFile: filepath.Join(tmpDir, "client-key.pem")},
+				CA:         &options.SecretSource{FromFile: filepath.Join(tmpDir, "ca.pem")},
+				ServerName: "upstream.local",
+			}
+		}
+
+		var done chan struct{}
+
+		BeforeEach(func() {
+			done = make(chan struct{})
+		})
+
+		AfterEach(func() {
+			close(done)
+		})
+
+		newTLS := func(opts *options.UpstreamTLS) *upstreamTLS {
+			tlsOpts, err := newUpstreamTLS(options.Upstream{ID: "mtls", TLS: opts}, done)
+			Expect(err).ToNot(HaveOccurred())
+			return tlsOpts
+		}
+
+		proxyRequest := func(opts *options.UpstreamTLS) *httptest.ResponseRecorder {
+			u, err := url.Parse(server.URL)
+			Expect(err).ToNot(HaveOccurred())
+			handler, err := newHTTPUpstreamProxy(options.Upstream{ID: "mtls", TLS: opts}, u, nil, func(rw http.ResponseWriter, _ *http.Request, _ error) {
+				rw.WriteHeader(http.StatusBadGateway)
+			}, newTLS(opts))
+			Expect(err).ToNot(HaveOccurred())
+
+			req := middlewareapi.AddRequestScope(httptest.NewRequest("", "/", nil), &middlewareapi.RequestScope{})
+			req.RequestURI = "/"
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			return rw
+		}
+
+		It("presents the client certificate to the upstream", func() {
+			rw := proxyRequest(mtlsOptions())
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(Equal("oauth2-proxy"))
+		})
+
+		It("fails without a client certificate", func() {
+			opts := mtlsOptions()
+			opts.ClientCert = nil
+			opts.ClientKey = nil
+			Expect(proxyRequest(opts).Code).To(Equal(http.StatusBadGateway))
+		})
+
+		It("fails when the server name does not match the certificate", func() {
+			opts := mtlsOptions()
+			opts.ServerName = "other.local"
+			Expect(proxyRequest(opts).Code).To(Equal(http.StatusBadGateway))
+		})
+
+		It("verifies the server name against the host without a configured server name", func() {
+			opts := mtlsOptions()
+			opts.ServerName = ""
+			rw := proxyRequest(opts)
+			Expect(rw.Code).To(Equal(http.StatusOK))
+			Expect(rw.Body.String()).To(Equal("oauth2-proxy"))
+		})
+
+		It("reloads the client certificate when the files change", func() {
+			u, err := url.Parse(server.URL)
+			Expect(err).ToNot(HaveOccurred())
+			transport, err := buildUpstreamTransport(options.Upstream{TLS: mtlsOptions()}, "", newTLS(mtlsOptions()).config(u.Hostname()))
+			Expect(err).ToNot(HaveOccurred())
+
+			getCommonName := func() string {
+				// New connections are needed to present the new certificate
+				transport.CloseIdleConnections()
+				resp, err := transport.RoundTrip(httptest.NewRequest("", server.URL, nil))
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+				body, err := ioutil.ReadAll(resp.Body)
+				Expect(err).ToNot(HaveOccurred())
+				return string(body)
+			}
+			Expect(getCommonName()).To(Equal("oauth2-proxy"))
+
+			rotated := newTestCertificate(&x509.Certificate{
+				Subject:     pkix.Name{CommonName: "oauth2-proxy-rotated"},
+				KeyUsage:    x509.KeyUsageDigitalSignature,
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			}, ca)
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "client-key.pem"), rotated.keyPEM, 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "client.pem"), rotated.certPEM, 0600)).To(Succeed())
+
+			Eventually(getCommonName, 5*time.Second, 50*time.Millisecond).Should(Equal("oauth2-proxy-rotated"))
+		})
+
+		It("keeps the current certificate when the files are invalid", func() {
+			tlsOpts := newTLS(mtlsOptions())
+			current := tlsOpts.clientCert
+
+			path := filepath.Join(tmpDir, "client.pem")
+			Expect(ioutil.WriteFile(path, bytes.Repeat([]byte("x"), 10), 0600)).To(Succeed())
+			tlsOpts.reload(path)
+
+			cert, err := tlsOpts.getClientCertificate(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cert).To(BeIdenticalTo(current))
+		})
+
+		It("uses the client certificate for health checks", func() {
+			u, err := url.Parse(server.URL)
+			Expect(err).ToNot(HaveOccurred())
+			upstream := options.Upstream{
+				ID:          "mtls",
+				TLS:         mtlsOptions(),
+				HealthCheck: &options.HealthCheck{Path: "/"},
+			}
+			handler, err := newHTTPUpstreamProxy(upstream, u, nil, nil, newTLS(upstream.TLS))
+			Expect(err).ToNot(HaveOccurred())
+
+			b := &backend{uri: server.URL, transport: handler.transport}
+			Expect(newHealthChecker(upstream, nil).check(context.Background(), b)).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,251 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"golang.org/x/net/http2"
+)
+
+// These match the settings of the http.DefaultTransport
+const (
+	defaultDialTimeout           = 30 * time.Second
+	defaultKeepAlive             = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultIdleConnTimeout       = 90 * time.Second
+	defaultMaxIdleConns          = 100
+	defaultExpectContinueTimeout = 1 * time.Second
+)
+
+// newUpstreamTransport creates the transport for requests to the upstream.
+// It returns nil when the upstream does not configure the transport, so that
+// the ReverseProxy uses the http.DefaultTransport.
+// If the socketPath is set, all connections are made to the unix socket.
+func newUpstreamTransport(upstream options.Upstream, socketPath string, tlsConfig *tls.Config) (http.RoundTripper, error) {
+	http2Upstream := upstream.Protocol == options.H2CUpstreamProtocol || upstream.Protocol == options.H2UpstreamProtocol
+	if upstream.Transport == nil && tlsConfig == nil && socketPath == "" && !http2Upstream {
+		return nil, nil
+	}
+	if upstream.Transport == nil && upstream.TLS == nil && socketPath == "" && !http2Upstream {
+		// Only InsecureSkipTLSVerify is set
+		return &http.Transport{TLSClientConfig: tlsConfig}, nil
+	}
+
+	if http2Upstream {
+		return buildHTTP2Transport(upstream, socketPath, tlsConfig)
+	}
+	return buildUpstreamTransport(upstream, socketPath, tlsConfig)
+}
+
+// buildUpstreamTransport creates a transport with the transport options of
+// the upstream and the TLS config.
+func buildUpstreamTransport(upstream options.Upstream, socketPath string, tlsConfig *tls.Config) (*http.Transport, error) {
+	opts := upstream.Transport
+	if opts == nil {
+		opts = &options.UpstreamTransport{}
+	}
+
+	// The http.DefaultTransport is not cloned, as once it has been used its
+	// TLS config is set up for HTTP/2
+	dialer := &net.Dialer{
+		Timeout:   durationOrDefault(opts.DialTimeout, defaultDialTimeout),
+		KeepAlive: durationOrDefault(opts.KeepAlive, defaultKeepAlive),
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   durationOrDefault(opts.TLSHandshakeTimeout, defaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: durationOrDefault(opts.ResponseHeaderTimeout, 0),
+		IdleConnTimeout:       durationOrDefault(opts.IdleConnTimeout, defaultIdleConnTimeout),
+		MaxIdleConns:          intOrDefault(opts.MaxIdleConns, defaultMaxIdleConns),
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		ExpectContinueTimeout: defaultExpectContinueTimeout,
+		TLSClientConfig:       tlsConfig,
+	}
+
+	if socketPath != "" {
+		// Requests to the socket must not be sent to a proxy
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+
+	if opts.HTTP2 != nil && !*opts.HTTP2 {
+		// A non-nil, empty TLSNextProto disables HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return transport, nil
+}
+
+// buildHTTP2Transport creates an HTTP/2 only transport for the upstream.
+// With the h2c protocol, connections are made without TLS.
+// Connections are dialed by http2ConnPool, so that dials are cancelled with
+// the request that triggered them.
+func buildHTTP2Transport(upstream options.Upstream, socketPath string, tlsConfig *tls.Config) (*http2.Transport, error) {
+	opts := upstream.Transport
+	if opts == nil {
+		opts = &options.UpstreamTransport{}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   durationOrDefault(opts.DialTimeout, defaultDialTimeout),
+		KeepAlive: durationOrDefault(opts.KeepAlive, defaultKeepAlive),
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if socketPath != "" {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	transport := &http2.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	pool := &http2ConnPool{
+		transport: transport,
+		dial:      dial,
+		conns:     make(map[string][]*http2.ClientConn),
+	}
+	transport.ConnPool = pool
+
+	if upstream.Protocol == options.H2CUpstreamProtocol {
+		// Connect without TLS
+		transport.AllowHTTP = true
+		return transport, nil
+	}
+
+	handshakeTimeout := durationOrDefault(opts.TLSHandshakeTimeout, defaultTLSHandshakeTimeout)
+	pool.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn, err := tlsHandshake(ctx, conn, http2TLSConfig(tlsConfig, addr), handshakeTimeout)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return transport, nil
+}
+
+// http2TLSConfig creates the TLS config for an HTTP/2 connection to the
+// address, in the same way as the http2.Transport.
+func http2TLSConfig(tlsConfig *tls.Config, addr string) *tls.Config {
+	cfg := &tls.Config{}
+	if tlsConfig != nil {
+		cfg = tlsConfig.Clone()
+	}
+	cfg.NextProtos = []string{http2.NextProtoTLS}
+	if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			cfg.ServerName = host
+		}
+	}
+	return cfg
+}
+
+// tlsHandshake makes the TLS handshake on the connection, giving up when the
+// context is cancelled or the handshake timeout has passed, and checks that
+// HTTP/2 was negotiated.
+func tlsHandshake(ctx context.Context, conn net.Conn, cfg *tls.Config, timeout time.Duration) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tlsConn := tls.Client(conn, cfg)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- tlsConn.Handshake()
+	}()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		// Closing the connection stops the handshake
+		conn.Close()
+		<-errs
+		return nil, ctx.Err()
+	}
+
+	if protocol := tlsConn.ConnectionState().NegotiatedProtocol; protocol != http2.NextProtoTLS {
+		return nil, fmt.Errorf("unexpected ALPN protocol %q, want %q", protocol, http2.NextProtoTLS)
+	}
+	return tlsConn, nil
+}
+
+// http2ConnPool is the connection pool of HTTP/2 transports.
+// Unlike the default pool of the http2.Transport, connections are dialed with
+// the context of the request that needs them, so that a cancelled request
+// does not wait for the dial to time out.
+type http2ConnPool struct {
+	transport *http2.Transport
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu    sync.Mutex
+	conns map[string][]*http2.ClientConn
+}
+
+// GetClientConn returns a connection to the address that can take the
+// request, dialing a new connection if there is none.
+func (p *http2ConnPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	p.mu.Lock()
+	for _, cc := range p.conns[addr] {
+		if cc.CanTakeNewRequest() {
+			p.mu.Unlock()
+			return cc, nil
+		}
+	}
+	p.mu.Unlock()
+
+	conn, err := p.dial(req.Context(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := p.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[addr] = append(p.conns[addr], cc)
+	return cc, nil
+}
+
+// MarkDead removes the connection from the pool.
+// It is called by the transport when the connection is closed.
+func (p *http2ConnPool) MarkDead(dead *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, conns := range p.conns {
+		for i, cc := range conns {
+			if cc != dead {
+				continue
+			}
+			conns = append(conns[:i], conns[i+1:]...)
+			if len(conns) == 0 {
+				delete(p.conns, addr)
+			} else {
+				p.conns[addr] = conns
+			}
+			return
+		}
+	}
+}
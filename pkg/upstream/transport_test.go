@@ -0,0 +1,139 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	middlewareapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transport Suite", func() {
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+
+	It("uses the default transport when not configured", func() {
+		transport, err := newUpstreamTransport(options.Upstream{}, "", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(transport).To(BeNil())
+	})
+
+	It("skips TLS verification without transport options", func() {
+		upstream := options.Upstream{InsecureSkipTLSVerify: true}
+		tlsOpts, err := newUpstreamTLS(upstream, nil)
+		Expect(err).ToNot(HaveOccurred())
+		transport, err := newUpstreamTransport(upstream, "", tlsOpts.config("upstream.local"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(transport).To(BeAssignableToTypeOf(&http.Transport{}))
+		Expect(transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify).To(BeTrue())
+	})
+
+	It("keeps the default settings for unset options", func() {
+		transport, err := buildUpstreamTransport(options.Upstream{Transport: &options.UpstreamTransport{}}, "", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(transport).ToNot(BeIdenticalTo(defaultTransport))
+		Expect(transport.Proxy).ToNot(BeNil())
+		Expect(transport.DialContext).ToNot(BeNil())
+		Expect(transport.TLSHandshakeTimeout).To(Equal(defaultTransport.TLSHandshakeTimeout))
+		Expect(transport.ResponseHeaderTimeout).To(Equal(defaultTransport.ResponseHeaderTimeout))
+		Expect(transport.IdleConnTimeout).To(Equal(defaultTransport.IdleConnTimeout))
+		Expect(transport.MaxIdleConns).To(Equal(defaultTransport.MaxIdleConns))
+		Expect(transport.MaxIdleConnsPerHost).To(Equal(defaultTransport.MaxIdleConnsPerHost))
+		Expect(transport.MaxConnsPerHost).To(Equal(defaultTransport.MaxConnsPerHost))
+		Expect(transport.ExpectContinueTimeout).To(Equal(defaultTransport.ExpectContinueTimeout))
+		Expect(transport.ForceAttemptHTTP2).To(BeTrue())
+		Expect(transport.TLSClientConfig).To(BeNil())
+	})
+
+	It("applies the configured options", func() {
+		http2 := false
+		transport, err := buildUpstreamTransport(options.Upstream{
+			Transport: &options.UpstreamTransport{
+				DialTimeout:           durationPtr(time.Second),
+				KeepAlive:             durationPtr(time.Minute),
+				TLSHandshakeTimeout:   durationPtr(2 * time.Second),
+				ResponseHeaderTimeout: durationPtr(3 * time.Minute),
+				IdleConnTimeout:       durationPtr(4 * time.Second),
+				MaxIdleConns:          10,
+				MaxIdleConnsPerHost:   5,
+				MaxConnsPerHost:       20,
+				HTTP2:                 &http2,
+			},
+		}, "", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(transport.TLSHandshakeTimeout).To(Equal(2 * time.Second))
+		Expect(transport.ResponseHeaderTimeout).To(Equal(3 * time.Minute))
+		Expect(transport.IdleConnTimeout).To(Equal(4 * time.Second))
+		Expect(transport.MaxIdleConns).To(Equal(10))
+		Expect(transport.MaxIdleConnsPerHost).To(Equal(5))
+		Expect(transport.MaxConnsPerHost).To(Equal(20))
+		Expect(transport.ForceAttemptHTTP2).To(BeFalse())
+		Expect(transport.TLSNextProto).To(Equal(map[string]func(string, *tls.Conn) http.RoundTripper{}))
+		Expect(transport.TLSClientConfig.InsecureSkipVerify).To(BeTrue())
+	})
+
+	It("times out waiting for response headers", func() {
+		done := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			<-done
+		}))
+		defer server.Close()
+		// Release the handler before the server is closed
+		defer close(done)
+
+		u, err := url.Parse(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		handler, err := newHTTPUpstreamProxy(options.Upstream{
+			ID: "slow",
+			Transport: &options.UpstreamTransport{
+				ResponseHeaderTimeout: durationPtr(10 * time.Millisecond),
+			},
+		}, u, nil, func(rw http.ResponseWriter, _ *http.Request, _ error) {
+			rw.WriteHeader(http.StatusBadGateway)
+		}, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		req := middlewareapi.AddRequestScope(httptest.NewRequest("", "/", nil), &middlewareapi.RequestScope{})
+		req.RequestURI = "/"
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		Expect(rw.Code).To(Equal(http.StatusBadGateway))
+	})
+
+	It("cancels HTTP/2 dials with the request", func() {
+		// The listener accepts connections but never completes the handshake
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		transport, err := newUpstreamTransport(options.Upstream{Protocol: options.H2UpstreamProtocol}, "", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "GET", "https://"+listener.Addr().String()+"/", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		start := time.Now()
+		_, err = transport.RoundTrip(req)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", defaultTLSHandshakeTimeout))
+	})
+})
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
@@ -23,3 +24,40 @@ func GetCertPool(paths []string) (*x509.CertPool, error) {
 	}
 	return pool, nil
 }
+
+// tlsVersions maps the configurable TLS version names to their values
+var tlsVersions = map[string]uint16{
+	"TLS1.0": tls.VersionTLS10,
+	"TLS1.1": tls.VersionTLS11,
+	"TLS1.2": tls.VersionTLS12,
+	"TLS1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion returns the TLS version with the given name, eg. "TLS1.2".
+func ParseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q: must be one of TLS1.0, TLS1.1, TLS1.2 or TLS1.3", version)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites returns the IDs of the cipher suites with the given names,
+// eg. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+// Only cipher suites without known security issues can be used.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
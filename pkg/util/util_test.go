@@ -1,6 +1,7 @@
 package util
 
 import (
+	"crypto/tls"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"io/ioutil"
@@ -95,3 +96,21 @@ func TestGetCertPool(t *testing.T) {
 	expectedSubjects := []string{testCA1Subj, testCA2Subj}
 	assert.Equal(t, expectedSubjects, got)
 }
+
+func TestParseTLSVersion(t *testing.T) {
+	version, err := ParseTLSVersion("TLS1.3")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), version)
+
+	_, err = ParseTLSVersion("SSL3.0")
+	assert.EqualError(t, err, "unknown TLS version \"SSL3.0\": must be one of TLS1.0, TLS1.1, TLS1.2 or TLS1.3")
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}, suites)
+
+	_, err = ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	assert.EqualError(t, err, "unknown cipher suite \"TLS_RSA_WITH_RC4_128_SHA\"")
+}
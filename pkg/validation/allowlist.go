@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/authentication/stepup"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
 )
 
@@ -14,8 +15,10 @@ func validateAllowlists(o *options.Options) []string {
 	msgs := []string{}
 
 	msgs = append(msgs, validateRoutes(o)...)
+	msgs = append(msgs, validateStepUpRoutes(o)...)
 	msgs = append(msgs, validateRegexes(o)...)
 	msgs = append(msgs, validateTrustedIPs(o)...)
+	msgs = append(msgs, validateTrustedProxyIPs(o)...)
 
 	if len(o.TrustedIPs) > 0 && o.ReverseProxy {
 		_, err := fmt.Fprintln(os.Stderr, "WARNING: mixing --trusted-ip with --reverse-proxy is a potential security vulnerability. An attacker can inject a trusted IP into an X-Real-IP or X-Forwarded-For header if they aren't properly protected outside of oauth2-proxy")
@@ -46,6 +49,18 @@ func validateRoutes(o *options.Options) []string {
 	return msgs
 }
 
+// validateStepUpRoutes validates requirements:method=path routes passed with
+// options.StepUpRoutes
+func validateStepUpRoutes(o *options.Options) []string {
+	msgs := []string{}
+	for _, route := range o.StepUpRoutes {
+		if _, err := stepup.ParseRoute(route); err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	return msgs
+}
+
 // validateRegex validates regex paths passed with options.SkipAuthRegex
 func validateRegexes(o *options.Options) []string {
 	msgs := []string{}
@@ -68,3 +83,34 @@ func validateTrustedIPs(o *options.Options) []string {
 	}
 	return msgs
 }
+
+// validateTrustedProxyIPs validates IP/CIDRs of the trusted proxies
+func validateTrustedProxyIPs(o *options.Options) []string {
+	msgs := []string{}
+	for i, ipStr := range o.TrustedProxyIPs {
+		if nil == ip.ParseIPNet(ipStr) {
+			msgs = append(msgs, fmt.Sprintf("trusted_proxy_ips[%d] (%s) could not be recognized", i, ipStr))
+		}
+	}
+	if len(o.TrustedProxyIPs) > 0 && !o.ReverseProxy {
+		msgs = append(msgs, "trusted_proxy_ips requires reverse_proxy to be enabled")
+	}
+	return msgs
+}
+
+// parseTrustedProxyIPs parses the IP/CIDRs of the trusted proxies into a
+// NetSet, or nil if there are no trusted proxies.
+// Invalid IP/CIDRs are reported by validateTrustedProxyIPs.
+func parseTrustedProxyIPs(trustedProxyIPs []string) *ip.NetSet {
+	if len(trustedProxyIPs) == 0 {
+		return nil
+	}
+
+	trustedProxies := ip.NewNetSet()
+	for _, ipStr := range trustedProxyIPs {
+		if ipNet := ip.ParseIPNet(ipStr); ipNet != nil {
+			trustedProxies.AddIPNet(*ipNet)
+		}
+	}
+	return trustedProxies
+}
@@ -24,6 +24,12 @@ var _ = Describe("Allowlist", func() {
 		errStrings []string
 	}
 
+	type validateTrustedProxyIPsTableInput struct {
+		trustedProxyIPs []string
+		reverseProxy    bool
+		errStrings      []string
+	}
+
 	DescribeTable("validateRoutes",
 		func(r *validateRoutesTableInput) {
 			opts := &options.Options{
@@ -56,6 +62,32 @@ var _ = Describe("Allowlist", func() {
 		}),
 	)
 
+	DescribeTable("validateStepUpRoutes",
+		func(r *validateRoutesTableInput) {
+			opts := &options.Options{
+				StepUpRoutes: r.routes,
+			}
+			Expect(validateStepUpRoutes(opts)).To(ConsistOf(r.errStrings))
+		},
+		Entry("Valid step-up routes", &validateRoutesTableInput{
+			routes: []string{
+				"max_age=10m:^/admin/",
+				"acr=mfa,amr=otp:POST=^/admin/",
+			},
+			errStrings: []string{},
+		}),
+		Entry("Invalid step-up routes", &validateRoutesTableInput{
+			routes: []string{
+				"^/admin/",
+				"acr=mfa:GET=/(admin",
+			},
+			errStrings: []string{
+				"step-up route \"^/admin/\" must be of the form requirements:[method=]path_regex",
+				"error compiling regex //(admin/: error parsing regexp: missing closing ): `/(admin`",
+			},
+		}),
+	)
+
 	DescribeTable("validateRegexes",
 		func(r *validateRegexesTableInput) {
 			opts := &options.Options{
@@ -122,4 +154,37 @@ var _ = Describe("Allowlist", func() {
 			},
 		}),
 	)
+
+	DescribeTable("validateTrustedProxyIPs",
+		func(t *validateTrustedProxyIPsTableInput) {
+			opts := &options.Options{
+				TrustedProxyIPs: t.trustedProxyIPs,
+				ReverseProxy:    t.reverseProxy,
+			}
+			Expect(validateTrustedProxyIPs(opts)).To(ConsistOf(t.errStrings))
+		},
+		Entry("No trusted proxies", &validateTrustedProxyIPsTableInput{
+			trustedProxyIPs: []string{},
+			errStrings:      []string{},
+		}),
+		Entry("Valid IPs", &validateTrustedProxyIPsTableInput{
+			trustedProxyIPs: []string{"10.0.0.0/8", "::1"},
+			reverseProxy:    true,
+			errStrings:      []string{},
+		}),
+		Entry("Invalid IPs", &validateTrustedProxyIPsTableInput{
+			trustedProxyIPs: []string{"10.0.0.0/33", "proxy"},
+			reverseProxy:    true,
+			errStrings: []string{
+				"trusted_proxy_ips[0] (10.0.0.0/33) could not be recognized",
+				"trusted_proxy_ips[1] (proxy) could not be recognized",
+			},
+		}),
+		Entry("Without reverse proxy", &validateTrustedProxyIPsTableInput{
+			trustedProxyIPs: []string{"10.0.0.0/8"},
+			errStrings: []string{
+				"trusted_proxy_ips requires reverse_proxy to be enabled",
+			},
+		}),
+	)
 })
@@ -12,6 +12,12 @@ import (
 func validateCookie(o options.Cookie) []string {
 	msgs := validateCookieSecret(o.Secret)
 
+	for i, secret := range o.OldSecrets {
+		for _, msg := range validateCookieSecret(secret) {
+			msgs = append(msgs, fmt.Sprintf("cookie_old_secrets[%d]: %s", i, msg))
+		}
+	}
+
 	if o.Refresh >= o.Expire {
 		msgs = append(msgs, fmt.Sprintf(
 			"cookie_refresh (%q) must be less than cookie_expire (%q)",
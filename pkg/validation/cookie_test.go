@@ -91,6 +91,40 @@ func TestValidateCookie(t *testing.T) {
 				invalidSecretMsg,
 			},
 		},
+		{
+			name: "with valid old cookie secrets",
+			cookie: options.Cookie{
+				Name:       validName,
+				Secret:     validSecret,
+				OldSecrets: []string{validBase64Secret},
+				Domains:    emptyDomains,
+				Path:       "",
+				Expire:     time.Hour,
+				Refresh:    15 * time.Minute,
+				Secure:     true,
+				HTTPOnly:   false,
+				SameSite:   "",
+			},
+			errStrings: []string{},
+		},
+		{
+			name: "with an invalid old cookie secret",
+			cookie: options.Cookie{
+				Name:       validName,
+				Secret:     validSecret,
+				OldSecrets: []string{validBase64Secret, invalidSecret},
+				Domains:    emptyDomains,
+				Path:       "",
+				Expire:     time.Hour,
+				Refresh:    15 * time.Minute,
+				Secure:     true,
+				HTTPOnly:   false,
+				SameSite:   "",
+			},
+			errStrings: []string{
+				"cookie_old_secrets[1]: " + invalidSecretMsg,
+			},
+		},
 		{
 			name: "with a valid Base64 secret",
 			cookie: options.Cookie{
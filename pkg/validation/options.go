@@ -27,6 +27,9 @@ func Validate(o *options.Options) error {
 	msgs := validateCookie(o.Cookie)
 	msgs = append(msgs, validateSessionCookieMinimal(o)...)
 	msgs = append(msgs, validateRedisSessionStore(o)...)
+	msgs = append(msgs, validateSessionTimeouts(o.Session)...)
+	msgs = append(msgs, validateSessionBinding(o.Session.Binding)...)
+	msgs = append(msgs, validateClientCertificateSessions(o)...)
 	msgs = append(msgs, prefixValues("injectRequestHeaders: ", validateHeaders(o.InjectRequestHeaders)...)...)
 	msgs = append(msgs, prefixValues("injectResponseHeaders: ", validateHeaders(o.InjectResponseHeaders)...)...)
 	msgs = append(msgs, validateProviders(o)...)
@@ -169,11 +172,11 @@ func Validate(o *options.Options) error {
 		logger.Print("WARNING: no explicit redirect URL: redirects will default to insecure HTTP")
 	}
 
-	msgs = append(msgs, validateUpstreams(o.UpstreamServers)...)
+	msgs = append(msgs, validateUpstreams(o.UpstreamServers, o.Session.Redis)...)
 	msgs = parseProviderInfo(o, msgs)
 
 	if o.ReverseProxy {
-		parser, err := ip.GetRealClientIPParser(o.RealClientIPHeader)
+		parser, err := ip.GetRealClientIPParser(o.RealClientIPHeader, parseTrustedProxyIPs(o.TrustedProxyIPs))
 		if err != nil {
 			msgs = append(msgs, fmt.Sprintf("real_client_ip_header (%s) not accepted parameter value: %v", o.RealClientIPHeader, err))
 		}
@@ -3,6 +3,7 @@ package validation
 import (
 	"crypto"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
@@ -265,17 +266,24 @@ func TestRealClientIPHeader(t *testing.T) {
 	assert.Equal(t, nil, Validate(o))
 	assert.NotNil(t, o.GetRealClientIPParser())
 
-	// Ensure unknown header format process an error.
+	// Ensure the Forwarded header works.
 	o = testOptions()
 	o.ReverseProxy = true
 	o.RealClientIPHeader = "Forwarded"
-	err := Validate(o)
-	assert.NotEqual(t, nil, err)
-	expected := errorMsg([]string{
-		"real_client_ip_header (Forwarded) not accepted parameter value: the http header key (Forwarded) is either invalid or unsupported",
-	})
-	assert.Equal(t, expected, err.Error())
-	assert.Nil(t, o.GetRealClientIPParser())
+	assert.Equal(t, nil, Validate(o))
+	assert.NotNil(t, o.GetRealClientIPParser())
+
+	// Ensure trusted proxies are skipped.
+	o = testOptions()
+	o.ReverseProxy = true
+	o.RealClientIPHeader = "X-Forwarded-For"
+	o.TrustedProxyIPs = []string{"10.0.0.0/8"}
+	assert.Equal(t, nil, Validate(o))
+	h := http.Header{}
+	h.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.0.0.1")
+	clientIP, err := o.GetRealClientIPParser().GetRealClientIP(h)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", clientIP.String())
 
 	// Ensure invalid header format produces an error.
 	o = testOptions()
@@ -283,7 +291,7 @@ func TestRealClientIPHeader(t *testing.T) {
 	o.RealClientIPHeader = "!934invalidheader-23:"
 	err = Validate(o)
 	assert.NotEqual(t, nil, err)
-	expected = errorMsg([]string{
+	expected := errorMsg([]string{
 		"real_client_ip_header (!934invalidheader-23:) not accepted parameter value: the http header key (!934invalidheader-23:) is either invalid or unsupported",
 	})
 	assert.Equal(t, expected, err.Error())
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
@@ -39,6 +40,78 @@ func validateSessionCookieMinimal(o *options.Options) []string {
 	return msgs
 }
 
+func validateSessionTimeouts(o options.SessionOptions) []string {
+	msgs := []string{}
+
+	if o.IdleTimeout < 0 {
+		msgs = append(msgs, "session_idle_timeout must not be negative")
+	}
+	if o.MaxLifetime < 0 {
+		msgs = append(msgs, "session_max_lifetime must not be negative")
+	}
+	if o.IdleTimeout > 0 && (o.ActivityUpdateInterval <= 0 || o.ActivityUpdateInterval >= o.IdleTimeout) {
+		msgs = append(msgs, fmt.Sprintf(
+			"session_activity_update_interval (%s) must be greater than 0 and less than session_idle_timeout (%s)",
+			o.ActivityUpdateInterval, o.IdleTimeout))
+	}
+	return msgs
+}
+
+func validateSessionBinding(o options.SessionBindingOptions) []string {
+	msgs := []string{}
+
+	modes := map[string]string{
+		"session_binding_client_ip":          o.ClientIP,
+		"session_binding_user_agent":         o.UserAgent,
+		"session_binding_client_certificate": o.ClientCertificate,
+	}
+	for _, name := range []string{"session_binding_client_ip", "session_binding_user_agent", "session_binding_client_certificate"} {
+		switch modes[name] {
+		case "", options.SessionBindingLogMode, options.SessionBindingEnforceMode:
+		default:
+			msgs = append(msgs, fmt.Sprintf("%s (%q) must be one of ['', 'log', 'enforce']", name, modes[name]))
+		}
+	}
+
+	if o.ClientIP != "" {
+		if o.ClientIPv4Prefix < 0 || o.ClientIPv4Prefix > 32 {
+			msgs = append(msgs, fmt.Sprintf("session_binding_client_ipv4_prefix (%d) must be between 0 and 32", o.ClientIPv4Prefix))
+		}
+		if o.ClientIPv6Prefix < 0 || o.ClientIPv6Prefix > 128 {
+			msgs = append(msgs, fmt.Sprintf("session_binding_client_ipv6_prefix (%d) must be between 0 and 128", o.ClientIPv6Prefix))
+		}
+	}
+	return msgs
+}
+
+// validateClientCertificateSessions checks that client certificate sessions
+// have a client CA to verify certificates against, and that the user field
+// and group mappings are valid.
+func validateClientCertificateSessions(o *options.Options) []string {
+	if !o.ClientCertificateSessions {
+		return []string{}
+	}
+
+	msgs := []string{}
+	if o.Server.TLS == nil || o.Server.TLS.ClientCA == nil {
+		msgs = append(msgs, "client_certificate_sessions requires a client CA to verify certificates, set tls_client_ca_file")
+	}
+
+	switch o.ClientCertificateUserField {
+	case options.ClientCertificateEmailField, options.ClientCertificateURIField, options.ClientCertificateDNSField, options.ClientCertificateCommonNameField:
+	default:
+		msgs = append(msgs, fmt.Sprintf("client_certificate_user_field (%q) must be one of ['email', 'uri', 'dns', 'cn']", o.ClientCertificateUserField))
+	}
+
+	for i, mapping := range o.ClientCertificateGroups {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			msgs = append(msgs, fmt.Sprintf("client_certificate_groups[%d] (%s) must be in the format ou=group", i, mapping))
+		}
+	}
+	return msgs
+}
+
 // validateRedisSessionStore builds a Redis Client from the options and
 // attempts to connect, Set, Get and Del a random health check key
 func validateRedisSessionStore(o *options.Options) []string {
@@ -46,6 +119,12 @@ func validateRedisSessionStore(o *options.Options) []string {
 		return []string{}
 	}
 
+	if o.Session.Redis.EncryptionKeyRingFile != "" {
+		if _, err := encryption.NewLocalKeyRing(o.Session.Redis.EncryptionKeyRingFile); err != nil {
+			return []string{fmt.Sprintf("unable to load the redis encryption key ring: %v", err)}
+		}
+	}
+
 	client, err := redis.NewRedisClient(o.Session.Redis)
 	if err != nil {
 		return []string{fmt.Sprintf("unable to initialize a redis client: %v", err)}
@@ -405,4 +405,77 @@ var _ = Describe("Sessions", func() {
 			errStrings: []string{clusterAndSentinelMsg},
 		}),
 	)
+
+	DescribeTable("validateSessionBinding",
+		func(o options.SessionBindingOptions, errStrings []string) {
+			Expect(validateSessionBinding(o)).To(ConsistOf(errStrings))
+		},
+		Entry("binding disabled", options.SessionBindingOptions{}, []string{}),
+		Entry("valid modes and prefixes", options.SessionBindingOptions{
+			ClientIP:          options.SessionBindingEnforceMode,
+			ClientIPv4Prefix:  24,
+			ClientIPv6Prefix:  64,
+			UserAgent:         options.SessionBindingLogMode,
+			ClientCertificate: options.SessionBindingEnforceMode,
+		}, []string{}),
+		Entry("invalid mode", options.SessionBindingOptions{
+			UserAgent: "strict",
+		}, []string{"session_binding_user_agent (\"strict\") must be one of ['', 'log', 'enforce']"}),
+		Entry("invalid prefixes", options.SessionBindingOptions{
+			ClientIP:         options.SessionBindingLogMode,
+			ClientIPv4Prefix: 33,
+			ClientIPv6Prefix: -1,
+		}, []string{
+			"session_binding_client_ipv4_prefix (33) must be between 0 and 32",
+			"session_binding_client_ipv6_prefix (-1) must be between 0 and 128",
+		}),
+	)
+
+	DescribeTable("validateClientCertificateSessions",
+		func(o *options.Options, errStrings []string) {
+			Expect(validateClientCertificateSessions(o)).To(ConsistOf(errStrings))
+		},
+		Entry("client certificate sessions disabled", &options.Options{}, []string{}),
+		Entry("valid options", &options.Options{
+			ClientCertificateSessions:  true,
+			ClientCertificateUserField: options.ClientCertificateURIField,
+			ClientCertificateGroups:    []string{"platform=admins", "platform=users"},
+			Server: options.Server{
+				TLS: &options.TLS{ClientCA: &options.SecretSource{FromFile: "ca.crt"}},
+			},
+		}, []string{}),
+		Entry("invalid options", &options.Options{
+			ClientCertificateSessions:  true,
+			ClientCertificateUserField: "serial",
+			ClientCertificateGroups:    []string{"admins", "=admins"},
+		}, []string{
+			"client_certificate_sessions requires a client CA to verify certificates, set tls_client_ca_file",
+			"client_certificate_user_field (\"serial\") must be one of ['email', 'uri', 'dns', 'cn']",
+			"client_certificate_groups[0] (admins) must be in the format ou=group",
+			"client_certificate_groups[1] (=admins) must be in the format ou=group",
+		}),
+	)
+
+	DescribeTable("validateSessionTimeouts",
+		func(o options.SessionOptions, errStrings []string) {
+			Expect(validateSessionTimeouts(o)).To(ConsistOf(errStrings))
+		},
+		Entry("timeouts disabled", options.SessionOptions{}, []string{}),
+		Entry("valid timeouts", options.SessionOptions{
+			IdleTimeout:            30 * time.Minute,
+			MaxLifetime:            8 * time.Hour,
+			ActivityUpdateInterval: time.Minute,
+		}, []string{}),
+		Entry("negative timeouts", options.SessionOptions{
+			IdleTimeout: -time.Minute,
+			MaxLifetime: -time.Minute,
+		}, []string{
+			"session_idle_timeout must not be negative",
+			"session_max_lifetime must not be negative",
+		}),
+		Entry("activity interval longer than the idle timeout", options.SessionOptions{
+			IdleTimeout:            time.Minute,
+			ActivityUpdateInterval: 5 * time.Minute,
+		}, []string{"session_activity_update_interval (5m0s) must be greater than 0 and less than session_idle_timeout (1m0s)"}),
+	)
 })
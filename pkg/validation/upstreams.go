@@ -3,17 +3,24 @@ package validation
 import (
 	"fmt"
 	"net/url"
+	"regexp"
+	"strings"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/ip"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/util"
 )
 
-func validateUpstreams(upstreams options.Upstreams) []string {
+// hostRegex matches a hostname made of dot separated labels
+var hostRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+func validateUpstreams(upstreams options.Upstreams, redisOpts options.RedisStoreOptions) []string {
 	msgs := []string{}
 	ids := make(map[string]struct{})
 	paths := make(map[string]struct{})
 
 	for _, upstream := range upstreams {
-		msgs = append(msgs, validateUpstream(upstream, ids, paths)...)
+		msgs = append(msgs, validateUpstream(upstream, ids, paths, redisOpts)...)
 	}
 
 	return msgs
@@ -21,7 +28,7 @@ func validateUpstreams(upstreams options.Upstreams) []string {
 
 // validateUpstream validates that the upstream has valid options and that
 // the ids and paths are unique across all options
-func validateUpstream(upstream options.Upstream, ids, paths map[string]struct{}) []string {
+func validateUpstream(upstream options.Upstream, ids, paths map[string]struct{}, redisOpts options.RedisStoreOptions) []string {
 	msgs := []string{}
 
 	if upstream.ID == "" {
@@ -37,13 +44,34 @@ func validateUpstream(upstream options.Upstream, ids, paths map[string]struct{})
 	}
 	ids[upstream.ID] = struct{}{}
 
-	// Ensure upstream Paths are unique
-	if _, ok := paths[upstream.Path]; ok {
-		msgs = append(msgs, fmt.Sprintf("multiple upstreams found with path %q: upstream paths must be unique", upstream.Path))
+	// Ensure upstream Paths are unique for each Host
+	route := strings.ToLower(upstream.Host) + upstream.Path
+	if _, ok := paths[route]; ok {
+		if upstream.Host == "" {
+			msgs = append(msgs, fmt.Sprintf("multiple upstreams found with path %q: upstream paths must be unique", upstream.Path))
+		} else {
+			msgs = append(msgs, fmt.Sprintf("multiple upstreams found with host %q and path %q: upstream host and path pairs must be unique", upstream.Host, upstream.Path))
+		}
 	}
-	paths[upstream.Path] = struct{}{}
+	paths[route] = struct{}{}
+
+	msgs = append(msgs, validateUpstreamHost(upstream)...)
 
 	msgs = append(msgs, validateUpstreamURI(upstream)...)
+	msgs = append(msgs, validateUpstreamBackends(upstream)...)
+	msgs = append(msgs, validateUpstreamHealthCheck(upstream)...)
+	msgs = append(msgs, validateUpstreamRetry(upstream)...)
+	msgs = append(msgs, validateUpstreamCircuitBreaker(upstream)...)
+	msgs = append(msgs, validateUpstreamTransport(upstream)...)
+	msgs = append(msgs, validateUpstreamTLS(upstream)...)
+	msgs = append(msgs, validateUpstreamProtocol(upstream)...)
+	msgs = append(msgs, validateUpstreamHeaderRules(upstream.ID, "requestHeaders", upstream.RequestHeaders)...)
+	msgs = append(msgs, validateUpstreamHeaderRules(upstream.ID, "responseHeaders", upstream.ResponseHeaders)...)
+	msgs = append(msgs, validateUpstreamResponseRewrite(upstream)...)
+	msgs = append(msgs, validateUpstreamCache(upstream)...)
+	msgs = append(msgs, validateUpstreamRateLimit(upstream, redisOpts)...)
+	msgs = append(msgs, validateUpstreamRequestLimits(upstream)...)
+	msgs = append(msgs, validateUpstreamIPAccess(upstream)...)
 	msgs = append(msgs, validateStaticUpstream(upstream)...)
 	return msgs
 }
@@ -78,6 +106,30 @@ func validateStaticUpstream(upstream options.Upstream) []string {
 	if upstream.ProxyWebSockets != nil {
 		msgs = append(msgs, fmt.Sprintf("upstream %q has proxyWebSockets, but is a static upstream, this will have no effect.", upstream.ID))
 	}
+	if len(upstream.Backends) > 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has backends, but is a static upstream, this will have no effect.", upstream.ID))
+	}
+	if upstream.Retry != nil {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has retry, but is a static upstream, this will have no effect.", upstream.ID))
+	}
+	if upstream.CircuitBreaker != nil {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has circuitBreaker, but is a static upstream, this will have no effect.", upstream.ID))
+	}
+	if upstream.Transport != nil {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has transport, but is a static upstream, this will have no effect.", upstream.ID))
+	}
+	if upstream.TLS != nil {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has tls, but is a static upstream, this will have no effect.", upstream.ID))
+	}
+	if upstream.Protocol != "" {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has protocol, but is a static upstream, this will have no effect.", upstream.ID))
+	}
+	if upstream.ResponseRewrite != nil {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has responseRewrite, but is a static upstream, this will have no effect.", upstream.ID))
+	}
+	if upstream.Cache != nil {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has cache, but is a static upstream, this will have no effect.", upstream.ID))
+	}
 
 	return msgs
 }
@@ -85,6 +137,13 @@ func validateStaticUpstream(upstream options.Upstream) []string {
 func validateUpstreamURI(upstream options.Upstream) []string {
 	msgs := []string{}
 
+	if len(upstream.Backends) > 0 {
+		if upstream.URI != "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has both uri and backends: only one may be set", upstream.ID))
+		}
+		return msgs
+	}
+
 	if !upstream.Static && upstream.URI == "" {
 		msgs = append(msgs, fmt.Sprintf("upstream %q has empty uri: uris are required for all non-static upstreams", upstream.ID))
 		return msgs
@@ -104,9 +163,517 @@ func validateUpstreamURI(upstream options.Upstream) []string {
 	switch u.Scheme {
 	case "http", "https", "file":
 		// Valid, do nothing
+	case "unix":
+		if u.Path == "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid uri %q: unix uris must include the socket path, eg unix:///var/run/app.sock", upstream.ID, upstream.URI))
+		}
+		if upstream.TLS != nil || upstream.InsecureSkipTLSVerify {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has tls options, but is a unix socket upstream, this will have no effect.", upstream.ID))
+		}
 	default:
 		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid scheme: %q", upstream.ID, u.Scheme))
 	}
 
 	return msgs
 }
+
+// validateUpstreamBackends checks that the backends of a load balanced
+// upstream are HTTP(S) servers and that the load balancing options are valid.
+func validateUpstreamBackends(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	if len(upstream.Backends) == 0 {
+		if upstream.LoadBalancing != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has loadBalancing, but has no backends, this will have no effect.", upstream.ID))
+		}
+		if upstream.HealthCheck != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has healthCheck, but has no backends, this will have no effect.", upstream.ID))
+		}
+		if upstream.OutlierDetection != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has outlierDetection, but has no backends, this will have no effect.", upstream.ID))
+		}
+		return msgs
+	}
+
+	for i, b := range upstream.Backends {
+		u, err := url.Parse(b.URI)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid uri for backends[%d]: %v", upstream.ID, i, err))
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid scheme for backends[%d]: %q", upstream.ID, i, u.Scheme))
+		}
+		if b.Weight < 0 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has negative weight (%d) for backends[%d]", upstream.ID, b.Weight, i))
+		}
+	}
+
+	if upstream.LoadBalancing == nil {
+		return msgs
+	}
+	switch upstream.LoadBalancing.Strategy {
+	case "", options.RoundRobinLoadBalancing, options.LeastConnectionsLoadBalancing:
+		if upstream.LoadBalancing.HashClaim != "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has hashClaim, but does not use the %s strategy, this will have no effect.", upstream.ID, options.ConsistentHashLoadBalancing))
+		}
+	case options.ConsistentHashLoadBalancing:
+		// Valid, do nothing
+	default:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid load balancing strategy: %q", upstream.ID, upstream.LoadBalancing.Strategy))
+	}
+
+	return msgs
+}
+
+// validateUpstreamHealthCheck checks that the active and passive health
+// checks of a load balanced upstream are valid.
+func validateUpstreamHealthCheck(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	if hc := upstream.HealthCheck; hc != nil {
+		if !strings.HasPrefix(hc.Path, "/") {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid healthCheck path %q: paths must start with '/'", upstream.ID, hc.Path))
+		}
+		if hc.Interval != nil && hc.Interval.Duration() < 0 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has negative healthCheck interval", upstream.ID))
+		}
+		if hc.Timeout != nil && hc.Timeout.Duration() < 0 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has negative healthCheck timeout", upstream.ID))
+		}
+		if hc.HealthyThreshold < 0 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has negative healthCheck healthyThreshold (%d)", upstream.ID, hc.HealthyThreshold))
+		}
+		if hc.UnhealthyThreshold < 0 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has negative healthCheck unhealthyThreshold (%d)", upstream.ID, hc.UnhealthyThreshold))
+		}
+		for _, code := range hc.ExpectedStatus {
+			if code < 100 || code > 599 {
+				msgs = append(msgs, fmt.Sprintf("upstream %q has invalid healthCheck expectedStatus: %d", upstream.ID, code))
+			}
+		}
+	}
+
+	if od := upstream.OutlierDetection; od != nil {
+		if od.ConsecutiveErrors < 1 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid outlierDetection consecutiveErrors (%d): must be at least 1", upstream.ID, od.ConsecutiveErrors))
+		}
+		if od.EjectionDuration != nil && od.EjectionDuration.Duration() < 0 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has negative outlierDetection ejectionDuration", upstream.ID))
+		}
+	}
+
+	return msgs
+}
+
+// validateUpstreamRetry checks that the retry policy of the upstream is valid.
+func validateUpstreamRetry(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	retry := upstream.Retry
+	if retry == nil {
+		return msgs
+	}
+
+	if retry.Attempts < 1 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid retry attempts (%d): must be at least 1", upstream.ID, retry.Attempts))
+	}
+	for _, code := range retry.StatusCodes {
+		if code < 100 || code > 599 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid retry statusCodes: %d", upstream.ID, code))
+		}
+	}
+	if retry.Backoff != nil && retry.Backoff.Duration() < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has negative retry backoff", upstream.ID))
+	}
+	if retry.MaxBackoff != nil && retry.MaxBackoff.Duration() < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has negative retry maxBackoff", upstream.ID))
+	}
+	if retry.MaxBodyBufferSize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has negative retry maxBodyBufferSize (%d)", upstream.ID, retry.MaxBodyBufferSize))
+	}
+
+	return msgs
+}
+
+// validateUpstreamCircuitBreaker checks that the circuit breaker of the
+// upstream is valid.
+func validateUpstreamCircuitBreaker(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	cb := upstream.CircuitBreaker
+	if cb == nil {
+		return msgs
+	}
+
+	if cb.ConsecutiveFailures < 1 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid circuitBreaker consecutiveFailures (%d): must be at least 1", upstream.ID, cb.ConsecutiveFailures))
+	}
+	if cb.OpenDuration != nil && cb.OpenDuration.Duration() < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has negative circuitBreaker openDuration", upstream.ID))
+	}
+	if cb.ErrorCode != nil && (*cb.ErrorCode < 400 || *cb.ErrorCode > 599) {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid circuitBreaker errorCode (%d): must be an error response code", upstream.ID, *cb.ErrorCode))
+	}
+
+	return msgs
+}
+
+// validateUpstreamTransport checks that none of the transport timeouts or
+// connection limits of the upstream are negative.
+func validateUpstreamTransport(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	transport := upstream.Transport
+	if transport == nil {
+		return msgs
+	}
+
+	durations := []struct {
+		name  string
+		value *options.Duration
+	}{
+		{"dialTimeout", transport.DialTimeout},
+		{"keepAlive", transport.KeepAlive},
+		{"tlsHandshakeTimeout", transport.TLSHandshakeTimeout},
+		{"responseHeaderTimeout", transport.ResponseHeaderTimeout},
+		{"idleConnTimeout", transport.IdleConnTimeout},
+	}
+	for _, d := range durations {
+		if d.value != nil && d.value.Duration() < 0 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has negative transport %s", upstream.ID, d.name))
+		}
+	}
+
+	limits := []struct {
+		name  string
+		value int
+	}{
+		{"maxIdleConns", transport.MaxIdleConns},
+		{"maxIdleConnsPerHost", transport.MaxIdleConnsPerHost},
+		{"maxConnsPerHost", transport.MaxConnsPerHost},
+	}
+	for _, l := range limits {
+		if l.value < 0 {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has negative transport %s (%d)", upstream.ID, l.name, l.value))
+		}
+	}
+
+	if upstream.Protocol == options.H2CUpstreamProtocol || upstream.Protocol == options.H2UpstreamProtocol {
+		msgs = append(msgs, validateHTTP2UpstreamTransport(upstream)...)
+	}
+
+	return msgs
+}
+
+// validateHTTP2UpstreamTransport checks that only the transport options that
+// apply to HTTP/2 upstreams are set.
+func validateHTTP2UpstreamTransport(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	transport := upstream.Transport
+	unsupported := []struct {
+		name string
+		set  bool
+	}{
+		{"responseHeaderTimeout", transport.ResponseHeaderTimeout != nil},
+		{"idleConnTimeout", transport.IdleConnTimeout != nil},
+		{"maxIdleConns", transport.MaxIdleConns != 0},
+		{"maxIdleConnsPerHost", transport.MaxIdleConnsPerHost != 0},
+		{"maxConnsPerHost", transport.MaxConnsPerHost != 0},
+		{"http2", transport.HTTP2 != nil},
+	}
+	for _, u := range unsupported {
+		if u.set {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has transport %s, which is not supported with protocol %q", upstream.ID, u.name, upstream.Protocol))
+		}
+	}
+	return msgs
+}
+
+// validateUpstreamTLS checks that the TLS certificates of the upstream can be
+// loaded and that the minimum TLS version is known.
+func validateUpstreamTLS(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	opts := upstream.TLS
+	if opts == nil {
+		return msgs
+	}
+
+	if (opts.ClientCert == nil) != (opts.ClientKey == nil) {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has tls clientCert or clientKey: both are required for a client certificate", upstream.ID))
+	}
+	sources := []struct {
+		name   string
+		source *options.SecretSource
+	}{
+		{"clientCert", opts.ClientCert},
+		{"clientKey", opts.ClientKey},
+		{"ca", opts.CA},
+	}
+	for _, s := range sources {
+		if s.source == nil {
+			continue
+		}
+		if msg := validateSecretSource(*s.source); msg != "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid tls %s: %s", upstream.ID, s.name, msg))
+		}
+	}
+
+	if opts.MinVersion != "" {
+		if _, err := util.ParseTLSVersion(opts.MinVersion); err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid tls minVersion: %v", upstream.ID, err))
+		}
+	}
+
+	return msgs
+}
+
+// validateUpstreamProtocol checks that the protocol is known and can be used
+// with the schemes of the upstream URIs.
+func validateUpstreamProtocol(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	var schemes map[string]bool
+	switch upstream.Protocol {
+	case "", options.HTTPUpstreamProtocol:
+		return msgs
+	case options.H2CUpstreamProtocol:
+		schemes = map[string]bool{"http": true, "unix": true}
+	case options.H2UpstreamProtocol:
+		schemes = map[string]bool{"https": true}
+	default:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid protocol %q: must be one of %q, %q or %q", upstream.ID, upstream.Protocol,
+			options.HTTPUpstreamProtocol, options.H2CUpstreamProtocol, options.H2UpstreamProtocol))
+		return msgs
+	}
+
+	// Static upstreams have no URIs to check
+	if upstream.Static {
+		return msgs
+	}
+
+	uris := []string{upstream.URI}
+	if len(upstream.Backends) > 0 {
+		uris = []string{}
+		for _, b := range upstream.Backends {
+			uris = append(uris, b.URI)
+		}
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			// Invalid URIs are reported by the URI validation
+			continue
+		}
+		if !schemes[u.Scheme] {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has protocol %q, which cannot be used with the %q scheme", upstream.ID, upstream.Protocol, u.Scheme))
+		}
+	}
+
+	return msgs
+}
+
+// validateUpstreamHost checks that the host is a hostname, optionally with a
+// leading wildcard label.
+func validateUpstreamHost(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	if upstream.Host == "" {
+		return msgs
+	}
+
+	host := strings.TrimPrefix(upstream.Host, "*.")
+	if !hostRegex.MatchString(host) {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid host %q: hosts must be a hostname, optionally starting with \"*.\" to match subdomains", upstream.ID, upstream.Host))
+	}
+
+	return msgs
+}
+
+// validateUpstreamHeaderRules checks that the header rules name the headers
+// they modify and that the set headers are valid.
+func validateUpstreamHeaderRules(id, field string, rules *options.HeaderRules) []string {
+	msgs := []string{}
+
+	if rules == nil {
+		return msgs
+	}
+
+	for _, name := range rules.Remove {
+		if name == "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has %s remove with empty name: names are required for all removed headers", id, field))
+		}
+	}
+
+	for _, rename := range rules.Rename {
+		if rename.From == "" || rename.To == "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has %s rename with empty name: from and to are required for all renamed headers", id, field))
+		}
+	}
+
+	msgs = append(msgs, prefixValues(fmt.Sprintf("upstream %q has invalid %s: ", id, field), validateHeaders(rules.Set)...)...)
+
+	return msgs
+}
+
+// validateUpstreamResponseRewrite checks that the path prefix is a path, the
+// body patterns compile and the max body size is not negative.
+func validateUpstreamResponseRewrite(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	rewrite := upstream.ResponseRewrite
+	if rewrite == nil {
+		return msgs
+	}
+
+	if rewrite.PathPrefix != "" && !strings.HasPrefix(rewrite.PathPrefix, "/") {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid responseRewrite pathPrefix %q: must start with \"/\"", upstream.ID, rewrite.PathPrefix))
+	}
+	for _, body := range rewrite.Body {
+		if _, err := regexp.Compile(body.Pattern); err != nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid responseRewrite body pattern %q: %v", upstream.ID, body.Pattern, err))
+		}
+	}
+	if rewrite.MaxMatchSize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has negative responseRewrite maxMatchSize (%d)", upstream.ID, rewrite.MaxMatchSize))
+	}
+
+	return msgs
+}
+
+// validateUpstreamCache checks that the cache sizes are not negative and the
+// disk options are only set with a disk path.
+func validateUpstreamCache(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	cache := upstream.Cache
+	if cache == nil {
+		return msgs
+	}
+
+	if cache.MaxSize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has negative cache maxSize (%d)", upstream.ID, cache.MaxSize))
+	}
+	if cache.MaxEntrySize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has negative cache maxEntrySize (%d)", upstream.ID, cache.MaxEntrySize))
+	}
+	if cache.DefaultTTL != nil && cache.DefaultTTL.Duration() < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has negative cache defaultTTL", upstream.ID))
+	}
+	if cache.DiskMaxSize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has negative cache diskMaxSize (%d)", upstream.ID, cache.DiskMaxSize))
+	}
+	if cache.DiskPath == "" && cache.DiskMaxSize != 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has cache diskMaxSize, but no diskPath, set 'diskPath' to enable the disk cache", upstream.ID))
+	}
+	for _, claim := range cache.KeyClaims {
+		if claim == "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has cache keyClaims with an empty claim", upstream.ID))
+		}
+	}
+
+	return msgs
+}
+
+// validateUpstreamRateLimit checks that the rate limit allows requests and has
+// a known key and backend, and that redis is configured for the redis backend.
+func validateUpstreamRateLimit(upstream options.Upstream, redisOpts options.RedisStoreOptions) []string {
+	msgs := []string{}
+
+	limit := upstream.RateLimit
+	if limit == nil {
+		return msgs
+	}
+
+	if limit.Requests < 1 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid rateLimit requests (%d): must be at least 1", upstream.ID, limit.Requests))
+	}
+	if limit.Period != nil && limit.Period.Duration() < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has negative rateLimit period", upstream.ID))
+	}
+	if limit.Burst < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has negative rateLimit burst (%d)", upstream.ID, limit.Burst))
+	}
+
+	switch limit.Key {
+	case "", options.UserRateLimitKey, options.IPRateLimitKey, options.RouteRateLimitKey:
+	default:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid rateLimit key %q: must be one of %q, %q or %q", upstream.ID, limit.Key,
+			options.UserRateLimitKey, options.IPRateLimitKey, options.RouteRateLimitKey))
+	}
+
+	switch limit.Backend {
+	case "", options.MemoryRateLimitBackend, options.RedisRateLimitBackend:
+	default:
+		msgs = append(msgs, fmt.Sprintf("upstream %q has invalid rateLimit backend %q: must be one of %q or %q", upstream.ID, limit.Backend,
+			options.MemoryRateLimitBackend, options.RedisRateLimitBackend))
+	}
+	if limit.Backend == options.RedisRateLimitBackend && !redisConfigured(redisOpts) {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has rateLimit backend %q: requires redis_connection_url, redis_sentinel_connection_urls or redis_cluster_connection_urls to be set", upstream.ID, limit.Backend))
+	}
+
+	return msgs
+}
+
+// redisConfigured checks whether the redis options have the addresses of a
+// redis server, sentinel or cluster.
+func redisConfigured(redisOpts options.RedisStoreOptions) bool {
+	switch {
+	case redisOpts.UseSentinel:
+		return len(redisOpts.SentinelConnectionURLs) > 0
+	case redisOpts.UseCluster:
+		return len(redisOpts.ClusterConnectionURLs) > 0
+	default:
+		return redisOpts.ConnectionURL != ""
+	}
+}
+
+// validateUpstreamRequestLimits checks that the limits are not negative and
+// the allowed content types are media types.
+func validateUpstreamRequestLimits(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	limits := upstream.RequestLimits
+	if limits == nil {
+		return msgs
+	}
+
+	if limits.MaxBodySize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has negative requestLimits maxBodySize (%d)", upstream.ID, limits.MaxBodySize))
+	}
+	if limits.MaxHeaderSize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream %q has negative requestLimits maxHeaderSize (%d)", upstream.ID, limits.MaxHeaderSize))
+	}
+	for _, contentType := range limits.AllowedContentTypes {
+		parts := strings.Split(contentType, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid requestLimits allowedContentType %q: must be a media type, eg \"application/json\" or \"image/*\"", upstream.ID, contentType))
+		}
+	}
+
+	return msgs
+}
+
+// validateUpstreamIPAccess checks that the allowed and denied networks are
+// valid IPs or CIDR ranges.
+func validateUpstreamIPAccess(upstream options.Upstream) []string {
+	msgs := []string{}
+
+	access := upstream.IPAccess
+	if access == nil {
+		return msgs
+	}
+
+	for i, ipStr := range access.Allow {
+		if ip.ParseIPNet(ipStr) == nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid ipAccess allow[%d] (%s): could not be recognized", upstream.ID, i, ipStr))
+		}
+	}
+	for i, ipStr := range access.Deny {
+		if ip.ParseIPNet(ipStr) == nil {
+			msgs = append(msgs, fmt.Sprintf("upstream %q has invalid ipAccess deny[%d] (%s): could not be recognized", upstream.ID, i, ipStr))
+		}
+	}
+
+	return msgs
+}
@@ -1,6 +1,7 @@
 package validation
 
 import (
+	"strings"
 	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
@@ -12,6 +13,7 @@ import (
 var _ = Describe("Upstreams", func() {
 	type validateUpstreamTableInput struct {
 		upstreams  options.Upstreams
+		redis      options.RedisStoreOptions
 		errStrings []string
 	}
 
@@ -34,11 +36,25 @@ var _ = Describe("Upstreams", func() {
 		Path: "/validFileUpstream",
 		URI:  "file://var/lib/foo",
 	}
+	validLoadBalancedUpstream := options.Upstream{
+		ID:   "validLoadBalancedUpstream",
+		Path: "/validLoadBalancedUpstream",
+		Backends: []options.UpstreamBackend{
+			{URI: "http://localhost:8080", Weight: 2},
+			{URI: "http://localhost:8081"},
+		},
+		LoadBalancing: &options.LoadBalancing{
+			Strategy:  options.ConsistentHashLoadBalancing,
+			HashClaim: "email",
+		},
+	}
 
 	emptyIDMsg := "upstream has empty id: ids are required for all upstreams"
 	emptyPathMsg := "upstream \"foo\" has empty path: paths are required for all upstreams"
 	emptyURIMsg := "upstream \"foo\" has empty uri: uris are required for all non-static upstreams"
 	invalidURIMsg := "upstream \"foo\" has invalid uri: parse \":\": missing protocol scheme"
+	unixWithoutPathMsg := "upstream \"foo\" has invalid uri \"unix://app.sock\": unix uris must include the socket path, eg unix:///var/run/app.sock"
+	unixWithTLSMsg := "upstream \"foo\" has tls options, but is a unix socket upstream, this will have no effect."
 	invalidURISchemeMsg := "upstream \"foo\" has invalid scheme: \"ftp\""
 	staticWithURIMsg := "upstream \"foo\" has uri, but is a static upstream, this will have no effect."
 	staticWithInsecureMsg := "upstream \"foo\" has insecureSkipTLSVerify, but is a static upstream, this will have no effect."
@@ -47,11 +63,73 @@ var _ = Describe("Upstreams", func() {
 	staticWithProxyWebSocketsMsg := "upstream \"foo\" has proxyWebSockets, but is a static upstream, this will have no effect."
 	multipleIDsMsg := "multiple upstreams found with id \"foo\": upstream ids must be unique"
 	multiplePathsMsg := "multiple upstreams found with path \"/foo\": upstream paths must be unique"
+	multipleHostPathsMsg := "multiple upstreams found with host \"App.example.com\" and path \"/foo\": upstream host and path pairs must be unique"
+	invalidHostMsg := "upstream \"foo\" has invalid host \"app.*.example.com\": hosts must be a hostname, optionally starting with \"*.\" to match subdomains"
+	invalidHostWithPortMsg := "upstream \"bar\" has invalid host \"app.example.com:8080\": hosts must be a hostname, optionally starting with \"*.\" to match subdomains"
 	staticCodeMsg := "upstream \"foo\" has staticCode (200), but is not a static upstream, set 'static' for a static response"
+	uriAndBackendsMsg := "upstream \"foo\" has both uri and backends: only one may be set"
+	invalidBackendSchemeMsg := "upstream \"foo\" has invalid scheme for backends[1]: \"file\""
+	negativeWeightMsg := "upstream \"foo\" has negative weight (-1) for backends[0]"
+	invalidStrategyMsg := "upstream \"foo\" has invalid load balancing strategy: \"random\""
+	hashClaimWithoutHashMsg := "upstream \"foo\" has hashClaim, but does not use the consistentHash strategy, this will have no effect."
+	loadBalancingWithoutBackendsMsg := "upstream \"foo\" has loadBalancing, but has no backends, this will have no effect."
+	staticWithBackendsMsg := "upstream \"foo\" has backends, but is a static upstream, this will have no effect."
+	healthCheckWithoutBackendsMsg := "upstream \"foo\" has healthCheck, but has no backends, this will have no effect."
+	outlierDetectionWithoutBackendsMsg := "upstream \"foo\" has outlierDetection, but has no backends, this will have no effect."
+	invalidHealthCheckPathMsg := "upstream \"foo\" has invalid healthCheck path \"healthz\": paths must start with '/'"
+	negativeUnhealthyThresholdMsg := "upstream \"foo\" has negative healthCheck unhealthyThreshold (-1)"
+	invalidExpectedStatusMsg := "upstream \"foo\" has invalid healthCheck expectedStatus: 999"
+	invalidRetryAttemptsMsg := "upstream \"foo\" has invalid retry attempts (0): must be at least 1"
+	invalidRetryStatusCodeMsg := "upstream \"foo\" has invalid retry statusCodes: 600"
+	negativeMaxBodyBufferSizeMsg := "upstream \"foo\" has negative retry maxBodyBufferSize (-1)"
+	invalidConsecutiveFailuresMsg := "upstream \"foo\" has invalid circuitBreaker consecutiveFailures (0): must be at least 1"
+	invalidErrorCodeMsg := "upstream \"foo\" has invalid circuitBreaker errorCode (200): must be an error response code"
+	staticWithRetryMsg := "upstream \"foo\" has retry, but is a static upstream, this will have no effect."
+	staticWithCircuitBreakerMsg := "upstream \"foo\" has circuitBreaker, but is a static upstream, this will have no effect."
+	negativeDialTimeoutMsg := "upstream \"foo\" has negative transport dialTimeout"
+	negativeResponseHeaderTimeoutMsg := "upstream \"foo\" has negative transport responseHeaderTimeout"
+	negativeMaxConnsPerHostMsg := "upstream \"foo\" has negative transport maxConnsPerHost (-1)"
+	invalidProtocolMsg := "upstream \"foo\" has invalid protocol \"grpc\": must be one of \"http\", \"h2c\" or \"h2\""
+	h2cWithHTTPSMsg := "upstream \"foo\" has protocol \"h2c\", which cannot be used with the \"https\" scheme"
+	h2WithHTTPMsg := "upstream \"foo\" has protocol \"h2\", which cannot be used with the \"http\" scheme"
+	staticWithProtocolMsg := "upstream \"foo\" has protocol, but is a static upstream, this will have no effect."
+	staticWithTransportMsg := "upstream \"foo\" has transport, but is a static upstream, this will have no effect."
+	h2WithResponseHeaderTimeoutMsg := "upstream \"foo\" has transport responseHeaderTimeout, which is not supported with protocol \"h2\""
+	h2cWithMaxConnsPerHostMsg := "upstream \"foo\" has transport maxConnsPerHost, which is not supported with protocol \"h2c\""
+	h2cWithIdleConnTimeoutMsg := "upstream \"foo\" has transport idleConnTimeout, which is not supported with protocol \"h2c\""
+	clientCertWithoutKeyMsg := "upstream \"foo\" has tls clientCert or clientKey: both are required for a client certificate"
+	invalidCASourceMsg := "upstream \"foo\" has invalid tls ca: multiple values specified for secret source: specify either value, fromEnv of fromFile"
+	invalidMinVersionMsg := "upstream \"foo\" has invalid tls minVersion: unknown TLS version \"TLS1.4\": must be one of TLS1.0, TLS1.1, TLS1.2 or TLS1.3"
+	staticWithTLSMsg := "upstream \"foo\" has tls, but is a static upstream, this will have no effect."
+	emptyRemoveHeaderMsg := "upstream \"foo\" has requestHeaders remove with empty name: names are required for all removed headers"
+	emptyRenameHeaderMsg := "upstream \"foo\" has responseHeaders rename with empty name: from and to are required for all renamed headers"
+	emptySetHeaderMsg := "upstream \"foo\" has invalid responseHeaders: header has empty name: names are required for all headers"
+	invalidPathPrefixMsg := "upstream \"foo\" has invalid responseRewrite pathPrefix \"app\": must start with \"/\""
+	invalidBodyPatternMsg := "upstream \"foo\" has invalid responseRewrite body pattern \"(\": error parsing regexp: missing closing ): `(`"
+	negativeMaxMatchSizeMsg := "upstream \"foo\" has negative responseRewrite maxMatchSize (-1)"
+	staticWithResponseRewriteMsg := "upstream \"foo\" has responseRewrite, but is a static upstream, this will have no effect."
+	negativeCacheMaxSizeMsg := "upstream \"foo\" has negative cache maxSize (-1)"
+	negativeCacheMaxEntrySizeMsg := "upstream \"foo\" has negative cache maxEntrySize (-1)"
+	negativeCacheDefaultTTLMsg := "upstream \"foo\" has negative cache defaultTTL"
+	diskMaxSizeWithoutPathMsg := "upstream \"foo\" has cache diskMaxSize, but no diskPath, set 'diskPath' to enable the disk cache"
+	emptyCacheKeyClaimMsg := "upstream \"foo\" has cache keyClaims with an empty claim"
+	staticWithCacheMsg := "upstream \"foo\" has cache, but is a static upstream, this will have no effect."
+	invalidRateLimitRequestsMsg := "upstream \"foo\" has invalid rateLimit requests (0): must be at least 1"
+	negativeRateLimitPeriodMsg := "upstream \"foo\" has negative rateLimit period"
+	negativeRateLimitBurstMsg := "upstream \"foo\" has negative rateLimit burst (-1)"
+	invalidRateLimitKeyMsg := "upstream \"foo\" has invalid rateLimit key \"session\": must be one of \"user\", \"ip\" or \"route\""
+	invalidRateLimitBackendMsg := "upstream \"foo\" has invalid rateLimit backend \"memcached\": must be one of \"memory\" or \"redis\""
+	rateLimitRedisNotConfiguredMsg := "upstream \"foo\" has rateLimit backend \"redis\": requires redis_connection_url, redis_sentinel_connection_urls or redis_cluster_connection_urls to be set"
+	invalidIPAccessAllowMsg := "upstream \"foo\" has invalid ipAccess allow[1] (10.0.0.0/33): could not be recognized"
+	invalidIPAccessDenyMsg := "upstream \"foo\" has invalid ipAccess deny[0] (vpn): could not be recognized"
+	negativeMaxRequestBodySizeMsg := "upstream \"foo\" has negative requestLimits maxBodySize (-1)"
+	negativeMaxRequestHeaderSizeMsg := "upstream \"foo\" has negative requestLimits maxHeaderSize (-1)"
+	invalidAllowedContentTypeMsg := "upstream \"foo\" has invalid requestLimits allowedContentType \"json\": must be a media type, eg \"application/json\" or \"image/*\""
+	invalidConsecutiveErrorsMsg := "upstream \"foo\" has invalid outlierDetection consecutiveErrors (0): must be at least 1"
 
 	DescribeTable("validateUpstreams",
 		func(o *validateUpstreamTableInput) {
-			Expect(validateUpstreams(o.upstreams)).To(ConsistOf(o.errStrings))
+			Expect(validateUpstreams(o.upstreams, o.redis)).To(ConsistOf(o.errStrings))
 		},
 		Entry("with no upstreams", &validateUpstreamTableInput{
 			upstreams:  options.Upstreams{},
@@ -62,6 +140,7 @@ var _ = Describe("Upstreams", func() {
 				validHTTPUpstream,
 				validStaticUpstream,
 				validFileUpstream,
+				validLoadBalancedUpstream,
 			},
 			errStrings: []string{},
 		}),
@@ -125,6 +204,37 @@ var _ = Describe("Upstreams", func() {
 			},
 			errStrings: []string{invalidURISchemeMsg},
 		}),
+		Entry("with a valid unix socket upstream", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "unix:///var/run/app.sock",
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with a unix socket upstream without a socket path", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "unix://app.sock",
+				},
+			},
+			errStrings: []string{unixWithoutPathMsg},
+		}),
+		Entry("with a unix socket upstream with tls options", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:                    "foo",
+					Path:                  "/foo",
+					URI:                   "unix:///var/run/app.sock",
+					InsecureSkipTLSVerify: true,
+				},
+			},
+			errStrings: []string{unixWithTLSMsg},
+		}),
 		Entry("with a static upstream and invalid optons", &validateUpstreamTableInput{
 			upstreams: options.Upstreams{
 				{
@@ -186,5 +296,669 @@ var _ = Describe("Upstreams", func() {
 			},
 			errStrings: []string{emptyURIMsg, staticCodeMsg},
 		}),
+		Entry("with both a uri and backends", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:       "foo",
+					Path:     "/foo",
+					URI:      "http://localhost:8080",
+					Backends: []options.UpstreamBackend{{URI: "http://localhost:8081"}},
+				},
+			},
+			errStrings: []string{uriAndBackendsMsg},
+		}),
+		Entry("with invalid backends", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					Backends: []options.UpstreamBackend{
+						{URI: "http://localhost:8080", Weight: -1},
+						{URI: "file://var/lib/foo"},
+					},
+				},
+			},
+			errStrings: []string{negativeWeightMsg, invalidBackendSchemeMsg},
+		}),
+		Entry("with invalid load balancing options", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:            "foo",
+					Path:          "/foo",
+					Backends:      []options.UpstreamBackend{{URI: "http://localhost:8080"}},
+					LoadBalancing: &options.LoadBalancing{Strategy: "random"},
+				},
+				{
+					ID:            "bar",
+					Path:          "/bar",
+					Backends:      []options.UpstreamBackend{{URI: "http://localhost:8080"}},
+					LoadBalancing: &options.LoadBalancing{HashClaim: "email"},
+				},
+			},
+			errStrings: []string{invalidStrategyMsg, strings.Replace(hashClaimWithoutHashMsg, "foo", "bar", 1)},
+		}),
+		Entry("with load balancing but no backends", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:            "foo",
+					Path:          "/foo",
+					URI:           "http://localhost:8080",
+					LoadBalancing: &options.LoadBalancing{},
+				},
+			},
+			errStrings: []string{loadBalancingWithoutBackendsMsg},
+		}),
+		Entry("with a static upstream and backends", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:       "foo",
+					Path:     "/foo",
+					Static:   true,
+					Backends: []options.UpstreamBackend{{URI: "http://localhost:8080"}},
+				},
+			},
+			errStrings: []string{staticWithBackendsMsg},
+		}),
+		Entry("with valid health checks", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:       "foo",
+					Path:     "/foo",
+					Backends: []options.UpstreamBackend{{URI: "http://localhost:8080"}},
+					HealthCheck: &options.HealthCheck{
+						Path:           "/healthz",
+						ExpectedStatus: []int{200, 204},
+					},
+					OutlierDetection: &options.OutlierDetection{ConsecutiveErrors: 5},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid health checks", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:       "foo",
+					Path:     "/foo",
+					Backends: []options.UpstreamBackend{{URI: "http://localhost:8080"}},
+					HealthCheck: &options.HealthCheck{
+						Path:               "healthz",
+						UnhealthyThreshold: -1,
+						ExpectedStatus:     []int{999},
+					},
+					OutlierDetection: &options.OutlierDetection{},
+				},
+			},
+			errStrings: []string{invalidHealthCheckPathMsg, negativeUnhealthyThresholdMsg, invalidExpectedStatusMsg, invalidConsecutiveErrorsMsg},
+		}),
+		Entry("with health checks but no backends", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:               "foo",
+					Path:             "/foo",
+					URI:              "http://localhost:8080",
+					HealthCheck:      &options.HealthCheck{Path: "/healthz"},
+					OutlierDetection: &options.OutlierDetection{ConsecutiveErrors: 5},
+				},
+			},
+			errStrings: []string{healthCheckWithoutBackendsMsg, outlierDetectionWithoutBackendsMsg},
+		}),
+		Entry("with valid retry and circuit breaker", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:             "foo",
+					Path:           "/foo",
+					URI:            "http://localhost:8080",
+					Retry:          &options.Retry{Attempts: 2, StatusCodes: []int{502, 503}},
+					CircuitBreaker: &options.CircuitBreaker{ConsecutiveFailures: 5, ErrorCode: &[]int{503}[0]},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid retry and circuit breaker", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:             "foo",
+					Path:           "/foo",
+					URI:            "http://localhost:8080",
+					Retry:          &options.Retry{StatusCodes: []int{600}, MaxBodyBufferSize: -1},
+					CircuitBreaker: &options.CircuitBreaker{ErrorCode: &[]int{200}[0]},
+				},
+			},
+			errStrings: []string{invalidRetryAttemptsMsg, invalidRetryStatusCodeMsg, negativeMaxBodyBufferSizeMsg, invalidConsecutiveFailuresMsg, invalidErrorCodeMsg},
+		}),
+		Entry("with a static upstream with retry and circuit breaker", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:             "foo",
+					Path:           "/foo",
+					Static:         true,
+					Retry:          &options.Retry{Attempts: 1},
+					CircuitBreaker: &options.CircuitBreaker{ConsecutiveFailures: 1},
+				},
+			},
+			errStrings: []string{staticWithRetryMsg, staticWithCircuitBreakerMsg},
+		}),
+		Entry("with valid transport options", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+					Transport: &options.UpstreamTransport{
+						DialTimeout:     &[]options.Duration{options.Duration(time.Second)}[0],
+						MaxConnsPerHost: 10,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid transport options", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+					Transport: &options.UpstreamTransport{
+						DialTimeout:           &[]options.Duration{options.Duration(-time.Second)}[0],
+						ResponseHeaderTimeout: &[]options.Duration{options.Duration(-time.Second)}[0],
+						MaxConnsPerHost:       -1,
+					},
+				},
+			},
+			errStrings: []string{negativeDialTimeoutMsg, negativeResponseHeaderTimeoutMsg, negativeMaxConnsPerHostMsg},
+		}),
+		Entry("with HTTP/2 transport options", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:       "foo",
+					Path:     "/foo",
+					URI:      "https://localhost:8443",
+					Protocol: options.H2UpstreamProtocol,
+					Transport: &options.UpstreamTransport{
+						DialTimeout:         &[]options.Duration{options.Duration(time.Second)}[0],
+						KeepAlive:           &[]options.Duration{options.Duration(time.Second)}[0],
+						TLSHandshakeTimeout: &[]options.Duration{options.Duration(time.Second)}[0],
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with transport options that do not apply to h2", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:       "foo",
+					Path:     "/foo",
+					URI:      "https://localhost:8443",
+					Protocol: options.H2UpstreamProtocol,
+					Transport: &options.UpstreamTransport{
+						ResponseHeaderTimeout: &[]options.Duration{options.Duration(time.Second)}[0],
+					},
+				},
+			},
+			errStrings: []string{h2WithResponseHeaderTimeoutMsg},
+		}),
+		Entry("with transport options that do not apply to h2c", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:       "foo",
+					Path:     "/foo",
+					URI:      "http://localhost:8080",
+					Protocol: options.H2CUpstreamProtocol,
+					Transport: &options.UpstreamTransport{
+						IdleConnTimeout: &[]options.Duration{options.Duration(time.Second)}[0],
+						MaxConnsPerHost: 10,
+					},
+				},
+			},
+			errStrings: []string{h2cWithIdleConnTimeoutMsg, h2cWithMaxConnsPerHostMsg},
+		}),
+		Entry("with a static upstream with transport options", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:        "foo",
+					Path:      "/foo",
+					Static:    true,
+					Transport: &options.UpstreamTransport{},
+				},
+			},
+			errStrings: []string{staticWithTransportMsg},
+		}),
+		Entry("with the same path on different hosts", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+				},
+				{
+					ID:   "bar",
+					Host: "app.example.com",
+					Path: "/foo",
+					URI:  "http://localhost:8081",
+				},
+				{
+					ID:   "baz",
+					Host: "*.example.com",
+					Path: "/foo",
+					URI:  "http://localhost:8082",
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with the same host and path", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Host: "app.example.com",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+				},
+				{
+					ID:   "bar",
+					Host: "App.example.com",
+					Path: "/foo",
+					URI:  "http://localhost:8081",
+				},
+			},
+			errStrings: []string{multipleHostPathsMsg},
+		}),
+		Entry("with invalid hosts", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Host: "app.*.example.com",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+				},
+				{
+					ID:   "bar",
+					Host: "app.example.com:8080",
+					Path: "/foo",
+					URI:  "http://localhost:8081",
+				},
+			},
+			errStrings: []string{invalidHostMsg, invalidHostWithPortMsg},
+		}),
+		Entry("with valid protocols", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:       "foo",
+					Path:     "/foo",
+					URI:      "http://localhost:8080",
+					Protocol: "h2c",
+				},
+				{
+					ID:       "bar",
+					Path:     "/bar",
+					URI:      "unix:///var/run/grpc.sock",
+					Protocol: "h2c",
+				},
+				{
+					ID:       "baz",
+					Path:     "/baz",
+					Protocol: "h2",
+					Backends: []options.UpstreamBackend{
+						{URI: "https://backend1:8443"},
+						{URI: "https://backend2:8443"},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an unknown protocol", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:       "foo",
+					Path:     "/foo",
+					URI:      "http://localhost:8080",
+					Protocol: "grpc",
+				},
+			},
+			errStrings: []string{invalidProtocolMsg},
+		}),
+		Entry("with h2c to an https upstream", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:       "foo",
+					Path:     "/foo",
+					URI:      "https://localhost:8443",
+					Protocol: "h2c",
+				},
+			},
+			errStrings: []string{h2cWithHTTPSMsg},
+		}),
+		Entry("with h2 to an http backend", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:       "foo",
+					Path:     "/foo",
+					Protocol: "h2",
+					Backends: []options.UpstreamBackend{
+						{URI: "https://backend1:8443"},
+						{URI: "http://backend2:8080"},
+					},
+				},
+			},
+			errStrings: []string{h2WithHTTPMsg},
+		}),
+		Entry("with a static upstream with a protocol", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:       "foo",
+					Path:     "/foo",
+					Static:   true,
+					Protocol: "h2c",
+				},
+			},
+			errStrings: []string{staticWithProtocolMsg},
+		}),
+		Entry("with valid tls options", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "https://localhost:8443",
+					TLS: &options.UpstreamTLS{
+						ClientCert: &options.SecretSource{Value: []byte("cert")},
+						ClientKey:  &options.SecretSource{Value: []byte("key")},
+						CA:         &options.SecretSource{Value: []byte("ca")},
+						ServerName: "upstream.local",
+						MinVersion: "TLS1.3",
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid tls options", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "https://localhost:8443",
+					TLS: &options.UpstreamTLS{
+						ClientCert: &options.SecretSource{Value: []byte("cert")},
+						CA:         &options.SecretSource{Value: []byte("ca"), FromEnv: "CA"},
+						MinVersion: "TLS1.4",
+					},
+				},
+			},
+			errStrings: []string{clientCertWithoutKeyMsg, invalidCASourceMsg, invalidMinVersionMsg},
+		}),
+		Entry("with a static upstream with tls options", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:     "foo",
+					Path:   "/foo",
+					Static: true,
+					TLS:    &options.UpstreamTLS{},
+				},
+			},
+			errStrings: []string{staticWithTLSMsg},
+		}),
+		Entry("with valid header rules", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+					RequestHeaders: &options.HeaderRules{
+						Remove: []string{"Cookie"},
+						Rename: []options.HeaderRename{{From: "X-Forwarded-User", To: "X-User"}},
+					},
+					ResponseHeaders: &options.HeaderRules{
+						Set: []options.Header{
+							{
+								Name: "Content-Security-Policy",
+								Values: []options.HeaderValue{
+									{SecretSource: &options.SecretSource{Value: []byte("default-src 'self'")}},
+								},
+							},
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid header rules", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+					RequestHeaders: &options.HeaderRules{
+						Remove: []string{""},
+					},
+					ResponseHeaders: &options.HeaderRules{
+						Rename: []options.HeaderRename{{From: "Server"}},
+						Set: []options.Header{
+							{
+								Name: "",
+								Values: []options.HeaderValue{
+									{SecretSource: &options.SecretSource{Value: []byte("value")}},
+								},
+							},
+						},
+					},
+				},
+			},
+			errStrings: []string{emptyRemoveHeaderMsg, emptyRenameHeaderMsg, emptySetHeaderMsg},
+		}),
+		Entry("with a valid response rewrite", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:            "foo",
+					Path:          "^/app/(.*)$",
+					RewriteTarget: "/$1",
+					URI:           "http://localhost:8080",
+					ResponseRewrite: &options.ResponseRewrite{
+						PathPrefix: "/app",
+						Location:   true,
+						Cookies:    true,
+						Body: []options.BodyRewrite{
+							{Pattern: `href="/`, Replacement: `href="/app/`},
+						},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid response rewrite", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+					ResponseRewrite: &options.ResponseRewrite{
+						PathPrefix: "app",
+						Body: []options.BodyRewrite{
+							{Pattern: "("},
+						},
+						MaxMatchSize: -1,
+					},
+				},
+			},
+			errStrings: []string{invalidPathPrefixMsg, invalidBodyPatternMsg, negativeMaxMatchSizeMsg},
+		}),
+		Entry("with a response rewrite on a static upstream", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:              "foo",
+					Path:            "/foo",
+					Static:          true,
+					ResponseRewrite: &options.ResponseRewrite{},
+				},
+			},
+			errStrings: []string{staticWithResponseRewriteMsg},
+		}),
+		Entry("with a valid cache", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/static/",
+					URI:  "file:///var/www/static/",
+					Cache: &options.UpstreamCache{
+						MaxSize:     1 << 20,
+						KeyClaims:   []string{"groups"},
+						DiskPath:    "/var/cache/oauth2-proxy",
+						DiskMaxSize: 1 << 30,
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with an invalid cache", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/static/",
+					URI:  "http://localhost:8080",
+					Cache: &options.UpstreamCache{
+						MaxSize:      -1,
+						MaxEntrySize: -1,
+						DefaultTTL:   func() *options.Duration { d := options.Duration(-time.Second); return &d }(),
+						KeyClaims:    []string{""},
+						DiskMaxSize:  1 << 30,
+					},
+				},
+			},
+			errStrings: []string{
+				negativeCacheMaxSizeMsg,
+				negativeCacheMaxEntrySizeMsg,
+				negativeCacheDefaultTTLMsg,
+				diskMaxSizeWithoutPathMsg,
+				emptyCacheKeyClaimMsg,
+			},
+		}),
+		Entry("with a cache on a static upstream", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:     "foo",
+					Path:   "/foo",
+					Static: true,
+					Cache:  &options.UpstreamCache{},
+				},
+			},
+			errStrings: []string{staticWithCacheMsg},
+		}),
+		Entry("with a valid rate limit", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+					RateLimit: &options.RateLimit{
+						Requests: 100,
+						Period:   func() *options.Duration { d := options.Duration(time.Minute); return &d }(),
+						Burst:    10,
+						Key:      "ip",
+						Backend:  "redis",
+					},
+				},
+			},
+			redis:      options.RedisStoreOptions{ConnectionURL: "redis://localhost:6379"},
+			errStrings: []string{},
+		}),
+		Entry("with a redis rate limit without redis", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+					RateLimit: &options.RateLimit{
+						Requests: 100,
+						Backend:  "redis",
+					},
+				},
+			},
+			redis:      options.RedisStoreOptions{UseCluster: true, ConnectionURL: "redis://localhost:6379"},
+			errStrings: []string{rateLimitRedisNotConfiguredMsg},
+		}),
+		Entry("with an invalid rate limit", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+					RateLimit: &options.RateLimit{
+						Period:  func() *options.Duration { d := options.Duration(-time.Minute); return &d }(),
+						Burst:   -1,
+						Key:     "session",
+						Backend: "memcached",
+					},
+				},
+			},
+			errStrings: []string{
+				invalidRateLimitRequestsMsg,
+				negativeRateLimitPeriodMsg,
+				negativeRateLimitBurstMsg,
+				invalidRateLimitKeyMsg,
+				invalidRateLimitBackendMsg,
+			},
+		}),
+		Entry("with valid request limits", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+					RequestLimits: &options.RequestLimits{
+						MaxBodySize:         10 << 20,
+						MaxHeaderSize:       8 << 10,
+						AllowedContentTypes: []string{"application/json", "image/*"},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid request limits", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+					RequestLimits: &options.RequestLimits{
+						MaxBodySize:         -1,
+						MaxHeaderSize:       -1,
+						AllowedContentTypes: []string{"json"},
+					},
+				},
+			},
+			errStrings: []string{
+				negativeMaxRequestBodySizeMsg,
+				negativeMaxRequestHeaderSizeMsg,
+				invalidAllowedContentTypeMsg,
+			},
+		}),
+		Entry("with valid ip access", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+					IPAccess: &options.IPAccess{
+						Allow: []string{"10.0.0.0/8", "fd00::/8"},
+						Deny:  []string{"10.0.0.1"},
+					},
+				},
+			},
+			errStrings: []string{},
+		}),
+		Entry("with invalid ip access", &validateUpstreamTableInput{
+			upstreams: options.Upstreams{
+				{
+					ID:   "foo",
+					Path: "/foo",
+					URI:  "http://localhost:8080",
+					IPAccess: &options.IPAccess{
+						Allow: []string{"10.0.0.0/8", "10.0.0.0/33"},
+						Deny:  []string{"vpn"},
+					},
+				},
+			},
+			errStrings: []string{
+				invalidIPAccessAllowMsg,
+				invalidIPAccessDenyMsg,
+			},
+		}),
 	)
 })
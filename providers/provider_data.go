@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
@@ -123,6 +124,8 @@ type OIDCClaims struct {
 	Groups   []string `json:"-"`
 	Verified *bool    `json:"email_verified"`
 	Nonce    string   `json:"nonce"`
+	ACR      string   `json:"acr"`
+	AMR      []string `json:"amr"`
 
 	raw map[string]interface{}
 }
@@ -161,6 +164,14 @@ func (p *ProviderData) buildSessionFromClaims(idToken *oidc.IDToken) (*sessions.
 		ss.PreferredUsername = pref
 	}
 
+	// Record how the user authenticated for step-up authentication
+	if authTime, ok := claims.raw["auth_time"].(float64); ok {
+		t := time.Unix(int64(authTime), 0)
+		ss.AuthTime = &t
+	}
+	ss.ACR = claims.ACR
+	ss.AMR = claims.AMR
+
 	// `email_verified` must be present and explicitly set to `false` to be
 	// considered unverified.
 	verifyEmail := (p.EmailClaim == OIDCEmailClaim) && !p.AllowUnverifiedEmail
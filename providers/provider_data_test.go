@@ -89,6 +89,16 @@ var (
 	minimalIDToken = idTokenClaims{
 		StandardClaims: standardClaims,
 	}
+
+	stepUpAuthTime = time.Unix(1600000000, 0)
+
+	stepUpIDToken = idTokenClaims{
+		Email:          "janed@me.com",
+		AuthTime:       stepUpAuthTime.Unix(),
+		ACR:            "mfa",
+		AMR:            []string{"pwd", "otp"},
+		StandardClaims: standardClaims,
+	}
 )
 
 type idTokenClaims struct {
@@ -100,6 +110,9 @@ type idTokenClaims struct {
 	Roles    interface{} `json:"roles,omitempty"`
 	Verified *bool       `json:"email_verified,omitempty"`
 	Nonce    string      `json:"nonce,omitempty"`
+	AuthTime int64       `json:"auth_time,omitempty"`
+	ACR      string      `json:"acr,omitempty"`
+	AMR      []string    `json:"amr,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -307,6 +320,19 @@ func TestProviderData_buildSessionFromClaims(t *testing.T) {
 				PreferredUsername: "Jane Dobbs",
 			},
 		},
+		"Step-up Claims": {
+			IDToken:         stepUpIDToken,
+			AllowUnverified: false,
+			EmailClaim:      "email",
+			GroupsClaim:     "groups",
+			ExpectedSession: &sessions.SessionState{
+				User:     "123456789",
+				Email:    "janed@me.com",
+				AuthTime: &stepUpAuthTime,
+				ACR:      "mfa",
+				AMR:      []string{"pwd", "otp"},
+			},
+		},
 		"Groups Claim Non Existent": {
 			IDToken:         defaultIDToken,
 			AllowUnverified: false,